@@ -0,0 +1,211 @@
+// audit.go - Immutable audit log
+// Every mutating action appends an AuditEvent recording who did what to which
+// resource, with a before/after diff of the changed fields and the IP, user agent
+// and request ID of the request that caused it. Rows are append-only and
+// hash-chained: each event's hash covers its contents and the previous event's
+// hash, so editing, inserting or removing a row breaks the chain from that point
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditUserRegister     = "user.register"
+	AuditUserLogin        = "user.login"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditJobRetry         = "job.retry"
+	AuditJobCancel        = "job.cancel"
+	AuditTaskRun          = "task.run"
+	AuditWebhookCreate    = "webhook.create"
+	AuditWebhookUpdate    = "webhook.update"
+	AuditWebhookDelete    = "webhook.delete"
+	AuditWebhookRedeliver = "webhook.redeliver"
+)
+
+// auditGenesisHash is the previous hash of the first event in the chain
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// auditRedactedFields never have their values written to the audit log, only the fact that they changed
+var auditRedactedFields = map[string]bool{"password": true, "secret": true}
+
+// auditRedacted replaces the values of redacted fields
+const auditRedacted = "[redacted]"
+
+// AuditEvent is one entry in the audit log
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	ActorID    *int            `json:"actor_id"` // Authenticated user; nil for anonymous requests such as registration
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Changes    json.RawMessage `json:"changes,omitempty"` // {"field": {"before": ..., "after": ...}}
+	IP         string          `json:"ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// auditHashInput is the part of an event covered by its hash
+// The ID is left out because it is assigned by the database after hashing
+type auditHashInput struct {
+	PrevHash   string          `json:"prev_hash"`
+	OccurredAt string          `json:"occurred_at"`
+	ActorID    *int            `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Changes    json.RawMessage `json:"changes"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	RequestID  string          `json:"request_id"`
+}
+
+// ComputeHash returns the hex SHA-256 of the event's contents and PrevHash
+func (e *AuditEvent) ComputeHash() string {
+	changes := e.Changes
+	if len(changes) == 0 {
+		changes = json.RawMessage("null")
+	}
+
+	// Marshalling a struct of strings can't fail
+	input, _ := json.Marshal(auditHashInput{
+		PrevHash:   e.PrevHash,
+		OccurredAt: e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		ActorID:    e.ActorID,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		Changes:    changes,
+		IP:         e.IP,
+		UserAgent:  e.UserAgent,
+		RequestID:  e.RequestID,
+	})
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter selects audit events
+type AuditFilter struct {
+	ActorID    *int
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      *time.Time // Inclusive
+	Until      *time.Time // Exclusive
+	AfterID    int64      // Only events with a larger ID, for cursoring through the log
+	Newest     bool       // Newest first instead of oldest first
+	Limit      int
+	Offset     int
+}
+
+// AuditVerification is the result of checking the hash chain
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Checked  int    `json:"checked"`             // Events checked, up to and including the first broken one
+	BrokenAt *int64 `json:"broken_at,omitempty"` // ID of the first event whose hashes don't match
+	Reason   string `json:"reason,omitempty"`
+	HeadHash string `json:"head_hash"` // Hash of the newest verified event; keep a copy elsewhere to detect truncation
+}
+
+// auditChanges diffs the JSON fields of before and after, either of which may be nil
+// It returns nil when nothing changed
+func auditChanges(before, after interface{}) (json.RawMessage, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]map[string]interface{})
+	for _, fields := range []map[string]interface{}{beforeFields, afterFields} {
+		for field := range fields {
+			if _, done := changes[field]; done {
+				continue
+			}
+			oldValue, newValue := beforeFields[field], afterFields[field]
+			if reflect.DeepEqual(oldValue, newValue) {
+				continue
+			}
+			if auditRedactedFields[field] {
+				oldValue, newValue = redact(oldValue), redact(newValue)
+			}
+			changes[field] = map[string]interface{}{"before": oldValue, "after": newValue}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	// Map keys are encoded in sorted order, so equal diffs always encode the same
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit changes: %w", err)
+	}
+	return encoded, nil
+}
+
+// auditFields returns the JSON fields of value, which must encode as an object or null
+func auditFields(value interface{}) (map[string]interface{}, error) {
+	if value == nil || (reflect.ValueOf(value).Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil()) {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit target: %w", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, fmt.Errorf("failed to decode audit target: %w", err)
+	}
+	return fields, nil
+}
+
+// redact hides a value, keeping whether it was set
+func redact(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return auditRedacted
+}
+
+// RequestInfo describes the request a change was made in, for the audit log
+// RequestIDMiddleware stores it in the request context and AuthMiddleware fills in the actor
+type RequestInfo struct {
+	RequestID string
+	IP        string
+	UserAgent string
+	ActorID   *int
+}
+
+// requestInfoKey is the context key of the *RequestInfo
+type requestInfoKey struct{}
+
+// withRequestInfo returns a copy of ctx carrying info
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request info stored in ctx
+// Work that doesn't come from a request, such as scheduled tasks, gets an empty RequestInfo
+func requestInfoFrom(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// newTestService creates a service on repo whose job queue and scheduler are never started
+func newTestService(t *testing.T, repo Repository) *service {
+	t.Helper()
+
+	events := NewEventBus(EventBusConfig{})
+	t.Cleanup(func() { events.Close(context.Background()) })
+	keys := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+	return NewService(repo, NewJobQueue(repo, JobQueueConfig{}), NewScheduler(repo, nil, nil), events, keys).(*service)
+}
+
+// appendTestAuditEvents appends n user.update events to repo
+func appendTestAuditEvents(t *testing.T, ctx context.Context, repo Repository, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := repo.AppendAuditEvent(ctx, &AuditEvent{Action: AuditUserUpdate, TargetType: "user", TargetID: "1"}); err != nil {
+			t.Fatalf("AppendAuditEvent() error = %v", err)
+		}
+	}
+}
+
+func TestAuditChanges(t *testing.T) {
+	before := map[string]interface{}{"username": "alice", "email": "a@example.com", "password": "old"}
+	after := map[string]interface{}{"username": "alice", "email": "b@example.com", "password": "new"}
+
+	changes, err := auditChanges(before, after)
+	if err != nil {
+		t.Fatalf("auditChanges() error = %v", err)
+	}
+	var got map[string]struct{ Before, After interface{} }
+	if err := json.Unmarshal(changes, &got); err != nil {
+		t.Fatalf("failed to decode changes: %v", err)
+	}
+
+	if _, ok := got["username"]; ok || len(got) != 2 {
+		t.Errorf("changes = %s, want only email and password", changes)
+	}
+	if got["email"].Before != "a@example.com" || got["email"].After != "b@example.com" {
+		t.Errorf("email change = %+v", got["email"])
+	}
+	if got["password"].Before != auditRedacted || got["password"].After != auditRedacted {
+		t.Errorf("password change not redacted: %+v", got["password"])
+	}
+
+	if changes, _ := auditChanges(before, before); changes != nil {
+		t.Errorf("auditChanges() of unchanged values = %s, want nil", changes)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(store *memoryStore)
+		brokenAt int64
+	}{
+		{"intact", func(*memoryStore) {}, 0},
+		{"modified", func(store *memoryStore) { store.audit[1].TargetID = "2" }, 2},
+		{"removed", func(store *memoryStore) { store.audit = append(store.audit[:1], store.audit[2:]...) }, 3},
+		{"inserted", func(store *memoryStore) {
+			forged := *store.audit[0]
+			forged.ID = 99
+			store.audit = append(store.audit[:2], append([]*AuditEvent{&forged}, store.audit[2:]...)...)
+		}, 99},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := NewMemoryRepository()
+			appendTestAuditEvents(t, ctx, repo, 3)
+			tt.tamper(repo.(*memoryRepository).memoryStore)
+
+			result, err := (&service{repo: repo}).VerifyAuditLog(ctx)
+			if err != nil {
+				t.Fatalf("VerifyAuditLog() error = %v", err)
+			}
+
+			if tt.brokenAt == 0 {
+				if !result.Valid || result.Checked != 3 || result.HeadHash != repo.(*memoryRepository).audit[2].Hash {
+					t.Errorf("VerifyAuditLog() = %+v, want a valid chain of 3 ending at the last hash", result)
+				}
+				return
+			}
+			if result.Valid || result.BrokenAt == nil || *result.BrokenAt != tt.brokenAt || result.Reason == "" {
+				t.Errorf("VerifyAuditLog() = %+v, want broken at %d", result, tt.brokenAt)
+			}
+		})
+	}
+}
+
+// failingAuditRepository is a Repository whose audit log rejects every append
+type failingAuditRepository struct {
+	Repository
+}
+
+func (r failingAuditRepository) AppendAuditEvent(context.Context, *AuditEvent) error {
+	return errors.New("audit log unavailable")
+}
+
+func (r failingAuditRepository) WithTx(ctx context.Context, fn func(tx Repository) error) error {
+	return r.Repository.WithTx(ctx, func(tx Repository) error {
+		return fn(failingAuditRepository{tx})
+	})
+}
+
+func TestUserChangesAreAuditedInTheirTransaction(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			testUserChangesAudited(t, backend.open(t))
+		})
+	}
+}
+
+func testUserChangesAudited(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	svc := newTestService(t, repo)
+
+	user, err := svc.Register(ctx, &RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if _, err := svc.UpdateUser(ctx, user.ID, &UpdateUserRequest{Username: "alice2"}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+
+	events, _ := repo.ListAuditEvents(ctx, AuditFilter{Limit: 10})
+	if len(events) != 2 || events[0].Action != AuditUserRegister || events[1].Action != AuditUserUpdate {
+		t.Fatalf("audit events = %+v, want register and update", events)
+	}
+
+	// With the audit log failing, every change is rolled back and reported
+	failing := newTestService(t, failingAuditRepository{repo})
+	if _, err := failing.Register(ctx, &RegisterRequest{Username: "bob", Email: "bob@example.com", Password: "password123"}); err == nil {
+		t.Error("Register() succeeded without an audit entry")
+	}
+	if _, err := repo.GetUserByEmail(ctx, "bob@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unaudited registration was saved: %v", err)
+	}
+
+	if _, err := failing.UpdateUser(ctx, user.ID, &UpdateUserRequest{Username: "alice3"}); err == nil {
+		t.Error("UpdateUser() succeeded without an audit entry")
+	}
+	if err := failing.DeleteUser(ctx, user.ID); err == nil {
+		t.Error("DeleteUser() succeeded without an audit entry")
+	}
+	if got, err := repo.GetUserByID(ctx, user.ID); err != nil || got.Username != "alice2" {
+		t.Errorf("unaudited changes were saved: %+v, %v", got, err)
+	}
+
+	if _, err := failing.Login(ctx, &LoginRequest{Email: "alice@example.com", Password: "password123"}); err == nil {
+		t.Error("Login() succeeded without an audit entry")
+	}
+}
+
+func TestAdminChangesAreAuditedInTheirTransaction(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "true")
+	t.Setenv("WEBHOOK_SECRET_KEY", "test-key")
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			testAdminChangesAudited(t, backend.open(t))
+		})
+	}
+}
+
+func testAdminChangesAudited(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	svc := newTestService(t, repo)
+	failing := newTestService(t, failingAuditRepository{repo})
+
+	// With the audit log failing, every change is rolled back and reported
+	if _, err := failing.CreateWebhook(ctx, &CreateWebhookRequest{URL: "http://127.0.0.1/hook", Events: []string{"*"}}); err == nil {
+		t.Error("CreateWebhook() succeeded without an audit entry")
+	}
+	if subs, _ := repo.ListWebhookSubscriptions(ctx); len(subs) != 0 {
+		t.Errorf("unaudited webhook was saved: %+v", subs)
+	}
+
+	sub, err := svc.CreateWebhook(ctx, &CreateWebhookRequest{URL: "http://127.0.0.1/hook", Events: []string{"*"}})
+	if err != nil {
+		t.Fatalf("CreateWebhook() error = %v", err)
+	}
+	if _, err := failing.UpdateWebhook(ctx, sub.ID, &UpdateWebhookRequest{URL: "http://127.0.0.1/other"}); err == nil {
+		t.Error("UpdateWebhook() succeeded without an audit entry")
+	}
+	if err := failing.DeleteWebhook(ctx, sub.ID); err == nil {
+		t.Error("DeleteWebhook() succeeded without an audit entry")
+	}
+	if got, err := repo.GetWebhookSubscription(ctx, sub.ID); err != nil || got.URL != "http://127.0.0.1/hook" {
+		t.Errorf("unaudited webhook changes were saved: %+v, %v", got, err)
+	}
+
+	delivery := &WebhookDelivery{SubscriptionID: sub.ID, EventType: EventUserCreated, Payload: []byte(`{}`), Status: DeliveryFailed}
+	if err := repo.CreateWebhookDelivery(ctx, delivery); err != nil {
+		t.Fatalf("CreateWebhookDelivery() error = %v", err)
+	}
+	if _, err := failing.RedeliverWebhook(ctx, delivery.ID); err == nil {
+		t.Error("RedeliverWebhook() succeeded without an audit entry")
+	}
+	if got, err := repo.GetWebhookDelivery(ctx, delivery.ID); err != nil || got.Status != DeliveryFailed {
+		t.Errorf("unaudited redelivery was saved: %+v, %v", got, err)
+	}
+
+	job := mustEnqueueJob(t, ctx, repo)
+	if _, err := failing.CancelJob(ctx, job.ID); err == nil {
+		t.Error("CancelJob() succeeded without an audit entry")
+	}
+	if got, err := repo.GetJob(ctx, job.ID); err != nil || got.State != JobPending {
+		t.Errorf("unaudited cancellation was saved: %+v, %v", got, err)
+	}
+	if _, err := svc.CancelJob(ctx, job.ID); err != nil {
+		t.Fatalf("CancelJob() error = %v", err)
+	}
+	if _, err := failing.RetryJob(ctx, job.ID); err == nil {
+		t.Error("RetryJob() succeeded without an audit entry")
+	}
+	if got, err := repo.GetJob(ctx, job.ID); err != nil || got.State != JobCancelled {
+		t.Errorf("unaudited retry was saved: %+v, %v", got, err)
+	}
+
+	failing.scheduler.locker = NewTaskLocker(nil, DialectSQLite)
+	if _, err := failing.TriggerTask(ctx, "recompute_statistics"); err == nil {
+		t.Error("TriggerTask() succeeded without an audit entry")
+	}
+	if runs, _ := repo.ListScheduledRuns(ctx, "recompute_statistics", 10); len(runs) != 0 {
+		t.Errorf("unaudited task run was recorded: %+v", runs)
+	}
+
+	events, _ := repo.ListAuditEvents(ctx, AuditFilter{Limit: 10})
+	if len(events) != 2 || events[0].Action != AuditWebhookCreate || events[1].Action != AuditJobCancel {
+		t.Errorf("audit events = %+v, want webhook create and job cancel", events)
+	}
+}
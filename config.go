@@ -1,8 +1,11 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,32 +14,456 @@ type Config struct {
 	DatabaseUrl string
 	Port        string
 	JWTSecret   string
+
+	// Encrypts the JWT signing keys stored in the database
+	SigningKeyEncryptionKey string
+
+	// Port of the admin server that serves /metrics to Prometheus; "off" disables it
+	MetricsPort string
+
+	// Logging
+	LogLevel  slog.Level    // debug, info, warn or error
+	SlowQuery time.Duration // SQL statements slower than this are logged as warnings
+
+	// Connection pool and startup retry settings
+	DBPool PoolConfig
+
+	// Users allowed to call /api/v1/admin endpoints
+	AdminUserIDs []int
+
+	// CORS policies by route group
+	CORS []CORSPolicy
+
+	// Proxies whose X-Forwarded-For header is believed when finding the client IP
+	TrustedProxies []string
+
+	// Outbox relay: where user lifecycle events are delivered
+	OutboxSinks        []string // Any of "log", "file", "webhook"
+	OutboxFilePath     string
+	OutboxWebhookURL   string
+	OutboxPollInterval time.Duration
+	OutboxBatchSize    int
+
+	// Background job queue
+	Jobs JobQueueConfig
+
+	// In-process domain event bus
+	EventBus EventBusConfig
+
+	// Real-time event stream (SSE and WebSocket)
+	Stream StreamConfig
+
+	// Request rate limits
+	RateLimits RateLimitConfig
+
+	// HTTP server timeouts, per route body size limits and deadlines, and security headers
+	Server          ServerConfig
+	RouteLimits     RouteLimitsConfig
+	SecurityHeaders SecurityHeadersConfig
+
+	// OpenTelemetry span export
+	Tracing TracingConfig
+
+	// Idempotency-Key replay
+	Idempotency IdempotencyConfig
+
+	// Outgoing webhook targets and secrets
+	Webhooks WebhookConfig
+
+	// Readiness checks and shutdown draining
+	Health HealthConfig
+
+	// Where recovered panics are reported
+	ErrorReporting ErrorReportingConfig
+
+	// Maintenance tasks
+	Schedules        map[string]string // Cron schedules by task name, from SCHEDULE_<TASK> variables
+	HistoryRetention time.Duration     // How long finished jobs and delivered events are kept
+
+	UserDeletionRetention time.Duration // How long deleted users are kept before they are purged
+
+	// Read replicas (optional, PostgreSQL only)
+	ReplicaUrls           []string
+	ReplicaStickyWindow   time.Duration // How long a user's reads stay on the primary after they write
+	ReplicaHealthInterval time.Duration // How often replicas are pinged
 }
 
 func LoadConfig() *Config {
 	// Load .env file if it exists (ignore error if file doesn't exist)
 	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using system environment variables")
+		slog.Debug("No .env file found, using system environment variables")
 	}
 
 	config := &Config{
 		DatabaseUrl: getEnv("DATABASE_URL", ""),
 		Port:        getEnv("PORT", "8080"),
 		JWTSecret:   getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this-in-production"),
+		MetricsPort: getEnv("METRICS_PORT", "9090"),
+
+		SigningKeyEncryptionKey: getEnv("SIGNING_KEY_ENCRYPTION_KEY", ""),
+
+		LogLevel:  getEnvLogLevel("LOG_LEVEL", slog.LevelInfo),
+		SlowQuery: getEnvDuration("LOG_SLOW_QUERY", 200*time.Millisecond),
+
+		DBPool: PoolConfig{
+			MaxOpenConns:        getEnvInt("DB_MAX_OPEN_CONNS", 25),
+			MaxIdleConns:        getEnvInt("DB_MAX_IDLE_CONNS", 25),
+			ConnMaxLifetime:     getEnvDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute),
+			ConnMaxIdleTime:     getEnvDuration("DB_CONN_MAX_IDLE_TIME", 0),
+			ConnectTimeout:      getEnvDuration("DB_CONNECT_TIMEOUT", 60*time.Second),
+			ConnectRetryBackoff: getEnvDuration("DB_CONNECT_RETRY_BACKOFF", 500*time.Millisecond),
+		},
+
+		AdminUserIDs: getEnvIntList("ADMIN_USER_IDS"),
+
+		CORS: loadCORSPolicies(),
+
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
+
+		OutboxSinks:        getEnvList("OUTBOX_SINKS"),
+		OutboxFilePath:     getEnv("OUTBOX_FILE_PATH", ""),
+		OutboxWebhookURL:   getEnv("OUTBOX_WEBHOOK_URL", ""),
+		OutboxPollInterval: getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		OutboxBatchSize:    getEnvInt("OUTBOX_BATCH_SIZE", 100),
+
+		Jobs: JobQueueConfig{
+			Workers:           getEnvInt("JOB_WORKERS", 3),
+			PollInterval:      getEnvDuration("JOB_POLL_INTERVAL", time.Second),
+			VisibilityTimeout: getEnvDuration("JOB_VISIBILITY_TIMEOUT", 5*time.Minute),
+			MaxAttempts:       getEnvInt("JOB_MAX_ATTEMPTS", 5),
+			RetryBackoff:      getEnvDuration("JOB_RETRY_BACKOFF", 2*time.Second),
+		},
+
+		EventBus: EventBusConfig{
+			Workers:   getEnvInt("EVENT_BUS_WORKERS", 4),
+			QueueSize: getEnvInt("EVENT_BUS_QUEUE_SIZE", 256),
+		},
+
+		Stream: StreamConfig{
+			ReplaySize:        getEnvInt("STREAM_REPLAY_SIZE", 1000),
+			ClientBuffer:      getEnvInt("STREAM_CLIENT_BUFFER", 64),
+			HeartbeatInterval: getEnvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
+			WriteTimeout:      getEnvDuration("STREAM_WRITE_TIMEOUT", 10*time.Second),
+			PollInterval:      getEnvDuration("STREAM_POLL_INTERVAL", time.Second),
+		},
+
+		RateLimits: RateLimitConfig{
+			Store: getEnv("RATE_LIMIT_STORE", "memory"),
+			Auth:  getEnvRateLimit("RATE_LIMIT_AUTH", "auth", "10/1m"),
+			API:   getEnvRateLimit("RATE_LIMIT_API", "api", "300/1m"),
+		},
+
+		Server: ServerConfig{
+			ReadHeaderTimeout: getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+			ReadTimeout:       getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+			WriteTimeout:      getEnvDuration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+			IdleTimeout:       getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+			MaxHeaderBytes:    int(getEnvBytes("SERVER_MAX_HEADER_BYTES", 64<<10)),
+		},
+
+		RouteLimits: RouteLimitsConfig{
+			Auth: RouteLimits{
+				MaxBodyBytes: getEnvBytes("BODY_LIMIT_AUTH", 16<<10),
+				Timeout:      getEnvDuration("REQUEST_TIMEOUT_AUTH", 10*time.Second),
+			},
+			API: RouteLimits{
+				MaxBodyBytes: getEnvBytes("BODY_LIMIT_API", 1<<20),
+				Timeout:      getEnvDuration("REQUEST_TIMEOUT_API", 15*time.Second),
+			},
+			Admin: RouteLimits{
+				MaxBodyBytes: getEnvBytes("BODY_LIMIT_ADMIN", 1<<20),
+				Timeout:      getEnvDuration("REQUEST_TIMEOUT_ADMIN", 45*time.Second),
+			},
+		},
+
+		SecurityHeaders: SecurityHeadersConfig{
+			HSTS:                  getEnvHeader("SECURITY_HSTS", "max-age=31536000; includeSubDomains"),
+			ContentTypeOptions:    getEnvHeader("SECURITY_CONTENT_TYPE_OPTIONS", "nosniff"),
+			FrameOptions:          getEnvHeader("SECURITY_FRAME_OPTIONS", "DENY"),
+			ReferrerPolicy:        getEnvHeader("SECURITY_REFERRER_POLICY", "no-referrer"),
+			ContentSecurityPolicy: getEnvHeader("SECURITY_CSP", "default-src 'none'; frame-ancestors 'none'"),
+		},
+
+		Tracing: TracingConfig{
+			Exporter:    getEnv("TRACING_EXPORTER", "none"),
+			Endpoint:    getEnv("TRACING_ENDPOINT", ""),
+			ServiceName: getEnv("TRACING_SERVICE_NAME", "my-go-api"),
+			SampleRatio: getEnvFloat("TRACING_SAMPLE_RATIO", 1),
+		},
+
+		Idempotency: IdempotencyConfig{
+			TTL:         getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+			LockTimeout: getEnvDuration("IDEMPOTENCY_LOCK_TIMEOUT", time.Minute),
+		},
+
+		Webhooks: WebhookConfig{
+			AllowPrivateTargets: getEnvBool("WEBHOOK_ALLOW_PRIVATE_TARGETS", false),
+			SecretKey:           getEnv("WEBHOOK_SECRET_KEY", ""),
+		},
+
+		Health: HealthConfig{
+			Timeout:       getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+			DBLatencyWarn: getEnvDuration("HEALTH_DB_LATENCY_WARN", 100*time.Millisecond),
+			QueueWarn:     getEnvInt("HEALTH_QUEUE_WARN", 1000),
+			QueueFail:     getEnvInt("HEALTH_QUEUE_FAIL", 0),
+			ShutdownDrain: getEnvDuration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+		},
+
+		ErrorReporting: ErrorReportingConfig{
+			Reporter: getEnv("ERROR_REPORTER", "none"),
+			FilePath: getEnv("ERROR_REPORT_FILE", ""),
+		},
+
+		Schedules:        getEnvPrefixed("SCHEDULE_"),
+		HistoryRetention: getEnvDuration("HISTORY_RETENTION", 7*24*time.Hour),
+
+		UserDeletionRetention: getEnvDuration("USER_DELETION_RETENTION", 30*24*time.Hour),
+
+		ReplicaUrls:           getEnvList("DATABASE_REPLICA_URLS"),
+		ReplicaStickyWindow:   getEnvDuration("REPLICA_STICKY_WINDOW", 5*time.Second),
+		ReplicaHealthInterval: getEnvDuration("REPLICA_HEALTH_INTERVAL", 10*time.Second),
+	}
+
+	if len(config.OutboxSinks) == 0 {
+		config.OutboxSinks = []string{"log"}
 	}
 
-	// Debug: Print what we're actually using
-	log.Printf("Config loaded - Port: %s, DatabaseUrl starts with: %.50s...",
-		config.Port, config.DatabaseUrl)
+	// The write timeout would cut off a response that a handler is still allowed to produce
+	for _, limits := range []RouteLimits{config.RouteLimits.Auth, config.RouteLimits.API, config.RouteLimits.Admin} {
+		if config.Server.WriteTimeout > 0 && limits.Timeout >= config.Server.WriteTimeout {
+			slog.Warn("Request timeout is not below SERVER_WRITE_TIMEOUT; responses may be cut off",
+				"timeout", limits.Timeout.String(), "write_timeout", config.Server.WriteTimeout.String())
+		}
+	}
+
+	slog.Debug("Config loaded", "port", config.Port)
 
 	return config
 }
 
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
-		log.Printf("Using environment variable %s", key)
+		slog.Debug("Using environment variable", "key", key)
 		return value
 	}
-	log.Printf("Using default value for %s", key)
+	slog.Debug("Using default value", "key", key)
 	return defaultValue
 }
+
+// PoolConfig configures a database connection pool
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectTimeout is how long startup keeps retrying an unreachable database
+	ConnectTimeout time.Duration
+	// ConnectRetryBackoff is the first retry delay; it doubles after every attempt
+	ConnectRetryBackoff time.Duration
+}
+
+// getEnvInt reads an integer
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvIntList reads a comma separated list of integers, skipping invalid entries
+func getEnvIntList(key string) []int {
+	var values []int
+	for _, value := range getEnvList(key) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			slog.Warn("Ignoring invalid integer", "key", key, "value", value)
+			continue
+		}
+		values = append(values, n)
+	}
+	return values
+}
+
+// getEnvList reads a comma separated list, ignoring empty entries
+func getEnvList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvFloat reads a floating point number
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid number, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvDuration reads a duration such as "5s" or "1m30s"
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", defaultValue.String())
+		return defaultValue
+	}
+	return duration
+}
+
+// getEnvBytes reads a size in bytes such as "65536", "64KB" or "1MB" (multiples of 1024)
+func getEnvBytes(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, multiplier := strings.ToUpper(value), int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		slog.Warn("Invalid size, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return n * multiplier
+}
+
+// getEnvHeader reads a response header value; "off" leaves the header out
+func getEnvHeader(key, defaultValue string) string {
+	value := getEnv(key, defaultValue)
+	if strings.EqualFold(value, "off") {
+		return ""
+	}
+	return value
+}
+
+// loadCORSPolicies reads the CORS policy for the API and the stricter one for /api/v1/admin
+// Admin routes allow no cross-origin requests unless CORS_ADMIN_ALLOWED_ORIGINS is set
+func loadCORSPolicies() []CORSPolicy {
+	api := CORSPolicy{
+		PathPrefix:       "/",
+		AllowedOrigins:   getEnvListDefault("CORS_ALLOWED_ORIGINS", "*"),
+		AllowedMethods:   getEnvListDefault("CORS_ALLOWED_METHODS", "GET, POST, PUT, PATCH, DELETE"),
+		AllowedHeaders:   getEnvListDefault("CORS_ALLOWED_HEADERS", "Authorization, Content-Type, Accept, Cache-Control, X-Requested-With, X-Request-ID, Last-Event-ID, Idempotency-Key, traceparent, tracestate"),
+		ExposedHeaders:   getEnvListDefault("CORS_EXPOSED_HEADERS", "X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After, Idempotent-Replayed"),
+		AllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		MaxAge:           getEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+
+	admin := api
+	admin.PathPrefix = "/api/v1/admin"
+	admin.AllowedOrigins = getEnvList("CORS_ADMIN_ALLOWED_ORIGINS")
+
+	for _, policy := range []*CORSPolicy{&api, &admin} {
+		for i, origin := range policy.AllowedOrigins {
+			policy.AllowedOrigins[i] = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		}
+		if policy.AllowCredentials && policy.anyOrigin() {
+			slog.Warn("CORS credentials are not sent because the policy allows any origin", "path_prefix", policy.PathPrefix)
+		}
+	}
+	return []CORSPolicy{api, admin}
+}
+
+// getEnvListDefault reads a comma separated list, using defaultValue when the variable is unset
+func getEnvListDefault(key, defaultValue string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultValue
+	}
+	return splitList(value)
+}
+
+// getEnvBool reads a boolean such as "true" or "0"
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// getEnvLogLevel reads a log level: debug, info, warn or error
+func getEnvLogLevel(key string, defaultValue slog.Level) slog.Level {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	level, err := parseLogLevel(value)
+	if err != nil {
+		slog.Warn("Invalid log level, using default", "key", key, "value", value, "default", defaultValue.String())
+		return defaultValue
+	}
+	return level
+}
+
+// getEnvRateLimit reads a rate limit policy such as "10/1m" (see parseRateLimit)
+func getEnvRateLimit(key, name, defaultValue string) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultValue
+	}
+
+	limit, err := parseRateLimit(name, value)
+	if err != nil {
+		slog.Warn("Invalid rate limit, using default", "key", key, "error", err, "default", defaultValue)
+		limit, _ = parseRateLimit(name, defaultValue)
+	}
+	return limit
+}
+
+// getEnvPrefixed collects the variables whose names start with prefix
+// Keys are the rest of the name in lower case (SCHEDULE_PURGE_HISTORY -> purge_history)
+func getEnvPrefixed(prefix string) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, prefix) && value != "" {
+			values[strings.ToLower(strings.TrimPrefix(name, prefix))] = value
+		}
+	}
+	return values
+}
@@ -0,0 +1,172 @@
+// cors.go - Cross-origin resource sharing
+// Each route group can have its own CORS policy, chosen by path prefix. The
+// middleware runs for every request, including preflights for routes that have
+// no OPTIONS handler, and reflects the request's origin only when the group's
+// allowlist accepts it
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSPolicy is the CORS policy of the routes under PathPrefix
+type CORSPolicy struct {
+	PathPrefix       string
+	AllowedOrigins   []string // Exact origins, "https://*.example.com" for any subdomain, or "*" for any origin
+	AllowedMethods   []string
+	AllowedHeaders   []string // Request headers a preflight may ask for; "*" allows any
+	ExposedHeaders   []string // Response headers scripts may read
+	AllowCredentials bool     // Ignored for "*" origins, which browsers don't allow with credentials
+	MaxAge           time.Duration
+}
+
+// allowsOrigin reports whether origin is on the allowlist
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		// "https://*.example.com" matches https://api.example.com and https://a.b.example.com, not https://example.com
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		rest, ok := strings.CutPrefix(origin, scheme+"://")
+		if ok && strings.HasSuffix(rest, "."+host) && len(rest) > len(host)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin reports whether the policy allows every origin
+func (p *CORSPolicy) anyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMethod reports whether a preflight may ask for method
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether a preflight may ask for every header in the
+// comma separated Access-Control-Request-Headers value
+func (p *CORSPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, candidate := range p.AllowedHeaders {
+			if candidate == "*" || strings.EqualFold(candidate, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// CORSMiddleware applies the policy with the longest PathPrefix matching the request
+// Requests outside every policy, and from origins a policy doesn't allow, get no CORS
+// headers, so browsers block the response
+func CORSMiddleware(policies []CORSPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		policy := corsPolicyFor(policies, c.Request.URL.Path)
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		header := c.Writer.Header()
+		if policy != nil {
+			// Responses differ by origin, so caches must key on it even when it isn't allowed
+			header.Add("Vary", "Origin")
+			if preflight {
+				header.Add("Vary", "Access-Control-Request-Method")
+				header.Add("Vary", "Access-Control-Request-Headers")
+			}
+		}
+
+		if origin == "" || policy == nil || !policy.allowsOrigin(origin) {
+			if preflight {
+				// Answer without CORS headers; the browser then refuses the real request
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// Credentials can't be combined with a wildcard origin, so only reflect origins for allowlists
+		credentials := policy.AllowCredentials && !policy.anyOrigin()
+		if policy.anyOrigin() && !policy.AllowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(policy.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+			c.Next()
+			return
+		}
+
+		requestedHeaders := c.GetHeader("Access-Control-Request-Headers")
+		if !policy.allowsMethod(c.GetHeader("Access-Control-Request-Method")) || !policy.allowsHeaders(requestedHeaders) {
+			header.Del("Access-Control-Allow-Origin")
+			header.Del("Access-Control-Allow-Credentials")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+		if requestedHeaders != "" {
+			// Every requested header was checked above, so echo them back
+			header.Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if policy.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// corsPolicyFor returns the policy with the longest PathPrefix that contains path, or nil
+func corsPolicyFor(policies []CORSPolicy, path string) *CORSPolicy {
+	var best *CORSPolicy
+	for i := range policies {
+		prefix := strings.TrimSuffix(policies[i].PathPrefix, "/")
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if best == nil || len(policies[i].PathPrefix) > len(best.PathPrefix) {
+			best = &policies[i]
+		}
+	}
+	return best
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	policy := &CORSPolicy{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"https://other.example.com", false},
+		{"http://app.example.com", false},
+		{"https://api.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://.example.org", false},
+		{"http://api.example.org", false},
+		{"https://api.example.org.evil.com", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := policy.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+
+	if wildcard := (&CORSPolicy{AllowedOrigins: []string{"*"}}); !wildcard.allowsOrigin("https://anything.test") {
+		t.Error("a \"*\" policy refused an origin")
+	}
+	if none := (&CORSPolicy{}); none.allowsOrigin("https://app.example.com") {
+		t.Error("a policy without origins allowed one")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(CORSMiddleware([]CORSPolicy{
+		{PathPrefix: "/api", AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET", "POST"}, AllowedHeaders: []string{"*"}},
+		{PathPrefix: "/api/admin", AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: []string{"GET"},
+			AllowedHeaders: []string{"Authorization"}, AllowCredentials: true},
+	}))
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/admin/jobs", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		origin        string
+		requestMethod string // Access-Control-Request-Method, for preflights
+		status        int
+		allowOrigin   string
+		credentials   string
+	}{
+		{"any origin", http.MethodGet, "/api/users", "https://app.test", "", http.StatusOK, "*", ""},
+		{"subdomain on admin", http.MethodGet, "/api/admin/jobs", "https://ops.example.com", "", http.StatusOK, "https://ops.example.com", "true"},
+		{"other origin on admin", http.MethodGet, "/api/admin/jobs", "https://app.test", "", http.StatusOK, "", ""},
+		{"preflight", http.MethodOptions, "/api/admin/jobs", "https://ops.example.com", "GET", http.StatusNoContent, "https://ops.example.com", "true"},
+		{"preflight for a refused method", http.MethodOptions, "/api/admin/jobs", "https://ops.example.com", "DELETE", http.StatusNoContent, "", ""},
+		{"preflight from a refused origin", http.MethodOptions, "/api/admin/jobs", "https://app.test", "GET", http.StatusNoContent, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			header := w.Header()
+			if w.Code != tt.status || header.Get("Access-Control-Allow-Origin") != tt.allowOrigin ||
+				header.Get("Access-Control-Allow-Credentials") != tt.credentials {
+				t.Errorf("status %d, allow origin %q, credentials %q; want %d, %q, %q", w.Code,
+					header.Get("Access-Control-Allow-Origin"), header.Get("Access-Control-Allow-Credentials"),
+					tt.status, tt.allowOrigin, tt.credentials)
+			}
+			if header.Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin first", header.Get("Vary"))
+			}
+		})
+	}
+}
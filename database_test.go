@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUTCArgs(t *testing.T) {
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	local := time.Date(2024, 1, 31, 12, 0, 0, 0, zone)
+
+	args := []interface{}{1, local, &local, sql.NullTime{Time: local, Valid: true}, (*time.Time)(nil), sql.NullTime{}}
+	got := utcArgs(args)
+
+	if got[1].(time.Time).Location() != time.UTC {
+		t.Errorf("time.Time not converted: %v", got[1])
+	}
+	if got[2].(time.Time).Location() != time.UTC {
+		t.Errorf("*time.Time not converted: %v", got[2])
+	}
+	if nt := got[3].(sql.NullTime); !nt.Valid || nt.Time.Location() != time.UTC {
+		t.Errorf("sql.NullTime not converted: %v", got[3])
+	}
+	if got[4].(*time.Time) != nil || got[5].(sql.NullTime).Valid {
+		t.Error("null times changed")
+	}
+	if args[1].(time.Time).Location() != zone {
+		t.Error("utcArgs modified the caller's slice")
+	}
+}
+
+func TestBindUTCComparesSQLiteTimes(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	if _, err := db.Exec(`CREATE TABLE t (expires_at TIMESTAMP NOT NULL)`); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	q := bindUTC(db, DialectSQLite)
+	expiresAt := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	if _, err := q.ExecContext(ctx, `INSERT INTO t (expires_at) VALUES ($1)`, expiresAt); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// 13:00 at UTC-05:00 is an hour after expiry, but its text sorts before "12:00:00"
+	now := expiresAt.Add(time.Hour).In(time.FixedZone("UTC-5", -5*60*60))
+	var expired int
+	if err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM t WHERE expires_at < $1`, now).Scan(&expired); err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if expired != 1 {
+		t.Errorf("expired rows = %d, want 1", expired)
+	}
+}
+
+// flakyConnector refuses the first failures connections, like a database that is still starting
+type flakyConnector struct {
+	failures int
+	attempts int
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return nil, errors.New("connection refused")
+	}
+	return fakeConn{}, nil
+}
+
+func (c *flakyConnector) Driver() driver.Driver { return nil }
+
+// fakeConn is a connection that only supports being pinged and closed
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestPingWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		timeout  time.Duration
+		attempts int
+		wantErr  bool
+	}{
+		{"reachable", 0, time.Second, 1, false},
+		{"starting up", 2, time.Second, 3, false},
+		{"never reachable", 1000, 20 * time.Millisecond, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector := &flakyConnector{failures: tt.failures}
+			db := sql.OpenDB(connector)
+			defer db.Close()
+
+			start := time.Now()
+			err := pingWithRetry(db, PoolConfig{ConnectTimeout: tt.timeout, ConnectRetryBackoff: time.Millisecond})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pingWithRetry() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// It gives up before the deadline rather than sleep past it
+				if elapsed := time.Since(start); elapsed > tt.timeout || !strings.Contains(err.Error(), "attempt") {
+					t.Errorf("pingWithRetry() = %v after %v, want an error within %v", err, elapsed, tt.timeout)
+				}
+				return
+			}
+			if connector.attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", connector.attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "7")
+	t.Setenv("DB_CONN_MAX_IDLE_TIME", "30s")
+	pool := LoadConfig().DBPool
+	if pool.MaxOpenConns != 7 || pool.MaxIdleConns != 25 || pool.ConnMaxIdleTime != 30*time.Second {
+		t.Fatalf("DBPool = %+v, want 7 open connections, the default 25 idle and a 30s idle time", pool)
+	}
+
+	postgres := sql.OpenDB(&flakyConnector{})
+	defer postgres.Close()
+	configurePool(postgres, DialectPostgres, pool)
+	if max := postgres.Stats().MaxOpenConnections; max != 7 {
+		t.Errorf("Postgres MaxOpenConnections = %d, want 7", max)
+	}
+
+	// SQLite always gets one connection, whatever is configured
+	sqlite := sql.OpenDB(&flakyConnector{})
+	defer sqlite.Close()
+	configurePool(sqlite, DialectSQLite, pool)
+	if max := sqlite.Stats().MaxOpenConnections; max != 1 {
+		t.Errorf("SQLite MaxOpenConnections = %d, want 1", max)
+	}
+}
@@ -0,0 +1,262 @@
+// errors.go - Domain errors
+// These errors are shared by the repository, service and handler layers so that
+// callers can branch on the kind of failure instead of matching error strings
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is returned when a requested record does not exist
+// Use errors.Is(err, ErrNotFound) to check for it
+var ErrNotFound = errors.New("not found")
+
+// ErrUnauthorized is returned when the caller could not be authenticated
+var ErrUnauthorized = errors.New("unauthorized")
+
+// UnauthorizedError explains why authentication failed
+// It matches ErrUnauthorized with errors.Is
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.Message
+}
+
+// Is lets errors.Is(err, ErrUnauthorized) match any UnauthorizedError
+func (e *UnauthorizedError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// ErrInvalidCredentials is returned when a login email/password pair does not match
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// NotFoundError describes which resource was missing
+// It matches ErrNotFound with errors.Is
+type NotFoundError struct {
+	Resource string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Resource + " not found"
+}
+
+// Is lets errors.Is(err, ErrNotFound) match any NotFoundError
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// notFound creates a NotFoundError for the given resource
+func notFound(resource string) error {
+	return &NotFoundError{Resource: resource}
+}
+
+// ErrConflict is returned when a unique field already holds the given value
+type ErrConflict struct {
+	Field string
+	Value string
+}
+
+func (e *ErrConflict) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s is already taken", e.Field)
+	}
+	return fmt.Sprintf("%s %s is already taken", e.Field, e.Value)
+}
+
+// ErrValidation is returned when input is rejected before reaching the database
+// Code is the machine readable error code sent to clients (defaults to "validation_error")
+// Violations lists individual field problems when more than one field was rejected
+type ErrValidation struct {
+	Code       string
+	Field      string
+	Message    string
+	Violations []FieldViolation
+}
+
+func (e *ErrValidation) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	if len(e.Violations) > 0 {
+		parts := make([]string, 0, len(e.Violations))
+		for _, v := range e.Violations {
+			parts = append(parts, v.Field+" "+v.Message)
+		}
+		return strings.Join(parts, "; ")
+	}
+	return e.Message
+}
+
+// ErrForbidden is returned when the caller is authenticated but not allowed to act
+type ErrForbidden struct {
+	Message string
+}
+
+func (e *ErrForbidden) Error() string {
+	return e.Message
+}
+
+// ErrInvalidState is returned when an action isn't allowed in a resource's current state
+type ErrInvalidState struct {
+	Resource string
+	State    string
+	Action   string
+}
+
+func (e *ErrInvalidState) Error() string {
+	return fmt.Sprintf("cannot %s %s in state %s", e.Action, e.Resource, e.State)
+}
+
+// ErrRateLimited is returned when a client has made too many requests
+type ErrRateLimited struct {
+	RetryAfter int // Seconds until the next request will be allowed
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("too many requests, retry in %d seconds", e.RetryAfter)
+}
+
+// ErrRequestTooLarge is returned when a request body is larger than its route allows
+type ErrRequestTooLarge struct {
+	Limit int64 // Bytes
+}
+
+func (e *ErrRequestTooLarge) Error() string {
+	return fmt.Sprintf("request body must not exceed %d bytes", e.Limit)
+}
+
+// ErrRequestTimeout is returned when a handler runs past its route's deadline
+var ErrRequestTimeout = errors.New("request timed out")
+
+// ErrIdempotencyKeyReused is returned when an Idempotency-Key comes back with a different request
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+// ErrIdempotencyKeyInFlight is returned when a request arrives while another with the same Idempotency-Key is still running
+var ErrIdempotencyKeyInFlight = errors.New("a request with this idempotency key is still in progress")
+
+// errorFallback is attached as gin error metadata by handlers
+// It describes the response to send when the error is not a known domain error
+type errorFallback struct {
+	Code    string
+	Message string
+}
+
+// mapError converts an error into the response description sent to the client
+// meta is the errorFallback recorded by the handler, if any
+func mapError(err error, meta interface{}) apiError {
+	e := mapDomainError(err, meta)
+	e.LegacyCode = legacyCode(err, e, meta)
+	return e
+}
+
+// mapDomainError picks the status, code and message for err
+func mapDomainError(err error, meta interface{}) apiError {
+	var notFoundErr *NotFoundError
+	var conflictErr *ErrConflict
+	var validationErr *ErrValidation
+	var unauthorizedErr *UnauthorizedError
+	var forbiddenErr *ErrForbidden
+	var stateErr *ErrInvalidState
+	var rateLimitErr *ErrRateLimited
+	var tooLargeErr *ErrRequestTooLarge
+
+	switch {
+	case errors.As(err, &notFoundErr):
+		resource := strings.ReplaceAll(notFoundErr.Resource, " ", "_")
+		return apiError{
+			Status:  http.StatusNotFound,
+			Code:    resource + "_not_found",
+			Message: capitalize(notFoundErr.Error()),
+		}
+	case errors.Is(err, ErrNotFound):
+		return apiError{Status: http.StatusNotFound, Code: "not_found", Message: "Resource not found"}
+	case errors.As(err, &conflictErr):
+		return apiError{
+			Status:     http.StatusConflict,
+			Code:       conflictErr.Field + "_taken",
+			Message:    capitalize(conflictErr.Error()),
+			Violations: []FieldViolation{{Field: conflictErr.Field, Rule: "unique", Message: "is already taken"}},
+		}
+	case errors.As(err, &validationErr):
+		code := validationErr.Code
+		if code == "" {
+			code = "validation_error"
+		}
+		violations := validationErr.Violations
+		if len(violations) == 0 && validationErr.Field != "" {
+			violations = []FieldViolation{{Field: validationErr.Field, Message: validationErr.Message}}
+		}
+		return apiError{
+			Status:     http.StatusBadRequest,
+			Code:       code,
+			Message:    capitalize(validationErr.Error()),
+			Violations: violations,
+		}
+	case errors.Is(err, ErrInvalidCredentials):
+		return apiError{Status: http.StatusUnauthorized, Code: "authentication_failed", Message: "Invalid email or password"}
+	case errors.As(err, &unauthorizedErr):
+		return apiError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: unauthorizedErr.Message}
+	case errors.Is(err, ErrUnauthorized):
+		return apiError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "User not authenticated"}
+	case errors.As(err, &forbiddenErr):
+		return apiError{Status: http.StatusForbidden, Code: "forbidden", Message: forbiddenErr.Message}
+	case errors.As(err, &stateErr):
+		return apiError{Status: http.StatusConflict, Code: "invalid_state", Message: capitalize(stateErr.Error())}
+	case errors.As(err, &rateLimitErr):
+		return apiError{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: capitalize(rateLimitErr.Error())}
+	case errors.As(err, &tooLargeErr):
+		return apiError{Status: http.StatusRequestEntityTooLarge, Code: "request_too_large", Message: capitalize(tooLargeErr.Error())}
+	case errors.Is(err, ErrRequestTimeout):
+		return apiError{Status: http.StatusServiceUnavailable, Code: "request_timeout", Message: "Request took too long, try again shortly"}
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return apiError{Status: http.StatusUnprocessableEntity, Code: "idempotency_key_reused", Message: capitalize(err.Error())}
+	case errors.Is(err, ErrIdempotencyKeyInFlight):
+		return apiError{Status: http.StatusConflict, Code: "idempotency_key_in_flight", Message: capitalize(err.Error())}
+	case errors.Is(err, ErrQueueClosed), errors.Is(err, ErrSchedulerClosed):
+		return apiError{Status: http.StatusServiceUnavailable, Code: "shutting_down", Message: "Server is shutting down, try again shortly"}
+	}
+
+	// Unknown error - never leak internal details to the client
+	if fallback, ok := meta.(errorFallback); ok {
+		return apiError{Status: http.StatusInternalServerError, Code: fallback.Code, Message: fallback.Message}
+	}
+	return apiError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"}
+}
+
+// legacyCodes maps codes introduced with problem+json back to the codes the
+// application/json shape used before them
+var legacyCodes = map[string]string{
+	"login_failed":   "authentication_failed",
+	"malformed_body": "validation_error",
+}
+
+// legacyCode returns the code sent to clients that negotiated application/json,
+// or "" when it is the same as e.Code. Those clients match on the original codes:
+// a duplicate at registration was user_exists (an update kept email_taken), and
+// AuthMiddleware put its message in the error field
+func legacyCode(err error, e apiError, meta interface{}) string {
+	var conflictErr *ErrConflict
+	var unauthorizedErr *UnauthorizedError
+	fallback, _ := meta.(errorFallback)
+
+	switch {
+	case errors.As(err, &conflictErr) && fallback.Code == "registration_failed":
+		return "user_exists"
+	case errors.As(err, &unauthorizedErr):
+		return unauthorizedErr.Message
+	}
+	return legacyCodes[e.Code]
+}
+
+// capitalize upper-cases the first letter of a message
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
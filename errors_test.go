@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		meta   interface{}
+		status int
+		code   string
+	}{
+		{"not found resource", notFound("user"), nil, http.StatusNotFound, "user_not_found"},
+		{"not found resource with spaces", notFound("webhook delivery"), nil, http.StatusNotFound, "webhook_delivery_not_found"},
+		{"wrapped not found", fmt.Errorf("failed to get user: %w", notFound("user")), nil, http.StatusNotFound, "user_not_found"},
+		{"bare not found", ErrNotFound, nil, http.StatusNotFound, "not_found"},
+		{"conflict", &ErrConflict{Field: "email", Value: "a@example.com"}, nil, http.StatusConflict, "email_taken"},
+		{"validation", &ErrValidation{Field: "email", Message: "is required"}, nil, http.StatusBadRequest, "validation_error"},
+		{"validation with code", &ErrValidation{Code: "invalid_id", Message: "User ID must be a valid number"}, nil, http.StatusBadRequest, "invalid_id"},
+		{"invalid credentials", ErrInvalidCredentials, nil, http.StatusUnauthorized, "authentication_failed"},
+		{"unauthorized", &UnauthorizedError{Message: "Invalid token"}, nil, http.StatusUnauthorized, "unauthorized"},
+		{"bare unauthorized", ErrUnauthorized, nil, http.StatusUnauthorized, "unauthorized"},
+		{"forbidden", &ErrForbidden{Message: "Admin privileges required"}, nil, http.StatusForbidden, "forbidden"},
+		{"invalid state", &ErrInvalidState{Resource: "job", State: "succeeded", Action: "cancel"}, nil, http.StatusConflict, "invalid_state"},
+		{"rate limited", &ErrRateLimited{RetryAfter: 3}, nil, http.StatusTooManyRequests, "rate_limited"},
+		{"too large", &ErrRequestTooLarge{Limit: 1024}, nil, http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"timeout", fmt.Errorf("failed to list users: %w", ErrRequestTimeout), nil, http.StatusServiceUnavailable, "request_timeout"},
+		{"key reused", ErrIdempotencyKeyReused, nil, http.StatusUnprocessableEntity, "idempotency_key_reused"},
+		{"key in flight", ErrIdempotencyKeyInFlight, nil, http.StatusConflict, "idempotency_key_in_flight"},
+		{"queue closed", ErrQueueClosed, nil, http.StatusServiceUnavailable, "shutting_down"},
+		{"unknown with fallback", errors.New("connection refused"), errorFallback{Code: "fetch_failed", Message: "Failed to fetch users"}, http.StatusInternalServerError, "fetch_failed"},
+		{"unknown without fallback", errors.New("connection refused"), nil, http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mapError(tt.err, tt.meta)
+			if got.Status != tt.status || got.Code != tt.code {
+				t.Errorf("mapError() = %d %q, want %d %q", got.Status, got.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestMapErrorHidesInternalDetails(t *testing.T) {
+	got := mapError(errors.New("pq: password authentication failed for user \"api\""), errorFallback{Code: "fetch_failed", Message: "Failed to fetch users"})
+	if got.Message != "Failed to fetch users" {
+		t.Errorf("message = %q, want the fallback message", got.Message)
+	}
+}
+
+func TestMapErrorConflictViolation(t *testing.T) {
+	got := mapError(&ErrConflict{Field: "username"}, nil)
+	if len(got.Violations) != 1 || got.Violations[0].Field != "username" || got.Violations[0].Rule != "unique" {
+		t.Errorf("violations = %+v, want one unique violation for username", got.Violations)
+	}
+}
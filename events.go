@@ -0,0 +1,352 @@
+// events.go - In-process domain event bus
+// Service methods publish typed events after their changes commit; side effects
+// such as analytics and notifications subscribe to them instead of being inlined
+// into the methods. Sync subscribers run inside Publish; async subscribers run on
+// a pool of partition workers, and events with the same aggregate ID always go to
+// the same partition so they are handled in order. Audit entries don't subscribe:
+// they are written in the change's own transaction, so they can't be lost
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DomainEvent is an event published on the EventBus
+type DomainEvent interface {
+	EventName() string
+	AggregateID() int // Async subscribers see events with the same aggregate ID in publish order
+}
+
+// UserRegistered is published after a user account is created
+type UserRegistered struct {
+	User *User
+	At   time.Time
+}
+
+func (e UserRegistered) EventName() string { return EventUserCreated }
+func (e UserRegistered) AggregateID() int  { return e.User.ID }
+
+// UserUpdated is published after a user's profile changes
+type UserUpdated struct {
+	User          *User
+	Before        *User // The user as it was before the change
+	ChangedFields []string
+	At            time.Time
+}
+
+func (e UserUpdated) EventName() string { return EventUserUpdated }
+func (e UserUpdated) AggregateID() int  { return e.User.ID }
+
+// UserDeleted is published after a user account is deleted
+type UserDeleted struct {
+	User *User
+	At   time.Time
+}
+
+func (e UserDeleted) EventName() string { return EventUserDeleted }
+func (e UserDeleted) AggregateID() int  { return e.User.ID }
+
+// UserLoggedIn is published after a successful login
+type UserLoggedIn struct {
+	User *User
+	At   time.Time
+}
+
+func (e UserLoggedIn) EventName() string { return EventUserLoggedIn }
+func (e UserLoggedIn) AggregateID() int  { return e.User.ID }
+
+// DeliveryMode selects how a subscriber is run
+type DeliveryMode int
+
+const (
+	DeliverSync  DeliveryMode = iota // Inside Publish, before it returns; errors are returned to the publisher
+	DeliverAsync                     // On a partition worker after Publish returns; errors are only logged
+)
+
+// EventBusConfig configures the async partition workers
+type EventBusConfig struct {
+	Workers   int // Partitions; each runs its events one at a time
+	QueueSize int // Events queued per partition before Publish blocks
+}
+
+// subscriber is a registered event handler
+type subscriber struct {
+	name   string
+	mode   DeliveryMode
+	handle func(ctx context.Context, event DomainEvent) error // Ignores events of other types
+}
+
+// busEnvelope is an event waiting for its async subscribers
+type busEnvelope struct {
+	ctx   context.Context
+	event DomainEvent
+}
+
+// EventBus delivers published events to subscribers
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers []subscriber
+
+	partitions []chan busEnvelope
+	workers    sync.WaitGroup
+	stop       chan struct{} // Closed by Close first, to wake publishers waiting on a full partition
+	stopOnce   sync.Once
+	closeMu    sync.RWMutex // Held for reading while queueing, so Close can't close a partition mid-send
+	closed     bool
+	pending    atomic.Int64 // Events queued or running on the partitions
+
+	statsMu   sync.Mutex
+	published map[string]int64 // By event name
+	failures  map[string]int64 // By subscriber
+	panics    map[string]int64 // By subscriber
+}
+
+// NewEventBus creates an event bus and starts its partition workers
+func NewEventBus(config EventBusConfig) *EventBus {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+
+	b := &EventBus{
+		partitions: make([]chan busEnvelope, config.Workers),
+		stop:       make(chan struct{}),
+		published:  make(map[string]int64),
+		failures:   make(map[string]int64),
+		panics:     make(map[string]int64),
+	}
+	for i := range b.partitions {
+		b.partitions[i] = make(chan busEnvelope, config.QueueSize)
+		b.workers.Add(1)
+		go b.worker(b.partitions[i])
+	}
+	return b
+}
+
+// Subscribe registers fn for events of type E
+// name identifies the subscriber in logs and metrics
+func Subscribe[E DomainEvent](bus *EventBus, name string, mode DeliveryMode, fn func(ctx context.Context, event E) error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.subscribers = append(bus.subscribers, subscriber{
+		name: name,
+		mode: mode,
+		handle: func(ctx context.Context, event DomainEvent) error {
+			typed, ok := event.(E)
+			if !ok {
+				return nil
+			}
+			return fn(ctx, typed)
+		},
+	})
+}
+
+// Publish delivers event to its sync subscribers, then queues it for its async subscribers
+// The returned error joins the sync subscribers' errors. Async subscribers get a context
+// that keeps ctx's values but is not cancelled with it. If the partition is full, Publish
+// waits for room until ctx ends or the bus closes, and then runs the async subscribers
+// itself, out of order, rather than lose the event
+func (b *EventBus) Publish(ctx context.Context, event DomainEvent) error {
+	b.count(b.published, event.EventName())
+
+	var errs []error
+	for _, sub := range b.subscribersFor(DeliverSync) {
+		if err := b.call(ctx, sub, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.name, err))
+		}
+	}
+
+	asyncCtx := context.WithoutCancel(ctx)
+	if !b.enqueue(ctx, busEnvelope{ctx: asyncCtx, event: event}) {
+		b.deliverAsync(asyncCtx, event)
+	}
+
+	return errors.Join(errs...)
+}
+
+// enqueue queues envelope on its partition, and reports false if it wasn't queued
+// because the bus is closing or ctx ended while the partition was full
+func (b *EventBus) enqueue(ctx context.Context, envelope busEnvelope) bool {
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+
+	if b.closed {
+		return false
+	}
+
+	b.pending.Add(1)
+	select {
+	case b.partitions[b.partition(envelope.event.AggregateID())] <- envelope:
+		return true
+	case <-b.stop:
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "Event bus partition is full; running async subscribers in the publisher",
+			"event", envelope.event.EventName(), "aggregate_id", envelope.event.AggregateID())
+	}
+	b.pending.Add(-1)
+	return false
+}
+
+// Close stops queueing events and waits for the queued ones to be handled
+// Events published after Close are handled synchronously. It returns the number
+// of events still queued or running when ctx expired
+func (b *EventBus) Close(ctx context.Context) int {
+	// Publishers waiting on a full partition give up first, so they release closeMu promptly
+	b.stopOnce.Do(func() { close(b.stop) })
+
+	b.closeMu.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, partition := range b.partitions {
+			close(partition)
+		}
+	}
+	b.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return int(b.pending.Load())
+	}
+}
+
+// Pending returns the number of events queued or running on the partition workers
+func (b *EventBus) Pending() int {
+	return int(b.pending.Load())
+}
+
+// Capacity returns how many events can be queued before Publish blocks
+func (b *EventBus) Capacity() int {
+	return len(b.partitions) * cap(b.partitions[0])
+}
+
+// EventBusHealthCheck fails once the bus is closed or its queues are full, since
+// Publish then blocks the requests that publish events, and warns when they are
+// more than 80% full
+func EventBusHealthCheck(bus *EventBus) HealthChecker {
+	return HealthCheckerFunc(func(context.Context) HealthResult {
+		bus.closeMu.RLock()
+		closed := bus.closed
+		bus.closeMu.RUnlock()
+
+		pending, capacity := bus.Pending(), bus.Capacity()
+		details := map[string]interface{}{"pending": pending, "capacity": capacity}
+		switch {
+		case closed:
+			return HealthResult{Status: HealthFail, Message: "event bus is closed", Details: details}
+		case pending >= capacity:
+			return HealthResult{Status: HealthFail, Message: "event bus queues are full", Details: details}
+		case pending*5 > capacity*4:
+			return HealthResult{Status: HealthWarn, Message: "event bus queues are filling up", Details: details}
+		}
+		return HealthResult{Status: HealthPass, Details: details}
+	})
+}
+
+// worker handles the events of one partition in order
+func (b *EventBus) worker(partition chan busEnvelope) {
+	defer b.workers.Done()
+
+	for envelope := range partition {
+		b.deliverAsync(envelope.ctx, envelope.event)
+		b.pending.Add(-1)
+	}
+}
+
+// deliverAsync runs every async subscriber for event, logging failures
+func (b *EventBus) deliverAsync(ctx context.Context, event DomainEvent) {
+	for _, sub := range b.subscribersFor(DeliverAsync) {
+		if err := b.call(ctx, sub, event); err != nil {
+			slog.ErrorContext(ctx, "Event subscriber failed", "subscriber", sub.name, "event", event.EventName(), "aggregate_id", event.AggregateID(), "error", err)
+		}
+	}
+}
+
+// call runs one subscriber, turning a panic into an error so it can't take down the publisher or a worker
+func (b *EventBus) call(ctx context.Context, sub subscriber, event DomainEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.count(b.panics, sub.name)
+			err = capturePanic(withLogAttrs(ctx, slog.String("subscriber", sub.name)), "event subscriber", r)
+		}
+		if err != nil {
+			b.count(b.failures, sub.name)
+		}
+	}()
+
+	return sub.handle(ctx, event)
+}
+
+// subscribersFor returns the subscribers with the given delivery mode, in registration order
+func (b *EventBus) subscribersFor(mode DeliveryMode) []subscriber {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var subs []subscriber
+	for _, sub := range b.subscribers {
+		if sub.mode == mode {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// partition picks the worker for an aggregate ID
+func (b *EventBus) partition(aggregateID int) int {
+	p := aggregateID % len(b.partitions)
+	if p < 0 {
+		p += len(b.partitions)
+	}
+	return p
+}
+
+// count increments a per-name counter
+func (b *EventBus) count(counters map[string]int64, name string) {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+
+	counters[name]++
+}
+
+// samples returns a counter map as samples labelled with key, sorted by label
+func (b *EventBus) samples(counters map[string]int64, key string) []Sample {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+
+	samples := make([]Sample, 0, len(counters))
+	for name, value := range counters {
+		samples = append(samples, Sample{Labels: Labels{key: name}, Value: float64(value)})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Labels[key] < samples[j].Labels[key] })
+	return samples
+}
+
+// RegisterEventBusMetrics exposes event counts, subscriber failures and the async backlog
+func RegisterEventBusMetrics(registry *Registry, bus *EventBus) {
+	registry.CounterFunc("app_events_published_total", "Domain events published, by event", func() []Sample {
+		return bus.samples(bus.published, "event")
+	})
+	registry.CounterFunc("app_event_subscriber_failures_total", "Subscriber calls that returned an error or panicked, by subscriber", func() []Sample {
+		return bus.samples(bus.failures, "subscriber")
+	})
+	registry.CounterFunc("app_event_subscriber_panics_total", "Subscriber calls that panicked, by subscriber", func() []Sample {
+		return bus.samples(bus.panics, "subscriber")
+	})
+	registry.GaugeFunc("app_event_bus_pending", "Events queued or running on the async workers", func() []Sample {
+		return []Sample{{Value: float64(bus.Pending())}}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEvent is a domain event carrying a sequence number, to check delivery order
+type testEvent struct {
+	Aggregate int
+	Seq       int
+}
+
+func (e testEvent) EventName() string { return "test.event" }
+func (e testEvent) AggregateID() int  { return e.Aggregate }
+
+func TestEventBusOrdersEventsPerAggregate(t *testing.T) {
+	ctx := context.Background()
+	bus := NewEventBus(EventBusConfig{Workers: 3, QueueSize: 100})
+
+	var mu sync.Mutex
+	received := map[int][]int{}
+	Subscribe(bus, "recorder", DeliverAsync, func(_ context.Context, e testEvent) error {
+		time.Sleep(time.Duration(e.Seq%3) * time.Millisecond) // Uneven handling times
+		mu.Lock()
+		defer mu.Unlock()
+		received[e.Aggregate] = append(received[e.Aggregate], e.Seq)
+		return nil
+	})
+
+	for seq := 0; seq < 20; seq++ {
+		for aggregate := 1; aggregate <= 4; aggregate++ {
+			bus.Publish(ctx, testEvent{Aggregate: aggregate, Seq: seq})
+		}
+	}
+	if pending := bus.Close(ctx); pending != 0 {
+		t.Fatalf("Close() = %d pending, want 0", pending)
+	}
+
+	want := make([]int, 20)
+	for i := range want {
+		want[i] = i
+	}
+	for aggregate := 1; aggregate <= 4; aggregate++ {
+		if !reflect.DeepEqual(received[aggregate], want) {
+			t.Errorf("aggregate %d received %v, want every event in publish order", aggregate, received[aggregate])
+		}
+	}
+}
+
+func TestEventBusIsolatesPanics(t *testing.T) {
+	ctx := context.Background()
+	bus := NewEventBus(EventBusConfig{Workers: 1, QueueSize: 10})
+
+	var after []string
+	Subscribe(bus, "broken", DeliverSync, func(context.Context, testEvent) error { panic("subscriber bug") })
+	Subscribe(bus, "failing", DeliverSync, func(context.Context, testEvent) error { return errors.New("boom") })
+	Subscribe(bus, "healthy", DeliverSync, func(context.Context, testEvent) error {
+		after = append(after, "sync")
+		return nil
+	})
+	Subscribe(bus, "broken_async", DeliverAsync, func(context.Context, testEvent) error { panic("async bug") })
+	Subscribe(bus, "healthy_async", DeliverAsync, func(context.Context, testEvent) error {
+		after = append(after, "async")
+		return nil
+	})
+
+	// The publisher gets the sync errors, and every other subscriber still runs
+	if err := bus.Publish(ctx, testEvent{Aggregate: 1}); err == nil {
+		t.Error("Publish() error = nil, want the sync subscribers' failures")
+	}
+	bus.Close(ctx)
+	if !reflect.DeepEqual(after, []string{"sync", "async"}) {
+		t.Errorf("healthy subscribers ran %v, want sync then async", after)
+	}
+
+	failures := map[string]float64{}
+	for _, sample := range bus.samples(bus.failures, "subscriber") {
+		failures[sample.Labels["subscriber"]] = sample.Value
+	}
+	panics := bus.samples(bus.panics, "subscriber")
+	if failures["broken"] != 1 || failures["failing"] != 1 || failures["broken_async"] != 1 || failures["healthy"] != 0 || len(panics) != 2 {
+		t.Errorf("failures = %v, panics = %v; want the two panics and the error counted", failures, panics)
+	}
+}
+
+func TestEventBusClose(t *testing.T) {
+	ctx := context.Background()
+	bus := NewEventBus(EventBusConfig{Workers: 1, QueueSize: 1})
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []int
+	Subscribe(bus, "slow", DeliverAsync, func(_ context.Context, e testEvent) error {
+		if e.Seq == 0 {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, e.Seq)
+		return nil
+	})
+
+	// Event 0 blocks the worker and event 1 fills the queue, so event 2 waits
+	bus.Publish(ctx, testEvent{Seq: 0})
+	bus.Publish(ctx, testEvent{Seq: 1})
+	for bus.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A publisher whose request ends stops waiting and runs the subscribers itself
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	bus.Publish(cancelled, testEvent{Seq: 2})
+
+	// A publisher still waiting when Close starts doesn't hold it up
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(ctx, testEvent{Seq: 3})
+		close(published)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	expired, cancelExpired := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelExpired()
+	if pending := bus.Close(expired); pending != 2 {
+		t.Errorf("Close() with the worker stuck = %d pending, want 2", pending)
+	}
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Publish() was still waiting after Close()")
+	}
+
+	// Once closed, events are handled in Publish; the queued ones still drain
+	bus.Publish(ctx, testEvent{Seq: 4})
+	close(release)
+	if pending := bus.Close(ctx); pending != 0 {
+		t.Errorf("Close() after the worker was released = %d pending, want 0", pending)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(handled, []int{2, 3, 4, 0, 1}) {
+		t.Errorf("handled %v, want 2, 3 and 4 in their publishers, then the queue", handled)
+	}
+}
@@ -3,21 +3,38 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
 )
 
 // Handler handles HTTP requests
 type Handler struct {
-	service Service
+	service  Service
+	replicas *ReplicaSet // Database pools, for admin statistics
+	metrics  *Registry
+	stream   *EventStream // Live user events for SSE and WebSocket clients
+	logins   *CounterVec  // Login attempts, by result
+	health   *HealthRegistry
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(service Service) *Handler {
+func NewHandler(service Service, replicas *ReplicaSet, metrics *Registry, stream *EventStream, health *HealthRegistry) *Handler {
 	return &Handler{
-		service: service,
+		service:  service,
+		replicas: replicas,
+		metrics:  metrics,
+		stream:   stream,
+		logins:   NewCounterVec("result"),
+		health:   health,
 	}
 }
 
@@ -28,29 +45,14 @@ func (h *Handler) Register(c *gin.Context) {
 
 	// Bind JSON request to struct with validation
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "validation_error",
-			Message: err.Error(),
-		})
+		reject(c, bindingError(err))
 		return
 	}
 
 	// Call service to register user
-	user, err := h.service.Register(&req)
+	user, err := h.service.Register(c.Request.Context(), &req)
 	if err != nil {
-		// Handle different types of errors
-		if err.Error() == "user with email "+req.Email+" already exists" {
-			c.JSON(http.StatusConflict, ErrorResponse{
-				Error:   "user_exists",
-				Message: "A user with this email already exists",
-			})
-			return
-		}
-
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "registration_failed",
-			Message: "Failed to register user",
-		})
+		fail(c, err, "registration_failed", "Failed to register user")
 		return
 	}
 
@@ -69,22 +71,22 @@ func (h *Handler) Login(c *gin.Context) {
 
 	// Bind and validate request
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "validation_error",
-			Message: err.Error(),
-		})
+		reject(c, bindingError(err))
 		return
 	}
 
 	// Call service to authenticate user
-	token, err := h.service.Login(&req)
+	token, err := h.service.Login(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "authentication_failed",
-			Message: "Invalid email or password",
-		})
+		if errors.Is(err, ErrInvalidCredentials) {
+			h.logins.Inc("failure")
+		} else {
+			h.logins.Inc("error")
+		}
+		fail(c, err, "login_failed", "Failed to log in")
 		return
 	}
+	h.logins.Inc("success")
 
 	// Return token
 	c.JSON(http.StatusOK, SuccessResponse{
@@ -105,12 +107,9 @@ func (h *Handler) GetUsers(c *gin.Context) {
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 
 	// Call service to get users
-	result, err := h.service.GetUsers(page, limit)
+	result, err := h.service.GetUsers(c.Request.Context(), page, limit)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "fetch_failed",
-			Message: "Failed to fetch users",
-		})
+		fail(c, err, "fetch_failed", "Failed to fetch users")
 		return
 	}
 
@@ -128,20 +127,14 @@ func (h *Handler) GetUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_id",
-			Message: "User ID must be a valid number",
-		})
+		reject(c, &ErrValidation{Code: "invalid_id", Message: "User ID must be a valid number"})
 		return
 	}
 
 	// Get current user ID from context (set by auth middleware)
 	currentUserID, exists := c.Get("user_id")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "unauthorized",
-			Message: "User not authenticated",
-		})
+		reject(c, ErrUnauthorized)
 		return
 	}
 
@@ -150,20 +143,9 @@ func (h *Handler) GetUser(c *gin.Context) {
 	// In a real app, you might want to restrict this
 
 	// Call service to get user
-	user, err := h.service.GetUser(id)
+	user, err := h.service.GetUser(c.Request.Context(), id)
 	if err != nil {
-		if err.Error() == "user not found" {
-			c.JSON(http.StatusNotFound, ErrorResponse{
-				Error:   "user_not_found",
-				Message: "User not found",
-			})
-			return
-		}
-
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "fetch_failed",
-			Message: "Failed to fetch user",
-		})
+		fail(c, err, "fetch_failed", "Failed to fetch user")
 		return
 	}
 
@@ -187,75 +169,35 @@ func (h *Handler) UpdateUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_id",
-			Message: "User ID must be a valid number",
-		})
+		reject(c, &ErrValidation{Code: "invalid_id", Message: "User ID must be a valid number"})
 		return
 	}
 
 	// Get current user ID from context
 	currentUserID, exists := c.Get("user_id")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "unauthorized",
-			Message: "User not authenticated",
-		})
+		reject(c, ErrUnauthorized)
 		return
 	}
 
 	// Check if user is trying to update their own profile
 	// In a real app, you might have admin roles that can update any user
 	if currentUserID != id {
-		c.JSON(http.StatusForbidden, ErrorResponse{
-			Error:   "forbidden",
-			Message: "You can only update your own profile",
-		})
+		reject(c, &ErrForbidden{Message: "You can only update your own profile"})
 		return
 	}
 
 	// Bind and validate request
 	var req UpdateUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "validation_error",
-			Message: err.Error(),
-		})
+		reject(c, bindingError(err))
 		return
 	}
 
 	// Call service to update user
-	user, err := h.service.UpdateUser(id, &req)
+	user, err := h.service.UpdateUser(c.Request.Context(), id, &req)
 	if err != nil {
-		if err.Error() == "user not found" {
-			c.JSON(http.StatusNotFound, ErrorResponse{
-				Error:   "user_not_found",
-				Message: "User not found",
-			})
-			return
-		}
-
-		if err.Error() == "no updates provided" {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Error:   "no_updates",
-				Message: "No updates provided",
-			})
-			return
-		}
-
-		// Check for email already taken error
-		if err.Error()[:5] == "email" && err.Error()[len(err.Error())-17:] == "is already taken" {
-			c.JSON(http.StatusConflict, ErrorResponse{
-				Error:   "email_taken",
-				Message: err.Error(),
-			})
-			return
-		}
-
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "update_failed",
-			Message: "Failed to update user",
-		})
+		fail(c, err, "update_failed", "Failed to update user")
 		return
 	}
 
@@ -274,47 +216,27 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_id",
-			Message: "User ID must be a valid number",
-		})
+		reject(c, &ErrValidation{Code: "invalid_id", Message: "User ID must be a valid number"})
 		return
 	}
 
 	// Get current user ID from context
 	currentUserID, exists := c.Get("user_id")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "unauthorized",
-			Message: "User not authenticated",
-		})
+		reject(c, ErrUnauthorized)
 		return
 	}
 
 	// Check if user is trying to delete their own account
 	// In a real app, you might have admin roles that can delete any user
 	if currentUserID != id {
-		c.JSON(http.StatusForbidden, ErrorResponse{
-			Error:   "forbidden",
-			Message: "You can only delete your own account",
-		})
+		reject(c, &ErrForbidden{Message: "You can only delete your own account"})
 		return
 	}
 
 	// Call service to delete user
-	if err := h.service.DeleteUser(id); err != nil {
-		if err.Error() == "user not found" {
-			c.JSON(http.StatusNotFound, ErrorResponse{
-				Error:   "user_not_found",
-				Message: "User not found",
-			})
-			return
-		}
-
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "delete_failed",
-			Message: "Failed to delete user",
-		})
+	if err := h.service.DeleteUser(c.Request.Context(), id); err != nil {
+		fail(c, err, "delete_failed", "Failed to delete user")
 		return
 	}
 
@@ -332,12 +254,9 @@ func (h *Handler) GetUserStatistics(c *gin.Context) {
 	// For this example, we'll allow any authenticated user
 
 	// Call service to get statistics (this demonstrates concurrent processing)
-	stats, err := h.service.GetUserStatistics()
+	stats, err := h.service.GetUserStatistics(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error:   "stats_failed",
-			Message: "Failed to get user statistics",
-		})
+		fail(c, err, "stats_failed", "Failed to get user statistics")
 		return
 	}
 
@@ -348,45 +267,699 @@ func (h *Handler) GetUserStatistics(c *gin.Context) {
 	})
 }
 
-// Example of a handler that demonstrates goroutine usage
+// GetDatabaseStats handles getting connection pool statistics for every database
+// GET /api/v1/admin/db/stats
+func (h *Handler) GetDatabaseStats(c *gin.Context) {
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data: gin.H{
+			"pools": h.replicas.PoolStats(),
+		},
+	})
+}
+
+// GetMetrics handles getting the current value of every registered metric
+// GET /api/v1/admin/metrics
+func (h *Handler) GetMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    h.metrics.Gather(),
+	})
+}
+
+// Livez reports that the process is up; it doesn't check dependencies, so a
+// database outage doesn't get every instance restarted
+// GET /livez
+func (h *Handler) Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz runs the health checks and answers 503 if any fails or shutdown has started
+// GET /readyz
+func (h *Handler) Readyz(c *gin.Context) {
+	report := h.health.Check(c.Request.Context())
+	c.JSON(healthStatusCode(report), gin.H{"status": report.Status})
+}
+
+// Healthz is Readyz for admins; with ?verbose it returns every check's result
+// GET /healthz?verbose
+func (h *Handler) Healthz(c *gin.Context) {
+	report := h.health.Check(c.Request.Context())
+	if _, verbose := c.GetQuery("verbose"); verbose {
+		c.JSON(healthStatusCode(report), report)
+		return
+	}
+	c.JSON(healthStatusCode(report), gin.H{"status": report.Status})
+}
+
+// healthStatusCode is 503 for a failed report, so load balancers take the instance out
+func healthStatusCode(report *HealthReport) int {
+	if report.Status == HealthFail {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// ProcessUserData queues background processing of the user's data
+// The response links to the job so the client can poll its status
 // POST /api/v1/users/:id/process
 func (h *Handler) ProcessUserData(c *gin.Context) {
 	// Parse user ID
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_id",
-			Message: "User ID must be a valid number",
-		})
+		reject(c, &ErrValidation{Code: "invalid_id", Message: "User ID must be a valid number"})
 		return
 	}
 
 	// Get current user ID from context
 	currentUserID, exists := c.Get("user_id")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "unauthorized",
-			Message: "User not authenticated",
-		})
+		reject(c, ErrUnauthorized)
 		return
 	}
 
 	// Check authorization
 	if currentUserID != id {
-		c.JSON(http.StatusForbidden, ErrorResponse{
-			Error:   "forbidden",
-			Message: "You can only process your own data",
-		})
+		reject(c, &ErrForbidden{Message: "You can only process your own data"})
 		return
 	}
 
 	// Trigger background processing
-	h.service.ProcessUserAnalytics(id)
+	job, err := h.service.ProcessUserAnalytics(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "processing_failed", "Failed to start user data processing")
+		return
+	}
 
 	// Return immediate response (processing happens in background)
+	c.Header("Location", fmt.Sprintf("/api/v1/jobs/%d", job.ID))
 	c.JSON(http.StatusAccepted, SuccessResponse{
 		Success: true,
+		Data:    job,
 		Message: "User data processing started",
 	})
 }
+
+// GetJob handles getting the status of one of the current user's jobs
+// GET /api/v1/jobs/:id
+func (h *Handler) GetJob(c *gin.Context) {
+	id, ok := idParam(c, "Job")
+	if !ok {
+		return
+	}
+
+	// Get current user ID from context (set by auth middleware)
+	currentUserID, exists := c.Get("user_id")
+	if !exists {
+		reject(c, ErrUnauthorized)
+		return
+	}
+
+	job, err := h.service.GetJob(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch job")
+		return
+	}
+
+	// Other users' jobs look the same as missing ones
+	if job.UserID == nil || *job.UserID != currentUserID {
+		reject(c, notFound("job"))
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    job,
+	})
+}
+
+// AdminGetJob handles getting any job by ID
+// GET /api/v1/admin/jobs/:id
+func (h *Handler) AdminGetJob(c *gin.Context) {
+	id, ok := idParam(c, "Job")
+	if !ok {
+		return
+	}
+
+	job, err := h.service.GetJob(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch job")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    job,
+	})
+}
+
+// ListJobs handles listing jobs with pagination and an optional state filter
+// GET /api/v1/admin/jobs?state=failed&page=1&limit=20
+func (h *Handler) ListJobs(c *gin.Context) {
+	// Parse query parameters
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	result, err := h.service.ListJobs(c.Request.Context(), c.Query("state"), page, limit)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch jobs")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// RetryJob handles queueing a failed or cancelled job to run again
+// POST /api/v1/admin/jobs/:id/retry
+func (h *Handler) RetryJob(c *gin.Context) {
+	id, ok := idParam(c, "Job")
+	if !ok {
+		return
+	}
+
+	job, err := h.service.RetryJob(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "retry_failed", "Failed to retry job")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    job,
+		Message: "Job queued for retry",
+	})
+}
+
+// CancelJob handles cancelling a pending or running job
+// POST /api/v1/admin/jobs/:id/cancel
+func (h *Handler) CancelJob(c *gin.Context) {
+	id, ok := idParam(c, "Job")
+	if !ok {
+		return
+	}
+
+	job, err := h.service.CancelJob(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "cancel_failed", "Failed to cancel job")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    job,
+		Message: "Job cancelled",
+	})
+}
+
+// ListScheduledTasks handles listing the maintenance tasks and their schedules
+// GET /api/v1/admin/scheduler/tasks
+func (h *Handler) ListScheduledTasks(c *gin.Context) {
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    h.service.ScheduledTasks(),
+	})
+}
+
+// TriggerTask handles running a maintenance task now
+// POST /api/v1/admin/scheduler/tasks/:name/run
+func (h *Handler) TriggerTask(c *gin.Context) {
+	run, err := h.service.TriggerTask(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		fail(c, err, "trigger_failed", "Failed to run task")
+		return
+	}
+
+	// The task keeps running after the response; its run shows up in the history
+	c.JSON(http.StatusAccepted, SuccessResponse{
+		Success: true,
+		Data:    run,
+		Message: "Task started",
+	})
+}
+
+// ListScheduledRuns handles listing the run history of maintenance tasks
+// GET /api/v1/admin/scheduler/runs?task=purge_history&limit=20
+func (h *Handler) ListScheduledRuns(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	runs, err := h.service.ListScheduledRuns(c.Request.Context(), c.Query("task"), limit)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch task runs")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    runs,
+	})
+}
+
+// CreateWebhook handles subscribing a URL to events
+// POST /api/v1/admin/webhooks
+func (h *Handler) CreateWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		reject(c, bindingError(err))
+		return
+	}
+
+	sub, err := h.service.CreateWebhook(c.Request.Context(), &req)
+	if err != nil {
+		fail(c, err, "create_failed", "Failed to create webhook")
+		return
+	}
+
+	// The secret is only shown now; receivers need it to verify signatures
+	c.JSON(http.StatusCreated, SuccessResponse{
+		Success: true,
+		Data:    sub,
+		Message: "Webhook created",
+	})
+}
+
+// ListWebhooks handles listing webhook subscriptions
+// GET /api/v1/admin/webhooks
+func (h *Handler) ListWebhooks(c *gin.Context) {
+	subs, err := h.service.ListWebhooks(c.Request.Context())
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch webhooks")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    subs,
+	})
+}
+
+// GetWebhook handles getting a webhook subscription by ID
+// GET /api/v1/admin/webhooks/:id
+func (h *Handler) GetWebhook(c *gin.Context) {
+	id, ok := idParam(c, "Webhook")
+	if !ok {
+		return
+	}
+
+	sub, err := h.service.GetWebhook(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    sub,
+	})
+}
+
+// UpdateWebhook handles changing a webhook subscription or rotating its secret
+// PUT /api/v1/admin/webhooks/:id
+func (h *Handler) UpdateWebhook(c *gin.Context) {
+	id, ok := idParam(c, "Webhook")
+	if !ok {
+		return
+	}
+
+	var req UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		reject(c, bindingError(err))
+		return
+	}
+
+	sub, err := h.service.UpdateWebhook(c.Request.Context(), id, &req)
+	if err != nil {
+		fail(c, err, "update_failed", "Failed to update webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    sub,
+		Message: "Webhook updated",
+	})
+}
+
+// DeleteWebhook handles deleting a webhook subscription and its delivery log
+// DELETE /api/v1/admin/webhooks/:id
+func (h *Handler) DeleteWebhook(c *gin.Context) {
+	id, ok := idParam(c, "Webhook")
+	if !ok {
+		return
+	}
+
+	if err := h.service.DeleteWebhook(c.Request.Context(), id); err != nil {
+		fail(c, err, "delete_failed", "Failed to delete webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "Webhook deleted",
+	})
+}
+
+// ListWebhookDeliveries handles listing the delivery log of a webhook subscription
+// GET /api/v1/admin/webhooks/:id/deliveries?limit=20
+func (h *Handler) ListWebhookDeliveries(c *gin.Context) {
+	id, ok := idParam(c, "Webhook")
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	deliveries, err := h.service.ListWebhookDeliveries(c.Request.Context(), id, limit)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch webhook deliveries")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    deliveries,
+	})
+}
+
+// RedeliverWebhook handles sending a webhook delivery again
+// POST /api/v1/admin/webhooks/deliveries/:id/redeliver
+func (h *Handler) RedeliverWebhook(c *gin.Context) {
+	id, ok := idParam(c, "Delivery")
+	if !ok {
+		return
+	}
+
+	delivery, err := h.service.RedeliverWebhook(c.Request.Context(), id)
+	if err != nil {
+		fail(c, err, "redeliver_failed", "Failed to redeliver webhook")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, SuccessResponse{
+		Success: true,
+		Data:    delivery,
+		Message: "Webhook queued for redelivery",
+	})
+}
+
+// auditFilterParams parses the audit log filters from the query string, rejecting the request if one is invalid
+// actor_id, action, target_type and target_id match exactly; since and until are RFC 3339 times
+func auditFilterParams(c *gin.Context) (AuditFilter, bool) {
+	filter := AuditFilter{
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+	}
+
+	if value := c.Query("actor_id"); value != "" {
+		actorID, err := strconv.Atoi(value)
+		if err != nil {
+			reject(c, &ErrValidation{Code: "invalid_filter", Field: "actor_id", Message: "must be a valid number"})
+			return filter, false
+		}
+		filter.ActorID = &actorID
+	}
+
+	for _, param := range []struct {
+		name   string
+		target **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			reject(c, &ErrValidation{Code: "invalid_filter", Field: param.name, Message: "must be an RFC 3339 time, e.g. 2024-01-31T00:00:00Z"})
+			return filter, false
+		}
+		*param.target = &t
+	}
+
+	return filter, true
+}
+
+// ListAuditEvents handles listing the audit log, newest first
+// GET /api/v1/admin/audit?actor_id=1&action=user.update&target_type=user&target_id=7&since=...&until=...&page=1&limit=50
+func (h *Handler) ListAuditEvents(c *gin.Context) {
+	filter, ok := auditFilterParams(c)
+	if !ok {
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	result, err := h.service.ListAuditEvents(c.Request.Context(), filter, page, limit)
+	if err != nil {
+		fail(c, err, "fetch_failed", "Failed to fetch audit events")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// ExportAuditEvents handles exporting the audit log as newline-delimited JSON, oldest first
+// GET /api/v1/admin/audit/export (same filters as ListAuditEvents, without paging)
+func (h *Handler) ExportAuditEvents(c *gin.Context) {
+	filter, ok := auditFilterParams(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.ndjson"`)
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	written := 0
+	err := h.service.ExportAuditEvents(c.Request.Context(), filter, func(event *AuditEvent) error {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		// Send each batch as it is read rather than buffering the whole export
+		if written++; written%auditBatchSize == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// The status line has been sent; all we can do is cut the export short
+		slog.ErrorContext(c.Request.Context(), "Audit export failed", "written", written, "error", err)
+		c.Abort()
+	}
+}
+
+// VerifyAuditLog handles checking the audit log's hash chain for tampering
+// GET /api/v1/admin/audit/verify
+func (h *Handler) VerifyAuditLog(c *gin.Context) {
+	result, err := h.service.VerifyAuditLog(c.Request.Context())
+	if err != nil {
+		fail(c, err, "verify_failed", "Failed to verify audit log")
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// streamFilterFor returns the events a user may see: admins see every event,
+// other users only events about themselves
+func streamFilterFor(c *gin.Context) StreamFilter {
+	if c.GetBool("is_admin") {
+		return func(*OutboxEvent) bool { return true }
+	}
+
+	userID := c.GetInt("user_id")
+	return func(event *OutboxEvent) bool {
+		return event.AggregateType == "user" && event.AggregateID == userID
+	}
+}
+
+// lastEventID reads the resume position from the Last-Event-ID header or the last_event_id query parameter
+// The query parameter is for WebSocket clients, which can't set headers
+func lastEventID(c *gin.Context) int64 {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	id, _ := strconv.ParseInt(value, 10, 64)
+	return id
+}
+
+// StreamEvents handles streaming user events with Server-Sent Events
+// GET /api/v1/events/stream
+func (h *Handler) StreamEvents(c *gin.Context) {
+	sub, replay, reset := h.stream.Subscribe(lastEventID(c), streamFilterFor(c))
+	defer h.stream.Unsubscribe(sub)
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	c.Status(http.StatusOK)
+
+	// A client that stops reading must not hold the handler forever
+	rc := http.NewResponseController(c.Writer)
+	write := func(event sse.Event) bool {
+		rc.SetWriteDeadline(time.Now().Add(h.stream.config.WriteTimeout))
+		if err := sse.Encode(c.Writer, event); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	send := func(event *OutboxEvent) bool {
+		return write(sse.Event{
+			Id:    strconv.FormatInt(event.ID, 10),
+			Event: event.EventType,
+			Data:  streamMessage{ID: event.ID, Type: event.EventType, Event: event},
+		})
+	}
+
+	if reset && !write(sse.Event{Event: StreamReset, Data: streamMessage{Type: StreamReset}}) {
+		return
+	}
+	for _, event := range replay {
+		if !send(event) {
+			return
+		}
+	}
+	// Flush the headers even when there is nothing to replay
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.stream.config.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-sub.Events():
+			if !send(event) {
+				return
+			}
+		case <-sub.Done():
+			if sub.Overflowed() {
+				write(sse.Event{Event: StreamOverflow, Data: streamMessage{Type: StreamOverflow}})
+			}
+			return
+		case <-heartbeat.C:
+			if !write(sse.Event{Event: StreamHeartbeat, Data: streamMessage{Type: StreamHeartbeat}}) {
+				return
+			}
+		}
+	}
+}
+
+// StreamEventsWebSocket handles streaming user events over a WebSocket
+// GET /api/v1/events/ws
+// Messages are JSON objects shaped like the SSE data; clients resume with ?last_event_id=
+func (h *Handler) StreamEventsWebSocket(c *gin.Context) {
+	filter := streamFilterFor(c)
+	lastID := lastEventID(c)
+
+	// Authentication is by token, not cookie, so any origin may connect
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			h.serveWebSocket(ws, lastID, filter)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// serveWebSocket pushes events to one WebSocket client until it disconnects
+func (h *Handler) serveWebSocket(ws *websocket.Conn, lastID int64, filter StreamFilter) {
+	sub, replay, reset := h.stream.Subscribe(lastID, filter)
+	defer h.stream.Unsubscribe(sub)
+
+	// The stream is one way; reading only detects the client closing the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for {
+			if err := websocket.Message.Receive(ws, &discard); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg streamMessage) bool {
+		ws.SetWriteDeadline(time.Now().Add(h.stream.config.WriteTimeout))
+		return websocket.JSON.Send(ws, msg) == nil
+	}
+	sendEvent := func(event *OutboxEvent) bool {
+		return send(streamMessage{ID: event.ID, Type: event.EventType, Event: event})
+	}
+
+	if reset && !send(streamMessage{Type: StreamReset}) {
+		return
+	}
+	for _, event := range replay {
+		if !sendEvent(event) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(h.stream.config.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-sub.Events():
+			if !sendEvent(event) {
+				return
+			}
+		case <-sub.Done():
+			if sub.Overflowed() {
+				send(streamMessage{Type: StreamOverflow})
+			}
+			return
+		case <-heartbeat.C:
+			if !send(streamMessage{Type: StreamHeartbeat}) {
+				return
+			}
+		}
+	}
+}
+
+// idParam parses the numeric :id URL parameter, rejecting the request if it is invalid
+// resource names the ID in the error message, e.g. "Job"
+func idParam(c *gin.Context, resource string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		reject(c, &ErrValidation{Code: "invalid_id", Message: resource + " ID must be a valid number"})
+		return 0, false
+	}
+	return id, true
+}
+
+// reject records a domain error on the context for ErrorMiddleware and aborts the request
+func reject(c *gin.Context, err error) {
+	c.Error(err)
+	c.Abort()
+}
+
+// fail records err on the context for ErrorMiddleware and aborts the request
+// code and message are the response used when err is not a known domain error
+func fail(c *gin.Context, err error, code, message string) {
+	c.Error(err).SetMeta(errorFallback{Code: code, Message: message})
+	c.Abort()
+}
+
+// RegisterLoginMetrics exposes login attempts: success, failure (wrong email or password) or error
+func RegisterLoginMetrics(registry *Registry, h *Handler) {
+	registry.CounterFunc("app_logins_total", "Login attempts, by result", h.logins.Samples)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetJobOnlyShowsOwnJobs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	handler := NewHandler(newTestService(t, repo), nil, NewRegistry(), nil, nil)
+
+	router := gin.New()
+	router.Use(ErrorMiddleware(), func(c *gin.Context) {
+		// Stands in for AuthMiddleware, which stores the user ID from the token
+		var userID int
+		fmt.Sscan(c.GetHeader("X-User"), &userID)
+		c.Set("user_id", userID)
+	})
+	router.GET("/jobs/:id", handler.GetJob)
+
+	owner := 7
+	owned, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: owner})
+	owned.UserID = &owner
+	system, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: owner})
+	for _, job := range []*Job{owned, system} {
+		if err := repo.EnqueueJob(ctx, job); err != nil {
+			t.Fatalf("EnqueueJob() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		user   int
+		id     int64
+		status int
+	}{
+		{"owner", owner, owned.ID, http.StatusOK},
+		{"another user", 8, owned.ID, http.StatusNotFound},
+		{"job without an owner", owner, system.ID, http.StatusNotFound},
+		{"missing job", owner, 999, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/jobs/%d", tt.id), nil)
+			req.Header.Set("X-User", fmt.Sprint(tt.user))
+			req.Header.Set("Accept", mediaTypeProblemJSON)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusNotFound {
+				return
+			}
+
+			// Someone else's job is indistinguishable from a missing one
+			var problem ProblemDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || problem.Code != "job_not_found" {
+				t.Errorf("code = %q, %v; want job_not_found", problem.Code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// health.go - Liveness and readiness
+// /livez only tells the orchestrator the process is up. /readyz runs every
+// registered HealthChecker and fails if any of them does, or once shutdown has
+// started, so load balancers stop sending traffic before the listener closes.
+// Components register their own checks, the same way they register metrics
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthStatus is the outcome of a check
+type HealthStatus string
+
+const (
+	HealthPass HealthStatus = "pass" // Working normally
+	HealthWarn HealthStatus = "warn" // Degraded, but still able to serve; doesn't fail readiness
+	HealthFail HealthStatus = "fail" // Unable to serve; fails readiness
+)
+
+// HealthConfig configures the health checks
+type HealthConfig struct {
+	Timeout       time.Duration // Per check; a check that takes longer fails
+	DBLatencyWarn time.Duration // Database pings slower than this warn
+	QueueWarn     int           // Pending jobs above this warn
+	QueueFail     int           // Pending jobs above this fail readiness; 0 disables
+	ShutdownDrain time.Duration // How long readiness fails before the listener closes
+}
+
+// HealthResult is the outcome of one check
+type HealthResult struct {
+	Status  HealthStatus           `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthChecker checks one dependency or component
+type HealthChecker interface {
+	Check(ctx context.Context) HealthResult
+}
+
+// HealthCheckerFunc adapts a function to HealthChecker
+type HealthCheckerFunc func(ctx context.Context) HealthResult
+
+func (f HealthCheckerFunc) Check(ctx context.Context) HealthResult {
+	return f(ctx)
+}
+
+// CheckReport is one check's result in a HealthReport
+type CheckReport struct {
+	HealthResult
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// HealthReport is the combined result of every check
+type HealthReport struct {
+	Status    HealthStatus           `json:"status"`
+	Draining  bool                   `json:"draining"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]CheckReport `json:"checks"`
+}
+
+// HealthRegistry holds the registered checks
+type HealthRegistry struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]HealthChecker
+
+	draining atomic.Bool
+}
+
+// NewHealthRegistry creates an empty registry whose checks are each given timeout to finish
+func NewHealthRegistry(timeout time.Duration) *HealthRegistry {
+	return &HealthRegistry{timeout: timeout, checks: make(map[string]HealthChecker)}
+}
+
+// Register adds a check; registering the same name again replaces it
+func (r *HealthRegistry) Register(name string, checker HealthChecker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks[name] = checker
+}
+
+// SetDraining makes readiness fail from now on; it is called when shutdown starts
+func (r *HealthRegistry) SetDraining() {
+	r.draining.Store(true)
+}
+
+// Check runs every check concurrently and combines the results
+// The report fails if any check fails or the server is draining, and warns if any check warns
+func (r *HealthRegistry) Check(ctx context.Context) *HealthReport {
+	r.mu.RLock()
+	checks := make(map[string]HealthChecker, len(r.checks))
+	for name, checker := range r.checks {
+		checks[name] = checker
+	}
+	r.mu.RUnlock()
+
+	report := &HealthReport{
+		Status:    HealthPass,
+		Draining:  r.draining.Load(),
+		CheckedAt: time.Now().UTC(),
+		Checks:    make(map[string]CheckReport, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, checker := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := r.run(ctx, checker)
+			mu.Lock()
+			report.Checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status == HealthFail:
+			report.Status = HealthFail
+		case result.Status == HealthWarn && report.Status == HealthPass:
+			report.Status = HealthWarn
+		}
+	}
+	if report.Draining {
+		report.Status = HealthFail
+	}
+	return report
+}
+
+// run runs one check within the timeout
+// A check that overruns is reported as failed even if it ignores its context
+func (r *HealthRegistry) run(ctx context.Context, checker HealthChecker) CheckReport {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan HealthResult, 1)
+	go func() {
+		// A panicking check fails instead of crashing the process
+		var err error
+		defer func() {
+			if err != nil {
+				done <- HealthResult{Status: HealthFail, Message: err.Error()}
+			}
+		}()
+		defer recoverPanic(ctx, "health check", &err)
+
+		done <- checker.Check(ctx)
+	}()
+
+	var result HealthResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = HealthResult{Status: HealthFail, Message: "check timed out"}
+	}
+	return CheckReport{HealthResult: result, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staticCheck always reports status
+func staticCheck(status HealthStatus) HealthChecker {
+	return HealthCheckerFunc(func(context.Context) HealthResult {
+		return HealthResult{Status: status}
+	})
+}
+
+func TestHealthRegistryCombinesResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks map[string]HealthStatus
+		want   HealthStatus
+	}{
+		{"no checks", nil, HealthPass},
+		{"all pass", map[string]HealthStatus{"db": HealthPass, "jobs": HealthPass}, HealthPass},
+		{"warn does not fail", map[string]HealthStatus{"db": HealthPass, "jobs": HealthWarn}, HealthWarn},
+		{"fail wins", map[string]HealthStatus{"db": HealthFail, "jobs": HealthWarn}, HealthFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewHealthRegistry(time.Second)
+			for name, status := range tt.checks {
+				registry.Register(name, staticCheck(status))
+			}
+
+			report := registry.Check(context.Background())
+			if report.Status != tt.want {
+				t.Errorf("Status = %q, want %q", report.Status, tt.want)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Errorf("len(Checks) = %d, want %d", len(report.Checks), len(tt.checks))
+			}
+		})
+	}
+}
+
+func TestHealthRegistryFailsChecksThatOverrun(t *testing.T) {
+	registry := NewHealthRegistry(20 * time.Millisecond)
+	// The check ignores its context, so only the registry's own timeout can end it
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	registry.Register("stuck", HealthCheckerFunc(func(context.Context) HealthResult {
+		<-release
+		return HealthResult{Status: HealthPass}
+	}))
+	registry.Register("db", staticCheck(HealthPass))
+
+	start := time.Now()
+	report := registry.Check(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Check() took %v, want it bounded by the timeout", elapsed)
+	}
+
+	if report.Status != HealthFail {
+		t.Errorf("Status = %q, want %q", report.Status, HealthFail)
+	}
+	stuck := report.Checks["stuck"]
+	if stuck.Status != HealthFail || stuck.Message != "check timed out" {
+		t.Errorf("stuck check = %+v, want a failed %q result", stuck.HealthResult, "check timed out")
+	}
+	if report.Checks["db"].Status != HealthPass {
+		t.Errorf("db check = %q, want %q; one slow check must not fail the others", report.Checks["db"].Status, HealthPass)
+	}
+}
+
+func TestHealthRegistryFailsPanickingChecks(t *testing.T) {
+	registry := NewHealthRegistry(time.Second)
+	registry.Register("broken", HealthCheckerFunc(func(context.Context) HealthResult {
+		panic("nil map")
+	}))
+
+	report := registry.Check(context.Background())
+	if got := report.Checks["broken"].Status; got != HealthFail {
+		t.Errorf("broken check = %q, want %q", got, HealthFail)
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	registry := NewHealthRegistry(time.Second)
+	registry.Register("db", staticCheck(HealthPass))
+	h := &Handler{health: registry}
+
+	router := gin.New()
+	router.GET("/readyz", h.Readyz)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	if got := ready(); got != http.StatusOK {
+		t.Fatalf("GET /readyz before draining = %d, want %d", got, http.StatusOK)
+	}
+
+	registry.SetDraining()
+	report := registry.Check(context.Background())
+	if !report.Draining || report.Status != HealthFail {
+		t.Errorf("report while draining = {Status: %q, Draining: %v}, want a failed draining report", report.Status, report.Draining)
+	}
+	if report.Checks["db"].Status != HealthPass {
+		t.Errorf("db check while draining = %q, want the checks to still run", report.Checks["db"].Status)
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while draining = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
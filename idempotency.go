@@ -0,0 +1,233 @@
+// idempotency.go - Idempotency-Key support
+// A client that retries a POST sends the same Idempotency-Key header. The first
+// request claims the key along with a fingerprint of the request; its response
+// is stored for IDEMPOTENCY_TTL and replayed to every retry, so the retry
+// doesn't register a second user or queue a second job. Keys are scoped to the
+// authenticated user, or to the client IP for anonymous routes
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders are the response headers stored for replay, besides Content-Type
+var replayedHeaders = []string{"Location"}
+
+// IdempotencyConfig configures how long keys are kept and locked
+type IdempotencyConfig struct {
+	TTL         time.Duration // How long a response is replayed for
+	LockTimeout time.Duration // How long a request holds its key; a retry may take over once it runs out
+}
+
+// IdempotencyRecord is a claimed Idempotency-Key
+type IdempotencyRecord struct {
+	Scope       string
+	Key         string
+	Fingerprint string // SHA-256 of the method, path and body
+	LockedUntil time.Time
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Response    *IdempotentResponse // nil while the first request is in flight
+}
+
+// IdempotentResponse is a stored response
+type IdempotentResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    []byte
+}
+
+// Idempotency stores and replays the responses of requests that carry an Idempotency-Key
+type Idempotency struct {
+	repo     Repository
+	config   IdempotencyConfig
+	requests *CounterVec // Requests with a key, by result
+}
+
+// Results of a request with an Idempotency-Key, for metrics
+const (
+	idempotencyNew      = "new"
+	idempotencyReplayed = "replayed"
+	idempotencyMismatch = "mismatch"
+	idempotencyInFlight = "in_flight"
+)
+
+// NewIdempotency creates an Idempotency that keeps its records in repo
+func NewIdempotency(repo Repository, config IdempotencyConfig) *Idempotency {
+	return &Idempotency{repo: repo, config: config, requests: NewCounterVec("result")}
+}
+
+// Purge deletes expired records; it runs as a scheduled task
+func (i *Idempotency) Purge(ctx context.Context) error {
+	purged, err := i.repo.PurgeIdempotencyKeys(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Purged expired idempotency keys", "purged", purged)
+	return nil
+}
+
+// RegisterIdempotencyMetrics exposes the requests that carried an Idempotency-Key
+func RegisterIdempotencyMetrics(registry *Registry, i *Idempotency) {
+	registry.CounterFunc("app_idempotent_requests_total", "Requests with an Idempotency-Key, by result", i.requests.Samples)
+}
+
+// IdempotencyMiddleware makes a route safe to retry with an Idempotency-Key header
+// A retry of a finished request gets the stored response with Idempotent-Replayed: true.
+// Reusing the key for a different request is rejected with 422, and a retry that
+// arrives while the first request is still running with 409. Server errors and
+// rate limited responses aren't stored, so those can be retried with the same key.
+// Requests without the header are passed through. It must run after AuthMiddleware
+func IdempotencyMiddleware(i *Idempotency) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			reject(c, &ErrValidation{Field: "Idempotency-Key", Message: "must be at most 255 characters"})
+			return
+		}
+
+		// The body is read once for the fingerprint and put back for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			reject(c, bindingError(err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		now := time.Now()
+		record := &IdempotencyRecord{
+			Scope:       idempotencyScope(c),
+			Key:         key,
+			Fingerprint: requestFingerprint(c.Request.Method, c.Request.URL.Path, body),
+			LockedUntil: now.Add(i.config.LockTimeout),
+			ExpiresAt:   now.Add(i.config.TTL),
+		}
+
+		existing, err := i.repo.ClaimIdempotencyKey(ctx, record)
+		if err != nil {
+			fail(c, err, "idempotency_failed", "Failed to check the idempotency key")
+			return
+		}
+		if existing != nil {
+			i.replay(c, record, existing)
+			return
+		}
+		i.requests.Inc(idempotencyNew)
+
+		// Store the response once the handler and the error rendering are done.
+		// The deferred release also frees the key if the handler panics
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		stored := false
+		defer func() {
+			if !stored {
+				if err := i.repo.ReleaseIdempotencyKey(context.WithoutCancel(ctx), record.Scope, record.Key); err != nil {
+					slog.ErrorContext(ctx, "Failed to release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		c.Next()
+		writeRecordedError(c)
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return
+		}
+
+		record.Response = &IdempotentResponse{
+			Status:  status,
+			Headers: map[string]string{"Content-Type": recorder.Header().Get("Content-Type")},
+			Body:    recorder.body.Bytes(),
+		}
+		for _, name := range replayedHeaders {
+			if value := recorder.Header().Get(name); value != "" {
+				record.Response.Headers[name] = value
+			}
+		}
+		record.ExpiresAt = time.Now().Add(i.config.TTL)
+
+		// The client already has its response, so a cancelled request must not stop it being stored
+		if err := i.repo.CompleteIdempotencyKey(context.WithoutCancel(ctx), record); err != nil {
+			slog.ErrorContext(ctx, "Failed to store idempotent response", "error", err)
+			return
+		}
+		stored = true
+	}
+}
+
+// replay answers a request whose key was already claimed
+func (i *Idempotency) replay(c *gin.Context, record, existing *IdempotencyRecord) {
+	switch {
+	case existing.Fingerprint != record.Fingerprint:
+		i.requests.Inc(idempotencyMismatch)
+		reject(c, ErrIdempotencyKeyReused)
+	case existing.Response == nil:
+		i.requests.Inc(idempotencyInFlight)
+		c.Header("Retry-After", strconv.Itoa(max(1, int(time.Until(existing.LockedUntil).Seconds()))))
+		reject(c, ErrIdempotencyKeyInFlight)
+	default:
+		i.requests.Inc(idempotencyReplayed)
+		for name, value := range existing.Response.Headers {
+			if name != "Content-Type" {
+				c.Header(name, value)
+			}
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(existing.Response.Status, existing.Response.Headers["Content-Type"], existing.Response.Body)
+		c.Abort()
+	}
+}
+
+// idempotencyScope keeps one client's keys apart from another's
+func idempotencyScope(c *gin.Context) string {
+	if userID, ok := c.Get("user_id"); ok {
+		if id, ok := userID.(int); ok {
+			return "user:" + strconv.Itoa(id)
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// requestFingerprint identifies a request by its method, path and body
+func requestFingerprint(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder copies the response body while it is written
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newIdempotentRouter serves POST /users behind IdempotencyMiddleware and counts the handler's calls
+// Requests with an X-Fail header fail with a 500
+func newIdempotentRouter(i *Idempotency, calls *int) *gin.Engine {
+	router := gin.New()
+	router.Use(ErrorMiddleware(), IdempotencyMiddleware(i))
+	router.POST("/users", func(c *gin.Context) {
+		*calls++
+		if c.GetHeader("X-Fail") != "" {
+			fail(c, errors.New("connection refused"), "registration_failed", "Failed to register user")
+			return
+		}
+		c.Header("Location", "/api/v1/users/1")
+		c.JSON(http.StatusCreated, gin.H{"id": *calls})
+	})
+	return router
+}
+
+// postIdempotent sends POST /users with body and the given Idempotency-Key
+func postIdempotent(router *gin.Engine, key, body string, fail bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if fail {
+		req.Header.Set("X-Fail", "1")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	idempotency := NewIdempotency(NewMemoryRepository(), IdempotencyConfig{TTL: time.Hour, LockTimeout: time.Minute})
+	calls := 0
+	router := newIdempotentRouter(idempotency, &calls)
+
+	steps := []struct {
+		name     string
+		key      string
+		body     string
+		fail     bool
+		status   int
+		replayed bool
+		calls    int // Handler calls so far
+	}{
+		{"without a key", "", `{"name":"alice"}`, false, http.StatusCreated, false, 1},
+		{"new key", "k1", `{"name":"alice"}`, false, http.StatusCreated, false, 2},
+		{"retry", "k1", `{"name":"alice"}`, false, http.StatusCreated, true, 2},
+		{"different body", "k1", `{"name":"bob"}`, false, http.StatusUnprocessableEntity, false, 2},
+		{"server error", "k2", `{"name":"bob"}`, true, http.StatusInternalServerError, false, 3},
+		{"retry after a server error", "k2", `{"name":"bob"}`, false, http.StatusCreated, false, 4},
+		{"too long", strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`, false, http.StatusBadRequest, false, 4},
+	}
+
+	var first *httptest.ResponseRecorder
+	for _, step := range steps {
+		w := postIdempotent(router, step.key, step.body, step.fail)
+
+		replayed := w.Header().Get("Idempotent-Replayed") == "true"
+		if w.Code != step.status || replayed != step.replayed || calls != step.calls {
+			t.Fatalf("%s: status %d, replayed %t, calls %d; want %d, %t, %d", step.name, w.Code, replayed, calls,
+				step.status, step.replayed, step.calls)
+		}
+
+		switch step.name {
+		case "new key":
+			first = w
+		case "retry":
+			if w.Body.String() != first.Body.String() || w.Header().Get("Location") != first.Header().Get("Location") ||
+				w.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+				t.Errorf("replayed %q %v, want %q %v", w.Body.String(), w.Header(), first.Body.String(), first.Header())
+			}
+		}
+	}
+
+	results := map[string]float64{}
+	for _, sample := range idempotency.requests.Samples() {
+		results[sample.Labels["result"]] = sample.Value
+	}
+	if results[idempotencyNew] != 3 || results[idempotencyReplayed] != 1 || results[idempotencyMismatch] != 1 {
+		t.Errorf("results = %v, want 3 new, 1 replayed and 1 mismatch", results)
+	}
+}
+
+func TestIdempotencyMiddlewareInFlight(t *testing.T) {
+	repo := NewMemoryRepository()
+	idempotency := NewIdempotency(repo, IdempotencyConfig{TTL: time.Hour, LockTimeout: time.Minute})
+	calls := 0
+	router := newIdempotentRouter(idempotency, &calls)
+
+	// Another request with the same key is still running
+	body := `{"name":"alice"}`
+	_, err := repo.ClaimIdempotencyKey(context.Background(), &IdempotencyRecord{
+		Scope:       "ip:192.0.2.1",
+		Key:         "k1",
+		Fingerprint: requestFingerprint(http.MethodPost, "/users", []byte(body)),
+		LockedUntil: time.Now().Add(30 * time.Second),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("ClaimIdempotencyKey() error = %v", err)
+	}
+
+	w := postIdempotent(router, "k1", body, false)
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" || calls != 0 {
+		t.Errorf("status %d, Retry-After %q, calls %d; want 409 with Retry-After and no call", w.Code, w.Header().Get("Retry-After"), calls)
+	}
+
+	// Keys are scoped to the client, so another one may use the same key
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", "k1")
+	req.RemoteAddr = "198.51.100.7:1234"
+	other := httptest.NewRecorder()
+	router.ServeHTTP(other, req)
+	if other.Code != http.StatusCreated || calls != 1 {
+		t.Errorf("another client: status %d, calls %d; want 201 and one call", other.Code, calls)
+	}
+}
+
+func TestIdempotencyMiddlewareTimeout(t *testing.T) {
+	idempotency := NewIdempotency(NewMemoryRepository(), IdempotencyConfig{TTL: time.Hour, LockTimeout: time.Minute})
+	router := gin.New()
+	router.Use(ErrorMiddleware(), RouteLimitsMiddleware(RouteLimits{Timeout: 20 * time.Millisecond}))
+	calls := 0
+	router.POST("/users", IdempotencyMiddleware(idempotency), func(c *gin.Context) {
+		calls++
+		if c.GetHeader("X-Fail") == "" {
+			c.JSON(http.StatusCreated, gin.H{"id": calls})
+			return
+		}
+		<-c.Request.Context().Done()
+		fail(c, c.Request.Context().Err(), "registration_failed", "Failed to register user")
+	})
+
+	// The deadline is reported even though the middleware renders the error itself
+	w := postIdempotent(router, "k1", `{"name":"alice"}`, true)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "request_timeout") {
+		t.Fatalf("timed out request: status %d %s, want 503 request_timeout", w.Code, w.Body.String())
+	}
+
+	// The timeout isn't stored, so a retry runs the handler again
+	if w := postIdempotent(router, "k1", `{"name":"alice"}`, false); w.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("retry: status %d, calls %d; want 201 and a second call", w.Code, calls)
+	}
+}
@@ -0,0 +1,492 @@
+// jobs.go - Durable background job queue
+// Jobs are rows in the jobs table, so queued work survives restarts. Workers
+// lease one job at a time; a job whose worker dies becomes visible again once
+// its lease (the visibility timeout) expires. Failed jobs are retried with
+// exponential backoff and moved to the "dead" state after MaxAttempts
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// JobKind identifies what a job does and which handler runs it
+type JobKind string
+
+// Job kinds
+const (
+	JobUserAnalytics JobKind = "user.analytics"
+)
+
+// JobState is where a job is in its lifecycle
+type JobState string
+
+const (
+	JobPending   JobState = "pending"   // Waiting for run_at
+	JobRunning   JobState = "running"   // Leased by a worker
+	JobSucceeded JobState = "succeeded" // Finished successfully
+	JobDead      JobState = "dead"      // Failed MaxAttempts times (dead letter)
+	JobCancelled JobState = "cancelled" // Cancelled by an admin
+)
+
+// JobFailed is a list filter, not a stored state: it matches jobs whose last
+// attempt failed, i.e. dead jobs and pending jobs waiting for a retry
+const JobFailed JobState = "failed"
+
+// Job is a unit of background work
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        JobKind         `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	UserID      *int            `json:"user_id,omitempty"` // User the job belongs to, if any
+	State       JobState        `json:"state"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	RequestID   string          `json:"request_id,omitempty"` // Request that queued the job, for correlating logs
+	TraceParent string          `json:"-"`                    // W3C traceparent of the span that queued the job, linked from the job's spans
+}
+
+// JobFilter selects jobs to list
+type JobFilter struct {
+	State  JobState // Empty for every state
+	Limit  int
+	Offset int
+}
+
+// UserJobPayload is the payload of jobs that concern a single user
+type UserJobPayload struct {
+	UserID int `json:"user_id"`
+}
+
+// NewJob builds a pending job of the given kind
+func NewJob(kind JobKind, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s job payload: %w", kind, err)
+	}
+
+	return &Job{
+		Kind:    kind,
+		Payload: data,
+		State:   JobPending,
+		RunAt:   time.Now(),
+	}, nil
+}
+
+// ErrQueueClosed is returned when a job is enqueued after the queue was closed
+var ErrQueueClosed = errors.New("job queue is closed")
+
+// ErrJobLeaseLost is returned when an attempt's outcome is recorded after the job was
+// cancelled, or leased again because the attempt overran its lease
+var ErrJobLeaseLost = errors.New("job is no longer leased by this attempt")
+
+// closeCancelWait bounds how long Close waits for cancelled jobs to stop
+const closeCancelWait = 2 * time.Second
+
+// JobHandler runs one job; returning an error schedules a retry
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobQueueConfig configures the worker pool
+type JobQueueConfig struct {
+	Workers           int           // Number of worker goroutines
+	PollInterval      time.Duration // How often idle workers look for new jobs
+	VisibilityTimeout time.Duration // How long a job stays leased; also the handler timeout
+	MaxAttempts       int           // Attempts before a job is dead-lettered
+	RetryBackoff      time.Duration // Delay before the first retry; doubles after each attempt
+}
+
+// JobQueue runs queued jobs on a pool of workers
+type JobQueue struct {
+	repo     Repository
+	config   JobQueueConfig
+	mu       sync.RWMutex
+	handlers map[JobKind]JobHandler
+	wake     chan struct{}
+
+	stop      chan struct{} // Closed by Close so workers stop claiming jobs
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+	alive     atomic.Int32 // Worker goroutines that haven't exited
+
+	runningMu sync.Mutex
+	running   map[int64]context.CancelFunc // Jobs this process is running, by ID
+
+	processed *CounterVec   // Attempts finished by this process, by kind and outcome
+	durations *HistogramVec // Attempt durations, by kind
+}
+
+// Outcomes of a job attempt, for metrics
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeRetried   = "retried"
+	outcomeDead      = "dead"
+	outcomeDiscarded = "discarded" // The attempt lost its lease, so its outcome wasn't stored
+)
+
+// NewJobQueue creates a job queue backed by repo
+func NewJobQueue(repo Repository, config JobQueueConfig) *JobQueue {
+	return &JobQueue{
+		repo:     repo,
+		config:   config,
+		handlers: make(map[JobKind]JobHandler),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		running:  make(map[int64]context.CancelFunc),
+
+		processed: NewCounterVec("kind", "outcome"),
+		durations: NewHistogramVec(DefaultBuckets, "kind"),
+	}
+}
+
+// Register sets the handler for a job kind
+func (q *JobQueue) Register(kind JobKind, handler JobHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.handlers[kind] = handler
+}
+
+// Enqueue stores a job using repo, which may be a transaction from Repository.WithTx
+// so the job only becomes visible if the surrounding change commits
+func (q *JobQueue) Enqueue(ctx context.Context, repo Repository, job *Job) error {
+	if q.isClosed() {
+		return ErrQueueClosed
+	}
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = q.config.MaxAttempts
+	}
+	if job.RequestID == "" {
+		job.RequestID = requestInfoFrom(ctx).RequestID
+	}
+	if job.TraceParent == "" {
+		job.TraceParent = traceParentFrom(ctx)
+	}
+	if err := repo.EnqueueJob(ctx, job); err != nil {
+		return err
+	}
+
+	q.Notify()
+	return nil
+}
+
+// Notify wakes an idle worker to look for jobs right away
+func (q *JobQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// A wake-up is already pending
+	}
+}
+
+// Start launches the worker goroutines; they stop when ctx is cancelled or the queue is closed
+func (q *JobQueue) Start(ctx context.Context) {
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go q.worker(ctx, i)
+	}
+}
+
+// Close stops the workers from claiming jobs and waits for running jobs to finish
+// If ctx expires first, the running jobs are cancelled and their IDs returned, once
+// their workers have stopped or closeCancelWait has passed. Cancelled jobs are
+// retried after their backoff, or once their lease expires if their worker didn't stop
+func (q *JobQueue) Close(ctx context.Context) []int64 {
+	q.closeOnce.Do(func() { close(q.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Out of time - cancel whatever is still running
+	q.runningMu.Lock()
+	abandoned := make([]int64, 0, len(q.running))
+	for id, cancel := range q.running {
+		cancel()
+		abandoned = append(abandoned, id)
+	}
+	q.runningMu.Unlock()
+	sort.Slice(abandoned, func(i, j int) bool { return abandoned[i] < abandoned[j] })
+
+	// Give the handlers a moment to return, so their failures are recorded before the database closes
+	select {
+	case <-done:
+	case <-time.After(closeCancelWait):
+		slog.Warn("Job workers didn't stop after their jobs were cancelled", "jobs", abandoned)
+	}
+	return abandoned
+}
+
+// isClosed reports whether Close has been called
+func (q *JobQueue) isClosed() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// worker claims and runs jobs until ctx is cancelled or the queue is closed
+func (q *JobQueue) worker(ctx context.Context, workerID int) {
+	defer q.workers.Done()
+
+	q.alive.Add(1)
+	defer q.alive.Add(-1)
+
+	// A panic outside a job handler stops this worker; the job_workers health check then fails
+	defer recoverPanic(ctx, "job worker", nil)
+
+	for {
+		// Don't start another job once the queue is closing
+		if q.isClosed() {
+			return
+		}
+
+		job, err := q.repo.ClaimJob(ctx, q.config.VisibilityTimeout)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Job worker failed to claim a job", "worker", workerID, "error", err)
+		}
+
+		if job != nil {
+			q.run(ctx, workerID, job)
+			continue
+		}
+
+		// Nothing to do - wait for a wake-up or the next poll
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-time.After(q.config.PollInterval):
+		}
+	}
+}
+
+// run executes one claimed job and records the outcome
+func (q *JobQueue) run(ctx context.Context, workerID int, job *Job) {
+	// Log lines from the handler carry the job and the ID of the request that enqueued it
+	ctx = withLogAttrs(ctx, slog.Int("worker", workerID), slog.Int64("job_id", job.ID),
+		slog.String("job_kind", string(job.Kind)), slog.Int("attempt", job.Attempts))
+	if job.RequestID != "" {
+		ctx = withRequestInfo(ctx, &RequestInfo{RequestID: job.RequestID})
+	}
+
+	// Each attempt is its own trace, linked back to the request that queued the job
+	ctx, span := startJobSpan(ctx, job)
+	defer span.End()
+
+	// A job leased more times than allowed means workers keep dying on it
+	if job.Attempts > job.MaxAttempts {
+		q.fail(ctx, job, fmt.Errorf("exceeded %d attempts", job.MaxAttempts))
+		return
+	}
+
+	q.mu.RLock()
+	handler, ok := q.handlers[job.Kind]
+	q.mu.RUnlock()
+	if !ok {
+		q.fail(ctx, job, fmt.Errorf("no handler registered for job kind %q", job.Kind))
+		return
+	}
+
+	// Finish before the lease expires, otherwise another worker could pick the job up
+	runCtx, cancel := context.WithTimeout(ctx, q.config.VisibilityTimeout)
+	q.track(job.ID, cancel)
+	start := time.Now()
+	err := q.call(runCtx, handler, job)
+	q.durations.Observe(time.Since(start).Seconds(), string(job.Kind))
+	q.untrack(job.ID)
+	cancel()
+
+	if err != nil {
+		slog.WarnContext(ctx, "Job attempt failed", "error", err)
+		q.fail(ctx, job, err)
+		return
+	}
+
+	q.record(ctx, job, outcomeSucceeded, q.repo.CompleteJob(ctx, job.ID, job.Attempts))
+}
+
+// call runs handler, turning a panic into an error so the job is retried instead of crashing the process
+func (q *JobQueue) call(ctx context.Context, handler JobHandler, job *Job) (err error) {
+	defer recoverPanic(ctx, "job", &err)
+	return handler(ctx, job)
+}
+
+// Interrupt cancels the context of a job if this process is running it
+// Jobs running in other instances finish their current attempt, but the
+// repository ignores the outcome because the job is no longer running
+func (q *JobQueue) Interrupt(id int64) {
+	q.runningMu.Lock()
+	defer q.runningMu.Unlock()
+
+	if cancel, ok := q.running[id]; ok {
+		cancel()
+	}
+}
+
+// track records the cancel function of a running job
+func (q *JobQueue) track(id int64, cancel context.CancelFunc) {
+	q.runningMu.Lock()
+	defer q.runningMu.Unlock()
+
+	q.running[id] = cancel
+}
+
+// untrack forgets a job that finished running
+func (q *JobQueue) untrack(id int64) {
+	q.runningMu.Lock()
+	defer q.runningMu.Unlock()
+
+	delete(q.running, id)
+}
+
+// fail schedules a retry, or dead-letters the job once it is out of attempts
+func (q *JobQueue) fail(ctx context.Context, job *Job, jobErr error) {
+	failSpan(trace.SpanFromContext(ctx), jobErr)
+
+	var retryAt *time.Time
+	outcome := outcomeDead
+	if job.Attempts < job.MaxAttempts {
+		at := time.Now().Add(q.backoff(job.Attempts))
+		retryAt = &at
+		outcome = outcomeRetried
+	}
+
+	err := q.repo.FailJob(ctx, job.ID, job.Attempts, jobErr.Error(), retryAt)
+	if err == nil && outcome == outcomeDead {
+		slog.ErrorContext(ctx, "Job is dead after its last attempt", "error", jobErr)
+	}
+	q.record(ctx, job, outcome, err)
+}
+
+// record counts the outcome of an attempt, given the error from storing it
+// An attempt that lost its lease is counted as discarded: the job was cancelled, or
+// another worker leased it again and decides its outcome
+func (q *JobQueue) record(ctx context.Context, job *Job, outcome string, err error) {
+	switch {
+	case errors.Is(err, ErrJobLeaseLost):
+		slog.WarnContext(ctx, "Job attempt lost its lease; its outcome was discarded", "outcome", outcome)
+		outcome = outcomeDiscarded
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to record job outcome", "outcome", outcome, "error", err)
+	}
+	q.processed.Inc(string(job.Kind), outcome)
+}
+
+// backoff returns the retry delay after the given number of attempts
+func (q *JobQueue) backoff(attempts int) time.Duration {
+	delay := q.config.RetryBackoff
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// JobWorkersHealthCheck fails once the queue is closed or any worker has exited,
+// and warns while every worker is busy, since new jobs then wait
+func JobWorkersHealthCheck(q *JobQueue) HealthChecker {
+	return HealthCheckerFunc(func(context.Context) HealthResult {
+		q.runningMu.Lock()
+		busy := len(q.running)
+		q.runningMu.Unlock()
+
+		alive := int(q.alive.Load())
+		details := map[string]interface{}{"workers": q.config.Workers, "alive": alive, "busy": busy}
+		switch {
+		case q.isClosed():
+			return HealthResult{Status: HealthFail, Message: "job queue is closed", Details: details}
+		case alive < q.config.Workers:
+			return HealthResult{Status: HealthFail, Message: "job workers are not running", Details: details}
+		case busy >= q.config.Workers:
+			return HealthResult{Status: HealthWarn, Message: "all job workers are busy", Details: details}
+		}
+		return HealthResult{Status: HealthPass, Details: details}
+	})
+}
+
+// JobQueueHealthCheck warns when more than warnAt jobs are pending and fails when
+// more than failAt are; a threshold of 0 disables it
+func JobQueueHealthCheck(q *JobQueue, warnAt, failAt int) HealthChecker {
+	return HealthCheckerFunc(func(ctx context.Context) HealthResult {
+		pending, err := q.repo.CountJobs(ctx, JobPending)
+		if err != nil {
+			return HealthResult{Status: HealthFail, Message: fmt.Sprintf("failed to count pending jobs: %v", err)}
+		}
+
+		details := map[string]interface{}{"pending": pending}
+		switch {
+		case failAt > 0 && pending > failAt:
+			return HealthResult{Status: HealthFail, Message: "job queue is saturated", Details: details}
+		case warnAt > 0 && pending > warnAt:
+			return HealthResult{Status: HealthWarn, Message: "job queue is backing up", Details: details}
+		}
+		return HealthResult{Status: HealthPass, Details: details}
+	})
+}
+
+// RegisterJobQueueMetrics exposes the queue depth, running jobs and worker throughput
+func RegisterJobQueueMetrics(registry *Registry, q *JobQueue) {
+	registry.GaugeFunc("app_job_queue_depth", "Jobs waiting to run, by kind", func() []Sample {
+		// Unlike the cached statistics this is read on every scrape, so alerts see the backlog as it grows
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		counts, err := q.repo.CountJobsByKind(ctx, JobPending)
+		if err != nil {
+			slog.Error("Failed to count pending jobs for metrics", "error", err)
+			return nil
+		}
+
+		// Report registered kinds even when nothing is waiting, so the series don't disappear
+		q.mu.RLock()
+		for kind := range q.handlers {
+			if _, ok := counts[kind]; !ok {
+				counts[kind] = 0
+			}
+		}
+		q.mu.RUnlock()
+
+		samples := make([]Sample, 0, len(counts))
+		for kind, count := range counts {
+			samples = append(samples, Sample{Labels: Labels{"kind": string(kind)}, Value: float64(count)})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Labels["kind"] < samples[j].Labels["kind"] })
+		return samples
+	})
+	registry.GaugeFunc("app_jobs_running", "Jobs running in this process", func() []Sample {
+		q.runningMu.Lock()
+		defer q.runningMu.Unlock()
+
+		return []Sample{{Value: float64(len(q.running))}}
+	})
+	registry.CounterFunc("app_jobs_processed_total", "Job attempts finished by this process, by kind and outcome", q.processed.Samples)
+	registry.HistogramFunc("app_job_duration_seconds", "Job attempt durations, by kind", q.durations.Samples)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobQueueBackoff(t *testing.T) {
+	q := NewJobQueue(NewMemoryRepository(), JobQueueConfig{RetryBackoff: 10 * time.Second})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{5, 160 * time.Second},
+		{12, time.Hour}, // Capped
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := q.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// claimAndRun claims the next due job of q and runs it, as a worker would
+func claimAndRun(t *testing.T, ctx context.Context, q *JobQueue) *Job {
+	t.Helper()
+
+	job, err := q.repo.ClaimJob(ctx, q.config.VisibilityTimeout)
+	if err != nil || job == nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want a due job", job, err)
+	}
+	q.run(ctx, 1, job)
+
+	stored, err := q.repo.GetJob(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("GetJob() error = %v", err)
+	}
+	return stored
+}
+
+// processedCount returns how many attempts of kind q has recorded with outcome
+func processedCount(q *JobQueue, kind JobKind, outcome string) float64 {
+	for _, sample := range q.processed.Samples() {
+		if sample.Labels["kind"] == string(kind) && sample.Labels["outcome"] == outcome {
+			return sample.Value
+		}
+	}
+	return 0
+}
+
+func TestJobQueueRetriesThenDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	q := NewJobQueue(NewMemoryRepository(), JobQueueConfig{VisibilityTimeout: time.Minute, MaxAttempts: 2, RetryBackoff: 20 * time.Millisecond})
+
+	calls := 0
+	q.Register(JobUserAnalytics, func(context.Context, *Job) error {
+		calls++
+		if calls == 1 {
+			return errors.New("boom")
+		}
+		panic("boom again")
+	})
+
+	job, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+	if err := q.Enqueue(ctx, q.repo, job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	before := time.Now()
+	retried := claimAndRun(t, ctx, q)
+	if retried.State != JobPending || retried.LastError != "boom" || retried.RunAt.Before(before.Add(20*time.Millisecond)) {
+		t.Fatalf("job after the first failure = %+v, want pending a retry after the backoff", retried)
+	}
+	if next, _ := q.repo.ClaimJob(ctx, time.Minute); next != nil {
+		t.Fatalf("ClaimJob() during the backoff = %+v, want nil", next)
+	}
+
+	// A panicking handler fails the attempt like an error; the last one dead-letters the job
+	time.Sleep(30 * time.Millisecond)
+	dead := claimAndRun(t, ctx, q)
+	if dead.State != JobDead || dead.Attempts != 2 || dead.FinishedAt == nil || dead.LastError == "" {
+		t.Errorf("job after the last attempt = %+v, want dead", dead)
+	}
+	if calls != 2 || processedCount(q, JobUserAnalytics, outcomeRetried) != 1 || processedCount(q, JobUserAnalytics, outcomeDead) != 1 {
+		t.Errorf("calls = %d, processed = %+v; want one retry and one dead", calls, q.processed.Samples())
+	}
+}
+
+func TestJobQueueDeadLettersJobsLeasedTooOften(t *testing.T) {
+	ctx := context.Background()
+	q := NewJobQueue(NewMemoryRepository(), JobQueueConfig{VisibilityTimeout: time.Minute, MaxAttempts: 1, RetryBackoff: time.Minute})
+
+	called := false
+	q.Register(JobUserAnalytics, func(context.Context, *Job) error {
+		called = true
+		return nil
+	})
+
+	job, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+	if err := q.Enqueue(ctx, q.repo, job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	// The worker holding the first lease died, so the job is claimed a second time
+	q.repo.ClaimJob(ctx, -time.Second)
+	claimed, _ := q.repo.ClaimJob(ctx, time.Minute)
+	q.run(ctx, 1, claimed)
+
+	stored, _ := q.repo.GetJob(ctx, job.ID)
+	if called || stored.State != JobDead {
+		t.Errorf("handler called = %t, job = %+v; want dead without running", called, stored)
+	}
+}
+
+func TestJobQueueDeadLettersUnknownKinds(t *testing.T) {
+	ctx := context.Background()
+	q := NewJobQueue(NewMemoryRepository(), JobQueueConfig{VisibilityTimeout: time.Minute, MaxAttempts: 1})
+
+	job, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+	if err := q.Enqueue(ctx, q.repo, job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if stored := claimAndRun(t, ctx, q); stored.State != JobDead || stored.LastError == "" {
+		t.Errorf("job without a handler = %+v, want dead", stored)
+	}
+}
+
+func TestJobQueueDiscardsOutcomesWithoutTheLease(t *testing.T) {
+	ctx := context.Background()
+	q := NewJobQueue(NewMemoryRepository(), JobQueueConfig{VisibilityTimeout: time.Minute, MaxAttempts: 3})
+	q.Register(JobUserAnalytics, func(context.Context, *Job) error { return nil })
+
+	job := mustEnqueueJob(t, ctx, q.repo)
+	claimed, _ := q.repo.ClaimJob(ctx, time.Minute)
+	if _, err := q.repo.CancelJob(ctx, job.ID); err != nil {
+		t.Fatalf("CancelJob() error = %v", err)
+	}
+
+	// The attempt finishes after an admin cancelled the job, so the cancellation stands
+	q.run(ctx, 1, claimed)
+	if stored, _ := q.repo.GetJob(ctx, job.ID); stored.State != JobCancelled {
+		t.Errorf("job = %+v, want still cancelled", stored)
+	}
+	if processedCount(q, JobUserAnalytics, outcomeDiscarded) != 1 || processedCount(q, JobUserAnalytics, outcomeSucceeded) != 0 {
+		t.Errorf("processed = %+v, want one discarded attempt", q.processed.Samples())
+	}
+}
+
+func TestJobQueueCloseWaitsForCancelledJobs(t *testing.T) {
+	repo := NewMemoryRepository()
+	q := NewJobQueue(repo, JobQueueConfig{Workers: 1, PollInterval: time.Millisecond, VisibilityTimeout: time.Minute,
+		MaxAttempts: 3, RetryBackoff: time.Minute})
+
+	started := make(chan struct{})
+	q.Register(JobUserAnalytics, func(ctx context.Context, _ *Job) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond) // Clean up before returning
+		return ctx.Err()
+	})
+	job := mustEnqueueJob(t, context.Background(), repo)
+	q.Start(context.Background())
+	<-started
+
+	// Out of time: the job is cancelled, and Close returns once its failure is recorded
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if abandoned := q.Close(expired); len(abandoned) != 1 || abandoned[0] != job.ID {
+		t.Fatalf("Close() = %v, want [%d]", abandoned, job.ID)
+	}
+	if stored, _ := repo.GetJob(context.Background(), job.ID); stored.State != JobPending || stored.LastError == "" {
+		t.Errorf("job after Close() = %+v, want pending a retry", stored)
+	}
+}
@@ -0,0 +1,177 @@
+// logging.go - Structured logging
+// Everything logs through log/slog as JSON on stdout. Log calls that pass a
+// context pick up the request ID and authenticated user stored there by the
+// middleware, plus any attributes added with withLogAttrs (a job ID in job
+// workers, for example), so one request can be followed through the handler,
+// service, repository and background work it caused. SQL statements are also
+// timed for the db_query_duration_seconds metric
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// slowQueryThreshold is how long a query may take before it is logged as a warning
+// It is set from LOG_SLOW_QUERY at startup
+var slowQueryThreshold = 200 * time.Millisecond
+
+// queryDurations times SQL statements by the repository method that ran them
+var queryDurations = NewHistogramVec([]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "method")
+
+// RegisterQueryMetrics exposes the SQL statement durations
+func RegisterQueryMetrics(registry *Registry) {
+	registry.HistogramFunc("db_query_duration_seconds", "SQL statement durations, by repository method", queryDurations.Samples)
+}
+
+// NewLogger creates the JSON logger that writes to stdout
+func NewLogger(level slog.Level) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})})
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(value))
+	return level, err
+}
+
+// contextHandler adds the request, trace and log attributes stored in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		if info.RequestID != "" {
+			record.AddAttrs(slog.String("request_id", info.RequestID))
+		}
+		if info.ActorID != nil {
+			record.AddAttrs(slog.Int("user_id", *info.ActorID))
+		}
+	}
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logAttrsKey is the context key of the extra log attributes
+type logAttrsKey struct{}
+
+// withLogAttrs returns a copy of ctx whose log records also carry attrs
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(combined, existing...)
+	combined = append(combined, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// fatal logs an error and exits; it replaces log.Fatal, which bypasses slog's JSON output
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// loggedQuerier times and traces every statement, and logs it at debug level or as a warning if it is slow
+type loggedQuerier struct {
+	querier
+	dialect Dialect
+}
+
+// logQueries wraps db so its statements are timed, traced and logged
+func logQueries(db querier, dialect Dialect) querier {
+	return loggedQuerier{db, dialect}
+}
+
+func (q loggedQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	spanCtx, span := startQuerySpan(ctx, q.dialect, query)
+	result, err := q.querier.ExecContext(spanCtx, query, args...)
+	logQuery(ctx, span, query, start, err)
+	return result, err
+}
+
+func (q loggedQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	spanCtx, span := startQuerySpan(ctx, q.dialect, query)
+	rows, err := q.querier.QueryContext(spanCtx, query, args...)
+	logQuery(ctx, span, query, start, err)
+	return rows, err
+}
+
+func (q loggedQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	spanCtx, span := startQuerySpan(ctx, q.dialect, query)
+	row := q.querier.QueryRowContext(spanCtx, query, args...)
+	logQuery(ctx, span, query, start, row.Err())
+	return row
+}
+
+// logQuery records one statement and ends its span
+// Arguments are left out because they may hold passwords or personal data
+func logQuery(ctx context.Context, span trace.Span, query string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	queryDurations.Observe(elapsed.Seconds(), repositoryMethod(ctx))
+
+	// A missing row is an answer, not a failure
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	endSpan(span, err)
+
+	level := slog.LevelDebug
+	if elapsed >= slowQueryThreshold {
+		level = slog.LevelWarn
+	}
+
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("query", sanitizeQuery(query)),
+		slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	msg := "SQL query"
+	if level == slog.LevelWarn {
+		msg = "Slow SQL query"
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// repositoryMethodKey is the context key of the Repository method running a statement
+type repositoryMethodKey struct{}
+
+// repositoryMethod returns the Repository method recorded in ctx by tracedRepository
+// Calls made inside a transaction record their own method, so a statement is reported
+// under the innermost method that ran it
+func repositoryMethod(ctx context.Context) string {
+	if method, ok := ctx.Value(repositoryMethodKey{}).(string); ok {
+		return method
+	}
+	return "unknown"
+}
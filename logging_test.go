@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// queryCount returns how many statements queryDurations has timed for method
+func queryCount(method string) float64 {
+	for _, sample := range queryDurations.Samples() {
+		if sample.Suffix == "_count" && sample.Labels["method"] == method {
+			return sample.Value
+		}
+	}
+	return 0
+}
+
+func TestQueryDurationsByRepositoryMethod(t *testing.T) {
+	ctx := context.Background()
+	repo := NewTracedRepository(repositoryBackends[1].open(t))
+
+	created, got := queryCount("CreateUser"), queryCount("GetUserByEmail")
+	mustCreateUser(t, ctx, repo, "alice")
+	if _, err := repo.GetUserByEmail(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("GetUserByEmail() error = %v", err)
+	}
+	if queryCount("CreateUser") == created || queryCount("GetUserByEmail") != got+1 {
+		t.Errorf("statements not timed under their repository method: %+v", queryDurations.Samples())
+	}
+
+	// Statements in a transaction are timed under the method that ran them, not WithTx
+	err := repo.WithTx(ctx, func(tx Repository) error {
+		_, err := tx.GetUserByEmail(ctx, "alice@example.com")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx() error = %v", err)
+	}
+	if queryCount("GetUserByEmail") != got+2 {
+		t.Errorf("GetUserByEmail count = %v, want %v", queryCount("GetUserByEmail"), got+2)
+	}
+
+	if method := repositoryMethod(ctx); method != "unknown" {
+		t.Errorf("repositoryMethod() without a traced call = %q, want unknown", method)
+	}
+}
+
+func TestContextHandlerAddsRequestAndTraceFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}).With("component", "test")
+
+	actor := 7
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := withRequestInfo(context.Background(), &RequestInfo{RequestID: "req-1", ActorID: &actor})
+	ctx = trace.ContextWithSpanContext(withLogAttrs(ctx, slog.Int64("job_id", 42)), span)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want map[string]interface{} // nil values must be absent
+	}{
+		{"request", ctx, map[string]interface{}{
+			"request_id": "req-1",
+			"user_id":    float64(7),
+			"job_id":     float64(42),
+			"trace_id":   "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span_id":    "00f067aa0ba902b7",
+			"component":  "test",
+		}},
+		{"background", context.Background(), map[string]interface{}{
+			"request_id": nil,
+			"user_id":    nil,
+			"trace_id":   nil,
+			"component":  "test",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			logger.InfoContext(tt.ctx, "hello")
+
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("failed to decode %q: %v", buf.String(), err)
+			}
+			for key, want := range tt.want {
+				if got, ok := record[key]; (want == nil && ok) || (want != nil && got != want) {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
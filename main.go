@@ -3,7 +3,7 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,60 +14,228 @@ import (
 )
 
 func main() {
+	// Configuration warnings are logged at info level until LOG_LEVEL has been read
+	slog.SetDefault(NewLogger(slog.LevelInfo))
+
 	// Load configuration from environment variables
 	config := LoadConfig()
 
+	// Log JSON through slog from here on; request IDs and users are added from the context
+	slog.SetDefault(NewLogger(config.LogLevel))
+	slowQueryThreshold = config.SlowQuery
+
+	// Export spans over OTLP or to stdout; the provider is flushed at shutdown
+	shutdownTracing, err := InitTracing(context.Background(), config.Tracing)
+	if err != nil {
+		fatal("Invalid tracing configuration", err)
+	}
+
+	// Recovered panics are logged and also sent to the error reporter
+	errorReporter, err = NewErrorReporter(config.ErrorReporting)
+	if err != nil {
+		fatal("Invalid error reporting configuration", err)
+	}
+	RegisterPanicMetrics(defaultRegistry)
+
+	// Webhook secrets are encrypted with their own key, never with the JWT secret
+	if err := CheckWebhookSecretKey(config); err != nil {
+		fatal("Invalid webhook configuration", err)
+	}
+	if err := CheckSigningKeyEncryptionKey(config); err != nil {
+		fatal("Invalid signing key configuration", err)
+	}
+
 	// Initialize database connection
-	db, err := InitDatabase(config.DatabaseUrl)
+	db, dialect, err := InitDatabase(config.DatabaseUrl, config.DBPool)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		fatal("Failed to connect to database", err)
 	}
 	defer db.Close()
 
-	// Run database migrations (create tables if they don't exist)
-	if err := RunMigrations(db); err != nil {
-		log.Fatal("Failed to run migrations:", err)
+	// "migrate up|down|status|to N" manages the schema instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(db, dialect, os.Args[2:]); err != nil {
+			fatal("Migration failed", err)
+		}
+		return
 	}
 
+	// Apply any pending database migrations
+	if err := RunMigrations(db, dialect); err != nil {
+		fatal("Failed to run migrations", err)
+	}
+
+	// Connect to read replicas (if any) and keep checking their health
+	replicas, err := NewReplicaSet(db, dialect, config.ReplicaUrls, config.DBPool, config.ReplicaStickyWindow)
+	if err != nil {
+		fatal("Failed to connect to read replicas", err)
+	}
+	defer replicas.Close()
+
+	healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+	defer stopHealthChecks()
+	replicas.StartHealthChecks(healthCtx, config.ReplicaHealthInterval)
+
+	// Expose connection pool statistics and SQL statement durations as metrics
+	RegisterPoolMetrics(defaultRegistry, replicas)
+	RegisterQueryMetrics(defaultRegistry)
+
 	// Initialize repository layer (handles database operations)
-	repo := NewRepository(db)
+	// Every Repository and Service method gets a span
+	repo := NewTracedRepository(NewRepository(db, dialect, replicas))
+
+	// Deliver user lifecycle events from the outbox to the configured sinks
+	sinks, err := NewOutboxSinks(config)
+	if err != nil {
+		fatal("Invalid outbox configuration", err)
+	}
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	relay := NewOutboxRelay(repo, sinks, config.OutboxPollInterval, config.OutboxBatchSize)
+	relay.Start(relayCtx)
+
+	// Every instance also reads the whole outbox and pushes its events to SSE and WebSocket clients
+	stream := NewEventStream(repo, config.Stream)
+	if err := stream.Load(context.Background()); err != nil {
+		fatal("Failed to load recent events for the stream", err)
+	}
+	stream.Start(relayCtx)
+	RegisterStreamMetrics(defaultRegistry, stream)
+
+	// Run background jobs on a pool of workers
+	jobs := NewJobQueue(repo, config.Jobs)
+	RegisterJobQueueMetrics(defaultRegistry, jobs)
+
+	// Run maintenance tasks on cron schedules, one instance at a time
+	scheduler := NewScheduler(repo, NewTaskLocker(db, dialect), config.Schedules)
+
+	// Throttle clients; limits are kept in memory or, to share them between instances, in Postgres
+	rateLimitStore, err := NewRateLimitStore(config.RateLimits.Store, db, dialect)
+	if err != nil {
+		fatal("Invalid rate limit configuration", err)
+	}
+	limiter := NewRateLimiter(rateLimitStore)
+	RegisterRateLimitMetrics(defaultRegistry, limiter)
+	scheduler.Register("purge_rate_limits", "Forget rate limit keys that have been idle long enough to reset",
+		"*/10 * * * *", limiter.Purge)
+
+	// Replay the responses of POSTs retried with the same Idempotency-Key
+	idempotency := NewIdempotency(repo, config.Idempotency)
+	RegisterIdempotencyMetrics(defaultRegistry, idempotency)
+	scheduler.Register("purge_idempotency_keys", "Forget idempotency keys whose responses have expired",
+		"15 * * * *", idempotency.Purge)
+
+	// Sign tokens with rotating random keys, stored encrypted with their own key
+	signingKeys := NewSigningKeys(repo, config.JWTSecret, config.SigningKeyEncryptionKey)
+	if err := signingKeys.Load(context.Background()); err != nil {
+		fatal("Failed to load signing keys", err)
+	}
+	if err := signingKeys.EnsureKey(context.Background()); err != nil {
+		fatal("Failed to add a signing key", err)
+	}
+	scheduler.Register("rotate_signing_keys", "Start signing tokens with a new key and drop keys no unexpired token uses",
+		"0 4 * * 0", signingKeys.Rotate)
+
+	// Deliver domain events from the service to its subscribers
+	events := NewEventBus(config.EventBus)
+	RegisterEventBusMetrics(defaultRegistry, events)
 
 	// Initialize service layer (handles business logic)
-	service := NewService(repo)
+	service := NewTracedService(NewService(repo, jobs, scheduler, events, signingKeys))
+
+	// Start the workers and the scheduler once the service has registered its jobs and tasks
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobs.Start(jobsCtx)
+	if err := scheduler.Start(); err != nil {
+		fatal("Invalid scheduler configuration", err)
+	}
+	RegisterStatisticsMetrics(defaultRegistry, service)
+
+	// Readiness checks; each component reports on itself
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		fatal("Failed to load migrations", err)
+	}
+	health := NewHealthRegistry(config.Health.Timeout)
+	health.Register("database", DatabaseHealthCheck(db, config.Health.DBLatencyWarn))
+	health.Register("migrations", MigrationHealthCheck(migrator))
+	health.Register("replicas", ReplicaHealthCheck(replicas))
+	health.Register("job_workers", JobWorkersHealthCheck(jobs))
+	health.Register("job_queue", JobQueueHealthCheck(jobs, config.Health.QueueWarn, config.Health.QueueFail))
+	health.Register("event_bus", EventBusHealthCheck(events))
+	health.Register("outbox_relay", OutboxRelayHealthCheck(relay))
 
 	// Initialize handler layer (handles HTTP requests)
-	handler := NewHandler(service)
+	handler := NewHandler(service, replicas, defaultRegistry, stream, health)
+	RegisterLoginMetrics(defaultRegistry, handler)
 
 	// Setup Gin router with middleware
-	router := gin.Default()
+	// gin.New instead of gin.Default, since LoggingMiddleware replaces gin's own logger
+	router := gin.New()
+	router.Use(RecoveryMiddleware()) // Catches panics in the middleware below
+	router.Use(TracingMiddleware())
+
+	// Client IPs feed rate limits and the audit log, so only take them from X-Forwarded-For
+	// when the request came through a known proxy
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
+	}
+
+	// Report validation errors using JSON field names
+	RegisterValidatorTagNames()
 
 	// Add middleware for CORS, logging, etc.
-	router.Use(CORSMiddleware())
+	router.Use(RequestIDMiddleware())
+	router.Use(CORSMiddleware(config.CORS))
+	router.Use(SecurityHeadersMiddleware(config.SecurityHeaders))
 	router.Use(LoggingMiddleware())
+	router.Use(MetricsMiddleware(defaultRegistry))
+	router.Use(ErrorMiddleware())
+	router.Use(RecoveryMiddleware()) // Catches handler panics here, so the 500 is logged, counted and traced
 
 	// Setup routes
-	setupRoutes(router, handler)
+	setupRoutes(router, handler, replicas, limiter, idempotency, signingKeys, config)
 
-	// Create HTTP server
-	server := &http.Server{
-		Addr:    ":" + config.Port,
-		Handler: router,
-	}
+	// Create HTTP server; the timeouts stop slow clients from holding connections open
+	server := NewServer(":"+config.Port, router, config.Server)
+
+	// Streams never go idle, so end them when shutdown starts instead of at the deadline
+	server.RegisterOnShutdown(stream.Close)
 
 	// Start server in a goroutine so it doesn't block
 	go func() {
-		log.Printf("Server starting on port %s", config.Port)
+		slog.Info("Server starting", "port", config.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("Failed to start server:", err)
+			fatal("Failed to start server", err)
 		}
 	}()
 
+	// Serve Prometheus metrics on their own port, so they can stay off the public listener
+	var metricsServer *http.Server
+	if config.MetricsPort != "off" {
+		metricsServer = NewMetricsServer(":"+config.MetricsPort, defaultRegistry)
+		go func() {
+			slog.Info("Metrics server starting", "port", config.MetricsPort)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Failed to start metrics server", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	// Fail readiness first and keep serving while load balancers notice, so no
+	// requests are sent to a closed listener
+	health.SetDraining()
+	slog.Info("Draining before shutdown", "delay", config.Health.ShutdownDrain.String())
+	time.Sleep(config.Health.ShutdownDrain)
+
+	slog.Info("Shutting down server")
 
 	// Create context with timeout for graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -75,40 +243,126 @@ func main() {
 
 	// Attempt graceful shutdown
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		slog.Error("Server forced to shutdown", "error", err)
 	}
 
-	log.Println("Server exited")
+	// Let background jobs and tasks finish within the same deadline
+	if err := service.Close(ctx); err != nil {
+		slog.Error("Background work did not drain", "error", err)
+	}
+
+	// Stop serving metrics last, so the shutdown can be watched
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			slog.Error("Metrics server forced to shutdown", "error", err)
+		}
+	}
+
+	// Send the crash reports and spans still buffered
+	if !errorReporter.Flush(5 * time.Second) {
+		slog.Error("Failed to flush crash reports")
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+
+	slog.Info("Server exited")
 }
 
 // setupRoutes configures all API routes
-func setupRoutes(router *gin.Engine, handler *Handler) {
-	// Health check endpoint
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+func setupRoutes(router *gin.Engine, handler *Handler, replicas *ReplicaSet, limiter *RateLimiter, idempotency *Idempotency, signingKeys *SigningKeys, config *Config) {
+	// POSTs that create something can be retried safely with an Idempotency-Key
+	idempotent := IdempotencyMiddleware(idempotency)
+
+	// Health check endpoints
+	router.GET("/livez", handler.Livez)   // Liveness: the process is up
+	router.GET("/readyz", handler.Readyz) // Readiness: dependencies are healthy and we aren't shutting down
+	router.GET("/health", handler.Readyz) // Kept for existing probes
+
+	// Detailed health report, for admins
+	healthz := router.Group("/healthz")
+	healthz.Use(AuthMiddleware(signingKeys), AdminMiddleware(config.AdminUserIDs))
+	{
+		healthz.GET("", handler.Healthz) // GET /healthz?verbose
+	}
 
 	// API version 1 routes
 	v1 := router.Group("/api/v1")
 	{
-		// Authentication routes (no auth required)
+		// Authentication routes (no auth required), limited per client IP to slow down password guessing
 		auth := v1.Group("/auth")
+		auth.Use(RateLimitMiddleware(limiter, config.RateLimits.Auth, KeyByIP))
+		auth.Use(RouteLimitsMiddleware(config.RouteLimits.Auth))
+		auth.Use(ReadYourWritesMiddleware(replicas)) // A new user's first reads go to the primary
 		{
-			auth.POST("/register", handler.Register)
+			auth.POST("/register", idempotent, handler.Register)
 			auth.POST("/login", handler.Login)
 		}
 
+		// Live user events; admins see every user's events, others only their own
+		// Browsers can't set headers on EventSource and WebSocket, so the token may also be ?access_token=
+		// Streams stay open, so they get no request deadline
+		events := v1.Group("/events")
+		events.Use(QueryTokenMiddleware(), AuthMiddleware(signingKeys), MarkAdminMiddleware(config.AdminUserIDs))
+		events.Use(RateLimitMiddleware(limiter, config.RateLimits.API, KeyByUser))
+		{
+			events.GET("/stream", handler.StreamEvents)      // GET /api/v1/events/stream (Server-Sent Events)
+			events.GET("/ws", handler.StreamEventsWebSocket) // GET /api/v1/events/ws (WebSocket)
+		}
+
 		// Protected routes (require authentication)
 		protected := v1.Group("/")
-		protected.Use(AuthMiddleware()) // Apply authentication middleware
+		protected.Use(AuthMiddleware(signingKeys))                                    // Apply authentication middleware
+		protected.Use(RateLimitMiddleware(limiter, config.RateLimits.API, KeyByUser)) // Limit each user's request rate
+		protected.Use(ReadYourWritesMiddleware(replicas))                             // Keep clients that just wrote on the primary
 		{
+			// Body limits and deadlines are set on each group rather than on protected,
+			// since a nested group can't relax its parent's deadline for the admin routes
+
 			// User routes
 			users := protected.Group("/users")
+			users.Use(RouteLimitsMiddleware(config.RouteLimits.API))
 			{
 				users.GET("", handler.GetUsers)          // GET /api/v1/users
 				users.GET("/:id", handler.GetUser)       // GET /api/v1/users/123
 				users.PUT("/:id", handler.UpdateUser)    // PUT /api/v1/users/123
 				users.DELETE("/:id", handler.DeleteUser) // DELETE /api/v1/users/123
+
+				users.POST("/:id/process", idempotent, handler.ProcessUserData) // POST /api/v1/users/123/process
+			}
+
+			// Background job status
+			protected.GET("/jobs/:id", RouteLimitsMiddleware(config.RouteLimits.API), handler.GetJob) // GET /api/v1/jobs/42
+
+			// Admin routes (restricted to ADMIN_USER_IDS)
+			admin := protected.Group("/admin")
+			admin.Use(AdminMiddleware(config.AdminUserIDs))
+			admin.Use(RouteLimitsMiddleware(config.RouteLimits.Admin))
+			{
+				admin.GET("/stats", handler.GetUserStatistics)   // GET /api/v1/admin/stats
+				admin.GET("/db/stats", handler.GetDatabaseStats) // GET /api/v1/admin/db/stats
+				admin.GET("/metrics", handler.GetMetrics)        // GET /api/v1/admin/metrics
+
+				admin.GET("/jobs", handler.ListJobs)              // GET /api/v1/admin/jobs?state=failed
+				admin.GET("/jobs/:id", handler.AdminGetJob)       // GET /api/v1/admin/jobs/42
+				admin.POST("/jobs/:id/retry", handler.RetryJob)   // POST /api/v1/admin/jobs/42/retry
+				admin.POST("/jobs/:id/cancel", handler.CancelJob) // POST /api/v1/admin/jobs/42/cancel
+
+				admin.GET("/scheduler/tasks", handler.ListScheduledTasks)     // GET /api/v1/admin/scheduler/tasks
+				admin.POST("/scheduler/tasks/:name/run", handler.TriggerTask) // POST /api/v1/admin/scheduler/tasks/purge_history/run
+				admin.GET("/scheduler/runs", handler.ListScheduledRuns)       // GET /api/v1/admin/scheduler/runs?task=purge_history
+
+				admin.POST("/webhooks", idempotent, handler.CreateWebhook)                 // POST /api/v1/admin/webhooks
+				admin.GET("/webhooks", handler.ListWebhooks)                               // GET /api/v1/admin/webhooks
+				admin.GET("/webhooks/:id", handler.GetWebhook)                             // GET /api/v1/admin/webhooks/7
+				admin.PUT("/webhooks/:id", handler.UpdateWebhook)                          // PUT /api/v1/admin/webhooks/7
+				admin.DELETE("/webhooks/:id", handler.DeleteWebhook)                       // DELETE /api/v1/admin/webhooks/7
+				admin.GET("/webhooks/:id/deliveries", handler.ListWebhookDeliveries)       // GET /api/v1/admin/webhooks/7/deliveries
+				admin.POST("/webhooks/deliveries/:id/redeliver", handler.RedeliverWebhook) // POST /api/v1/admin/webhooks/deliveries/42/redeliver
+
+				admin.GET("/audit", handler.ListAuditEvents)          // GET /api/v1/admin/audit?action=user.update
+				admin.GET("/audit/export", handler.ExportAuditEvents) // GET /api/v1/admin/audit/export (NDJSON)
+				admin.GET("/audit/verify", handler.VerifyAuditLog)    // GET /api/v1/admin/audit/verify
 			}
 
 			// You can add more resource routes here (posts, products, etc.)
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	// Keep test output to the test results; set TEST_LOGS=1 to see the application logs
+	if os.Getenv("TEST_LOGS") == "" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		log.SetOutput(io.Discard)
+	}
+
+	os.Exit(m.Run())
+}
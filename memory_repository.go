@@ -0,0 +1,1085 @@
+// memory_repository.go - In-memory repository
+// A Repository that keeps users in a map. It mirrors the SQL implementation's
+// behaviour (unique email/username, newest-first ordering, not-found errors)
+// so it can stand in for a database in unit tests
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryRepository implements the Repository interface in memory
+// Its methods take mu around every access to the store. Inside WithTx they run on
+// a view whose mu is a no-op, since the transaction already holds the write lock
+type memoryRepository struct {
+	mu rwLocker
+	*memoryStore
+}
+
+// rwLocker is the lock taken by memoryRepository methods
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+}
+
+// heldLock is the rwLocker of a transaction's view, whose lock WithTx already holds
+type heldLock struct{}
+
+func (heldLock) Lock()    {}
+func (heldLock) Unlock()  {}
+func (heldLock) RLock()   {}
+func (heldLock) RUnlock() {}
+
+// memoryStore holds the data of a memoryRepository
+type memoryStore struct {
+	users        map[int]*User
+	deletedUsers map[int]*memoryDeletedUser // Soft-deleted, hidden from every lookup
+	nextID       int
+
+	outbox       []*memoryOutboxEntry
+	nextOutboxID int64
+
+	jobs      []*memoryJob
+	nextJobID int64
+
+	runs      []*ScheduledRun
+	nextRunID int64
+
+	webhooks       []*WebhookSubscription
+	nextWebhookID  int64
+	deliveries     []*WebhookDelivery
+	nextDeliveryID int64
+
+	audit       []*AuditEvent
+	nextAuditID int64
+
+	idempotency map[string]*IdempotencyRecord // By scope and key
+
+	signingKeys []*SigningKey // Newest first
+}
+
+// memoryDeletedUser is a soft-deleted user waiting to be purged
+type memoryDeletedUser struct {
+	user      User
+	deletedAt time.Time
+}
+
+// memoryOutboxEntry is an outbox event with its delivery state
+type memoryOutboxEntry struct {
+	event        OutboxEvent
+	lastError    string
+	lockedUntil  time.Time
+	dispatchedAt time.Time
+}
+
+// memoryJob is a queued job with its lease
+type memoryJob struct {
+	job         Job
+	lockedUntil time.Time
+}
+
+// NewMemoryRepository creates an empty in-memory repository
+func NewMemoryRepository() Repository {
+	return &memoryRepository{mu: &sync.RWMutex{}, memoryStore: &memoryStore{
+		users:        make(map[int]*User),
+		deletedUsers: make(map[int]*memoryDeletedUser),
+		nextID:       1,
+		nextOutboxID: 1,
+		nextJobID:    1,
+		nextRunID:    1,
+
+		nextWebhookID:  1,
+		nextDeliveryID: 1,
+		nextAuditID:    1,
+
+		idempotency: make(map[string]*IdempotencyRecord),
+	}}
+}
+
+// CreateUser stores a new user and fills in its ID and timestamps
+func (r *memoryRepository) CreateUser(_ context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkUnique(0, user.Username, user.Email); err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	now := time.Now()
+	user.ID = r.nextID
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	r.nextID++
+
+	stored := *user
+	r.users[user.ID] = &stored
+	return nil
+}
+
+// GetUserByID retrieves a user by their ID
+func (r *memoryRepository) GetUserByID(_ context.Context, id int) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, notFound("user")
+	}
+
+	// Return a copy so callers can't modify stored data
+	found := *user
+	return &found, nil
+}
+
+// GetUserByEmail retrieves a user by their email address
+func (r *memoryRepository) GetUserByEmail(_ context.Context, email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.Email == email {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, notFound("user")
+}
+
+// GetUsers retrieves a page of users, newest first
+func (r *memoryRepository) GetUsers(_ context.Context, limit, offset int) ([]*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		all = append(all, user)
+	}
+
+	// Match ORDER BY created_at DESC; IDs break ties between users created in the same instant
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].CreatedAt.Equal(all[j].CreatedAt) {
+			return all[i].CreatedAt.After(all[j].CreatedAt)
+		}
+		return all[i].ID > all[j].ID
+	})
+
+	var users []*User
+	for i := offset; i < len(all) && i < offset+limit; i++ {
+		user := *all[i]
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+// UpdateUser updates a user's information
+// Only the columns the SQL repository accepts ("username", "email", "password") are supported
+func (r *memoryRepository) UpdateUser(_ context.Context, id int, updates map[string]interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return notFound("user")
+	}
+
+	updated := *user
+	for field, value := range updates {
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("failed to update user: %s must be a string", field)
+		}
+
+		switch field {
+		case "username":
+			updated.Username = str
+		case "email":
+			updated.Email = str
+		case "password":
+			updated.Password = str
+		default:
+			return fmt.Errorf("failed to update user: unknown column %q", field)
+		}
+	}
+
+	if err := r.checkUnique(id, updated.Username, updated.Email); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+
+	updated.UpdatedAt = time.Now()
+	r.users[id] = &updated
+	return nil
+}
+
+// DeleteUser soft-deletes a user; it is hidden at once and removed by PurgeDeletedUsers
+func (r *memoryRepository) DeleteUser(_ context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return notFound("user")
+	}
+	r.deletedUsers[id] = &memoryDeletedUser{user: *user, deletedAt: time.Now()}
+	delete(r.users, id)
+	return nil
+}
+
+// GetUserCount returns the total number of users
+func (r *memoryRepository) GetUserCount(_ context.Context) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.users), nil
+}
+
+// PurgeDeletedUsers removes the users soft-deleted before the given time
+func (r *memoryRepository) PurgeDeletedUsers(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged int64
+	for id, deleted := range r.deletedUsers {
+		if deleted.deletedAt.Before(before) {
+			delete(r.deletedUsers, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// AddOutboxEvent stores an event to be delivered by the outbox relay
+func (r *memoryRepository) AddOutboxEvent(_ context.Context, event *OutboxEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.ID = r.nextOutboxID
+	event.CreatedAt = time.Now()
+	r.nextOutboxID++
+
+	r.outbox = append(r.outbox, &memoryOutboxEntry{event: *event})
+	return nil
+}
+
+// ClaimOutboxEvents leases up to limit undelivered events, oldest first
+func (r *memoryRepository) ClaimOutboxEvents(_ context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var events []*OutboxEvent
+	for _, entry := range r.outbox {
+		if len(events) == limit {
+			break
+		}
+		if !entry.dispatchedAt.IsZero() || entry.lockedUntil.After(now) {
+			continue
+		}
+
+		entry.lockedUntil = now.Add(lease)
+		entry.event.Attempts++
+		event := entry.event
+		event.DeliveredSinks = append([]string(nil), entry.event.DeliveredSinks...)
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// MarkOutboxDispatched records that an event was delivered to every sink
+func (r *memoryRepository) MarkOutboxDispatched(_ context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range r.outbox {
+		if entry.event.ID == id {
+			entry.dispatchedAt = time.Now()
+			entry.lockedUntil = time.Time{}
+			entry.lastError = ""
+		}
+	}
+	return nil
+}
+
+// MarkOutboxFailed records a failed delivery; the event is retried after retryAt
+func (r *memoryRepository) MarkOutboxFailed(_ context.Context, id int64, lastError string, retryAt time.Time, deliveredSinks []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range r.outbox {
+		if entry.event.ID == id {
+			entry.lastError = lastError
+			entry.lockedUntil = retryAt
+			entry.event.DeliveredSinks = append([]string(nil), deliveredSinks...)
+		}
+	}
+	return nil
+}
+
+// ListOutboxEvents returns up to limit events with an ID above afterID, in ID order, whatever their delivery state
+func (r *memoryRepository) ListOutboxEvents(_ context.Context, afterID int64, limit int) ([]*OutboxEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var events []*OutboxEvent
+	for _, entry := range r.outbox {
+		if len(events) == limit {
+			break
+		}
+		if entry.event.ID > afterID {
+			event := entry.event
+			event.DeliveredSinks = nil
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+// LastOutboxEventID returns the highest outbox event ID, or 0 if the outbox is empty
+func (r *memoryRepository) LastOutboxEventID(_ context.Context) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.outbox) == 0 {
+		return 0, nil
+	}
+	return r.outbox[len(r.outbox)-1].event.ID, nil
+}
+
+// EnqueueJob stores a new pending job and fills in its ID and timestamps
+func (r *memoryRepository) EnqueueJob(_ context.Context, job *Job) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	job.ID = r.nextJobID
+	job.State = JobPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	r.nextJobID++
+
+	r.jobs = append(r.jobs, &memoryJob{job: *job})
+	return nil
+}
+
+// ClaimJob leases the next job that is due and returns it, or nil if there is none
+func (r *memoryRepository) ClaimJob(_ context.Context, visibilityTimeout time.Duration) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Match ORDER BY run_at, id
+	now := time.Now()
+	var next *memoryJob
+	for _, entry := range r.jobs {
+		due := (entry.job.State == JobPending && !entry.job.RunAt.After(now)) ||
+			(entry.job.State == JobRunning && entry.lockedUntil.Before(now))
+		if due && (next == nil || entry.job.RunAt.Before(next.job.RunAt)) {
+			next = entry
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	next.job.State = JobRunning
+	next.job.Attempts++
+	next.job.UpdatedAt = now
+	next.lockedUntil = now.Add(visibilityTimeout)
+
+	job := next.job
+	return &job, nil
+}
+
+// CompleteJob marks a running job as succeeded, if attempt still holds its lease
+func (r *memoryRepository) CompleteJob(_ context.Context, id int64, attempt int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := r.leasedJob(id, attempt)
+	if entry == nil {
+		return ErrJobLeaseLost
+	}
+
+	now := time.Now()
+	entry.job.State = JobSucceeded
+	entry.job.LastError = ""
+	entry.job.UpdatedAt = now
+	entry.job.FinishedAt = &now
+	entry.lockedUntil = time.Time{}
+	return nil
+}
+
+// FailJob records a failed attempt of a running job, if attempt still holds its lease
+// The job runs again at retryAt, or is dead-lettered when retryAt is nil
+func (r *memoryRepository) FailJob(_ context.Context, id int64, attempt int, lastError string, retryAt *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := r.leasedJob(id, attempt)
+	if entry == nil {
+		return ErrJobLeaseLost
+	}
+
+	now := time.Now()
+	entry.job.LastError = lastError
+	entry.job.UpdatedAt = now
+	entry.lockedUntil = time.Time{}
+	if retryAt != nil {
+		entry.job.State = JobPending
+		entry.job.RunAt = *retryAt
+	} else {
+		entry.job.State = JobDead
+		entry.job.FinishedAt = &now
+	}
+	return nil
+}
+
+// CountJobs returns the number of jobs in the given state
+func (r *memoryRepository) CountJobs(_ context.Context, state JobState) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := 0
+	for _, entry := range r.jobs {
+		if entry.job.State == state {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CountJobsByKind returns the number of jobs of each kind in the given state
+func (r *memoryRepository) CountJobsByKind(_ context.Context, state JobState) (map[JobKind]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[JobKind]int)
+	for _, entry := range r.jobs {
+		if entry.job.State == state {
+			counts[entry.job.Kind]++
+		}
+	}
+	return counts, nil
+}
+
+// GetJob retrieves a job by its ID
+func (r *memoryRepository) GetJob(_ context.Context, id int64) (*Job, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry := r.findJob(id)
+	if entry == nil {
+		return nil, notFound("job")
+	}
+
+	job := entry.job
+	return &job, nil
+}
+
+// ListJobs retrieves a page of jobs matching filter, newest first
+func (r *memoryRepository) ListJobs(_ context.Context, filter JobFilter) ([]*Job, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var matched []*Job
+	for i := len(r.jobs) - 1; i >= 0; i-- {
+		job := r.jobs[i].job
+		switch filter.State {
+		case "":
+		case JobFailed:
+			if job.State != JobDead && (job.State != JobPending || job.LastError == "") {
+				continue
+			}
+		default:
+			if job.State != filter.State {
+				continue
+			}
+		}
+		matched = append(matched, &job)
+	}
+
+	var jobs []*Job
+	for i := filter.Offset; i < len(matched) && i < filter.Offset+filter.Limit; i++ {
+		jobs = append(jobs, matched[i])
+	}
+	return jobs, nil
+}
+
+// RetryJob queues a dead, cancelled or retry-waiting job to run now with a fresh set of attempts
+func (r *memoryRepository) RetryJob(_ context.Context, id int64) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := r.findJob(id)
+	if entry == nil {
+		return nil, notFound("job")
+	}
+
+	state := entry.job.State
+	if state != JobDead && state != JobCancelled && (state != JobPending || entry.job.LastError == "") {
+		return nil, &ErrInvalidState{Resource: "job", State: string(state), Action: "retry"}
+	}
+
+	now := time.Now()
+	entry.job.State = JobPending
+	entry.job.Attempts = 0
+	entry.job.RunAt = now
+	entry.job.UpdatedAt = now
+	entry.job.FinishedAt = nil
+	entry.lockedUntil = time.Time{}
+
+	job := entry.job
+	return &job, nil
+}
+
+// CancelJob stops a pending or running job from running (again)
+func (r *memoryRepository) CancelJob(_ context.Context, id int64) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := r.findJob(id)
+	if entry == nil {
+		return nil, notFound("job")
+	}
+
+	if state := entry.job.State; state != JobPending && state != JobRunning {
+		return nil, &ErrInvalidState{Resource: "job", State: string(state), Action: "cancel"}
+	}
+
+	now := time.Now()
+	entry.job.State = JobCancelled
+	entry.job.UpdatedAt = now
+	entry.job.FinishedAt = &now
+	entry.lockedUntil = time.Time{}
+
+	job := entry.job
+	return &job, nil
+}
+
+// PurgeFinishedJobs deletes succeeded and cancelled jobs that finished before the given time
+func (r *memoryRepository) PurgeFinishedJobs(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged int64
+	kept := r.jobs[:0]
+	for _, entry := range r.jobs {
+		finished := entry.job.State == JobSucceeded || entry.job.State == JobCancelled
+		if finished && entry.job.FinishedAt != nil && entry.job.FinishedAt.Before(before) {
+			purged++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	r.jobs = kept
+	return purged, nil
+}
+
+// PurgeDispatchedOutbox deletes outbox events that were delivered before the given time
+func (r *memoryRepository) PurgeDispatchedOutbox(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged int64
+	kept := r.outbox[:0]
+	for _, entry := range r.outbox {
+		if !entry.dispatchedAt.IsZero() && entry.dispatchedAt.Before(before) {
+			purged++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	r.outbox = kept
+	return purged, nil
+}
+
+// CreateScheduledRun records the start of a task run and fills in its ID
+func (r *memoryRepository) CreateScheduledRun(_ context.Context, run *ScheduledRun) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run.ID = r.nextRunID
+	r.nextRunID++
+
+	stored := *run
+	r.runs = append(r.runs, &stored)
+	return nil
+}
+
+// FinishScheduledRun records the outcome of a task run
+func (r *memoryRepository) FinishScheduledRun(_ context.Context, id int64, status, runError string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, run := range r.runs {
+		if run.ID == id {
+			now := time.Now().UTC()
+			run.Status = status
+			run.Error = runError
+			run.FinishedAt = &now
+		}
+	}
+	return nil
+}
+
+// ScheduledRunExists reports whether a scheduled run of task was already recorded for the slot
+func (r *memoryRepository) ScheduledRunExists(_ context.Context, task string, scheduledAt time.Time) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, run := range r.runs {
+		if run.Task == task && run.Trigger == TriggerSchedule && run.ScheduledAt.Equal(scheduledAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListScheduledRuns retrieves the most recent runs, optionally of a single task
+func (r *memoryRepository) ListScheduledRuns(_ context.Context, task string, limit int) ([]*ScheduledRun, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var runs []*ScheduledRun
+	for i := len(r.runs) - 1; i >= 0 && len(runs) < limit; i-- {
+		if task != "" && r.runs[i].Task != task {
+			continue
+		}
+		run := *r.runs[i]
+		runs = append(runs, &run)
+	}
+	return runs, nil
+}
+
+// CreateWebhookSubscription stores a new subscription and fills in its ID and timestamps
+func (r *memoryRepository) CreateWebhookSubscription(_ context.Context, sub *WebhookSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	sub.ID = r.nextWebhookID
+	sub.CreatedAt = now
+	sub.UpdatedAt = now
+	r.nextWebhookID++
+
+	r.webhooks = append(r.webhooks, copyWebhookSubscription(sub))
+	return nil
+}
+
+// GetWebhookSubscription retrieves a subscription by ID
+func (r *memoryRepository) GetWebhookSubscription(_ context.Context, id int64) (*WebhookSubscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, sub := range r.webhooks {
+		if sub.ID == id {
+			return copyWebhookSubscription(sub), nil
+		}
+	}
+	return nil, notFound("webhook")
+}
+
+// ListWebhookSubscriptions retrieves every subscription, oldest first
+func (r *memoryRepository) ListWebhookSubscriptions(_ context.Context) ([]*WebhookSubscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var subs []*WebhookSubscription
+	for _, sub := range r.webhooks {
+		subs = append(subs, copyWebhookSubscription(sub))
+	}
+	return subs, nil
+}
+
+// UpdateWebhookSubscription saves the URL, events, secret and active flag of a subscription
+func (r *memoryRepository) UpdateWebhookSubscription(_ context.Context, sub *WebhookSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, stored := range r.webhooks {
+		if stored.ID == sub.ID {
+			sub.CreatedAt = stored.CreatedAt
+			sub.UpdatedAt = time.Now()
+			r.webhooks[i] = copyWebhookSubscription(sub)
+			return nil
+		}
+	}
+	return notFound("webhook")
+}
+
+// DeleteWebhookSubscription deletes a subscription and its delivery log
+func (r *memoryRepository) DeleteWebhookSubscription(_ context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, sub := range r.webhooks {
+		if sub.ID != id {
+			continue
+		}
+		r.webhooks = append(r.webhooks[:i], r.webhooks[i+1:]...)
+
+		kept := r.deliveries[:0]
+		for _, delivery := range r.deliveries {
+			if delivery.SubscriptionID != id {
+				kept = append(kept, delivery)
+			}
+		}
+		r.deliveries = kept
+		return nil
+	}
+	return notFound("webhook")
+}
+
+// CreateWebhookDelivery stores a new delivery and fills in its ID and timestamps
+func (r *memoryRepository) CreateWebhookDelivery(_ context.Context, delivery *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	delivery.ID = r.nextDeliveryID
+	delivery.CreatedAt = now
+	delivery.UpdatedAt = now
+	r.nextDeliveryID++
+
+	stored := *delivery
+	r.deliveries = append(r.deliveries, &stored)
+	return nil
+}
+
+// GetWebhookDelivery retrieves a delivery by ID
+func (r *memoryRepository) GetWebhookDelivery(_ context.Context, id int64) (*WebhookDelivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, delivery := range r.deliveries {
+		if delivery.ID == id {
+			copied := *delivery
+			return &copied, nil
+		}
+	}
+	return nil, notFound("webhook delivery")
+}
+
+// UpdateWebhookDelivery saves the outcome of a delivery attempt
+func (r *memoryRepository) UpdateWebhookDelivery(_ context.Context, delivery *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, stored := range r.deliveries {
+		if stored.ID == delivery.ID {
+			delivery.UpdatedAt = time.Now()
+			copied := *delivery
+			r.deliveries[i] = &copied
+			return nil
+		}
+	}
+	return notFound("webhook delivery")
+}
+
+// ListWebhookDeliveries retrieves the most recent deliveries to a subscription
+func (r *memoryRepository) ListWebhookDeliveries(_ context.Context, subscriptionID int64, limit int) ([]*WebhookDelivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var deliveries []*WebhookDelivery
+	for i := len(r.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if r.deliveries[i].SubscriptionID != subscriptionID {
+			continue
+		}
+		delivery := *r.deliveries[i]
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, nil
+}
+
+// copyWebhookSubscription copies a subscription, including its event list
+func copyWebhookSubscription(sub *WebhookSubscription) *WebhookSubscription {
+	copied := *sub
+	copied.Events = append([]string(nil), sub.Events...)
+	return &copied
+}
+
+// AppendAuditEvent links an event to the end of the audit chain, hashes it and stores it
+func (r *memoryRepository) AppendAuditEvent(_ context.Context, event *AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.PrevHash = auditGenesisHash
+	if len(r.audit) > 0 {
+		event.PrevHash = r.audit[len(r.audit)-1].Hash
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	event.OccurredAt = event.OccurredAt.UTC().Truncate(time.Microsecond)
+	event.Hash = event.ComputeHash()
+	event.ID = r.nextAuditID
+	r.nextAuditID++
+
+	stored := *event
+	r.audit = append(r.audit, &stored)
+	return nil
+}
+
+// ListAuditEvents retrieves the audit events matching filter, oldest first unless filter.Newest is set
+func (r *memoryRepository) ListAuditEvents(_ context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	matches := func(event *AuditEvent) bool {
+		switch {
+		case filter.ActorID != nil && (event.ActorID == nil || *event.ActorID != *filter.ActorID),
+			filter.Action != "" && event.Action != filter.Action,
+			filter.TargetType != "" && event.TargetType != filter.TargetType,
+			filter.TargetID != "" && event.TargetID != filter.TargetID,
+			filter.Since != nil && event.OccurredAt.Before(*filter.Since),
+			filter.Until != nil && !event.OccurredAt.Before(*filter.Until),
+			event.ID <= filter.AfterID:
+			return false
+		}
+		return true
+	}
+
+	var events []*AuditEvent
+	skipped := 0
+	for i := range r.audit {
+		event := r.audit[i]
+		if filter.Newest {
+			event = r.audit[len(r.audit)-1-i]
+		}
+		if !matches(event) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		if len(events) == filter.Limit {
+			break
+		}
+		copied := *event
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+// ClaimIdempotencyKey stores record as in flight, unless its key is already taken
+// It returns nil when the caller now owns the key, or a copy of the existing record
+func (r *memoryRepository) ClaimIdempotencyKey(_ context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	id := record.Scope + "\x00" + record.Key
+	if existing, ok := r.idempotency[id]; ok && existing.ExpiresAt.After(now) {
+		stale := existing.Response == nil && existing.LockedUntil.Before(now) && existing.Fingerprint == record.Fingerprint
+		if !stale {
+			copied := *existing
+			return &copied, nil
+		}
+	}
+
+	record.CreatedAt = now
+	copied := *record
+	copied.Response = nil
+	r.idempotency[id] = &copied
+	return nil, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request that claimed record and releases its lock
+func (r *memoryRepository) CompleteIdempotencyKey(_ context.Context, record *IdempotencyRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.idempotency[record.Scope+"\x00"+record.Key]
+	if !ok || existing.Fingerprint != record.Fingerprint || existing.Response != nil {
+		return nil
+	}
+	response := *record.Response
+	existing.Response = &response
+	existing.LockedUntil = time.Time{}
+	existing.ExpiresAt = record.ExpiresAt
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes an in-flight record, so the request can be retried with the same key
+func (r *memoryRepository) ReleaseIdempotencyKey(_ context.Context, scope, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := scope + "\x00" + key
+	if existing, ok := r.idempotency[id]; ok && existing.Response == nil {
+		delete(r.idempotency, id)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the records that expired before the given time
+func (r *memoryRepository) PurgeIdempotencyKeys(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged int64
+	for id, record := range r.idempotency {
+		if record.ExpiresAt.Before(before) {
+			delete(r.idempotency, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// AddSigningKey stores a new JWT signing key, which becomes the one tokens are signed with
+func (r *memoryRepository) AddSigningKey(_ context.Context, key *SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key.CreatedAt = time.Now()
+	stored := *key
+	r.signingKeys = append([]*SigningKey{&stored}, r.signingKeys...)
+	return nil
+}
+
+// ListSigningKeys returns every signing key, newest first
+func (r *memoryRepository) ListSigningKeys(_ context.Context) ([]*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.signingKeys) == 0 {
+		return nil, nil
+	}
+	return copyEach(r.signingKeys), nil
+}
+
+// PurgeSigningKeys deletes the keys older than the newest key created before the given time
+func (r *memoryRepository) PurgeSigningKeys(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, key := range r.signingKeys {
+		if key.CreatedAt.Before(before) {
+			purged := int64(len(r.signingKeys) - i - 1)
+			r.signingKeys = r.signingKeys[:i+1]
+			return purged, nil
+		}
+	}
+	return 0, nil
+}
+
+// leasedJob returns the stored job with the given ID if it is running its attempt-th
+// attempt, or nil; the caller must hold r.mu
+func (r *memoryRepository) leasedJob(id int64, attempt int) *memoryJob {
+	entry := r.findJob(id)
+	if entry == nil || entry.job.State != JobRunning || entry.job.Attempts != attempt {
+		return nil
+	}
+	return entry
+}
+
+// findJob returns the stored job with the given ID; the caller must hold r.mu
+func (r *memoryRepository) findJob(id int64) *memoryJob {
+	for _, entry := range r.jobs {
+		if entry.job.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// WithTx runs fn and undoes its changes if it returns an error
+// The write lock is held until fn returns, so other callers wait for the
+// transaction as they would for SQL row locks, and a rollback can't undo their writes
+func (r *memoryRepository) WithTx(ctx context.Context, fn func(tx Repository) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saved := r.snapshot()
+	if err := fn(memoryTx{&memoryRepository{mu: heldLock{}, memoryStore: r.memoryStore}}); err != nil {
+		r.restore(saved)
+		return err
+	}
+	return nil
+}
+
+// memoryTx is the Repository handed to WithTx callbacks
+// Nested WithTx calls join the surrounding transaction
+type memoryTx struct {
+	*memoryRepository
+}
+
+func (tx memoryTx) WithTx(_ context.Context, fn func(tx Repository) error) error {
+	return fn(tx)
+}
+
+// snapshot copies the store, so a failed transaction can be rolled back; the caller must hold r.mu
+func (s *memoryStore) snapshot() *memoryStore {
+	saved := *s
+	saved.users = make(map[int]*User, len(s.users))
+	for id, user := range s.users {
+		copied := *user
+		saved.users[id] = &copied
+	}
+	saved.deletedUsers = make(map[int]*memoryDeletedUser, len(s.deletedUsers))
+	for id, deleted := range s.deletedUsers {
+		copied := *deleted
+		saved.deletedUsers[id] = &copied
+	}
+	saved.outbox = copyEach(s.outbox)
+	saved.jobs = copyEach(s.jobs)
+	saved.runs = copyEach(s.runs)
+	saved.webhooks = copyEach(s.webhooks)
+	saved.deliveries = copyEach(s.deliveries)
+	saved.audit = copyEach(s.audit)
+	saved.signingKeys = copyEach(s.signingKeys)
+	saved.idempotency = make(map[string]*IdempotencyRecord, len(s.idempotency))
+	for key, record := range s.idempotency {
+		copied := *record
+		saved.idempotency[key] = &copied
+	}
+	return &saved
+}
+
+// restore puts back the state saved by snapshot; the caller must hold r.mu
+func (s *memoryStore) restore(saved *memoryStore) {
+	*s = *saved
+}
+
+// copyEach returns a slice holding copies of the values items point to
+func copyEach[T any](items []*T) []*T {
+	copied := make([]*T, len(items))
+	for i, item := range items {
+		value := *item
+		copied[i] = &value
+	}
+	return copied
+}
+
+// checkUnique enforces the UNIQUE constraints on username and email
+// excludeID skips the user being updated; the caller must hold r.mu
+func (r *memoryRepository) checkUnique(excludeID int, username, email string) error {
+	others := make([]*User, 0, len(r.users)+len(r.deletedUsers))
+	for _, other := range r.users {
+		others = append(others, other)
+	}
+	// Like the unique constraints, soft-deleted users keep their username and email
+	for _, deleted := range r.deletedUsers {
+		others = append(others, &deleted.user)
+	}
+
+	for _, other := range others {
+		if other.ID == excludeID {
+			continue
+		}
+		if other.Username == username {
+			return &ErrConflict{Field: "username"}
+		}
+		if other.Email == email {
+			return &ErrConflict{Field: "email"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+// metrics.go - Metrics registry
+// Components register named metrics here; the registry gathers the current
+// values on demand so they can be served as JSON by an admin endpoint, or in
+// the Prometheus text format on the metrics port. Values a component doesn't
+// already track can be kept in a CounterVec or HistogramVec
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricType is the kind of value a metric holds
+type MetricType string
+
+const (
+	MetricGauge     MetricType = "gauge"     // Value that can go up and down
+	MetricCounter   MetricType = "counter"   // Value that only increases
+	MetricHistogram MetricType = "histogram" // Observations counted into buckets
+)
+
+// DefaultBuckets are histogram buckets in seconds suited to request latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Labels identify one series within a metric (e.g. pool="primary")
+type Labels map[string]string
+
+// Sample is one labelled value of a metric
+type Sample struct {
+	Suffix string  `json:"suffix,omitempty"` // Appended to the metric name: "_bucket", "_sum" or "_count" for histograms
+	Labels Labels  `json:"labels,omitempty"`
+	Value  float64 `json:"value"`
+}
+
+// MetricFamily is a gathered metric with all of its samples
+type MetricFamily struct {
+	Name    string     `json:"name"`
+	Help    string     `json:"help"`
+	Type    MetricType `json:"type"`
+	Samples []Sample   `json:"samples"`
+}
+
+// metricFunc produces the current samples of a metric
+type metricFunc struct {
+	help    string
+	kind    MetricType
+	collect func() []Sample
+}
+
+// Registry holds every registered metric
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metricFunc
+}
+
+// defaultRegistry is the registry used by the application
+var defaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metricFunc)}
+}
+
+// GaugeFunc registers a gauge whose samples are read from collect when gathered
+// Registering the same name again replaces the previous metric
+func (r *Registry) GaugeFunc(name, help string, collect func() []Sample) {
+	r.register(name, metricFunc{help: help, kind: MetricGauge, collect: collect})
+}
+
+// CounterFunc registers a counter whose samples are read from collect when gathered
+func (r *Registry) CounterFunc(name, help string, collect func() []Sample) {
+	r.register(name, metricFunc{help: help, kind: MetricCounter, collect: collect})
+}
+
+// HistogramFunc registers a histogram whose samples are read from collect when gathered
+// collect must return cumulative "_bucket" samples with an "le" label, then "_sum" and "_count"
+func (r *Registry) HistogramFunc(name, help string, collect func() []Sample) {
+	r.register(name, metricFunc{help: help, kind: MetricHistogram, collect: collect})
+}
+
+func (r *Registry) register(name string, m metricFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[name] = m
+}
+
+// Gather returns the current value of every metric, sorted by name
+func (r *Registry) Gather() []MetricFamily {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	families := make([]MetricFamily, 0, len(r.metrics))
+	for name, m := range r.metrics {
+		families = append(families, MetricFamily{
+			Name:    name,
+			Help:    m.help,
+			Type:    m.kind,
+			Samples: m.collect(),
+		})
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// NewMetricsServer creates the admin server that serves registry at /metrics
+func NewMetricsServer(addr string, registry *Registry) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := registry.WriteText(w); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write metrics", "error", err)
+		}
+	})
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, family := range r.Gather() {
+		fmt.Fprintf(buf, "# HELP %s %s\n", family.Name, escapeHelp(family.Help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, sample := range family.Samples {
+			fmt.Fprintf(buf, "%s%s%s %s\n", family.Name, sample.Suffix, formatLabels(sample.Labels), formatValue(sample.Value))
+		}
+	}
+	return buf.Flush()
+}
+
+// formatLabels renders labels as {a="1",b="2"}, sorted by name with "le" last as Prometheus expects
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "le") != (names[j] == "le") {
+			return names[j] == "le"
+		}
+		return names[i] < names[j]
+	})
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelValueEscaper escapes backslashes, quotes and newlines in label values
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeHelp escapes backslashes and newlines in help text
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// formatValue renders a sample value, including +Inf, -Inf and NaN
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// seriesKey identifies one combination of label values
+func seriesKey(names, values []string) string {
+	if len(values) != len(names) {
+		panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(values), names))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// seriesLabels pairs label names with values
+func seriesLabels(names, values []string) Labels {
+	labels := make(Labels, len(names))
+	for i, name := range names {
+		labels[name] = values[i]
+	}
+	return labels
+}
+
+// CounterVec is a counter with one series per combination of label values
+type CounterVec struct {
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels Labels
+	value  float64
+}
+
+// NewCounterVec creates a counter with the given label names
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{labels: labels, series: make(map[string]*counterSeries)}
+}
+
+// Inc adds one to the series with the given label values, in label order
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the series with the given label values
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := seriesKey(c.labels, values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: seriesLabels(c.labels, values)}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+// Samples returns the value of every series, for CounterFunc
+func (c *CounterVec) Samples() []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := sortedKeys(c.series)
+	samples := make([]Sample, 0, len(keys))
+	for _, key := range keys {
+		s := c.series[key]
+		samples = append(samples, Sample{Labels: s.labels, Value: s.value})
+	}
+	return samples
+}
+
+// HistogramVec is a histogram with one series per combination of label values
+type HistogramVec struct {
+	buckets []float64 // Upper bounds, ascending; +Inf is implied
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels Labels
+	counts []uint64 // Per bucket, not cumulative; the last entry is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates a histogram with the given bucket upper bounds and label names
+func NewHistogramVec(buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{buckets: sorted, labels: labels, series: make(map[string]*histogramSeries)}
+}
+
+// Observe records one value in the series with the given label values, in label order
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := seriesKey(h.labels, values)
+	bucket := sort.SearchFloat64s(h.buckets, value) // First bucket whose bound is >= value
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: seriesLabels(h.labels, values), counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += value
+	s.count++
+}
+
+// Samples returns the buckets, sum and count of every series, for HistogramFunc
+func (h *HistogramVec) Samples() []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := sortedKeys(h.series)
+	samples := make([]Sample, 0, len(keys)*(len(h.buckets)+3))
+	for _, key := range keys {
+		s := h.series[key]
+
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			labels := make(Labels, len(s.labels)+1)
+			for name, value := range s.labels {
+				labels[name] = value
+			}
+			labels["le"] = formatValue(bound)
+			samples = append(samples, Sample{Suffix: "_bucket", Labels: labels, Value: float64(cumulative)})
+		}
+		samples = append(samples,
+			Sample{Suffix: "_sum", Labels: s.labels, Value: s.sum},
+			Sample{Suffix: "_count", Labels: s.labels, Value: float64(s.count)},
+		)
+	}
+	return samples
+}
+
+// sortedKeys returns the keys of m in order, so series are always listed the same way
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// openTestDB opens an empty SQLite database in a temporary directory
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, _, err := InitDatabase("sqlite://"+filepath.Join(t.TempDir(), "test.db"), PoolConfig{ConnectTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0010_add_index.up.sql":      {Data: []byte("CREATE INDEX idx ON t (name);")},
+		"m/0010_add_index.down.sql":    {Data: []byte("DROP INDEX idx;")},
+		"m/0002_create_t.up.sql":       {Data: []byte("CREATE TABLE t (name TEXT);")},
+		"m/0002_create_t.down.sql":     {Data: []byte("DROP TABLE t;")},
+		"m/0003_irreversible.up.sql":   {Data: []byte("UPDATE t SET name = '';")},
+		"m/README.md":                  {Data: []byte("not a migration")},
+		"m/0001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INTEGER);")},
+		"m/0001_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	}
+
+	migrations, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+
+	want := []struct {
+		version int
+		name    string
+		hasDown bool
+	}{
+		{1, "create_users", true},
+		{2, "create_t", true},
+		{3, "irreversible", false},
+		{10, "add_index", true},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("loaded %d migrations, want %d", len(migrations), len(want))
+	}
+	for i, w := range want {
+		m := migrations[i]
+		if m.Version != w.version || m.Name != w.name || (m.Down != "") != w.hasDown {
+			t.Errorf("migration %d = %d %s (down %t), want %d %s (down %t)", i, m.Version, m.Name, m.Down != "", w.version, w.name, w.hasDown)
+		}
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		want  string
+	}{
+		{"no up file", fstest.MapFS{"m/0001_a.down.sql": {}}, "has no up file"},
+		{"no name", fstest.MapFS{"m/0001.up.sql": {}}, "invalid migration file name"},
+		{"bad version", fstest.MapFS{"m/abc_a.up.sql": {}}, "invalid migration version"},
+		{"zero version", fstest.MapFS{"m/0000_a.up.sql": {}}, "invalid migration version"},
+		{"conflicting names", fstest.MapFS{"m/0001_a.up.sql": {}, "m/0001_b.down.sql": {}}, "conflicting names"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Give up files some contents so only the case under test fails
+			for name, file := range tt.files {
+				if strings.HasSuffix(name, ".up.sql") {
+					file.Data = []byte("SELECT 1;")
+				}
+			}
+
+			_, err := loadMigrations(tt.files, "m")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadMigrations() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrationsMatchAcrossDialects(t *testing.T) {
+	postgres, err := loadMigrations(migrationFiles, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("failed to load postgres migrations: %v", err)
+	}
+	sqlite, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		t.Fatalf("failed to load sqlite migrations: %v", err)
+	}
+
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("postgres has %d migrations, sqlite %d", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != sqlite[i].Version || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d: postgres %04d_%s, sqlite %04d_%s", i, postgres[i].Version, postgres[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+		if postgres[i].Down == "" || sqlite[i].Down == "" {
+			t.Errorf("migration %04d_%s has no down file", postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	m, err := NewMigrator(db, DialectSQLite)
+	if err != nil {
+		t.Fatalf("NewMigrator() error = %v", err)
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil || version != 0 {
+		t.Fatalf("Version() before migrating = %d, %v; want 0", version, err)
+	}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	if version, _ := m.Version(ctx); version != m.Latest() {
+		t.Fatalf("Version() after Up = %d, want %d", version, m.Latest())
+	}
+
+	// Up again is a no-op
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("second Up() error = %v", err)
+	}
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatalf("Down() error = %v", err)
+	}
+	if version, _ := m.Version(ctx); version != m.Latest()-1 {
+		t.Errorf("Version() after Down = %d, want %d", version, m.Latest()-1)
+	}
+
+	// Every down file must undo its up file, so the whole schema can be rebuilt
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatalf("To(0) error = %v", err)
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&tables); err != nil {
+		t.Fatalf("failed to count tables: %v", err)
+	}
+	if tables != 0 {
+		t.Errorf("%d tables left after rolling everything back", tables)
+	}
+
+	if err := m.To(ctx, 1); err != nil {
+		t.Fatalf("To(1) error = %v", err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	for _, status := range statuses {
+		if status.Applied != (status.Version == 1) {
+			t.Errorf("migration %d applied = %t", status.Version, status.Applied)
+		}
+	}
+
+	if err := m.To(ctx, 999); err == nil {
+		t.Error("To(999) succeeded for an unknown version")
+	}
+}
+
+func TestMigrationHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	m, err := NewMigrator(db, DialectSQLite)
+	if err != nil {
+		t.Fatalf("NewMigrator() error = %v", err)
+	}
+	check := MigrationHealthCheck(m)
+
+	if result := check.Check(ctx); result.Status != HealthFail {
+		t.Errorf("unmigrated database: status = %s, want %s", result.Status, HealthFail)
+	}
+
+	// The probe must not create schema_migrations itself
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_migrations'`).Scan(&tables)
+	if tables != 0 {
+		t.Error("health check created schema_migrations")
+	}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	if result := check.Check(ctx); result.Status != HealthPass {
+		t.Errorf("migrated database: status = %s (%s), want %s", result.Status, result.Message, HealthPass)
+	}
+
+	if _, err := db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatalf("failed to insert future migration: %v", err)
+	}
+	if result := check.Check(ctx); result.Status != HealthWarn {
+		t.Errorf("newer schema: status = %s, want %s", result.Status, HealthWarn)
+	}
+}
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_state;
+DROP INDEX IF EXISTS idx_jobs_due;
+DROP TABLE IF EXISTS jobs;
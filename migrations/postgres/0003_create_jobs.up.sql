@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	kind VARCHAR(100) NOT NULL,
+	payload JSONB NOT NULL,
+	state VARCHAR(20) NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMP NOT NULL,
+	locked_until TIMESTAMP,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP
+);
+
+-- Workers only ever scan jobs that are waiting or leased
+CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs(run_at, id) WHERE state IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS idx_jobs_state ON jobs(state);
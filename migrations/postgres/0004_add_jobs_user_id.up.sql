@@ -0,0 +1,4 @@
+-- Jobs may belong to a user, who can then poll their status
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS user_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_user_id ON jobs(user_id);
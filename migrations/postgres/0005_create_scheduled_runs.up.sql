@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS scheduled_runs (
+	id BIGSERIAL PRIMARY KEY,
+	task VARCHAR(100) NOT NULL,
+	trigger_type VARCHAR(20) NOT NULL,
+	scheduled_at TIMESTAMP NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP,
+	status VARCHAR(20) NOT NULL,
+	error TEXT,
+	instance VARCHAR(255) NOT NULL
+);
+
+-- Looked up before every scheduled run to skip slots another instance already ran
+CREATE INDEX IF NOT EXISTS idx_scheduled_runs_task ON scheduled_runs(task, scheduled_at);
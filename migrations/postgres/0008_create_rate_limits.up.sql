@@ -0,0 +1,7 @@
+-- GCRA state for the postgres rate limit store: one theoretical arrival time per key
+CREATE TABLE IF NOT EXISTS rate_limits (
+	key VARCHAR(255) PRIMARY KEY,
+	tat BIGINT NOT NULL -- Unix nanoseconds
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_tat ON rate_limits(tat);
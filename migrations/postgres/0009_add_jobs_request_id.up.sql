@@ -0,0 +1,2 @@
+-- The request that queued a job, so its worker logs can be correlated with it
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS request_id VARCHAR(128);
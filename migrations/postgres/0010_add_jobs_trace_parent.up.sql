@@ -0,0 +1,2 @@
+-- W3C traceparent of the request that queued a job, so the job's trace can link back to it
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS trace_parent VARCHAR(55);
@@ -0,0 +1,16 @@
+-- Idempotency-Key records: the request fingerprint and, once the first request finishes, its response
+-- A row without a response is in flight; locked_until lets a retry take over if that request died
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	scope VARCHAR(100) NOT NULL, -- "user:<id>" or "ip:<address>"
+	key VARCHAR(255) NOT NULL,
+	fingerprint CHAR(64) NOT NULL,
+	locked_until TIMESTAMP,
+	response_status INTEGER,
+	response_headers TEXT,
+	response_body BYTEA,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
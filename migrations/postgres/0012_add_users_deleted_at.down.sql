@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_users_deleted_at;
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,9 @@
+-- JWT signing keys, newest first in use; the rotate_signing_keys task adds one and drops
+-- those no unexpired token can have been signed with. Only the key ID is stored: the key
+-- itself is derived from JWT_SECRET, so reading this table isn't enough to forge tokens
+CREATE TABLE IF NOT EXISTS signing_keys (
+	kid CHAR(32) PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_signing_keys_created_at ON signing_keys(created_at);
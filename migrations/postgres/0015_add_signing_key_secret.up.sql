@@ -0,0 +1,3 @@
+-- Random key material, sealed with SIGNING_KEY_ENCRYPTION_KEY. Keys added before this
+-- migration have none: their material is still derived from JWT_SECRET until they are purged
+ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS secret TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_type VARCHAR(100) NOT NULL,
+	aggregate_type VARCHAR(50) NOT NULL,
+	aggregate_id INTEGER NOT NULL,
+	payload TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	locked_until TIMESTAMP,
+	dispatched_at TIMESTAMP
+);
+
+-- The relay only ever scans undelivered events
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE dispatched_at IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_scheduled_runs_task;
+DROP TABLE IF EXISTS scheduled_runs;
@@ -0,0 +1,8 @@
+-- GCRA state, one theoretical arrival time per key. The shared rate limit store
+-- requires PostgreSQL; SQLite gets the table so both dialects keep the same versions
+CREATE TABLE IF NOT EXISTS rate_limits (
+	key VARCHAR(255) PRIMARY KEY,
+	tat BIGINT NOT NULL -- Unix nanoseconds
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_tat ON rate_limits(tat);
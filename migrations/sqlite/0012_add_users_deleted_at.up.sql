@@ -0,0 +1,5 @@
+-- Deleted accounts are kept, hidden, until the purge_deleted_users task removes them
+-- Their username and email stay taken until then
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users(deleted_at);
@@ -0,0 +1,2 @@
+-- Sinks that already received an event, so a retry only goes to the sinks that failed
+ALTER TABLE outbox ADD COLUMN delivered_sinks TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,358 @@
+// outbox.go - Transactional outbox
+// User changes write an event row in the same transaction as the change itself.
+// The relay then delivers pending events to the configured sinks at least once,
+// so no event is lost when the process crashes between the commit and delivery
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// User lifecycle event types
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+// OutboxEvent is an event waiting in (or delivered from) the outbox table
+type OutboxEvent struct {
+	ID             int64           `json:"id"`
+	EventType      string          `json:"type"`
+	AggregateType  string          `json:"aggregate_type"`
+	AggregateID    int             `json:"aggregate_id"`
+	Payload        json.RawMessage `json:"payload"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Attempts       int             `json:"-"`
+	DeliveredSinks []string        `json:"-"` // Sinks that received the event on an earlier attempt
+}
+
+// UserEventPayload is the payload of user.* events
+type UserEventPayload struct {
+	User          *User    `json:"user"`
+	ChangedFields []string `json:"changed_fields,omitempty"`
+}
+
+// newUserEvent builds a user.* outbox event
+// Passwords are never included because User.Password is not serialized
+func newUserEvent(eventType string, user *User, changedFields []string) (*OutboxEvent, error) {
+	payload, err := json.Marshal(UserEventPayload{User: user, ChangedFields: changedFields})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+
+	return &OutboxEvent{
+		EventType:     eventType,
+		AggregateType: "user",
+		AggregateID:   user.ID,
+		Payload:       payload,
+	}, nil
+}
+
+// EventSink receives events from the outbox relay
+// A retry skips the sinks that already received the event, but a relay that crashes
+// between delivering and recording it delivers again, so consumers must still
+// tolerate duplicates. The event ID is unique and stable for deduplicating
+type EventSink interface {
+	Name() string
+	Deliver(ctx context.Context, event *OutboxEvent) error
+}
+
+// LogSink writes events to the application log
+type LogSink struct{}
+
+func (LogSink) Name() string { return "log" }
+
+func (LogSink) Deliver(ctx context.Context, event *OutboxEvent) error {
+	slog.InfoContext(ctx, "Event", "event_type", event.EventType, "aggregate_type", event.AggregateType,
+		"aggregate_id", event.AggregateID, "payload", event.Payload)
+	return nil
+}
+
+// FileSink appends events to a file as newline delimited JSON
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileSink creates a sink that appends to path
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Deliver(_ context.Context, event *OutboxEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// WebhookSink POSTs each event as JSON to a URL
+// Any non-2xx response counts as a failed delivery
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink creates a sink that posts to url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Deliver(ctx context.Context, event *OutboxEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", fmt.Sprint(event.ID))
+	req.Header.Set("X-Event-Type", event.EventType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// NATSPublisher is the publishing half of a NATS client
+// *nats.Conn satisfies it, so the API doesn't need to depend on a NATS library
+type NATSPublisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// NATSSink publishes each event to "<prefix>.<event type>" (e.g. "events.user.created")
+type NATSSink struct {
+	publisher NATSPublisher
+	prefix    string
+}
+
+// NewNATSSink creates a sink that publishes through publisher
+func NewNATSSink(publisher NATSPublisher, subjectPrefix string) *NATSSink {
+	return &NATSSink{publisher: publisher, prefix: subjectPrefix}
+}
+
+func (s *NATSSink) Name() string { return "nats" }
+
+func (s *NATSSink) Deliver(_ context.Context, event *OutboxEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish(s.prefix+"."+event.EventType, data)
+}
+
+// NewOutboxSinks builds the sinks named in config.OutboxSinks
+// The NATS sink needs a live client connection and is wired up in code with NewNATSSink
+func NewOutboxSinks(config *Config) ([]EventSink, error) {
+	var sinks []EventSink
+	for _, name := range config.OutboxSinks {
+		switch strings.ToLower(name) {
+		case "log":
+			sinks = append(sinks, LogSink{})
+		case "file":
+			if config.OutboxFilePath == "" {
+				return nil, errors.New("outbox file sink requires OUTBOX_FILE_PATH")
+			}
+			sinks = append(sinks, NewFileSink(config.OutboxFilePath))
+		case "webhook":
+			if config.OutboxWebhookURL == "" {
+				return nil, errors.New("outbox webhook sink requires OUTBOX_WEBHOOK_URL")
+			}
+			sinks = append(sinks, NewWebhookSink(config.OutboxWebhookURL))
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// OutboxRelay delivers pending outbox events to its sinks
+type OutboxRelay struct {
+	repo      Repository
+	sinks     []EventSink
+	interval  time.Duration
+	batchSize int
+	lease     time.Duration
+
+	lastPoll atomic.Int64 // Unix nanoseconds of the last poll that ran to completion
+	running  atomic.Bool
+}
+
+// NewOutboxRelay creates a relay that polls the outbox every interval
+func NewOutboxRelay(repo Repository, sinks []EventSink, interval time.Duration, batchSize int) *OutboxRelay {
+	return &OutboxRelay{
+		repo:      repo,
+		sinks:     sinks,
+		interval:  interval,
+		batchSize: batchSize,
+		lease:     time.Minute, // Must exceed the time a batch takes to deliver
+	}
+}
+
+// Start runs the relay in a goroutine until ctx is cancelled
+func (o *OutboxRelay) Start(ctx context.Context) {
+	o.running.Store(true)
+	go func() {
+		defer o.running.Store(false)
+
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+
+		for {
+			// Keep draining while full batches come back
+			for {
+				if claimed, ok := o.runBatch(ctx); !ok || claimed < o.batchSize {
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runBatch runs runOnce, recovering a panic so one bad event or sink doesn't stop the relay
+// ok is false if the batch panicked or failed to claim; events it leased are retried once the lease expires
+func (o *OutboxRelay) runBatch(ctx context.Context) (claimed int, ok bool) {
+	var err error
+	defer recoverPanic(ctx, "outbox relay", &err)
+
+	claimed, err = o.runOnce(ctx)
+	if err != nil {
+		return claimed, false
+	}
+	o.lastPoll.Store(time.Now().UnixNano())
+	return claimed, true
+}
+
+// runOnce delivers one batch of events and returns how many were claimed
+func (o *OutboxRelay) runOnce(ctx context.Context) (int, error) {
+	events, err := o.repo.ClaimOutboxEvents(ctx, o.batchSize, o.lease)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Outbox relay failed to claim events", "error", err)
+		}
+		return 0, err
+	}
+
+	for _, event := range events {
+		o.deliver(ctx, event)
+	}
+	return len(events), nil
+}
+
+// deliver sends event to every sink that hasn't received it yet and records the outcome
+func (o *OutboxRelay) deliver(ctx context.Context, event *OutboxEvent) {
+	ctx = withLogAttrs(ctx, slog.Int64("event_id", event.ID))
+
+	delivered := event.DeliveredSinks
+	var failures []string
+	for _, sink := range o.sinks {
+		if slices.Contains(event.DeliveredSinks, sink.Name()) {
+			continue
+		}
+		if err := sink.Deliver(ctx, event); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", sink.Name(), err))
+			continue
+		}
+		delivered = append(delivered, sink.Name())
+	}
+
+	if len(failures) == 0 {
+		if err := o.repo.MarkOutboxDispatched(ctx, event.ID); err != nil {
+			slog.ErrorContext(ctx, "Outbox relay failed to mark event dispatched", "error", err)
+		}
+		return
+	}
+
+	// Retry later, only to the sinks that failed
+	lastError := strings.Join(failures, "; ")
+	retryAt := time.Now().Add(outboxBackoff(event.Attempts))
+	slog.WarnContext(ctx, "Outbox relay delivery failed", "attempt", event.Attempts, "retry_at", retryAt, "error", lastError)
+
+	if err := o.repo.MarkOutboxFailed(ctx, event.ID, lastError, retryAt, delivered); err != nil {
+		slog.ErrorContext(ctx, "Outbox relay failed to mark event failed", "error", err)
+	}
+}
+
+// OutboxRelayHealthCheck fails when the relay has stopped, or hasn't finished a poll in
+// longer than a batch may take, e.g. because claims keep failing or batches keep panicking
+func OutboxRelayHealthCheck(o *OutboxRelay) HealthChecker {
+	maxAge := o.lease + 3*o.interval
+	return HealthCheckerFunc(func(context.Context) HealthResult {
+		details := map[string]interface{}{}
+		var since time.Duration
+		if last := o.lastPoll.Load(); last > 0 {
+			since = time.Since(time.Unix(0, last))
+			details["last_poll_seconds_ago"] = since.Seconds()
+		}
+
+		switch {
+		case !o.running.Load():
+			return HealthResult{Status: HealthFail, Message: "outbox relay is not running", Details: details}
+		case o.lastPoll.Load() == 0:
+			return HealthResult{Status: HealthWarn, Message: "outbox relay hasn't polled yet", Details: details}
+		case since > maxAge:
+			return HealthResult{Status: HealthFail, Message: "outbox relay is stuck", Details: details}
+		}
+		return HealthResult{Status: HealthPass, Details: details}
+	})
+}
+
+// outboxBackoff returns the retry delay after the given number of attempts
+// 2s, 4s, 8s ... capped at 10 minutes
+func outboxBackoff(attempts int) time.Duration {
+	delay := 2 * time.Second
+	for i := 1; i < attempts && delay < 10*time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > 10*time.Minute {
+		delay = 10 * time.Minute
+	}
+	return delay
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingSink is an EventSink that records the IDs it receives and fails while failing is set
+type recordingSink struct {
+	name      string
+	failing   bool
+	panicking bool
+	received  []int64
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Deliver(_ context.Context, event *OutboxEvent) error {
+	if s.panicking {
+		panic("sink bug")
+	}
+	if s.failing {
+		return errors.New("sink down")
+	}
+	s.received = append(s.received, event.ID)
+	return nil
+}
+
+// newTestRelay creates a relay over a memory repository holding count user.created events
+func newTestRelay(t *testing.T, count int, sinks ...EventSink) (*OutboxRelay, *memoryRepository) {
+	t.Helper()
+
+	repo := NewMemoryRepository().(*memoryRepository)
+	for i := 1; i <= count; i++ {
+		event := &OutboxEvent{EventType: EventUserCreated, AggregateType: "user", AggregateID: i, Payload: json.RawMessage(`{}`)}
+		if err := repo.AddOutboxEvent(context.Background(), event); err != nil {
+			t.Fatalf("AddOutboxEvent() error = %v", err)
+		}
+	}
+	return NewOutboxRelay(repo, sinks, time.Second, 10), repo
+}
+
+// expireOutboxLeases makes every undelivered event due, as if its lease or backoff had run out
+func expireOutboxLeases(repo *memoryRepository) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, entry := range repo.outbox {
+		entry.lockedUntil = time.Time{}
+	}
+}
+
+// pendingOutbox returns the number of events that haven't been dispatched
+func pendingOutbox(repo *memoryRepository) int {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	pending := 0
+	for _, entry := range repo.outbox {
+		if entry.dispatchedAt.IsZero() {
+			pending++
+		}
+	}
+	return pending
+}
+
+func TestOutboxRelayRetriesOnlyFailedSinks(t *testing.T) {
+	ctx := context.Background()
+	healthy := &recordingSink{name: "log"}
+	flaky := &recordingSink{name: "webhook", failing: true}
+	relay, repo := newTestRelay(t, 2, healthy, flaky)
+
+	if claimed, ok := relay.runBatch(ctx); claimed != 2 || !ok {
+		t.Fatalf("runBatch() = %d, %t; want 2 events", claimed, ok)
+	}
+	if len(healthy.received) != 2 || len(flaky.received) != 0 || pendingOutbox(repo) != 2 {
+		t.Fatalf("received %v and %v with %d pending; want both events pending a retry", healthy.received, flaky.received, pendingOutbox(repo))
+	}
+
+	// Failed events wait for their backoff
+	if claimed, _ := relay.runBatch(ctx); claimed != 0 {
+		t.Errorf("runBatch() during the backoff claimed %d events", claimed)
+	}
+
+	flaky.failing = false
+	expireOutboxLeases(repo)
+	relay.runBatch(ctx)
+	if len(healthy.received) != 2 || len(flaky.received) != 2 {
+		t.Errorf("received %v and %v after the retry; want each event once per sink", healthy.received, flaky.received)
+	}
+	if pending := pendingOutbox(repo); pending != 0 {
+		t.Errorf("pending events = %d, want every event dispatched", pending)
+	}
+}
+
+func TestOutboxRelayRedeliversAfterLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{name: "log"}
+	relay, repo := newTestRelay(t, 1, sink)
+
+	// Another relay claimed the event and crashed before delivering it
+	if events, err := repo.ClaimOutboxEvents(ctx, 10, time.Minute); err != nil || len(events) != 1 {
+		t.Fatalf("ClaimOutboxEvents() = %d events, %v", len(events), err)
+	}
+	if claimed, _ := relay.runBatch(ctx); claimed != 0 {
+		t.Fatalf("runBatch() claimed %d leased events", claimed)
+	}
+
+	expireOutboxLeases(repo)
+	if claimed, _ := relay.runBatch(ctx); claimed != 1 || len(sink.received) != 1 || pendingOutbox(repo) != 0 {
+		t.Errorf("after the lease expired: claimed %d, received %v, pending %d; want the event delivered", claimed, sink.received, pendingOutbox(repo))
+	}
+}
+
+func TestOutboxRelaySurvivesPanics(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{name: "log", panicking: true}
+	relay, repo := newTestRelay(t, 1, sink)
+	relay.running.Store(true)
+
+	if claimed, ok := relay.runBatch(ctx); ok || claimed != 0 {
+		t.Fatalf("runBatch() with a panicking sink = %d, %t; want a failed batch", claimed, ok)
+	}
+	if result := OutboxRelayHealthCheck(relay).Check(ctx); result.Status != HealthWarn {
+		t.Errorf("health before a poll finished = %+v, want warn", result)
+	}
+
+	// The panicked batch keeps its lease, and is delivered once the lease runs out
+	sink.panicking = false
+	expireOutboxLeases(repo)
+	if _, ok := relay.runBatch(ctx); !ok || len(sink.received) != 1 {
+		t.Errorf("runBatch() after the panic = %t, received %v; want the event delivered", ok, sink.received)
+	}
+	if result := OutboxRelayHealthCheck(relay).Check(ctx); result.Status != HealthPass {
+		t.Errorf("health after a poll = %+v, want pass", result)
+	}
+
+	relay.lastPoll.Store(time.Now().Add(-relay.lease - 4*relay.interval).UnixNano())
+	if result := OutboxRelayHealthCheck(relay).Check(ctx); result.Status != HealthFail {
+		t.Errorf("health after a stuck poll = %+v, want fail", result)
+	}
+	relay.running.Store(false)
+	if result := OutboxRelayHealthCheck(relay).Check(ctx); result.Status != HealthFail || result.Message != "outbox relay is not running" {
+		t.Errorf("health of a stopped relay = %+v, want fail", result)
+	}
+}
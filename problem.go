@@ -0,0 +1,159 @@
+// problem.go - RFC 7807 problem details responses
+// Errors are rendered as application/problem+json by default. Clients that ask
+// for plain application/json still get the original ErrorResponse shape
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Media types used for content negotiation of error responses
+const (
+	mediaTypeProblemJSON = "application/problem+json"
+	mediaTypeJSON        = "application/json"
+)
+
+// ProblemDetails is an RFC 7807 error response body
+type ProblemDetails struct {
+	Type      string           `json:"type"`
+	Title     string           `json:"title"`
+	Status    int              `json:"status"`
+	Detail    string           `json:"detail,omitempty"`
+	Instance  string           `json:"instance,omitempty"`
+	Code      string           `json:"code"`
+	RequestID string           `json:"request_id,omitempty"`
+	Errors    []FieldViolation `json:"errors,omitempty"`
+}
+
+// FieldViolation describes why a single request field was rejected
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// apiError is the transport independent description of an error response
+type apiError struct {
+	Status     int
+	Code       string
+	Message    string
+	Violations []FieldViolation
+	LegacyCode string // Code for the application/json shape when it differs from Code
+}
+
+// writeError renders err in the format the client negotiated
+func writeError(c *gin.Context, e apiError) {
+	if c.NegotiateFormat(mediaTypeProblemJSON, mediaTypeJSON) == mediaTypeJSON {
+		// Old clients keep receiving the original error shape and codes
+		code := e.Code
+		if e.LegacyCode != "" {
+			code = e.LegacyCode
+		}
+		c.JSON(e.Status, ErrorResponse{Error: code, Message: e.Message})
+		return
+	}
+
+	problem := ProblemDetails{
+		Type:      "/problems/" + strings.ReplaceAll(e.Code, "_", "-"),
+		Title:     http.StatusText(e.Status),
+		Status:    e.Status,
+		Detail:    e.Message,
+		Instance:  c.Request.URL.Path,
+		Code:      e.Code,
+		RequestID: c.GetString("request_id"),
+		Errors:    e.Violations,
+	}
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(e.Status, mediaTypeProblemJSON, body)
+}
+
+// RegisterValidatorTagNames makes validation errors report JSON field names
+// (e.g. "email") instead of Go struct field names (e.g. "Email")
+func RegisterValidatorTagNames() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+}
+
+// bindingError converts an error from ShouldBindJSON into an *ErrValidation
+// Validator messages are turned into field violations so raw validator strings never reach clients
+func bindingError(err error) error {
+	var tooLargeErr *http.MaxBytesError
+	if errors.As(err, &tooLargeErr) {
+		return &ErrRequestTooLarge{Limit: tooLargeErr.Limit}
+	}
+
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		violations := make([]FieldViolation, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			violations = append(violations, FieldViolation{
+				Field:   fe.Field(),
+				Rule:    fe.Tag(),
+				Message: violationMessage(fe),
+			})
+		}
+		return &ErrValidation{Message: "Request validation failed", Violations: violations}
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ErrValidation{
+			Message: "Request validation failed",
+			Violations: []FieldViolation{{
+				Field:   typeErr.Field,
+				Rule:    "type",
+				Message: fmt.Sprintf("must be a %s", typeErr.Type.Kind()),
+			}},
+		}
+	}
+
+	return &ErrValidation{Code: "malformed_body", Message: "Request body must be valid JSON"}
+}
+
+// violationMessage returns a human readable message for a failed validation rule
+func violationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	case "min":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("must have at least %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s characters", fe.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s characters", fe.Param())
+	default:
+		return fmt.Sprintf("failed the %q rule", fe.Tag())
+	}
+}
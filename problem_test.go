@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveError runs a request whose handler records err with fail, rendered by ErrorMiddleware
+func serveError(t *testing.T, err error, fallbackCode, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	router := gin.New()
+	router.Use(ErrorMiddleware())
+	router.POST("/test", func(c *gin.Context) {
+		fail(c, err, fallbackCode, "Request failed")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/test", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWriteErrorNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{"no accept header", "", mediaTypeProblemJSON},
+		{"any", "*/*", mediaTypeProblemJSON},
+		{"problem json", mediaTypeProblemJSON, mediaTypeProblemJSON},
+		{"legacy json", mediaTypeJSON, mediaTypeJSON},
+		{"prefers legacy json", "application/json, application/problem+json;q=0.5", mediaTypeJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveError(t, notFound("user"), "fetch_failed", tt.accept)
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType && got != tt.contentType+"; charset=utf-8" {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestWriteErrorProblemDetails(t *testing.T) {
+	err := &ErrValidation{Message: "Request validation failed", Violations: []FieldViolation{
+		{Field: "email", Rule: "email", Message: "must be a valid email address"},
+	}}
+	w := serveError(t, err, "registration_failed", mediaTypeProblemJSON)
+
+	var problem ProblemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Status != http.StatusBadRequest || problem.Code != "validation_error" {
+		t.Errorf("status, code = %d, %q; want 400, validation_error", problem.Status, problem.Code)
+	}
+	if problem.Type != "/problems/validation-error" || problem.Instance != "/test" {
+		t.Errorf("type, instance = %q, %q", problem.Type, problem.Instance)
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "email" {
+		t.Errorf("errors = %+v, want one violation for email", problem.Errors)
+	}
+}
+
+func TestWriteErrorLegacyCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		fallbackCode string
+		status       int
+		problemCode  string
+		legacyCode   string
+	}{
+		{"duplicate at registration", &ErrConflict{Field: "email"}, "registration_failed", http.StatusConflict, "email_taken", "user_exists"},
+		{"duplicate username at registration", &ErrConflict{Field: "username"}, "registration_failed", http.StatusConflict, "username_taken", "user_exists"},
+		{"duplicate on update", &ErrConflict{Field: "email"}, "update_failed", http.StatusConflict, "email_taken", "email_taken"},
+		{"login error", errors.New("connection refused"), "login_failed", http.StatusInternalServerError, "login_failed", "authentication_failed"},
+		{"wrong password", ErrInvalidCredentials, "login_failed", http.StatusUnauthorized, "authentication_failed", "authentication_failed"},
+		{"malformed body", bindingError(errors.New("unexpected EOF")), "", http.StatusBadRequest, "malformed_body", "validation_error"},
+		{"missing token", &UnauthorizedError{Message: "Authorization header required"}, "", http.StatusUnauthorized, "unauthorized", "Authorization header required"},
+		{"unchanged code", notFound("user"), "fetch_failed", http.StatusNotFound, "user_not_found", "user_not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveError(t, tt.err, tt.fallbackCode, mediaTypeProblemJSON)
+			var problem ProblemDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if w.Code != tt.status || problem.Code != tt.problemCode {
+				t.Errorf("problem+json: status, code = %d, %q; want %d, %q", w.Code, problem.Code, tt.status, tt.problemCode)
+			}
+
+			w = serveError(t, tt.err, tt.fallbackCode, mediaTypeJSON)
+			var legacy ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &legacy); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if w.Code != tt.status || legacy.Error != tt.legacyCode {
+				t.Errorf("application/json: status, error = %d, %q; want %d, %q", w.Code, legacy.Error, tt.status, tt.legacyCode)
+			}
+		})
+	}
+}
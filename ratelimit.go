@@ -0,0 +1,306 @@
+// ratelimit.go - Request rate limiting
+// Limits use GCRA (the generic cell rate algorithm), which behaves like a token
+// bucket that holds Limit requests and refills over Period, but only needs one
+// timestamp per key: the theoretical arrival time (TAT) of the next request.
+// State lives in a RateLimitStore, in memory for a single instance or in Postgres
+// when several instances must share limits
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit is a rate limiting policy: Limit requests per Period, all of which may come at once
+type RateLimit struct {
+	Name   string // Namespaces the keys, and labels the metrics
+	Limit  int    // 0 disables the policy
+	Period time.Duration
+}
+
+// RateLimitConfig configures rate limiting
+type RateLimitConfig struct {
+	Store string    // "memory" or "postgres"
+	Auth  RateLimit // /auth routes, per client IP
+	API   RateLimit // Authenticated routes, per user
+}
+
+// parseRateLimit parses a policy written as "<limit>/<period>", e.g. "10/1m"
+// "off" and "0" disable the policy
+func parseRateLimit(name, value string) (RateLimit, error) {
+	if strings.EqualFold(value, "off") || value == "0" {
+		return RateLimit{Name: name}, nil
+	}
+
+	limitPart, periodPart, ok := strings.Cut(value, "/")
+	limit, limitErr := strconv.Atoi(strings.TrimSpace(limitPart))
+	period, periodErr := time.ParseDuration(strings.TrimSpace(periodPart))
+	if !ok || limitErr != nil || periodErr != nil || limit < 1 || period <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <limit>/<period> such as 10/1m", value)
+	}
+	return RateLimit{Name: name, Limit: limit, Period: period}, nil
+}
+
+// interval is the time one request uses up
+func (l RateLimit) interval() time.Duration {
+	return l.Period / time.Duration(l.Limit)
+}
+
+// RateLimitDecision is the outcome of one request against a policy
+type RateLimitDecision struct {
+	Allowed    bool
+	Remaining  int           // Requests that could be made right now
+	ResetAfter time.Duration // Until the full limit is available again
+	RetryAfter time.Duration // Until the next request will be allowed; zero if Allowed
+}
+
+// take applies one request at now to a key whose theoretical arrival time is tat
+// It returns the key's new TAT, which is unchanged if the request is rejected
+func (l RateLimit) take(tat, now time.Time) (time.Time, RateLimitDecision) {
+	interval := l.interval()
+	burst := interval * time.Duration(l.Limit)
+
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+
+	// The request is allowed if it doesn't push the TAT more than a full burst ahead of now
+	allowAt := next.Add(-burst)
+	if now.Before(allowAt) {
+		return tat, RateLimitDecision{
+			Remaining:  0,
+			ResetAfter: tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}
+	}
+	return next, l.allowed(next, now)
+}
+
+// allowed returns the decision for a request allowed at now that moved the TAT to next
+func (l RateLimit) allowed(next, now time.Time) RateLimitDecision {
+	interval := l.interval()
+	allowAt := next.Add(-interval * time.Duration(l.Limit))
+	return RateLimitDecision{
+		Allowed:    true,
+		Remaining:  int(now.Sub(allowAt) / interval),
+		ResetAfter: next.Sub(now),
+	}
+}
+
+// RateLimitStore keeps the state of every rate limited key
+type RateLimitStore interface {
+	// Take counts one request for key under limit, unless it is over the limit
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitDecision, error)
+	// Purge forgets keys whose limits have fully reset by now
+	Purge(ctx context.Context, now time.Time) (int64, error)
+}
+
+// NewRateLimitStore returns the named store: "memory", or "postgres" to share limits between instances
+func NewRateLimitStore(name string, db *sql.DB, dialect Dialect) (RateLimitStore, error) {
+	switch strings.ToLower(name) {
+	case "", "memory":
+		return &memoryRateLimitStore{tats: make(map[string]time.Time)}, nil
+	case "postgres":
+		if dialect != DialectPostgres {
+			return nil, errors.New("the postgres rate limit store requires a PostgreSQL database")
+		}
+		return &postgresRateLimitStore{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", name)
+	}
+}
+
+// memoryRateLimitStore keeps limits in this process
+type memoryRateLimitStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+}
+
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tat, decision := limit.take(s.tats[key], now)
+	s.tats[key] = tat
+	return decision, nil
+}
+
+func (s *memoryRateLimitStore) Purge(_ context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for key, tat := range s.tats {
+		if !tat.After(now) {
+			delete(s.tats, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// postgresRateLimitStore keeps limits in the rate_limits table, shared by every instance
+type postgresRateLimitStore struct {
+	db *sql.DB
+}
+
+// postgresTakeQuery applies GCRA in one statement: $2 is now, $3 the interval and $4 the burst,
+// all in nanoseconds. The row lock taken by the upsert makes concurrent requests for a key
+// take turns. An allowed request returns the new TAT; a rejected one returns no row
+const postgresTakeQuery = `
+	INSERT INTO rate_limits AS r (key, tat) VALUES ($1, $2::BIGINT + $3::BIGINT)
+	ON CONFLICT (key) DO UPDATE SET tat = GREATEST(r.tat, $2::BIGINT) + $3::BIGINT
+	WHERE GREATEST(r.tat, $2::BIGINT) + $3::BIGINT - $4::BIGINT <= $2::BIGINT
+	RETURNING tat`
+
+// Take costs one statement for an allowed request. A rejected one reads the TAT again
+// to fill in the headers, without a lock: the TAT only moves forward, so the read can
+// only make Retry-After a little longer
+func (s *postgresRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitDecision, error) {
+	interval := limit.interval()
+	burst := interval * time.Duration(limit.Limit)
+
+	var next int64
+	err := s.db.QueryRowContext(ctx, postgresTakeQuery, key, now.UnixNano(), int64(interval), int64(burst)).Scan(&next)
+	if err == nil {
+		return limit.allowed(time.Unix(0, next), now), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return RateLimitDecision{}, fmt.Errorf("failed to take rate limit: %w", err)
+	}
+
+	var stored int64
+	if err := s.db.QueryRowContext(ctx, `SELECT tat FROM rate_limits WHERE key = $1`, key).Scan(&stored); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return RateLimitDecision{}, fmt.Errorf("failed to read rate limit: %w", err)
+	}
+	_, decision := limit.take(time.Unix(0, stored), now)
+	decision.Allowed, decision.Remaining = false, 0
+	return decision, nil
+}
+
+func (s *postgresRateLimitStore) Purge(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE tat <= $1`, now.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge rate limits: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// RateLimiter applies policies to requests and counts the rejections
+type RateLimiter struct {
+	store    RateLimitStore
+	failOpen *CounterVec // Requests let through because the store failed, by policy
+
+	mu       sync.Mutex
+	rejected map[string]int64 // By policy
+}
+
+// NewRateLimiter creates a rate limiter backed by store
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+	return &RateLimiter{store: store, failOpen: NewCounterVec("policy"), rejected: make(map[string]int64)}
+}
+
+// Purge forgets keys whose limits have reset; it runs as the purge_rate_limits task
+func (l *RateLimiter) Purge(ctx context.Context) error {
+	purged, err := l.store.Purge(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Purged idle rate limit keys", "purged", purged)
+	return nil
+}
+
+// RateLimitKey picks the key a request is counted against
+type RateLimitKey func(c *gin.Context) string
+
+// KeyByIP counts requests per client IP
+func KeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByUser counts requests per authenticated user, falling back to the client IP
+// It must run after AuthMiddleware
+func KeyByUser(c *gin.Context) string {
+	if userID, ok := c.Get("user_id"); ok {
+		return fmt.Sprintf("user:%v", userID)
+	}
+	return KeyByIP(c)
+}
+
+// RateLimitMiddleware rejects requests over policy with 429 Too Many Requests
+// Every response carries RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers; rejections also carry Retry-After
+func RateLimitMiddleware(limiter *RateLimiter, policy RateLimit, key RateLimitKey) gin.HandlerFunc {
+	if policy.Limit == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	policyHeader := fmt.Sprintf("%d;w=%d", policy.Limit, int(math.Ceil(policy.Period.Seconds())))
+
+	return func(c *gin.Context) {
+		decision, err := limiter.store.Take(c.Request.Context(), policy.Name+":"+key(c), policy, time.Now())
+		if err != nil {
+			// Fail open: an unavailable store shouldn't take the API down with it
+			limiter.failOpen.Inc(policy.Name)
+			slog.ErrorContext(c.Request.Context(), "Rate limit unavailable", "policy", policy.Name, "error", err)
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.ResetAfter)))
+		header.Set("RateLimit-Policy", policyHeader)
+
+		if !decision.Allowed {
+			limiter.count(policy.Name)
+			retryAfter := ceilSeconds(decision.RetryAfter)
+			header.Set("Retry-After", strconv.Itoa(retryAfter))
+			reject(c, &ErrRateLimited{RetryAfter: retryAfter})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds, for headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// count records a rejected request
+func (l *RateLimiter) count(policy string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rejected[policy]++
+}
+
+// RegisterRateLimitMetrics exposes the number of rejected and unchecked requests by policy
+func RegisterRateLimitMetrics(registry *Registry, limiter *RateLimiter) {
+	registry.CounterFunc("app_rate_limit_fail_open_total", "Requests let through unchecked because the rate limit store failed, by policy", limiter.failOpen.Samples)
+	registry.CounterFunc("app_rate_limited_total", "Requests rejected by a rate limit, by policy", func() []Sample {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+
+		samples := make([]Sample, 0, len(limiter.rejected))
+		for policy, value := range limiter.rejected {
+			samples = append(samples, Sample{Labels: Labels{"policy": policy}, Value: float64(value)})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Labels["policy"] < samples[j].Labels["policy"] })
+		return samples
+	})
+}
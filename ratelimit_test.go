@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{"10/1m", RateLimit{Name: "p", Limit: 10, Period: time.Minute}, false},
+		{" 5 / 30s ", RateLimit{Name: "p", Limit: 5, Period: 30 * time.Second}, false},
+		{"off", RateLimit{Name: "p"}, false},
+		{"0", RateLimit{Name: "p"}, false},
+		{"10", RateLimit{}, true},
+		{"-1/1m", RateLimit{}, true},
+		{"10/soon", RateLimit{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseRateLimit("p", tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseRateLimit(%q) = %+v, %v; want %+v, error %t", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimitTake(t *testing.T) {
+	limit := RateLimit{Name: "p", Limit: 3, Period: 3 * time.Second}
+	start := time.Unix(1000, 0)
+
+	// Each step is a request at start+at, applied to the TAT left by the previous one
+	steps := []struct {
+		at        time.Duration
+		allowed   bool
+		remaining int
+		reset     time.Duration
+		retry     time.Duration
+	}{
+		{0, true, 2, time.Second, 0},
+		{0, true, 1, 2 * time.Second, 0},
+		{0, true, 0, 3 * time.Second, 0},
+		{0, false, 0, 3 * time.Second, time.Second},
+		{500 * time.Millisecond, false, 0, 2500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, true, 0, 3 * time.Second, 0},
+		{10 * time.Second, true, 2, time.Second, 0}, // Idle long enough to refill completely
+	}
+
+	var tat time.Time
+	for i, step := range steps {
+		var decision RateLimitDecision
+		tat, decision = limit.take(tat, start.Add(step.at))
+
+		want := RateLimitDecision{Allowed: step.allowed, Remaining: step.remaining, ResetAfter: step.reset, RetryAfter: step.retry}
+		if decision != want {
+			t.Errorf("step %d: take() = %+v, want %+v", i, decision, want)
+		}
+	}
+}
+
+// failingRateLimitStore is a RateLimitStore that is always unavailable
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(context.Context, string, RateLimit, time.Time) (RateLimitDecision, error) {
+	return RateLimitDecision{}, errors.New("connection refused")
+}
+
+func (failingRateLimitStore) Purge(context.Context, time.Time) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	store, _ := NewRateLimitStore("memory", nil, DialectSQLite)
+	limiter := NewRateLimiter(store)
+
+	router := gin.New()
+	router.Use(ErrorMiddleware(), RateLimitMiddleware(limiter, RateLimit{Name: "auth", Limit: 2, Period: time.Minute}, KeyByIP))
+	router.GET("/test", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		status     int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+		header := w.Header()
+		if w.Code != tt.status || header.Get("RateLimit-Remaining") != tt.remaining || header.Get("RateLimit-Reset") != tt.reset ||
+			header.Get("Retry-After") != tt.retryAfter {
+			t.Errorf("request %d: status %d, remaining %q, reset %q, retry after %q; want %d, %q, %q, %q", i, w.Code,
+				header.Get("RateLimit-Remaining"), header.Get("RateLimit-Reset"), header.Get("Retry-After"),
+				tt.status, tt.remaining, tt.reset, tt.retryAfter)
+		}
+		if header.Get("RateLimit-Limit") != "2" || header.Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("request %d: limit %q, policy %q", i, header.Get("RateLimit-Limit"), header.Get("RateLimit-Policy"))
+		}
+	}
+}
+
+func TestRateLimitMiddlewareFailsOpen(t *testing.T) {
+	limiter := NewRateLimiter(failingRateLimitStore{})
+
+	router := gin.New()
+	router.Use(ErrorMiddleware(), RateLimitMiddleware(limiter, RateLimit{Name: "api", Limit: 1, Period: time.Minute}, KeyByIP))
+	router.GET("/test", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("request %d: status %d, RateLimit-Limit %q; want 200 without headers", i, w.Code, w.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	samples := limiter.failOpen.Samples()
+	if len(samples) != 1 || samples[0].Labels["policy"] != "api" || samples[0].Value != 2 {
+		t.Errorf("fail open samples = %+v, want 2 for api", samples)
+	}
+}
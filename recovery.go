@@ -0,0 +1,207 @@
+// recovery.go - Panic recovery and crash reports
+// A panic in a handler, job, scheduled task or background goroutine is recovered
+// instead of taking the process down. The panic and its stack are logged with the
+// context's request ID and log attributes, counted in app_panics_total and sent to
+// the configured ErrorReporter. HTTP requests get a problem+json 500 carrying the
+// request ID, so a user's report can be matched to the crash
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrorReportingConfig configures where crash reports are sent
+type ErrorReportingConfig struct {
+	Reporter string // none or file
+	FilePath string // File the file reporter appends to
+}
+
+// CrashReport describes one recovered panic
+// The fields follow Sentry's event format, so an adapter only has to copy them over
+type CrashReport struct {
+	EventID   string            `json:"event_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Source    string            `json:"source"` // Where the panic was recovered, e.g. "http" or "job"
+	Message   string            `json:"message"`
+	Stack     string            `json:"stacktrace"`
+	RequestID string            `json:"request_id,omitempty"`
+	UserID    *int              `json:"user_id,omitempty"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"` // The context's log attributes, e.g. job_id
+}
+
+// ErrorReporter receives crash reports
+// Its methods mirror sentry.Hub, so a Sentry client can be plugged in with a thin wrapper
+type ErrorReporter interface {
+	// CaptureException records a report; it is called on the goroutine that panicked, so it must not block for long
+	CaptureException(ctx context.Context, report *CrashReport)
+	// Flush waits up to timeout for buffered reports to be sent and reports whether they were
+	Flush(timeout time.Duration) bool
+}
+
+// errorReporter receives every crash report; it is set from ERROR_REPORTER at startup
+var errorReporter ErrorReporter = nopReporter{}
+
+// panics counts recovered panics by source
+var panics = NewCounterVec("source")
+
+// RegisterPanicMetrics exposes the number of recovered panics
+func RegisterPanicMetrics(registry *Registry) {
+	registry.CounterFunc("app_panics_total", "Recovered panics, by source", panics.Samples)
+}
+
+// NewErrorReporter creates the reporter named in config
+func NewErrorReporter(config ErrorReportingConfig) (ErrorReporter, error) {
+	switch strings.ToLower(config.Reporter) {
+	case "", "none":
+		return nopReporter{}, nil
+	case "file":
+		if config.FilePath == "" {
+			return nil, fmt.Errorf("file error reporter requires ERROR_REPORT_FILE")
+		}
+		return NewFileReporter(config.FilePath), nil
+	default:
+		return nil, fmt.Errorf("unknown error reporter %q", config.Reporter)
+	}
+}
+
+// nopReporter drops reports; panics are still logged
+type nopReporter struct{}
+
+func (nopReporter) CaptureException(context.Context, *CrashReport) {}
+
+func (nopReporter) Flush(time.Duration) bool { return true }
+
+// FileReporter appends reports to a file as newline delimited JSON, for local use
+type FileReporter struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileReporter creates a reporter that appends to path
+func NewFileReporter(path string) *FileReporter {
+	return &FileReporter{path: path}
+}
+
+func (r *FileReporter) CaptureException(ctx context.Context, report *CrashReport) {
+	line, err := json.Marshal(report)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode crash report", "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to write crash report", "error", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.ErrorContext(ctx, "Failed to write crash report", "error", err)
+	}
+}
+
+// Flush has nothing to do, since reports are written as they arrive
+func (r *FileReporter) Flush(time.Duration) bool { return true }
+
+// PanicError is a recovered panic returned as an error, so a job or task fails instead of crashing
+type PanicError struct {
+	Value   interface{}
+	EventID string // ID of the crash report
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// capturePanic logs and reports a recovered panic value and returns it as an error
+// It must be called from the deferred function that recovered, so the stack still shows where the panic happened
+func capturePanic(ctx context.Context, source string, value interface{}) *PanicError {
+	report := &CrashReport{
+		EventID:   newRequestID(),
+		Timestamp: time.Now().UTC(),
+		Source:    source,
+		Message:   fmt.Sprint(value),
+		Stack:     string(debug.Stack()),
+	}
+	info := requestInfoFrom(ctx)
+	report.RequestID = info.RequestID
+	report.UserID = info.ActorID
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		report.TraceID = span.TraceID().String()
+	}
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		report.Tags = make(map[string]string, len(attrs))
+		for _, attr := range attrs {
+			report.Tags[attr.Key] = attr.Value.String()
+		}
+	}
+
+	panics.Inc(source)
+	slog.ErrorContext(ctx, "Panic recovered", "source", source, "panic", report.Message,
+		"event_id", report.EventID, "stack", report.Stack)
+	errorReporter.CaptureException(ctx, report)
+
+	return &PanicError{Value: value, EventID: report.EventID}
+}
+
+// recoverPanic recovers a panic and reports it; use it as
+//
+//	defer recoverPanic(ctx, "outbox relay", &err)
+//
+// If errp is not nil, the panic is stored there as a *PanicError
+func recoverPanic(ctx context.Context, source string, errp *error) {
+	if value := recover(); value != nil {
+		err := capturePanic(ctx, source, value)
+		if errp != nil {
+			*errp = err
+		}
+	}
+}
+
+// RecoveryMiddleware turns a panic into a problem+json 500 carrying the request ID
+// It replaces gin.Recovery, which only prints the stack to stderr
+func RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			// Handlers panic with http.ErrAbortHandler to drop the connection on purpose
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+
+			ctx := withLogAttrs(c.Request.Context(),
+				slog.String("method", c.Request.Method),
+				slog.String("route", c.FullPath()),
+				slog.String("path", c.Request.URL.Path),
+			)
+			capturePanic(ctx, "http", value)
+
+			c.Abort()
+			if !c.Writer.Written() {
+				writeError(c, apiError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"})
+			}
+		}()
+
+		c.Next()
+	}
+}
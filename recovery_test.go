@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// capturingReporter keeps the crash reports it receives
+type capturingReporter struct {
+	mu      sync.Mutex
+	reports []*CrashReport
+}
+
+func (r *capturingReporter) CaptureException(_ context.Context, report *CrashReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reports = append(r.reports, report)
+}
+
+func (r *capturingReporter) Flush(time.Duration) bool { return true }
+
+// captureCrashReports sends crash reports to a capturingReporter for the rest of the test
+func captureCrashReports(t *testing.T) *capturingReporter {
+	t.Helper()
+
+	reporter := &capturingReporter{}
+	previous := errorReporter
+	errorReporter = reporter
+	t.Cleanup(func() { errorReporter = previous })
+	return reporter
+}
+
+// panicCount returns how many panics have been recovered from source
+func panicCount(source string) float64 {
+	for _, sample := range panics.Samples() {
+		if sample.Labels["source"] == source {
+			return sample.Value
+		}
+	}
+	return 0
+}
+
+func TestRecoveryMiddlewareAnswersPanicsWithAProblem(t *testing.T) {
+	reporter := captureCrashReports(t)
+	before := panicCount("http")
+
+	router := gin.New()
+	router.Use(RequestIDMiddleware(), ErrorMiddleware(), RecoveryMiddleware())
+	router.GET("/users/:id", func(c *gin.Context) {
+		var logins map[string]int
+		logins[c.Param("id")]++
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, mediaTypeProblemJSON) {
+		t.Errorf("Content-Type = %q, want %q", got, mediaTypeProblemJSON)
+	}
+	var problem ProblemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Status != http.StatusInternalServerError || problem.Code != "internal_error" || problem.RequestID != "req-123" {
+		t.Errorf("problem = %+v, want an internal_error 500 carrying request ID req-123", problem)
+	}
+	// The panic value is reported, never shown to the caller
+	if strings.Contains(w.Body.String(), "nil") {
+		t.Errorf("body = %s, leaks the panic", w.Body.String())
+	}
+
+	if len(reporter.reports) != 1 {
+		t.Fatalf("got %d crash reports, want 1", len(reporter.reports))
+	}
+	report := reporter.reports[0]
+	if report.Source != "http" || report.RequestID != "req-123" || report.EventID == "" {
+		t.Errorf("report = {Source: %q, RequestID: %q, EventID: %q}, want an http report for req-123", report.Source, report.RequestID, report.EventID)
+	}
+	if !strings.Contains(report.Message, "assignment to entry in nil map") {
+		t.Errorf("report Message = %q, want the panic value", report.Message)
+	}
+	if !strings.Contains(report.Stack, "TestRecoveryMiddlewareAnswersPanicsWithAProblem") {
+		t.Error("report Stack does not show where the panic happened")
+	}
+	if report.Tags["route"] != "/users/:id" || report.Tags["method"] != http.MethodGet {
+		t.Errorf("report Tags = %v, want the method and route", report.Tags)
+	}
+	if got, want := panicCount("http"), before+1; got != want {
+		t.Errorf("app_panics_total{source=http} = %v, want %v", got, want)
+	}
+}
+
+func TestRecoveryMiddlewareKeepsAWrittenResponse(t *testing.T) {
+	reporter := captureCrashReports(t)
+
+	router := gin.New()
+	router.Use(RecoveryMiddleware())
+	router.GET("/stream", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		panic("connection reset")
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+
+	// Headers have gone out, so the status can't change and nothing more is written
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("response = %d %q, want the handler's 200 %q untouched", w.Code, w.Body.String(), "partial")
+	}
+	if len(reporter.reports) != 1 {
+		t.Errorf("got %d crash reports, want 1", len(reporter.reports))
+	}
+}
+
+func TestRecoveryMiddlewareRepanicsAbortHandler(t *testing.T) {
+	reporter := captureCrashReports(t)
+
+	router := gin.New()
+	router.Use(RecoveryMiddleware())
+	router.GET("/abort", func(c *gin.Context) {
+		panic(http.ErrAbortHandler)
+	})
+
+	defer func() {
+		if value := recover(); value != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler to reach the server", value)
+		}
+		if len(reporter.reports) != 0 {
+			t.Errorf("got %d crash reports, want none for a deliberate abort", len(reporter.reports))
+		}
+	}()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+}
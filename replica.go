@@ -0,0 +1,299 @@
+// replica.go - Read replica routing
+// Reads that can tolerate replication lag are spread across healthy replicas.
+// Writes always go to the primary, and a request that wrote (or whose client
+// wrote within the sticky window) keeps reading from the primary so users
+// always see their own changes. The sticky window travels in a cookie, so it
+// holds whichever instance the client's next request lands on
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replica is a read-only database connection with its last known health
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaSet routes reads between the primary and its replicas
+type ReplicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     atomic.Uint64
+
+	stickyWindow time.Duration // How long a client's reads stay on the primary after it writes
+}
+
+// stickyCookie holds the Unix time in milliseconds until which a client reads from the primary
+const stickyCookie = "read_primary_until"
+
+// routingKey is the context key for per-request routing state
+type routingKey struct{}
+
+// requestRouting tracks routing decisions for a single request
+type requestRouting struct {
+	sticky atomic.Bool // Reads must use the primary
+	wrote  atomic.Bool // The request wrote to the primary
+}
+
+// NewReplicaSet connects to every replica URL
+// Replicas that can't be reached are kept but marked unhealthy until a health check succeeds
+func NewReplicaSet(primary *sql.DB, dialect Dialect, urls []string, pool PoolConfig, stickyWindow time.Duration) (*ReplicaSet, error) {
+	rs := &ReplicaSet{
+		primary:      primary,
+		stickyWindow: stickyWindow,
+	}
+
+	if len(urls) > 0 && dialect != DialectPostgres {
+		slog.Warn("Ignoring read replicas: replicas are only supported with PostgreSQL", "replicas", len(urls))
+		return rs, nil
+	}
+
+	for i, url := range urls {
+		_, dsn := ParseDatabaseURL(url)
+		db, err := sql.Open(string(dialect), dsn)
+		if err != nil {
+			rs.Close()
+			return nil, err
+		}
+		configurePool(db, dialect, pool)
+
+		r := &replica{name: replicaName(i), db: db}
+		r.healthy.Store(db.Ping() == nil)
+		if !r.healthy.Load() {
+			slog.Warn("Read replica is unreachable, reads will skip it until it recovers", "replica", r.name)
+		}
+		rs.replicas = append(rs.replicas, r)
+	}
+
+	if len(rs.replicas) > 0 {
+		slog.Info("Routing reads across read replicas", "replicas", len(rs.replicas))
+	}
+	return rs, nil
+}
+
+// replicaName returns a log friendly name that doesn't expose credentials
+func replicaName(index int) string {
+	return fmt.Sprintf("replica-%d", index+1)
+}
+
+// Reader returns the database a read should use
+// It falls back to the primary when the request is sticky or no replica is healthy
+func (rs *ReplicaSet) Reader(ctx context.Context) *sql.DB {
+	if len(rs.replicas) == 0 {
+		return rs.primary
+	}
+	if routing, ok := ctx.Value(routingKey{}).(*requestRouting); ok && routing.sticky.Load() {
+		return rs.primary
+	}
+
+	// Round-robin over healthy replicas
+	n := uint64(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return rs.primary
+}
+
+// MarkWrite records that the request wrote to the primary
+// Later reads in the same request are sent to the primary as well
+func MarkWrite(ctx context.Context) {
+	if routing, ok := ctx.Value(routingKey{}).(*requestRouting); ok {
+		routing.wrote.Store(true)
+		routing.sticky.Store(true)
+	}
+}
+
+// withRouting attaches fresh routing state to ctx
+func withRouting(ctx context.Context, sticky bool) context.Context {
+	routing := &requestRouting{}
+	routing.sticky.Store(sticky)
+	return context.WithValue(ctx, routingKey{}, routing)
+}
+
+// StartHealthChecks pings every replica on the given interval until ctx is cancelled
+func (rs *ReplicaSet) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if rs == nil || len(rs.replicas) == 0 {
+		return
+	}
+
+	go func() {
+		defer recoverPanic(ctx, "replica health checks", nil)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+// checkHealth pings each replica and logs health changes
+func (rs *ReplicaSet) checkHealth(ctx context.Context) {
+	for _, r := range rs.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		healthy := r.db.PingContext(pingCtx) == nil
+		cancel()
+
+		if was := r.healthy.Swap(healthy); was != healthy {
+			if healthy {
+				slog.Info("Read replica recovered", "replica", r.name)
+			} else {
+				slog.Warn("Read replica is unhealthy, routing its reads elsewhere", "replica", r.name)
+			}
+		}
+	}
+}
+
+// PoolStats returns connection pool statistics for the primary and every replica
+func (rs *ReplicaSet) PoolStats() []PoolStats {
+	stats := []PoolStats{newPoolStats("primary", true, rs.primary.Stats())}
+	for _, r := range rs.replicas {
+		stats = append(stats, newPoolStats(r.name, r.healthy.Load(), r.db.Stats()))
+	}
+	return stats
+}
+
+// ReplicaHealthCheck warns while any replica is unhealthy; reads then fall back
+// to the primary, so the instance can still serve
+func ReplicaHealthCheck(rs *ReplicaSet) HealthChecker {
+	return HealthCheckerFunc(func(context.Context) HealthResult {
+		var unhealthy []string
+		for _, r := range rs.replicas {
+			if !r.healthy.Load() {
+				unhealthy = append(unhealthy, r.name)
+			}
+		}
+
+		details := map[string]interface{}{"replicas": len(rs.replicas)}
+		if len(unhealthy) > 0 {
+			details["unhealthy"] = unhealthy
+			return HealthResult{Status: HealthWarn, Message: "some replicas are unhealthy", Details: details}
+		}
+		return HealthResult{Status: HealthPass, Details: details}
+	})
+}
+
+// Close closes all replica connections (the primary is owned by the caller)
+func (rs *ReplicaSet) Close() {
+	if rs == nil {
+		return
+	}
+	for _, r := range rs.replicas {
+		r.db.Close()
+	}
+}
+
+// ReadYourWritesMiddleware keeps a client's reads on the primary for the sticky
+// window after it writes. A request that writes gets a cookie holding the end of
+// the window; requests that bring it back before then read from the primary
+func ReadYourWritesMiddleware(rs *ReplicaSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rs == nil || len(rs.replicas) == 0 {
+			c.Next()
+			return
+		}
+
+		ctx := withRouting(c.Request.Context(), rs.stickyUntil(c).After(time.Now()))
+		c.Request = c.Request.WithContext(ctx)
+		routing := ctx.Value(routingKey{}).(*requestRouting)
+
+		// The cookie has to be set before the response headers are sent, which
+		// usually happens before the handler returns
+		writer := &stickyWriter{ResponseWriter: c.Writer, routing: routing, window: rs.stickyWindow}
+		c.Writer = writer
+
+		c.Next()
+
+		if !writer.Written() {
+			writer.setCookie()
+		}
+	}
+}
+
+// stickyUntil returns the end of the sticky window in the request's cookie
+// Windows longer than the configured one are ignored, so a forged cookie can't pin a client to the primary
+func (rs *ReplicaSet) stickyUntil(c *gin.Context) time.Time {
+	value, err := c.Cookie(stickyCookie)
+	if err != nil {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	until := time.UnixMilli(ms)
+	if until.After(time.Now().Add(rs.stickyWindow)) {
+		return time.Time{}
+	}
+	return until
+}
+
+// stickyWriter adds the sticky cookie to the response of a request that wrote
+type stickyWriter struct {
+	gin.ResponseWriter
+	routing *requestRouting
+	window  time.Duration
+	set     bool
+}
+
+// setCookie adds the cookie once, if the request wrote and the headers haven't been sent
+func (w *stickyWriter) setCookie() {
+	if w.set || !w.routing.wrote.Load() {
+		return
+	}
+	w.set = true
+
+	until := time.Now().Add(w.window)
+	http.SetCookie(w.ResponseWriter, &http.Cookie{
+		Name:     stickyCookie,
+		Value:    strconv.FormatInt(until.UnixMilli(), 10),
+		Path:     "/",
+		Expires:  until,
+		MaxAge:   int(w.window.Seconds()) + 1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (w *stickyWriter) WriteHeaderNow() {
+	w.setCookie()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *stickyWriter) Write(data []byte) (int, error) {
+	w.setCookie()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *stickyWriter) WriteString(s string) (int, error) {
+	w.setCookie()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *stickyWriter) Flush() {
+	w.setCookie()
+	w.ResponseWriter.Flush()
+}
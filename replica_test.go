@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadYourWritesMiddleware(t *testing.T) {
+	primary, _ := sql.Open("sqlite", ":memory:")
+	replicaDB, _ := sql.Open("sqlite", ":memory:")
+	defer primary.Close()
+	defer replicaDB.Close()
+
+	r := &replica{name: "replica-1", db: replicaDB}
+	r.healthy.Store(true)
+	rs := &ReplicaSet{primary: primary, replicas: []*replica{r}, stickyWindow: 5 * time.Second}
+
+	router := gin.New()
+	router.Use(ReadYourWritesMiddleware(rs))
+	router.POST("/write", func(c *gin.Context) {
+		MarkWrite(c.Request.Context())
+		c.JSON(http.StatusCreated, gin.H{"ok": true})
+	})
+	router.DELETE("/write", func(c *gin.Context) {
+		MarkWrite(c.Request.Context())
+		c.Status(http.StatusNoContent)
+	})
+	router.GET("/read", func(c *gin.Context) {
+		if rs.Reader(c.Request.Context()) == primary {
+			c.String(http.StatusOK, "primary")
+		} else {
+			c.String(http.StatusOK, "replica")
+		}
+	})
+
+	read := func(cookie *http.Cookie) string {
+		req := httptest.NewRequest(http.MethodGet, "/read", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("a read set the sticky cookie")
+		}
+		return w.Body.String()
+	}
+
+	if got := read(nil); got != "replica" {
+		t.Errorf("read without cookie went to the %s", got)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/write", nil))
+
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == stickyCookie {
+				cookie = c
+			}
+		}
+		if cookie == nil {
+			t.Fatalf("%s that wrote set no sticky cookie", method)
+		}
+		if got := read(cookie); got != "primary" {
+			t.Errorf("read after %s went to the %s", method, got)
+		}
+	}
+
+	expired := &http.Cookie{Name: stickyCookie, Value: strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)}
+	if got := read(expired); got != "replica" {
+		t.Errorf("read with an expired cookie went to the %s", got)
+	}
+	forged := &http.Cookie{Name: stickyCookie, Value: strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)}
+	if got := read(forged); got != "replica" {
+		t.Errorf("read with a cookie past the sticky window went to the %s", got)
+	}
+}
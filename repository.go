@@ -3,8 +3,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -12,27 +17,133 @@ import (
 // Using interfaces makes our code more testable and maintainable
 type Repository interface {
 	// User operations
-	CreateUser(user *User) error
-	GetUserByID(id int) (*User, error)
-	GetUserByEmail(email string) (*User, error)
-	GetUsers(limit, offset int) ([]*User, error)
-	UpdateUser(id int, updates map[string]interface{}) error
-	DeleteUser(id int) error
-	GetUserCount() (int, error)
+	CreateUser(ctx context.Context, user *User) error
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUsers(ctx context.Context, limit, offset int) ([]*User, error)
+	UpdateUser(ctx context.Context, id int, updates map[string]interface{}) error
+	DeleteUser(ctx context.Context, id int) error // Soft delete; PurgeDeletedUsers removes the row
+	GetUserCount(ctx context.Context) (int, error)
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error)
+
+	// Outbox operations (events written alongside the change that caused them)
+	AddOutboxEvent(ctx context.Context, event *OutboxEvent) error
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error)
+	MarkOutboxDispatched(ctx context.Context, id int64) error
+	MarkOutboxFailed(ctx context.Context, id int64, lastError string, retryAt time.Time, deliveredSinks []string) error
+	ListOutboxEvents(ctx context.Context, afterID int64, limit int) ([]*OutboxEvent, error)
+	LastOutboxEventID(ctx context.Context) (int64, error)
+
+	// Job queue operations
+	EnqueueJob(ctx context.Context, job *Job) error
+	ClaimJob(ctx context.Context, visibilityTimeout time.Duration) (*Job, error)
+	CompleteJob(ctx context.Context, id int64, attempt int) error
+	FailJob(ctx context.Context, id int64, attempt int, lastError string, retryAt *time.Time) error
+	CountJobs(ctx context.Context, state JobState) (int, error)
+	CountJobsByKind(ctx context.Context, state JobState) (map[JobKind]int, error)
+	GetJob(ctx context.Context, id int64) (*Job, error)
+	ListJobs(ctx context.Context, filter JobFilter) ([]*Job, error)
+	RetryJob(ctx context.Context, id int64) (*Job, error)
+	CancelJob(ctx context.Context, id int64) (*Job, error)
+	PurgeFinishedJobs(ctx context.Context, before time.Time) (int64, error)
+
+	// Outbox maintenance
+	PurgeDispatchedOutbox(ctx context.Context, before time.Time) (int64, error)
+
+	// Scheduler run history
+	CreateScheduledRun(ctx context.Context, run *ScheduledRun) error
+	FinishScheduledRun(ctx context.Context, id int64, status, runError string) error
+	ScheduledRunExists(ctx context.Context, task string, scheduledAt time.Time) (bool, error)
+	ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error)
+
+	// Webhook subscriptions and their delivery log
+	CreateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error
+	GetWebhookSubscription(ctx context.Context, id int64) (*WebhookSubscription, error)
+	ListWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error)
+	UpdateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error
+	DeleteWebhookSubscription(ctx context.Context, id int64) error
+	CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, id int64) (*WebhookDelivery, error)
+	UpdateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	ListWebhookDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]*WebhookDelivery, error)
+
+	// Audit log (append-only and hash-chained)
+	AppendAuditEvent(ctx context.Context, event *AuditEvent) error
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error)
+
+	// Idempotency-Key records
+	ClaimIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error
+	ReleaseIdempotencyKey(ctx context.Context, scope, key string) error
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+
+	// JWT signing keys
+	AddSigningKey(ctx context.Context, key *SigningKey) error
+	ListSigningKeys(ctx context.Context) ([]*SigningKey, error)
+	PurgeSigningKeys(ctx context.Context, before time.Time) (int64, error)
+
+	// WithTx runs fn with a Repository bound to a single transaction
+	// The transaction commits if fn returns nil and rolls back otherwise
+	WithTx(ctx context.Context, fn func(tx Repository) error) error
+}
+
+// querier is the part of *sql.DB and *sql.Tx the repository uses
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // repository implements the Repository interface
 type repository struct {
-	db *sql.DB
+	db       querier     // Primary (or the open transaction), used for writes and read-your-writes lookups
+	pool     *sql.DB     // Primary connection pool, used to begin transactions
+	dialect  Dialect     // Selects dialect specific SQL where the backends differ
+	replicas *ReplicaSet // Optional, used for reads that tolerate replication lag
+	inTx     bool        // True for repositories handed out by WithTx
 }
 
 // NewRepository creates a new repository instance
-func NewRepository(db *sql.DB) Repository {
-	return &repository{db: db}
+// replicas may be nil, in which case every query goes to db
+func NewRepository(db *sql.DB, dialect Dialect, replicas *ReplicaSet) Repository {
+	return &repository{db: logQueries(bindUTC(db, dialect), dialect), pool: db, dialect: dialect, replicas: replicas}
+}
+
+// reader returns the database to use for lag tolerant reads
+// Inside a transaction every read must see the transaction's own writes
+func (r *repository) reader(ctx context.Context) querier {
+	if r.replicas == nil || r.inTx {
+		return r.db
+	}
+	return logQueries(bindUTC(r.replicas.Reader(ctx), r.dialect), r.dialect)
+}
+
+// WithTx runs fn inside a database transaction
+// Nested calls reuse the transaction that is already open
+func (r *repository) WithTx(ctx context.Context, fn func(tx Repository) error) error {
+	if r.inTx {
+		return fn(r)
+	}
+
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	txRepo := &repository{db: logQueries(bindUTC(tx, r.dialect), r.dialect), pool: r.pool, dialect: r.dialect, replicas: r.replicas, inTx: true}
+	if err := fn(txRepo); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
 }
 
 // CreateUser creates a new user in the database
-func (r *repository) CreateUser(user *User) error {
+func (r *repository) CreateUser(ctx context.Context, user *User) error {
 	// SQL query to insert a new user
 	query := `
 		INSERT INTO users (username, email, password, created_at, updated_at)
@@ -40,7 +151,8 @@ func (r *repository) CreateUser(user *User) error {
 		RETURNING id, created_at, updated_at`
 
 	// Execute the query and scan the returned values
-	err := r.db.QueryRow(
+	err := r.db.QueryRowContext(
+		ctx,
 		query,
 		user.Username,
 		user.Email,
@@ -50,22 +162,24 @@ func (r *repository) CreateUser(user *User) error {
 	).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
+		return fmt.Errorf("failed to create user: %w", mapDBError(err))
 	}
 
+	MarkWrite(ctx)
 	return nil
 }
 
 // GetUserByID retrieves a user by their ID
-func (r *repository) GetUserByID(id int) (*User, error) {
+// It may be served by a replica unless the request has written
+func (r *repository) GetUserByID(ctx context.Context, id int) (*User, error) {
 	user := &User{}
 
 	query := `
 		SELECT id, username, email, password, created_at, updated_at
 		FROM users
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`
 
-	err := r.db.QueryRow(query, id).Scan(
+	err := r.reader(ctx).QueryRowContext(ctx, query, id).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
@@ -75,8 +189,8 @@ func (r *repository) GetUserByID(id int) (*User, error) {
 	)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound("user")
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -85,15 +199,16 @@ func (r *repository) GetUserByID(id int) (*User, error) {
 }
 
 // GetUserByEmail retrieves a user by their email address
-func (r *repository) GetUserByEmail(email string) (*User, error) {
+// Always served by the primary: it backs uniqueness checks and login
+func (r *repository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	user := &User{}
 
 	query := `
 		SELECT id, username, email, password, created_at, updated_at
 		FROM users
-		WHERE email = $1`
+		WHERE email = $1 AND deleted_at IS NULL`
 
-	err := r.db.QueryRow(query, email).Scan(
+	err := r.db.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
@@ -103,8 +218,8 @@ func (r *repository) GetUserByEmail(email string) (*User, error) {
 	)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound("user")
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -113,15 +228,16 @@ func (r *repository) GetUserByEmail(email string) (*User, error) {
 }
 
 // GetUsers retrieves a list of users with pagination
-func (r *repository) GetUsers(limit, offset int) ([]*User, error) {
+func (r *repository) GetUsers(ctx context.Context, limit, offset int) ([]*User, error) {
 	query := `
 		SELECT id, username, email, password, created_at, updated_at
 		FROM users
+		WHERE deleted_at IS NULL
 		ORDER BY created_at DESC
 		LIMIT $1 OFFSET $2`
 
 	// Execute query
-	rows, err := r.db.Query(query, limit, offset)
+	rows, err := r.reader(ctx).QueryContext(ctx, query, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get users: %w", err)
 	}
@@ -155,7 +271,7 @@ func (r *repository) GetUsers(limit, offset int) ([]*User, error) {
 }
 
 // UpdateUser updates a user's information
-func (r *repository) UpdateUser(id int, updates map[string]interface{}) error {
+func (r *repository) UpdateUser(ctx context.Context, id int, updates map[string]interface{}) error {
 	// Build dynamic query based on which fields are being updated
 	setParts := []string{}
 	args := []interface{}{}
@@ -180,15 +296,15 @@ func (r *repository) UpdateUser(id int, updates map[string]interface{}) error {
 	query := fmt.Sprintf(`
 		UPDATE users
 		SET %s
-		WHERE id = $%d`,
+		WHERE id = $%d AND deleted_at IS NULL`,
 		joinStrings(setParts, ", "),
 		argIndex,
 	)
 
 	// Execute update
-	result, err := r.db.Exec(query, args...)
+	result, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
+		return fmt.Errorf("failed to update user: %w", mapDBError(err))
 	}
 
 	// Check if any rows were affected
@@ -198,17 +314,18 @@ func (r *repository) UpdateUser(id int, updates map[string]interface{}) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("user not found")
+		return notFound("user")
 	}
 
+	MarkWrite(ctx)
 	return nil
 }
 
-// DeleteUser deletes a user from the database
-func (r *repository) DeleteUser(id int) error {
-	query := `DELETE FROM users WHERE id = $1`
+// DeleteUser soft-deletes a user; it is hidden at once and removed by PurgeDeletedUsers
+func (r *repository) DeleteUser(ctx context.Context, id int) error {
+	query := `UPDATE users SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
 
-	result, err := r.db.Exec(query, id)
+	result, err := r.db.ExecContext(ctx, query, time.Now(), id)
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
@@ -220,18 +337,19 @@ func (r *repository) DeleteUser(id int) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("user not found")
+		return notFound("user")
 	}
 
+	MarkWrite(ctx)
 	return nil
 }
 
 // GetUserCount returns the total number of users
-func (r *repository) GetUserCount() (int, error) {
+func (r *repository) GetUserCount(ctx context.Context) (int, error) {
 	var count int
-	query := `SELECT COUNT(*) FROM users`
+	query := `SELECT COUNT(*) FROM users WHERE deleted_at IS NULL`
 
-	err := r.db.QueryRow(query).Scan(&count)
+	err := r.reader(ctx).QueryRowContext(ctx, query).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get user count: %w", err)
 	}
@@ -239,6 +357,1227 @@ func (r *repository) GetUserCount() (int, error) {
 	return count, nil
 }
 
+// PurgeDeletedUsers removes the users soft-deleted before the given time
+func (r *repository) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM users WHERE deleted_at < $1`
+
+	result, err := r.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// AddOutboxEvent stores an event to be delivered by the outbox relay
+// Call it through WithTx so the event commits together with the change it describes
+func (r *repository) AddOutboxEvent(ctx context.Context, event *OutboxEvent) error {
+	query := `
+		INSERT INTO outbox (event_type, aggregate_type, aggregate_id, payload, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		event.EventType,
+		event.AggregateType,
+		event.AggregateID,
+		string(event.Payload),
+		time.Now(),
+	).Scan(&event.ID, &event.CreatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to add outbox event: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimOutboxEvents leases up to limit undelivered events, oldest first
+// Leased events are hidden from other relays until the lease expires, so an event
+// whose relay crashed mid-delivery is picked up again (at-least-once delivery)
+func (r *repository) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	now := time.Now()
+	query := fmt.Sprintf(`
+		UPDATE outbox
+		SET locked_until = $1, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE dispatched_at IS NULL AND (locked_until IS NULL OR locked_until < $2)
+			ORDER BY id
+			LIMIT $3
+			%s
+		)
+		RETURNING id, event_type, aggregate_type, aggregate_id, payload, created_at, attempts, delivered_sinks`, r.skipLocked())
+
+	rows, err := r.db.QueryContext(ctx, query, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*OutboxEvent
+	for rows.Next() {
+		event := &OutboxEvent{}
+		var payload []byte
+		var deliveredSinks string
+		err := rows.Scan(
+			&event.ID,
+			&event.EventType,
+			&event.AggregateType,
+			&event.AggregateID,
+			&payload,
+			&event.CreatedAt,
+			&event.Attempts,
+			&deliveredSinks,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		event.Payload = payload
+		if deliveredSinks != "" {
+			event.DeliveredSinks = strings.Split(deliveredSinks, ",")
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbox events: %w", err)
+	}
+
+	// RETURNING doesn't guarantee order
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// MarkOutboxDispatched records that an event was delivered to every sink
+func (r *repository) MarkOutboxDispatched(ctx context.Context, id int64) error {
+	query := `UPDATE outbox SET dispatched_at = $1, locked_until = NULL, last_error = NULL WHERE id = $2`
+
+	if _, err := r.db.ExecContext(ctx, query, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to mark outbox event dispatched: %w", err)
+	}
+	return nil
+}
+
+// MarkOutboxFailed records a failed delivery; the event is retried after retryAt
+// deliveredSinks are the sinks that have received the event, which the retry skips
+func (r *repository) MarkOutboxFailed(ctx context.Context, id int64, lastError string, retryAt time.Time, deliveredSinks []string) error {
+	query := `UPDATE outbox SET last_error = $1, locked_until = $2, delivered_sinks = $3 WHERE id = $4`
+
+	if _, err := r.db.ExecContext(ctx, query, lastError, retryAt, strings.Join(deliveredSinks, ","), id); err != nil {
+		return fmt.Errorf("failed to mark outbox event failed: %w", err)
+	}
+	return nil
+}
+
+// ListOutboxEvents returns up to limit events with an ID above afterID, in ID order, whatever their delivery state
+// It reads from the primary, so every instance can tail the outbox as soon as events commit
+func (r *repository) ListOutboxEvents(ctx context.Context, afterID int64, limit int) ([]*OutboxEvent, error) {
+	query := `
+		SELECT id, event_type, aggregate_type, aggregate_id, payload, created_at
+		FROM outbox
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	rows, err := r.db.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*OutboxEvent
+	for rows.Next() {
+		event := &OutboxEvent{}
+		var payload []byte
+		err := rows.Scan(&event.ID, &event.EventType, &event.AggregateType, &event.AggregateID, &payload, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbox events: %w", err)
+	}
+	return events, nil
+}
+
+// LastOutboxEventID returns the highest outbox event ID, or 0 if the outbox is empty
+func (r *repository) LastOutboxEventID(ctx context.Context) (int64, error) {
+	query := `SELECT COALESCE(MAX(id), 0) FROM outbox`
+
+	var id int64
+	if err := r.db.QueryRowContext(ctx, query).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get last outbox event ID: %w", err)
+	}
+	return id, nil
+}
+
+// skipLocked returns the row locking clause for claim queries
+// Postgres needs SKIP LOCKED so concurrent workers claim different rows;
+// SQLite serializes writers so the plain subquery is already safe
+func (r *repository) skipLocked() string {
+	if r.dialect == DialectPostgres {
+		return "FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+// jobColumns is the column list shared by the job queries
+const jobColumns = `id, kind, payload, user_id, state, attempts, max_attempts, run_at, last_error, created_at, updated_at, finished_at, request_id, trace_parent`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJob reads a row selected with jobColumns
+func scanJob(row rowScanner) (*Job, error) {
+	job := &Job{}
+	var payload []byte
+	var userID sql.NullInt64
+	var lastError sql.NullString
+	var finishedAt sql.NullTime
+	var requestID sql.NullString
+	var traceParent sql.NullString
+
+	err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&payload,
+		&userID,
+		&job.State,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&lastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&finishedAt,
+		&requestID,
+		&traceParent,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = payload
+	job.RequestID = requestID.String
+	job.TraceParent = traceParent.String
+	if userID.Valid {
+		id := int(userID.Int64)
+		job.UserID = &id
+	}
+	job.LastError = lastError.String
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+// EnqueueJob stores a new pending job and fills in its ID and timestamps
+// Call it through WithTx to enqueue the job only if the surrounding change commits
+func (r *repository) EnqueueJob(ctx context.Context, job *Job) error {
+	query := `
+		INSERT INTO jobs (kind, payload, user_id, state, max_attempts, run_at, created_at, updated_at, request_id, trace_parent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9)
+		RETURNING id, created_at, updated_at`
+
+	var requestID, traceParent interface{}
+	if job.RequestID != "" {
+		requestID = job.RequestID
+	}
+	if job.TraceParent != "" {
+		traceParent = job.TraceParent
+	}
+
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		job.Kind,
+		string(job.Payload),
+		job.UserID,
+		JobPending,
+		job.MaxAttempts,
+		job.RunAt,
+		time.Now(),
+		requestID,
+		traceParent,
+	).Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to enqueue %s job: %w", job.Kind, err)
+	}
+
+	job.State = JobPending
+	return nil
+}
+
+// ClaimJob leases the next job that is due and returns it, or nil if there is none
+// Running jobs whose lease has expired (their worker crashed) are claimed again
+func (r *repository) ClaimJob(ctx context.Context, visibilityTimeout time.Duration) (*Job, error) {
+	now := time.Now()
+	query := fmt.Sprintf(`
+		UPDATE jobs
+		SET state = $1, attempts = attempts + 1, locked_until = $2, updated_at = $3
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (state = $4 AND run_at <= $3) OR (state = $1 AND locked_until < $3)
+			ORDER BY run_at, id
+			LIMIT 1
+			%s
+		)
+		RETURNING %s`, r.skipLocked(), jobColumns)
+
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, JobRunning, now.Add(visibilityTimeout), now, JobPending))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to claim job: %w", err)
+	}
+
+	return job, nil
+}
+
+// CompleteJob marks a running job as succeeded, if attempt still holds its lease
+// It returns ErrJobLeaseLost for jobs that were cancelled, or leased again after
+// the attempt's lease expired
+func (r *repository) CompleteJob(ctx context.Context, id int64, attempt int) error {
+	query := `
+		UPDATE jobs
+		SET state = $1, locked_until = NULL, last_error = NULL, updated_at = $2, finished_at = $2
+		WHERE id = $3 AND state = $4 AND attempts = $5`
+
+	result, err := r.db.ExecContext(ctx, query, JobSucceeded, time.Now(), id, JobRunning, attempt)
+	if err != nil {
+		return fmt.Errorf("failed to complete job %d: %w", id, err)
+	}
+	return leaseHeld(result)
+}
+
+// FailJob records a failed attempt of a running job, if attempt still holds its lease
+// The job runs again at retryAt, or is dead-lettered when retryAt is nil.
+// It returns ErrJobLeaseLost like CompleteJob
+func (r *repository) FailJob(ctx context.Context, id int64, attempt int, lastError string, retryAt *time.Time) error {
+	now := time.Now()
+
+	var result sql.Result
+	var err error
+	if retryAt != nil {
+		query := `
+			UPDATE jobs
+			SET state = $1, run_at = $2, locked_until = NULL, last_error = $3, updated_at = $4
+			WHERE id = $5 AND state = $6 AND attempts = $7`
+		result, err = r.db.ExecContext(ctx, query, JobPending, *retryAt, lastError, now, id, JobRunning, attempt)
+	} else {
+		query := `
+			UPDATE jobs
+			SET state = $1, locked_until = NULL, last_error = $2, updated_at = $3, finished_at = $3
+			WHERE id = $4 AND state = $5 AND attempts = $6`
+		result, err = r.db.ExecContext(ctx, query, JobDead, lastError, now, id, JobRunning, attempt)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to record failure of job %d: %w", id, err)
+	}
+	return leaseHeld(result)
+}
+
+// leaseHeld returns ErrJobLeaseLost when the update of a job attempt's outcome matched no row
+func leaseHeld(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check job update: %w", err)
+	}
+	if rows == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
+
+// CountJobs returns the number of jobs in the given state
+func (r *repository) CountJobs(ctx context.Context, state JobState) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM jobs WHERE state = $1`
+
+	if err := r.db.QueryRowContext(ctx, query, state).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count %s jobs: %w", state, err)
+	}
+	return count, nil
+}
+
+// CountJobsByKind returns the number of jobs of each kind in the given state
+func (r *repository) CountJobsByKind(ctx context.Context, state JobState) (map[JobKind]int, error) {
+	query := `SELECT kind, COUNT(*) FROM jobs WHERE state = $1 GROUP BY kind`
+
+	rows, err := r.db.QueryContext(ctx, query, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count %s jobs: %w", state, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[JobKind]int)
+	for rows.Next() {
+		var kind JobKind
+		var count int
+		if err := rows.Scan(&kind, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan job count: %w", err)
+		}
+		counts[kind] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count %s jobs: %w", state, err)
+	}
+	return counts, nil
+}
+
+// GetJob retrieves a job by its ID
+func (r *repository) GetJob(ctx context.Context, id int64) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = $1`
+
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound("job")
+		}
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+
+	return job, nil
+}
+
+// ListJobs retrieves a page of jobs matching filter, newest first
+func (r *repository) ListJobs(ctx context.Context, filter JobFilter) ([]*Job, error) {
+	var where string
+	var args []interface{}
+	switch filter.State {
+	case "":
+		where = "1 = 1"
+	case JobFailed:
+		where = "(state = $1 OR (state = $2 AND last_error IS NOT NULL))"
+		args = append(args, JobDead, JobPending)
+	default:
+		where = "state = $1"
+		args = append(args, filter.State)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM jobs WHERE %s ORDER BY id DESC LIMIT $%d OFFSET $%d`,
+		jobColumns, where, len(args)+1, len(args)+2)
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating jobs: %w", err)
+	}
+
+	return jobs, nil
+}
+
+// RetryJob queues a dead, cancelled or retry-waiting job to run now with a fresh set of attempts
+func (r *repository) RetryJob(ctx context.Context, id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET state = $1, attempts = 0, run_at = $2, locked_until = NULL, updated_at = $2, finished_at = NULL
+		WHERE id = $3 AND (state IN ($4, $5) OR (state = $1 AND last_error IS NOT NULL))
+		RETURNING ` + jobColumns
+
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, JobPending, time.Now(), id, JobDead, JobCancelled))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, r.jobStateError(ctx, id, "retry")
+		}
+		return nil, fmt.Errorf("failed to retry job: %w", err)
+	}
+
+	return job, nil
+}
+
+// CancelJob stops a pending or running job from running (again)
+func (r *repository) CancelJob(ctx context.Context, id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET state = $1, locked_until = NULL, updated_at = $2, finished_at = $2
+		WHERE id = $3 AND state IN ($4, $5)
+		RETURNING ` + jobColumns
+
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, JobCancelled, time.Now(), id, JobPending, JobRunning))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, r.jobStateError(ctx, id, "cancel")
+		}
+		return nil, fmt.Errorf("failed to cancel job: %w", err)
+	}
+
+	return job, nil
+}
+
+// jobStateError explains why a job could not be retried or cancelled:
+// either it doesn't exist or it is in a state that doesn't allow the action
+func (r *repository) jobStateError(ctx context.Context, id int64, action string) error {
+	job, err := r.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	return &ErrInvalidState{Resource: "job", State: string(job.State), Action: action}
+}
+
+// PurgeFinishedJobs deletes succeeded and cancelled jobs that finished before the given time
+// Dead jobs are kept so they can still be inspected and retried
+func (r *repository) PurgeFinishedJobs(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM jobs WHERE state IN ($1, $2) AND finished_at < $3`
+
+	result, err := r.db.ExecContext(ctx, query, JobSucceeded, JobCancelled, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// PurgeDispatchedOutbox deletes outbox events that were delivered before the given time
+func (r *repository) PurgeDispatchedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM outbox WHERE dispatched_at < $1`
+
+	result, err := r.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbox: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// scheduledRunColumns is the column list shared by the scheduled run queries
+const scheduledRunColumns = `id, task, trigger_type, scheduled_at, started_at, finished_at, status, error, instance`
+
+// CreateScheduledRun records the start of a task run and fills in its ID
+func (r *repository) CreateScheduledRun(ctx context.Context, run *ScheduledRun) error {
+	query := `
+		INSERT INTO scheduled_runs (task, trigger_type, scheduled_at, started_at, status, instance)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		run.Task,
+		run.Trigger,
+		run.ScheduledAt,
+		run.StartedAt,
+		run.Status,
+		run.Instance,
+	).Scan(&run.ID)
+
+	if err != nil {
+		return fmt.Errorf("failed to record run of %s: %w", run.Task, err)
+	}
+
+	return nil
+}
+
+// FinishScheduledRun records the outcome of a task run
+func (r *repository) FinishScheduledRun(ctx context.Context, id int64, status, runError string) error {
+	query := `UPDATE scheduled_runs SET status = $1, error = $2, finished_at = $3 WHERE id = $4`
+
+	var errValue interface{}
+	if runError != "" {
+		errValue = runError
+	}
+
+	if _, err := r.db.ExecContext(ctx, query, status, errValue, time.Now().UTC(), id); err != nil {
+		return fmt.Errorf("failed to finish run %d: %w", id, err)
+	}
+	return nil
+}
+
+// ScheduledRunExists reports whether a scheduled run of task was already recorded for the slot
+func (r *repository) ScheduledRunExists(ctx context.Context, task string, scheduledAt time.Time) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM scheduled_runs WHERE task = $1 AND trigger_type = $2 AND scheduled_at = $3`
+
+	if err := r.db.QueryRowContext(ctx, query, task, TriggerSchedule, scheduledAt).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check runs of %s: %w", task, err)
+	}
+	return count > 0, nil
+}
+
+// ListScheduledRuns retrieves the most recent runs, optionally of a single task
+func (r *repository) ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error) {
+	query := `SELECT ` + scheduledRunColumns + ` FROM scheduled_runs ORDER BY id DESC LIMIT $1`
+	args := []interface{}{limit}
+	if task != "" {
+		query = `SELECT ` + scheduledRunColumns + ` FROM scheduled_runs WHERE task = $1 ORDER BY id DESC LIMIT $2`
+		args = []interface{}{task, limit}
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*ScheduledRun
+	for rows.Next() {
+		run := &ScheduledRun{}
+		var finishedAt sql.NullTime
+		var runError sql.NullString
+		err := rows.Scan(
+			&run.ID,
+			&run.Task,
+			&run.Trigger,
+			&run.ScheduledAt,
+			&run.StartedAt,
+			&finishedAt,
+			&run.Status,
+			&runError,
+			&run.Instance,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run: %w", err)
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		run.Error = runError.String
+		runs = append(runs, run)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating runs: %w", err)
+	}
+
+	return runs, nil
+}
+
+// webhookSubscriptionColumns is the column list shared by the subscription queries
+const webhookSubscriptionColumns = `id, url, events, secret, active, created_at, updated_at`
+
+// scanWebhookSubscription reads a row selected with webhookSubscriptionColumns
+func scanWebhookSubscription(row rowScanner) (*WebhookSubscription, error) {
+	sub := &WebhookSubscription{}
+	var events string
+
+	err := row.Scan(&sub.ID, &sub.URL, &events, &sub.Secret, &sub.Active, &sub.CreatedAt, &sub.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Events = strings.Split(events, ",")
+	return sub, nil
+}
+
+// CreateWebhookSubscription stores a new subscription and fills in its ID and timestamps
+func (r *repository) CreateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	query := `
+		INSERT INTO webhook_subscriptions (url, events, secret, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at`
+
+	now := time.Now()
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		sub.URL,
+		strings.Join(sub.Events, ","),
+		sub.Secret,
+		sub.Active,
+		now,
+		now,
+	).Scan(&sub.ID, &sub.CreatedAt, &sub.UpdatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create webhook subscription: %w", err)
+	}
+
+	return nil
+}
+
+// GetWebhookSubscription retrieves a subscription by ID
+func (r *repository) GetWebhookSubscription(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions WHERE id = $1`
+
+	sub, err := scanWebhookSubscription(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound("webhook")
+		}
+		return nil, fmt.Errorf("failed to get webhook subscription: %w", err)
+	}
+
+	return sub, nil
+}
+
+// ListWebhookSubscriptions retrieves every subscription, oldest first
+func (r *repository) ListWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []*WebhookSubscription
+	for rows.Next() {
+		sub, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating webhook subscriptions: %w", err)
+	}
+
+	return subs, nil
+}
+
+// UpdateWebhookSubscription saves the URL, events, secret and active flag of a subscription
+func (r *repository) UpdateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	query := `
+		UPDATE webhook_subscriptions
+		SET url = $1, events = $2, secret = $3, active = $4, updated_at = $5
+		WHERE id = $6
+		RETURNING updated_at`
+
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		sub.URL,
+		strings.Join(sub.Events, ","),
+		sub.Secret,
+		sub.Active,
+		time.Now(),
+		sub.ID,
+	).Scan(&sub.UpdatedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("webhook")
+		}
+		return fmt.Errorf("failed to update webhook subscription: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteWebhookSubscription deletes a subscription and, by cascade, its delivery log
+func (r *repository) DeleteWebhookSubscription(ctx context.Context, id int64) error {
+	query := `DELETE FROM webhook_subscriptions WHERE id = $1`
+
+	result, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return notFound("webhook")
+	}
+
+	return nil
+}
+
+// webhookDeliveryColumns is the column list shared by the delivery queries
+const webhookDeliveryColumns = `id, subscription_id, event_type, payload, status, attempts, response_code, error, created_at, updated_at, delivered_at`
+
+// scanWebhookDelivery reads a row selected with webhookDeliveryColumns
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	var payload []byte
+	var responseCode sql.NullInt64
+	var deliveryError sql.NullString
+	var deliveredAt sql.NullTime
+
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.SubscriptionID,
+		&delivery.EventType,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&responseCode,
+		&deliveryError,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+		&deliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = payload
+	if responseCode.Valid {
+		code := int(responseCode.Int64)
+		delivery.ResponseCode = &code
+	}
+	delivery.Error = deliveryError.String
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return delivery, nil
+}
+
+// CreateWebhookDelivery stores a new delivery and fills in its ID and timestamps
+func (r *repository) CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event_type, payload, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at`
+
+	now := time.Now()
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		delivery.SubscriptionID,
+		delivery.EventType,
+		string(delivery.Payload),
+		delivery.Status,
+		now,
+		now,
+	).Scan(&delivery.ID, &delivery.CreatedAt, &delivery.UpdatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+// GetWebhookDelivery retrieves a delivery by ID
+func (r *repository) GetWebhookDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1`
+
+	delivery, err := scanWebhookDelivery(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound("webhook delivery")
+		}
+		return nil, fmt.Errorf("failed to get webhook delivery: %w", err)
+	}
+
+	return delivery, nil
+}
+
+// UpdateWebhookDelivery saves the outcome of a delivery attempt
+func (r *repository) UpdateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_code = $3, error = $4, delivered_at = $5, updated_at = $6
+		WHERE id = $7
+		RETURNING updated_at`
+
+	var responseCode, deliveryError, deliveredAt interface{}
+	if delivery.ResponseCode != nil {
+		responseCode = *delivery.ResponseCode
+	}
+	if delivery.Error != "" {
+		deliveryError = delivery.Error
+	}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = *delivery.DeliveredAt
+	}
+
+	err := r.db.QueryRowContext(
+		ctx,
+		query,
+		delivery.Status,
+		delivery.Attempts,
+		responseCode,
+		deliveryError,
+		deliveredAt,
+		time.Now(),
+		delivery.ID,
+	).Scan(&delivery.UpdatedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("webhook delivery")
+		}
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+// ListWebhookDeliveries retrieves the most recent deliveries to a subscription
+func (r *repository) ListWebhookDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id DESC LIMIT $2`
+
+	rows, err := r.db.QueryContext(ctx, query, subscriptionID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// auditChainLock is the Postgres advisory lock key that serializes appends to the audit chain
+const auditChainLock = 0x61756469 // "audi"
+
+// auditEventColumns is the column list shared by the audit queries
+const auditEventColumns = `id, occurred_at, actor_id, action, target_type, target_id, changes, ip, user_agent, request_id, prev_hash, hash`
+
+// scanAuditEvent reads a row selected with auditEventColumns
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	event := &AuditEvent{}
+	var actorID sql.NullInt64
+	var changes, ip, userAgent, requestID sql.NullString
+
+	err := row.Scan(
+		&event.ID,
+		&event.OccurredAt,
+		&actorID,
+		&event.Action,
+		&event.TargetType,
+		&event.TargetID,
+		&changes,
+		&ip,
+		&userAgent,
+		&requestID,
+		&event.PrevHash,
+		&event.Hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if actorID.Valid {
+		id := int(actorID.Int64)
+		event.ActorID = &id
+	}
+	if changes.Valid {
+		event.Changes = json.RawMessage(changes.String)
+	}
+	event.IP = ip.String
+	event.UserAgent = userAgent.String
+	event.RequestID = requestID.String
+	return event, nil
+}
+
+// AppendAuditEvent links an event to the end of the audit chain, hashes it and stores it
+// It fills in the event's ID, PrevHash and Hash
+func (r *repository) AppendAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return r.WithTx(ctx, func(tx Repository) error {
+		return tx.(*repository).appendAuditEvent(ctx, event)
+	})
+}
+
+// appendAuditEvent does the work of AppendAuditEvent inside a transaction
+func (r *repository) appendAuditEvent(ctx context.Context, event *AuditEvent) error {
+	// Appends must not interleave, or two events would link to the same previous hash.
+	// SQLite has a single connection, so its transactions are already serialized
+	if r.dialect == DialectPostgres {
+		if _, err := r.db.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditChainLock); err != nil {
+			return fmt.Errorf("failed to lock audit log: %w", err)
+		}
+	}
+
+	prevHash := auditGenesisHash
+	err := r.db.QueryRowContext(ctx, `SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&prevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to read audit log head: %w", err)
+	}
+
+	// Store the time at the database's precision so the hash still matches when it is read back
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	event.OccurredAt = event.OccurredAt.UTC().Truncate(time.Microsecond)
+	event.PrevHash = prevHash
+	event.Hash = event.ComputeHash()
+
+	query := `
+		INSERT INTO audit_events (occurred_at, actor_id, action, target_type, target_id, changes, ip, user_agent, request_id, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id`
+
+	var actorID, changes interface{}
+	if event.ActorID != nil {
+		actorID = *event.ActorID
+	}
+	if len(event.Changes) > 0 {
+		changes = string(event.Changes)
+	}
+
+	err = r.db.QueryRowContext(
+		ctx,
+		query,
+		event.OccurredAt,
+		actorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		changes,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		event.PrevHash,
+		event.Hash,
+	).Scan(&event.ID)
+
+	if err != nil {
+		return fmt.Errorf("failed to append audit event: %w", err)
+	}
+
+	return nil
+}
+
+// ListAuditEvents retrieves the audit events matching filter, oldest first unless filter.Newest is set
+func (r *repository) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ActorID != nil {
+		where("actor_id = $%d", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		where("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		where("target_id = $%d", filter.TargetID)
+	}
+	if filter.Since != nil {
+		where("occurred_at >= $%d", filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		where("occurred_at < $%d", filter.Until.UTC())
+	}
+	if filter.AfterID > 0 {
+		where("id > $%d", filter.AfterID)
+	}
+
+	clause := "1 = 1"
+	if len(conditions) > 0 {
+		clause = strings.Join(conditions, " AND ")
+	}
+	order := "ASC"
+	if filter.Newest {
+		order = "DESC"
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM audit_events WHERE %s ORDER BY id %s LIMIT $%d OFFSET $%d`,
+		auditEventColumns, clause, order, len(args)+1, len(args)+2)
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audit events: %w", err)
+	}
+
+	return events, nil
+}
+
+// ClaimIdempotencyKey stores record as in flight, unless its key is already taken
+// It returns nil when the caller now owns the key, or the existing record. Expired
+// records are replaced, and so is an in-flight record of the same request whose
+// lock has run out, since the request holding it died
+func (r *repository) ClaimIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	claim := `
+		INSERT INTO idempotency_keys (scope, key, fingerprint, locked_until, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (scope, key) DO UPDATE
+		SET fingerprint = excluded.fingerprint, locked_until = excluded.locked_until,
+			response_status = NULL, response_headers = NULL, response_body = NULL,
+			created_at = excluded.created_at, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at < $5
+			OR (idempotency_keys.response_status IS NULL AND idempotency_keys.locked_until < $5
+				AND idempotency_keys.fingerprint = excluded.fingerprint)`
+	lookup := `
+		SELECT fingerprint, locked_until, response_status, response_headers, response_body, created_at, expires_at
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2`
+
+	// The existing record can be released between the two statements, so try again if it's gone
+	for attempt := 0; attempt < 3; attempt++ {
+		now := time.Now()
+		result, err := r.db.ExecContext(ctx, claim, record.Scope, record.Key, record.Fingerprint,
+			record.LockedUntil, now, record.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+		}
+		if claimed, err := result.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+		} else if claimed > 0 {
+			record.CreatedAt = now
+			return nil, nil
+		}
+
+		existing := &IdempotencyRecord{Scope: record.Scope, Key: record.Key}
+		var lockedUntil sql.NullTime
+		var status sql.NullInt64
+		var headers sql.NullString
+		var body []byte
+		err = r.db.QueryRowContext(ctx, lookup, record.Scope, record.Key).Scan(
+			&existing.Fingerprint, &lockedUntil, &status, &headers, &body, &existing.CreatedAt, &existing.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+
+		if lockedUntil.Valid {
+			existing.LockedUntil = lockedUntil.Time
+		}
+		if status.Valid {
+			existing.Response = &IdempotentResponse{Status: int(status.Int64), Body: body}
+			if headers.Valid {
+				if err := json.Unmarshal([]byte(headers.String), &existing.Response.Headers); err != nil {
+					return nil, fmt.Errorf("failed to decode idempotent response headers: %w", err)
+				}
+			}
+		}
+		return existing, nil
+	}
+	return nil, fmt.Errorf("failed to claim idempotency key: kept changing")
+}
+
+// CompleteIdempotencyKey stores the response of the request that claimed record and releases its lock
+func (r *repository) CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error {
+	headers, err := json.Marshal(record.Response.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotent response headers: %w", err)
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET locked_until = NULL, response_status = $1, response_headers = $2, response_body = $3, expires_at = $4
+		WHERE scope = $5 AND key = $6 AND fingerprint = $7 AND response_status IS NULL`
+
+	_, err = r.db.ExecContext(ctx, query, record.Response.Status, string(headers), record.Response.Body,
+		record.ExpiresAt, record.Scope, record.Key, record.Fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes an in-flight record, so the request can be retried with the same key
+func (r *repository) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND response_status IS NULL`
+
+	if _, err := r.db.ExecContext(ctx, query, scope, key); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the records that expired before the given time
+func (r *repository) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE expires_at < $1`
+
+	result, err := r.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// AddSigningKey stores a new JWT signing key, which becomes the one tokens are signed with
+func (r *repository) AddSigningKey(ctx context.Context, key *SigningKey) error {
+	query := `INSERT INTO signing_keys (kid, secret, created_at) VALUES ($1, $2, $3)`
+
+	key.CreatedAt = time.Now()
+	if _, err := r.db.ExecContext(ctx, query, key.ID, key.Secret, key.CreatedAt); err != nil {
+		return fmt.Errorf("failed to add signing key: %w", err)
+	}
+	return nil
+}
+
+// ListSigningKeys returns every signing key, newest first
+// Always served by the primary, so a key is usable as soon as it has been added
+func (r *repository) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	query := `SELECT kid, secret, created_at FROM signing_keys ORDER BY created_at DESC, kid DESC`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		key := &SigningKey{}
+		if err := rows.Scan(&key.ID, &key.Secret, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating signing keys: %w", err)
+	}
+	return keys, nil
+}
+
+// PurgeSigningKeys deletes the keys older than the newest key created before the given time
+// That key was still signing tokens at that time, so only the keys it replaced are deleted
+func (r *repository) PurgeSigningKeys(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM signing_keys
+		WHERE created_at < (SELECT MAX(created_at) FROM signing_keys WHERE created_at < $1)`
+
+	result, err := r.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge signing keys: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 // Helper function to join strings (like strings.Join but inline)
 func joinStrings(strings []string, separator string) string {
 	if len(strings) == 0 {
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// repositoryBackends creates an empty Repository of each implementation
+var repositoryBackends = []struct {
+	name string
+	open func(t *testing.T) Repository
+}{
+	{"memory", func(*testing.T) Repository { return NewMemoryRepository() }},
+	{"sqlite", func(t *testing.T) Repository {
+		db := openTestDB(t)
+		if err := RunMigrations(db, DialectSQLite); err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		return NewRepository(db, DialectSQLite, nil)
+	}},
+}
+
+// repositoryConformanceCases describe the behaviour every Repository must share
+var repositoryConformanceCases = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, repo Repository)
+}{
+	{"create and get user", func(t *testing.T, ctx context.Context, repo Repository) {
+		user := mustCreateUser(t, ctx, repo, "alice")
+		if user.ID == 0 || user.CreatedAt.IsZero() || user.UpdatedAt.IsZero() {
+			t.Fatalf("CreateUser() did not fill in ID and timestamps: %+v", user)
+		}
+
+		byID, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil || byID.Email != "alice@example.com" || byID.Password != "hash" {
+			t.Errorf("GetUserByID() = %+v, %v", byID, err)
+		}
+		byEmail, err := repo.GetUserByEmail(ctx, "alice@example.com")
+		if err != nil || byEmail.ID != user.ID {
+			t.Errorf("GetUserByEmail() = %+v, %v", byEmail, err)
+		}
+	}},
+	{"missing user", func(t *testing.T, ctx context.Context, repo Repository) {
+		if _, err := repo.GetUserByID(ctx, 42); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUserByID() error = %v, want ErrNotFound", err)
+		}
+		if _, err := repo.GetUserByEmail(ctx, "nobody@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUserByEmail() error = %v, want ErrNotFound", err)
+		}
+		if err := repo.UpdateUser(ctx, 42, map[string]interface{}{"username": "x"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateUser() error = %v, want ErrNotFound", err)
+		}
+		if err := repo.DeleteUser(ctx, 42); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteUser() error = %v, want ErrNotFound", err)
+		}
+	}},
+	{"unique username and email", func(t *testing.T, ctx context.Context, repo Repository) {
+		mustCreateUser(t, ctx, repo, "alice")
+		bob := mustCreateUser(t, ctx, repo, "bob")
+
+		var conflict *ErrConflict
+		err := repo.CreateUser(ctx, &User{Username: "alice", Email: "other@example.com", Password: "hash"})
+		if !errors.As(err, &conflict) || conflict.Field != "username" {
+			t.Errorf("duplicate username: error = %v, want a username conflict", err)
+		}
+		err = repo.CreateUser(ctx, &User{Username: "other", Email: "alice@example.com", Password: "hash"})
+		if !errors.As(err, &conflict) || conflict.Field != "email" {
+			t.Errorf("duplicate email: error = %v, want an email conflict", err)
+		}
+		err = repo.UpdateUser(ctx, bob.ID, map[string]interface{}{"email": "alice@example.com"})
+		if !errors.As(err, &conflict) || conflict.Field != "email" {
+			t.Errorf("update to a taken email: error = %v, want an email conflict", err)
+		}
+	}},
+	{"list, count, update and delete users", func(t *testing.T, ctx context.Context, repo Repository) {
+		alice := mustCreateUser(t, ctx, repo, "alice")
+		bob := mustCreateUser(t, ctx, repo, "bob")
+		carol := mustCreateUser(t, ctx, repo, "carol")
+
+		users, err := repo.GetUsers(ctx, 2, 0)
+		if err != nil || len(users) != 2 || users[0].ID != carol.ID || users[1].ID != bob.ID {
+			t.Fatalf("GetUsers(2, 0) = %v, %v; want carol, bob", userIDs(users), err)
+		}
+		users, err = repo.GetUsers(ctx, 2, 2)
+		if err != nil || len(users) != 1 || users[0].ID != alice.ID {
+			t.Fatalf("GetUsers(2, 2) = %v, %v; want alice", userIDs(users), err)
+		}
+
+		if err := repo.UpdateUser(ctx, bob.ID, map[string]interface{}{"username": "robert", "email": "robert@example.com"}); err != nil {
+			t.Fatalf("UpdateUser() error = %v", err)
+		}
+		updated, _ := repo.GetUserByID(ctx, bob.ID)
+		if updated.Username != "robert" || updated.Email != "robert@example.com" || updated.Password != "hash" {
+			t.Errorf("updated user = %+v", updated)
+		}
+
+		if err := repo.DeleteUser(ctx, alice.ID); err != nil {
+			t.Fatalf("DeleteUser() error = %v", err)
+		}
+		if count, err := repo.GetUserCount(ctx); err != nil || count != 2 {
+			t.Errorf("GetUserCount() = %d, %v; want 2", count, err)
+		}
+	}},
+	{"transaction commits", func(t *testing.T, ctx context.Context, repo Repository) {
+		err := repo.WithTx(ctx, func(tx Repository) error {
+			if err := tx.CreateUser(ctx, &User{Username: "alice", Email: "alice@example.com", Password: "hash"}); err != nil {
+				return err
+			}
+			// Nested transactions join the outer one
+			return tx.WithTx(ctx, func(tx Repository) error {
+				return tx.AddOutboxEvent(ctx, &OutboxEvent{EventType: "user.created", AggregateType: "user", AggregateID: 1, Payload: json.RawMessage(`{}`)})
+			})
+		})
+		if err != nil {
+			t.Fatalf("WithTx() error = %v", err)
+		}
+
+		if count, _ := repo.GetUserCount(ctx); count != 1 {
+			t.Errorf("users after commit = %d, want 1", count)
+		}
+		if events, _ := repo.ClaimOutboxEvents(ctx, 10, time.Minute); len(events) != 1 {
+			t.Errorf("outbox events after commit = %d, want 1", len(events))
+		}
+	}},
+	{"transaction rolls back", func(t *testing.T, ctx context.Context, repo Repository) {
+		alice := mustCreateUser(t, ctx, repo, "alice")
+		errRollback := errors.New("rollback")
+
+		err := repo.WithTx(ctx, func(tx Repository) error {
+			if err := tx.UpdateUser(ctx, alice.ID, map[string]interface{}{"username": "changed"}); err != nil {
+				return err
+			}
+			if err := tx.CreateUser(ctx, &User{Username: "bob", Email: "bob@example.com", Password: "hash"}); err != nil {
+				return err
+			}
+			job, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: alice.ID})
+			if err := tx.EnqueueJob(ctx, job); err != nil {
+				return err
+			}
+			if err := tx.AppendAuditEvent(ctx, &AuditEvent{Action: "user.updated", TargetType: "user", TargetID: "1"}); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("WithTx() error = %v, want the callback's error", err)
+		}
+
+		if user, _ := repo.GetUserByID(ctx, alice.ID); user.Username != "alice" {
+			t.Errorf("username after rollback = %q, want alice", user.Username)
+		}
+		if count, _ := repo.GetUserCount(ctx); count != 1 {
+			t.Errorf("users after rollback = %d, want 1", count)
+		}
+		if count, _ := repo.CountJobs(ctx, JobPending); count != 0 {
+			t.Errorf("jobs after rollback = %d, want 0", count)
+		}
+		if events, _ := repo.ListAuditEvents(ctx, AuditFilter{Limit: 10}); len(events) != 0 {
+			t.Errorf("audit events after rollback = %d, want 0", len(events))
+		}
+	}},
+	{"rollback keeps concurrent writes", func(t *testing.T, ctx context.Context, repo Repository) {
+		written := make(chan error, 1)
+		err := repo.WithTx(ctx, func(tx Repository) error {
+			if err := tx.CreateUser(ctx, &User{Username: "alice", Email: "alice@example.com", Password: "hash"}); err != nil {
+				return err
+			}
+
+			// A write outside the transaction has to wait for it, or at least survive its rollback
+			go func() {
+				written <- repo.CreateUser(ctx, &User{Username: "bob", Email: "bob@example.com", Password: "hash"})
+			}()
+			select {
+			case err := <-written:
+				t.Error("a write outside the transaction ran while it was open")
+				written <- err
+			case <-time.After(50 * time.Millisecond):
+			}
+			return errors.New("rollback")
+		})
+		if err == nil {
+			t.Fatal("WithTx() succeeded, want the callback's error")
+		}
+
+		if err := <-written; err != nil {
+			t.Fatalf("concurrent CreateUser() error = %v", err)
+		}
+		if _, err := repo.GetUserByEmail(ctx, "bob@example.com"); err != nil {
+			t.Errorf("concurrent write lost: %v", err)
+		}
+		if _, err := repo.GetUserByEmail(ctx, "alice@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("rolled back write kept: %v", err)
+		}
+	}},
+	{"outbox claim, retry and purge", func(t *testing.T, ctx context.Context, repo Repository) {
+		for i := 1; i <= 2; i++ {
+			if err := repo.AddOutboxEvent(ctx, &OutboxEvent{EventType: "user.created", AggregateType: "user", AggregateID: i, Payload: json.RawMessage(`{}`)}); err != nil {
+				t.Fatalf("AddOutboxEvent() error = %v", err)
+			}
+		}
+
+		events, err := repo.ClaimOutboxEvents(ctx, 10, time.Minute)
+		if err != nil || len(events) != 2 || events[0].AggregateID != 1 || events[0].Attempts != 1 {
+			t.Fatalf("ClaimOutboxEvents() = %d events, %v; want 2 oldest first with one attempt", len(events), err)
+		}
+
+		// The stream reads every event by ID, whatever its delivery state
+		last, err := repo.LastOutboxEventID(ctx)
+		if err != nil || last != events[1].ID {
+			t.Errorf("LastOutboxEventID() = %d, %v; want %d", last, err, events[1].ID)
+		}
+		if listed, err := repo.ListOutboxEvents(ctx, events[0].ID, 10); err != nil || len(listed) != 1 || listed[0].AggregateID != 2 {
+			t.Errorf("ListOutboxEvents() after the first event = %+v, %v; want the second", listed, err)
+		}
+		if leased, _ := repo.ClaimOutboxEvents(ctx, 10, time.Minute); len(leased) != 0 {
+			t.Errorf("leased events claimed again: %d", len(leased))
+		}
+
+		if err := repo.MarkOutboxDispatched(ctx, events[0].ID); err != nil {
+			t.Fatalf("MarkOutboxDispatched() error = %v", err)
+		}
+		if err := repo.MarkOutboxFailed(ctx, events[1].ID, "sink down", time.Now().Add(-time.Second), []string{"log", "file"}); err != nil {
+			t.Fatalf("MarkOutboxFailed() error = %v", err)
+		}
+
+		retried, _ := repo.ClaimOutboxEvents(ctx, 10, time.Minute)
+		if len(retried) != 1 || retried[0].ID != events[1].ID || retried[0].Attempts != 2 ||
+			!reflect.DeepEqual(retried[0].DeliveredSinks, []string{"log", "file"}) {
+			t.Errorf("retried events = %+v, want the failed event on its second attempt", retried)
+		}
+
+		if purged, err := repo.PurgeDispatchedOutbox(ctx, time.Now().Add(time.Second)); err != nil || purged != 1 {
+			t.Errorf("PurgeDispatchedOutbox() = %d, %v; want 1", purged, err)
+		}
+	}},
+	{"job leases", func(t *testing.T, ctx context.Context, repo Repository) {
+		job := mustEnqueueJob(t, ctx, repo)
+
+		// The first attempt overruns its lease and the job is leased again
+		if first, _ := repo.ClaimJob(ctx, -time.Second); first == nil || first.Attempts != 1 {
+			t.Fatalf("ClaimJob() = %+v, want the first attempt", first)
+		}
+		second, _ := repo.ClaimJob(ctx, time.Minute)
+		if second == nil || second.Attempts != 2 {
+			t.Fatalf("ClaimJob() after the lease expired = %+v, want the second attempt", second)
+		}
+
+		// Only the attempt holding the lease records an outcome
+		if err := repo.CompleteJob(ctx, job.ID, 1); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("CompleteJob() of the expired attempt error = %v, want ErrJobLeaseLost", err)
+		}
+		if err := repo.FailJob(ctx, job.ID, 1, "late", nil); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("FailJob() of the expired attempt error = %v, want ErrJobLeaseLost", err)
+		}
+		if running, _ := repo.GetJob(ctx, job.ID); running.State != JobRunning {
+			t.Errorf("job after the expired attempt finished = %+v, want still running", running)
+		}
+		if _, err := repo.CancelJob(ctx, job.ID); err != nil {
+			t.Fatalf("CancelJob() error = %v", err)
+		}
+		if err := repo.CompleteJob(ctx, job.ID, 2); !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("CompleteJob() of a cancelled job error = %v, want ErrJobLeaseLost", err)
+		}
+		if cancelled, _ := repo.GetJob(ctx, job.ID); cancelled.State != JobCancelled {
+			t.Errorf("job after completing a cancelled attempt = %+v, want cancelled", cancelled)
+		}
+	}},
+	{"job lifecycle", func(t *testing.T, ctx context.Context, repo Repository) {
+		job := mustEnqueueJob(t, ctx, repo)
+
+		claimed, err := repo.ClaimJob(ctx, time.Minute)
+		if err != nil || claimed == nil || claimed.ID != job.ID || claimed.State != JobRunning || claimed.Attempts != 1 {
+			t.Fatalf("ClaimJob() = %+v, %v; want the job running on its first attempt", claimed, err)
+		}
+		if again, err := repo.ClaimJob(ctx, time.Minute); err != nil || again != nil {
+			t.Fatalf("ClaimJob() while leased = %+v, %v; want nil", again, err)
+		}
+
+		retryAt := time.Now().Add(-time.Second)
+		if err := repo.FailJob(ctx, job.ID, 1, "boom", &retryAt); err != nil {
+			t.Fatalf("FailJob() error = %v", err)
+		}
+		failed, _ := repo.ListJobs(ctx, JobFilter{State: JobFailed, Limit: 10})
+		if len(failed) != 1 || failed[0].LastError != "boom" || failed[0].State != JobPending {
+			t.Errorf("failed jobs = %+v, want the job pending a retry", failed)
+		}
+
+		claimed, _ = repo.ClaimJob(ctx, time.Minute)
+		if claimed == nil || claimed.Attempts != 2 {
+			t.Fatalf("ClaimJob() after retry = %+v, want the second attempt", claimed)
+		}
+		if err := repo.FailJob(ctx, job.ID, 2, "boom again", nil); err != nil {
+			t.Fatalf("FailJob() error = %v", err)
+		}
+		dead, _ := repo.GetJob(ctx, job.ID)
+		if dead.State != JobDead || dead.FinishedAt == nil {
+			t.Errorf("job after final failure = %+v, want dead", dead)
+		}
+
+		retried, err := repo.RetryJob(ctx, job.ID)
+		if err != nil || retried.State != JobPending || retried.Attempts != 0 {
+			t.Fatalf("RetryJob() = %+v, %v; want pending with no attempts", retried, err)
+		}
+		claimed, _ = repo.ClaimJob(ctx, time.Minute)
+		if err := repo.CompleteJob(ctx, claimed.ID, claimed.Attempts); err != nil {
+			t.Fatalf("CompleteJob() error = %v", err)
+		}
+		if count, _ := repo.CountJobs(ctx, JobSucceeded); count != 1 {
+			t.Errorf("succeeded jobs = %d, want 1", count)
+		}
+		if counts, _ := repo.CountJobsByKind(ctx, JobSucceeded); counts[JobUserAnalytics] != 1 {
+			t.Errorf("CountJobsByKind() = %v", counts)
+		}
+
+		var stateErr *ErrInvalidState
+		if _, err := repo.CancelJob(ctx, job.ID); !errors.As(err, &stateErr) {
+			t.Errorf("CancelJob() of a succeeded job error = %v, want ErrInvalidState", err)
+		}
+		if _, err := repo.RetryJob(ctx, job.ID); !errors.As(err, &stateErr) {
+			t.Errorf("RetryJob() of a succeeded job error = %v, want ErrInvalidState", err)
+		}
+		if _, err := repo.GetJob(ctx, 999); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetJob() of a missing job error = %v, want ErrNotFound", err)
+		}
+
+		if purged, err := repo.PurgeFinishedJobs(ctx, time.Now().Add(time.Second)); err != nil || purged != 1 {
+			t.Errorf("PurgeFinishedJobs() = %d, %v; want 1", purged, err)
+		}
+	}},
+	{"cancel and list jobs", func(t *testing.T, ctx context.Context, repo Repository) {
+		first := mustEnqueueJob(t, ctx, repo)
+		second := mustEnqueueJob(t, ctx, repo)
+
+		cancelled, err := repo.CancelJob(ctx, first.ID)
+		if err != nil || cancelled.State != JobCancelled || cancelled.FinishedAt == nil {
+			t.Fatalf("CancelJob() = %+v, %v", cancelled, err)
+		}
+
+		jobs, _ := repo.ListJobs(ctx, JobFilter{Limit: 10})
+		if len(jobs) != 2 || jobs[0].ID != second.ID {
+			t.Errorf("ListJobs() = %d jobs, want 2 newest first", len(jobs))
+		}
+		pending, _ := repo.ListJobs(ctx, JobFilter{State: JobPending, Limit: 10})
+		if len(pending) != 1 || pending[0].ID != second.ID {
+			t.Errorf("ListJobs(pending) = %d jobs, want the second job", len(pending))
+		}
+
+		claimed, _ := repo.ClaimJob(ctx, time.Minute)
+		if claimed == nil || claimed.ID != second.ID {
+			t.Errorf("ClaimJob() = %+v, want the job that wasn't cancelled", claimed)
+		}
+	}},
+	{"scheduled runs", func(t *testing.T, ctx context.Context, repo Repository) {
+		slot := time.Date(2024, 1, 31, 3, 0, 0, 0, time.UTC)
+		run := &ScheduledRun{Task: "purge", Trigger: TriggerSchedule, ScheduledAt: slot, StartedAt: time.Now().UTC(), Status: RunRunning, Instance: "test"}
+		if err := repo.CreateScheduledRun(ctx, run); err != nil || run.ID == 0 {
+			t.Fatalf("CreateScheduledRun() = %d, %v", run.ID, err)
+		}
+		if err := repo.CreateScheduledRun(ctx, &ScheduledRun{Task: "other", Trigger: TriggerManual, ScheduledAt: slot, StartedAt: time.Now().UTC(), Status: RunRunning, Instance: "test"}); err != nil {
+			t.Fatalf("CreateScheduledRun() error = %v", err)
+		}
+
+		if exists, err := repo.ScheduledRunExists(ctx, "purge", slot); err != nil || !exists {
+			t.Errorf("ScheduledRunExists() = %t, %v; want true", exists, err)
+		}
+		if exists, _ := repo.ScheduledRunExists(ctx, "purge", slot.Add(time.Hour)); exists {
+			t.Error("ScheduledRunExists() found a run for another slot")
+		}
+
+		if err := repo.FinishScheduledRun(ctx, run.ID, RunSucceeded, ""); err != nil {
+			t.Fatalf("FinishScheduledRun() error = %v", err)
+		}
+		runs, err := repo.ListScheduledRuns(ctx, "purge", 10)
+		if err != nil || len(runs) != 1 || runs[0].Status != RunSucceeded || runs[0].FinishedAt == nil {
+			t.Errorf("ListScheduledRuns(purge) = %+v, %v", runs, err)
+		}
+		if runs, _ := repo.ListScheduledRuns(ctx, "", 10); len(runs) != 2 || runs[0].Task != "other" {
+			t.Errorf("ListScheduledRuns() = %d runs, want 2 newest first", len(runs))
+		}
+	}},
+	{"webhook subscriptions and deliveries", func(t *testing.T, ctx context.Context, repo Repository) {
+		sub := &WebhookSubscription{URL: "https://example.com/hook", Events: []string{"user.*"}, Secret: "s3cret", Active: true}
+		if err := repo.CreateWebhookSubscription(ctx, sub); err != nil || sub.ID == 0 {
+			t.Fatalf("CreateWebhookSubscription() = %d, %v", sub.ID, err)
+		}
+
+		sub.Events = []string{"user.created", "user.deleted"}
+		sub.Active = false
+		if err := repo.UpdateWebhookSubscription(ctx, sub); err != nil {
+			t.Fatalf("UpdateWebhookSubscription() error = %v", err)
+		}
+		stored, err := repo.GetWebhookSubscription(ctx, sub.ID)
+		if err != nil || stored.Active || len(stored.Events) != 2 || stored.Secret != "s3cret" {
+			t.Errorf("GetWebhookSubscription() = %+v, %v", stored, err)
+		}
+		if subs, _ := repo.ListWebhookSubscriptions(ctx); len(subs) != 1 {
+			t.Errorf("ListWebhookSubscriptions() = %d, want 1", len(subs))
+		}
+
+		var deliveries []*WebhookDelivery
+		for i := 0; i < 2; i++ {
+			delivery := &WebhookDelivery{SubscriptionID: sub.ID, EventType: "user.created", Payload: json.RawMessage(`{}`), Status: DeliveryPending}
+			if err := repo.CreateWebhookDelivery(ctx, delivery); err != nil {
+				t.Fatalf("CreateWebhookDelivery() error = %v", err)
+			}
+			deliveries = append(deliveries, delivery)
+		}
+
+		code := 500
+		deliveries[0].Status, deliveries[0].Attempts, deliveries[0].ResponseCode = DeliveryFailed, 1, &code
+		if err := repo.UpdateWebhookDelivery(ctx, deliveries[0]); err != nil {
+			t.Fatalf("UpdateWebhookDelivery() error = %v", err)
+		}
+		got, err := repo.GetWebhookDelivery(ctx, deliveries[0].ID)
+		if err != nil || got.Status != DeliveryFailed || got.ResponseCode == nil || *got.ResponseCode != 500 {
+			t.Errorf("GetWebhookDelivery() = %+v, %v", got, err)
+		}
+		if listed, _ := repo.ListWebhookDeliveries(ctx, sub.ID, 1); len(listed) != 1 || listed[0].ID != deliveries[1].ID {
+			t.Errorf("ListWebhookDeliveries(limit 1) = %d, want the newest delivery", len(listed))
+		}
+
+		if err := repo.DeleteWebhookSubscription(ctx, sub.ID); err != nil {
+			t.Fatalf("DeleteWebhookSubscription() error = %v", err)
+		}
+		if _, err := repo.GetWebhookSubscription(ctx, sub.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetWebhookSubscription() after delete error = %v, want ErrNotFound", err)
+		}
+		if _, err := repo.GetWebhookDelivery(ctx, deliveries[0].ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("delivery outlived its subscription: error = %v", err)
+		}
+		if err := repo.UpdateWebhookSubscription(ctx, sub); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateWebhookSubscription() of a missing subscription error = %v, want ErrNotFound", err)
+		}
+	}},
+	{"audit chain and filters", func(t *testing.T, ctx context.Context, repo Repository) {
+		actor := 7
+		start := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+		for i, action := range []string{"user.created", "user.updated", "user.deleted"} {
+			event := &AuditEvent{OccurredAt: start.Add(time.Duration(i) * time.Second), ActorID: &actor, Action: action, TargetType: "user", TargetID: "1"}
+			if err := repo.AppendAuditEvent(ctx, event); err != nil {
+				t.Fatalf("AppendAuditEvent() error = %v", err)
+			}
+		}
+
+		events, err := repo.ListAuditEvents(ctx, AuditFilter{Limit: 10})
+		if err != nil || len(events) != 3 {
+			t.Fatalf("ListAuditEvents() = %d events, %v; want 3", len(events), err)
+		}
+		if events[0].PrevHash != auditGenesisHash {
+			t.Errorf("first event links to %q, want the genesis hash", events[0].PrevHash)
+		}
+		for i, event := range events {
+			if event.Hash != event.ComputeHash() {
+				t.Errorf("event %d hash does not match its contents", event.ID)
+			}
+			if i > 0 && event.PrevHash != events[i-1].Hash {
+				t.Errorf("event %d does not link to event %d", event.ID, events[i-1].ID)
+			}
+		}
+
+		filtered, _ := repo.ListAuditEvents(ctx, AuditFilter{Action: "user.updated", ActorID: &actor, Limit: 10})
+		if len(filtered) != 1 || filtered[0].ID != events[1].ID {
+			t.Errorf("ListAuditEvents(action) = %d events, want the update", len(filtered))
+		}
+		since, until := start.Add(time.Second), start.Add(2*time.Second)
+		if ranged, _ := repo.ListAuditEvents(ctx, AuditFilter{Since: &since, Until: &until, Limit: 10}); len(ranged) != 1 || ranged[0].ID != events[1].ID {
+			t.Errorf("ListAuditEvents(since, until) = %d events, want the update", len(ranged))
+		}
+		if after, _ := repo.ListAuditEvents(ctx, AuditFilter{AfterID: events[0].ID, Limit: 10}); len(after) != 2 {
+			t.Errorf("ListAuditEvents(after) = %d events, want 2", len(after))
+		}
+		if newest, _ := repo.ListAuditEvents(ctx, AuditFilter{Newest: true, Offset: 1, Limit: 1}); len(newest) != 1 || newest[0].ID != events[1].ID {
+			t.Errorf("ListAuditEvents(newest, offset 1) = %d events, want the update", len(newest))
+		}
+	}},
+	{"idempotency keys", func(t *testing.T, ctx context.Context, repo Repository) {
+		now := time.Now()
+		record := &IdempotencyRecord{Scope: "user:1", Key: "k1", Fingerprint: "f1", LockedUntil: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}
+
+		if existing, err := repo.ClaimIdempotencyKey(ctx, record); err != nil || existing != nil {
+			t.Fatalf("first claim = %+v, %v; want nil", existing, err)
+		}
+		existing, err := repo.ClaimIdempotencyKey(ctx, record)
+		if err != nil || existing == nil || existing.Response != nil || existing.Fingerprint != "f1" {
+			t.Fatalf("claim while in flight = %+v, %v; want the record without a response", existing, err)
+		}
+		other := *record
+		other.Scope = "user:2"
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, &other); existing != nil {
+			t.Error("a key in another scope was already claimed")
+		}
+
+		record.Response = &IdempotentResponse{Status: 201, Headers: map[string]string{"Content-Type": "application/json"}, Body: []byte(`{"id":1}`)}
+		if err := repo.CompleteIdempotencyKey(ctx, record); err != nil {
+			t.Fatalf("CompleteIdempotencyKey() error = %v", err)
+		}
+		existing, _ = repo.ClaimIdempotencyKey(ctx, record)
+		if existing == nil || existing.Response == nil || existing.Response.Status != 201 || string(existing.Response.Body) != `{"id":1}` ||
+			existing.Response.Headers["Content-Type"] != "application/json" {
+			t.Fatalf("claim after completion = %+v, want the stored response", existing)
+		}
+
+		// Releasing leaves completed keys alone but frees in-flight ones
+		if err := repo.ReleaseIdempotencyKey(ctx, record.Scope, record.Key); err != nil {
+			t.Fatalf("ReleaseIdempotencyKey() error = %v", err)
+		}
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, record); existing == nil || existing.Response == nil {
+			t.Error("releasing removed a completed key")
+		}
+		repo.ReleaseIdempotencyKey(ctx, other.Scope, other.Key)
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, &other); existing != nil {
+			t.Error("released key is still claimed")
+		}
+
+		// A stale lock is taken over by a retry of the same request, but not by a different one
+		stale := &IdempotencyRecord{Scope: "user:1", Key: "k2", Fingerprint: "f2", LockedUntil: now.Add(-time.Second), ExpiresAt: now.Add(time.Hour)}
+		repo.ClaimIdempotencyKey(ctx, stale)
+		different := *stale
+		different.Fingerprint, different.LockedUntil = "other", now.Add(time.Minute)
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, &different); existing == nil {
+			t.Error("a different request took over a stale key")
+		}
+		retry := *stale
+		retry.LockedUntil = now.Add(time.Minute)
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, &retry); existing != nil {
+			t.Error("a retry could not take over a stale key")
+		}
+
+		// Expired keys can be claimed again and are purged
+		expired := &IdempotencyRecord{Scope: "user:1", Key: "k3", Fingerprint: "f3", LockedUntil: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+		repo.ClaimIdempotencyKey(ctx, expired)
+		if purged, err := repo.PurgeIdempotencyKeys(ctx, now); err != nil || purged != 1 {
+			t.Errorf("PurgeIdempotencyKeys() = %d, %v; want 1", purged, err)
+		}
+		if existing, _ := repo.ClaimIdempotencyKey(ctx, &IdempotencyRecord{Scope: "user:1", Key: "k3", Fingerprint: "new", LockedUntil: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}); existing != nil {
+			t.Error("an expired key could not be claimed again")
+		}
+	}},
+	{"soft-deleted users", func(t *testing.T, ctx context.Context, repo Repository) {
+		alice := mustCreateUser(t, ctx, repo, "alice")
+		if err := repo.DeleteUser(ctx, alice.ID); err != nil {
+			t.Fatalf("DeleteUser() error = %v", err)
+		}
+
+		// Deleted users are hidden but keep their username and email until purged
+		if _, err := repo.GetUserByEmail(ctx, alice.Email); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUserByEmail() of a deleted user error = %v, want ErrNotFound", err)
+		}
+		if err := repo.UpdateUser(ctx, alice.ID, map[string]interface{}{"username": "x"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateUser() of a deleted user error = %v, want ErrNotFound", err)
+		}
+		if err := repo.DeleteUser(ctx, alice.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second DeleteUser() error = %v, want ErrNotFound", err)
+		}
+		if count, _ := repo.GetUserCount(ctx); count != 0 {
+			t.Errorf("GetUserCount() = %d, want 0", count)
+		}
+		var conflict *ErrConflict
+		if err := repo.CreateUser(ctx, &User{Username: "alice", Email: "alice@example.com", Password: "hash"}); !errors.As(err, &conflict) {
+			t.Errorf("CreateUser() reusing a deleted user's username error = %v, want a conflict", err)
+		}
+
+		if purged, err := repo.PurgeDeletedUsers(ctx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+			t.Errorf("PurgeDeletedUsers() before the deletion = %d, %v; want 0", purged, err)
+		}
+		if purged, err := repo.PurgeDeletedUsers(ctx, time.Now().Add(time.Second)); err != nil || purged != 1 {
+			t.Errorf("PurgeDeletedUsers() = %d, %v; want 1", purged, err)
+		}
+		mustCreateUser(t, ctx, repo, "alice")
+	}},
+	{"signing keys", func(t *testing.T, ctx context.Context, repo Repository) {
+		if keys, err := repo.ListSigningKeys(ctx); err != nil || len(keys) != 0 {
+			t.Fatalf("ListSigningKeys() = %v, %v; want none", keys, err)
+		}
+
+		start := time.Now().Add(-time.Second)
+		for _, id := range []string{"k1", "k2", "k3"} {
+			if err := repo.AddSigningKey(ctx, &SigningKey{ID: id, Secret: "sealed-" + id}); err != nil {
+				t.Fatalf("AddSigningKey(%s) error = %v", id, err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		keys, err := repo.ListSigningKeys(ctx)
+		if err != nil || len(keys) != 3 || keys[0].ID != "k3" || keys[2].ID != "k1" || keys[0].Secret != "sealed-k3" {
+			t.Fatalf("ListSigningKeys() = %v, %v; want k3, k2, k1", keys, err)
+		}
+
+		// Keys are only purged once a newer key was already in use at the cutoff
+		if purged, err := repo.PurgeSigningKeys(ctx, start); err != nil || purged != 0 {
+			t.Errorf("PurgeSigningKeys() before every key = %d, %v; want 0", purged, err)
+		}
+		if purged, err := repo.PurgeSigningKeys(ctx, keys[1].CreatedAt.Add(time.Millisecond)); err != nil || purged != 1 {
+			t.Errorf("PurgeSigningKeys() after k2 = %d, %v; want 1", purged, err)
+		}
+		if keys, _ := repo.ListSigningKeys(ctx); len(keys) != 2 || keys[1].ID != "k2" {
+			t.Errorf("keys after purging = %v, want k3, k2", keys)
+		}
+	}},
+}
+
+func TestRepositoryConformance(t *testing.T) {
+	for _, backend := range repositoryBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tc := range repositoryConformanceCases {
+				t.Run(tc.name, func(t *testing.T) {
+					tc.run(t, context.Background(), backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+// mustCreateUser stores a user called name with the password hash "hash"
+func mustCreateUser(t *testing.T, ctx context.Context, repo Repository, name string) *User {
+	t.Helper()
+
+	user := &User{Username: name, Email: name + "@example.com", Password: "hash"}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatalf("CreateUser(%s) error = %v", name, err)
+	}
+	// SQLite stores timestamps with a second's precision at best, so space users out
+	// enough for newest-first ordering not to depend on ID tie breaks
+	time.Sleep(time.Millisecond)
+	return user
+}
+
+// mustEnqueueJob queues an analytics job that is due now
+func mustEnqueueJob(t *testing.T, ctx context.Context, repo Repository) *Job {
+	t.Helper()
+
+	job, err := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+	if err != nil {
+		t.Fatalf("NewJob() error = %v", err)
+	}
+	job.MaxAttempts = 3
+	if err := repo.EnqueueJob(ctx, job); err != nil {
+		t.Fatalf("EnqueueJob() error = %v", err)
+	}
+	return job
+}
+
+// userIDs lists the IDs of users, for failure messages
+func userIDs(users []*User) []int {
+	ids := make([]int, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
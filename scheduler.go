@@ -0,0 +1,521 @@
+// scheduler.go - Cron-style scheduler for maintenance tasks
+// Every instance runs the scheduler, but a task only runs where its lock can be
+// taken (a Postgres advisory lock), and each scheduled slot is recorded in the
+// scheduled_runs table so an instance with a slightly late clock skips a slot
+// that another instance already ran
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Run triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+// Run statuses
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// ScheduledRun is one execution of a scheduled task
+type ScheduledRun struct {
+	ID          int64      `json:"id"`
+	Task        string     `json:"task"`
+	Trigger     string     `json:"trigger"`
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Instance    string     `json:"instance"`
+}
+
+// TaskFunc performs a scheduled task
+type TaskFunc func(ctx context.Context) error
+
+// TaskInfo describes a registered task
+type TaskInfo struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Schedule    string     `json:"schedule,omitempty"` // Empty when the task only runs on demand
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+// scheduledTask is a registered task and its parsed schedule
+type scheduledTask struct {
+	name        string
+	description string
+	spec        string
+	schedule    cron.Schedule
+	parseErr    error
+	fn          TaskFunc
+	next        time.Time
+}
+
+// TaskLocker makes sure only one instance runs a task at a time
+type TaskLocker interface {
+	// TryLock takes the lock for key without waiting
+	// ok is false if another holder has it; unlock must be called once the work is done
+	TryLock(ctx context.Context, key string) (unlock func(), ok bool, err error)
+}
+
+// NewTaskLocker returns the locker for the dialect: Postgres advisory locks,
+// or an in-process lock for SQLite, which only ever has one instance
+func NewTaskLocker(db *sql.DB, dialect Dialect) TaskLocker {
+	if dialect == DialectPostgres {
+		return &advisoryLocker{db: db}
+	}
+	return &localLocker{held: make(map[string]bool)}
+}
+
+// advisoryLocker uses session level Postgres advisory locks
+type advisoryLocker struct {
+	db *sql.DB
+}
+
+func (l *advisoryLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	// The lock belongs to the session, so keep one connection until unlock
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	lockID := advisoryLockID(key)
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&acquired); err != nil {
+		// The lock may have been taken before the error, so don't hand the session back to the pool
+		discardConn(conn)
+		return nil, false, fmt.Errorf("failed to take lock %s: %w", key, err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	unlock := func() {
+		// Use a fresh context: the caller's may already be cancelled
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID); err != nil {
+			// The session still holds the lock; closing it is the only way to release it
+			slog.Error("Failed to release lock, discarding its connection", "lock", key, "error", err)
+			discardConn(conn)
+			return
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+// discardConn closes conn's session instead of returning it to the pool, which
+// releases any session level locks it still holds
+func discardConn(conn *sql.Conn) {
+	// driver.ErrBadConn tells database/sql to close the connection for good
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// advisoryLockID hashes a lock name into the int64 key space of advisory locks
+func advisoryLockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// localLocker locks within this process
+type localLocker struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (l *localLocker) TryLock(_ context.Context, key string) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held[key] {
+		return nil, false, nil
+	}
+	l.held[key] = true
+
+	unlock := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.held, key)
+	}
+	return unlock, true, nil
+}
+
+// ErrTaskRunning is returned when a task's lock is held by another run
+var ErrTaskRunning = errors.New("task is already running")
+
+// ErrSchedulerClosed is returned when a task is triggered after the scheduler was closed
+var ErrSchedulerClosed = errors.New("scheduler is closed")
+
+// Scheduler runs registered tasks on cron schedules
+// Schedules use standard 5 field cron expressions (e.g. "0 3 * * *") or
+// descriptors such as "@hourly" and "@every 10m", evaluated in UTC
+type Scheduler struct {
+	repo      Repository
+	locker    TaskLocker
+	overrides map[string]string // Schedules from config, by task name
+	instance  string
+
+	mu    sync.Mutex
+	tasks map[string]*scheduledTask
+
+	// ctx is the parent of every task run; cancel abandons them on Close
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stop      chan struct{}
+	closeOnce sync.Once
+	runs      sync.WaitGroup
+	running   map[string]bool // Tasks running in this process
+}
+
+// NewScheduler creates a scheduler
+// overrides replaces the default schedule of the named tasks; "off" disables scheduling
+func NewScheduler(repo Repository, locker TaskLocker, overrides map[string]string) *Scheduler {
+	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Scheduler{
+		repo:      repo,
+		locker:    locker,
+		overrides: overrides,
+		instance:  fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		tasks:     make(map[string]*scheduledTask),
+		ctx:       ctx,
+		cancel:    cancel,
+		stop:      make(chan struct{}),
+		running:   make(map[string]bool),
+	}
+}
+
+// Register adds a task with its default schedule
+// An empty schedule (or "off" in config) means the task only runs when triggered manually
+func (s *Scheduler) Register(name, description, defaultSchedule string, fn TaskFunc) {
+	spec := defaultSchedule
+	if override, ok := s.overrides[name]; ok {
+		spec = override
+	}
+	if strings.EqualFold(spec, "off") {
+		spec = ""
+	}
+
+	task := &scheduledTask{name: name, description: description, spec: spec, fn: fn}
+	if spec != "" {
+		task.schedule, task.parseErr = cron.ParseStandard(spec)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks[name] = task
+}
+
+// Start validates the schedules and runs the scheduling loop until Close is called
+func (s *Scheduler) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Catch typos in config before anything runs
+	for name := range s.overrides {
+		if _, ok := s.tasks[name]; !ok {
+			return fmt.Errorf("schedule configured for unknown task %q", name)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, task := range s.tasks {
+		if task.parseErr != nil {
+			return fmt.Errorf("invalid schedule %q for task %s: %w", task.spec, task.name, task.parseErr)
+		}
+		if task.schedule != nil {
+			task.next = task.schedule.Next(now)
+		}
+	}
+
+	go s.loop()
+	return nil
+}
+
+// loop sleeps until the next task is due and starts it
+func (s *Scheduler) loop() {
+	defer recoverPanic(s.ctx, "scheduler", nil)
+
+	for {
+		wait := s.dispatchDue(time.Now().UTC())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatchDue starts every task that is due at now and returns how long to wait for the next one
+func (s *Scheduler) dispatchDue(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wait := time.Minute
+	for _, task := range s.tasks {
+		if task.schedule == nil {
+			continue
+		}
+
+		if !task.next.After(now) {
+			slot := task.next
+			task.next = task.schedule.Next(now)
+			s.start(task, TriggerSchedule, slot)
+		}
+
+		if until := task.next.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	return wait
+}
+
+// start runs task in a goroutine unless it is already running here; the caller must hold s.mu
+func (s *Scheduler) start(task *scheduledTask, trigger string, slot time.Time) {
+	if s.isClosed() {
+		return
+	}
+	if s.running[task.name] {
+		slog.Warn("Scheduler skipping task, previous run still in progress", "task", task.name, "slot", slot)
+		return
+	}
+	s.running[task.name] = true
+	s.runs.Add(1)
+
+	go func() {
+		defer s.runs.Done()
+		defer s.finished(task.name)
+
+		if _, err := s.execute(task, trigger, slot, nil, nil); err != nil && !errors.Is(err, ErrTaskRunning) {
+			slog.Error("Scheduler failed to run task", "task", task.name, "error", err)
+		}
+	}()
+}
+
+// finished marks a task as no longer running in this process
+func (s *Scheduler) finished(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.running, name)
+}
+
+// execute takes the task's lock, records the run and performs it
+// record, if not nil, runs in the transaction that creates the run record, and the task
+// doesn't run if it fails. started, if not nil, receives the run record once it is created
+func (s *Scheduler) execute(task *scheduledTask, trigger string, slot time.Time, record func(tx Repository, run *ScheduledRun) error, started chan<- *ScheduledRun) (*ScheduledRun, error) {
+	ctx := withLogAttrs(s.ctx, slog.String("task", task.name), slog.String("trigger", trigger))
+
+	unlock, ok, err := s.locker.TryLock(ctx, "scheduler:"+task.name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrTaskRunning
+	}
+	defer unlock()
+
+	// Another instance may already have run this slot and released the lock
+	if trigger == TriggerSchedule {
+		done, err := s.repo.ScheduledRunExists(ctx, task.name, slot)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return nil, nil
+		}
+	}
+
+	run := &ScheduledRun{
+		Task:        task.name,
+		Trigger:     trigger,
+		ScheduledAt: slot,
+		StartedAt:   time.Now().UTC(),
+		Status:      RunRunning,
+		Instance:    s.instance,
+	}
+	err = s.repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.CreateScheduledRun(ctx, run); err != nil {
+			return err
+		}
+		if record != nil {
+			return record(tx, run)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if started != nil {
+		copied := *run
+		started <- &copied
+	}
+
+	ctx = withLogAttrs(ctx, slog.Int64("run_id", run.ID))
+	slog.InfoContext(ctx, "Scheduler running task")
+
+	// Each run is its own trace, so the task's queries are traced too
+	taskCtx, span := tracer.Start(ctx, "task "+task.name, trace.WithAttributes(
+		attribute.String("task.name", task.name),
+		attribute.String("task.trigger", trigger),
+		attribute.Int64("task.run_id", run.ID),
+	))
+	taskErr := runTask(taskCtx, task)
+	endSpan(span, taskErr)
+
+	run.Status = RunSucceeded
+	if taskErr != nil {
+		run.Status = RunFailed
+		run.Error = taskErr.Error()
+		slog.ErrorContext(ctx, "Scheduled task failed", "error", taskErr)
+	}
+
+	// Record the outcome even if the task was cancelled by Close
+	if err := s.repo.FinishScheduledRun(context.Background(), run.ID, run.Status, run.Error); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// runTask runs the task's function, turning a panic into an error so the run is recorded as failed
+func runTask(ctx context.Context, task *scheduledTask) (err error) {
+	defer recoverPanic(ctx, "scheduled task", &err)
+	return task.fn(ctx)
+}
+
+// Trigger runs a task now, regardless of its schedule
+// It returns the run record once the task has started; the task itself keeps running in the background.
+// record, if not nil, runs in the transaction that creates the run record, e.g. to audit the trigger
+func (s *Scheduler) Trigger(name string, record func(tx Repository, run *ScheduledRun) error) (*ScheduledRun, error) {
+	s.mu.Lock()
+	task, ok := s.tasks[name]
+	if !ok {
+		s.mu.Unlock()
+		return nil, notFound("task")
+	}
+	if s.running[name] {
+		s.mu.Unlock()
+		return nil, &ErrInvalidState{Resource: "task", State: "running", Action: "trigger"}
+	}
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSchedulerClosed
+	}
+	s.running[name] = true
+	s.runs.Add(1)
+	s.mu.Unlock()
+
+	started := make(chan *ScheduledRun, 1)
+	result := make(chan error, 1)
+	go func() {
+		defer s.runs.Done()
+		defer s.finished(name)
+
+		_, err := s.execute(task, TriggerManual, time.Now().UTC(), record, started)
+		if err != nil && !errors.Is(err, ErrTaskRunning) {
+			slog.Error("Scheduler failed to run task", "task", name, "error", err)
+		}
+		result <- err
+	}()
+
+	select {
+	case run := <-started:
+		return run, nil
+	case err := <-result:
+		// The task never started: locked elsewhere or the run couldn't be recorded
+		if errors.Is(err, ErrTaskRunning) {
+			return nil, &ErrInvalidState{Resource: "task", State: "running", Action: "trigger"}
+		}
+		return nil, err
+	}
+}
+
+// isClosed reports whether Close has been called
+func (s *Scheduler) isClosed() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Tasks describes every registered task, sorted by name
+func (s *Scheduler) Tasks() []TaskInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]TaskInfo, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		info := TaskInfo{Name: task.name, Description: task.description, Schedule: task.spec}
+		if !task.next.IsZero() {
+			next := task.next
+			info.NextRun = &next
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Close stops scheduling and waits for running tasks to finish
+// If ctx expires first, the running tasks are cancelled and their names returned
+func (s *Scheduler) Close(ctx context.Context) []string {
+	s.mu.Lock()
+	s.closeOnce.Do(func() { close(s.stop) })
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Out of time - cancel whatever is still running
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	abandoned := make([]string, 0, len(s.running))
+	for name := range s.running {
+		abandoned = append(abandoned, name)
+	}
+	sort.Strings(abandoned)
+	return abandoned
+}
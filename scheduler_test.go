@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiscardConnLeavesThePool(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	kept, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	kept.Close()
+	idle := db.Stats().Idle
+
+	// A session that may still hold a lock must not be reused
+	discarded, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	discardConn(discarded)
+	if stats := db.Stats(); stats.Idle != idle-1 || stats.InUse != 0 {
+		t.Errorf("after discardConn: %d idle and %d in use, want %d idle and none in use", stats.Idle, stats.InUse, idle-1)
+	}
+}
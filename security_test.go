@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRouteLimitsMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(ErrorMiddleware(), RouteLimitsMiddleware(RouteLimits{MaxBodyBytes: 32, Timeout: 20 * time.Millisecond}))
+
+	router.POST("/echo", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			reject(c, bindingError(err))
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	router.GET("/slow", func(c *gin.Context) {
+		// A query that gives up when the request context ends
+		<-c.Request.Context().Done()
+		fail(c, c.Request.Context().Err(), "fetch_failed", "Failed to fetch users")
+	})
+	router.GET("/broken", func(c *gin.Context) {
+		fail(c, errors.New("connection refused"), "fetch_failed", "Failed to fetch users")
+	})
+
+	large := `{"name":"` + strings.Repeat("a", 64) + `"}`
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		chunked bool // Sent without a Content-Length
+		status  int
+		code    string
+	}{
+		{"small body", http.MethodPost, "/echo", `{"name":"alice"}`, false, http.StatusOK, ""},
+		{"large body", http.MethodPost, "/echo", large, false, http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"large body without length", http.MethodPost, "/echo", large, true, http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"past the deadline", http.MethodGet, "/slow", "", false, http.StatusServiceUnavailable, "request_timeout"},
+		{"other failure", http.MethodGet, "/broken", "", false, http.StatusInternalServerError, "fetch_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Accept", mediaTypeProblemJSON)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.code == "" {
+				return
+			}
+			var problem ProblemDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || problem.Code != tt.code {
+				t.Errorf("code = %q, %v; want %s", problem.Code, err, tt.code)
+			}
+		})
+	}
+}
@@ -4,7 +4,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,28 +17,67 @@ import (
 // Service interface defines the contract for business logic operations
 type Service interface {
 	// Authentication operations
-	Register(req *RegisterRequest) (*User, error)
-	Login(req *LoginRequest) (string, error) // returns JWT token
+	Register(ctx context.Context, req *RegisterRequest) (*User, error)
+	Login(ctx context.Context, req *LoginRequest) (string, error) // returns JWT token
 
 	// User operations
-	GetUser(id int) (*User, error)
-	GetUsers(page, limit int) (*PaginatedUsers, error)
-	UpdateUser(id int, req *UpdateUserRequest) (*User, error)
-	DeleteUser(id int) error
-
-	// Background operations (using goroutines)
-	ProcessUserAnalytics(userID int)
-	GetUserStatistics() (*UserStatistics, error)
+	GetUser(ctx context.Context, id int) (*User, error)
+	GetUsers(ctx context.Context, page, limit int) (*PaginatedUsers, error)
+	UpdateUser(ctx context.Context, id int, req *UpdateUserRequest) (*User, error)
+	DeleteUser(ctx context.Context, id int) error
+
+	// Background operations (run by the job queue)
+	ProcessUserAnalytics(ctx context.Context, userID int) (*Job, error)
+	GetUserStatistics(ctx context.Context) (*UserStatistics, error)
+
+	// Job operations
+	GetJob(ctx context.Context, id int64) (*Job, error)
+	ListJobs(ctx context.Context, state string, page, limit int) (*PaginatedJobs, error)
+	RetryJob(ctx context.Context, id int64) (*Job, error)
+	CancelJob(ctx context.Context, id int64) (*Job, error)
+
+	// Scheduled maintenance tasks
+	ScheduledTasks() []TaskInfo
+	ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error)
+	TriggerTask(ctx context.Context, name string) (*ScheduledRun, error)
+	CachedStatistics() (*UserStatistics, time.Time)
+
+	// Outgoing webhook operations
+	CreateWebhook(ctx context.Context, req *CreateWebhookRequest) (*WebhookSubscription, error)
+	ListWebhooks(ctx context.Context) ([]*WebhookSubscription, error)
+	GetWebhook(ctx context.Context, id int64) (*WebhookSubscription, error)
+	UpdateWebhook(ctx context.Context, id int64, req *UpdateWebhookRequest) (*WebhookSubscription, error)
+	DeleteWebhook(ctx context.Context, id int64) error
+	ListWebhookDeliveries(ctx context.Context, id int64, limit int) ([]*WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, deliveryID int64) (*WebhookDelivery, error)
+
+	// Audit log operations
+	ListAuditEvents(ctx context.Context, filter AuditFilter, page, limit int) (*PaginatedAuditEvents, error)
+	ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error
+	VerifyAuditLog(ctx context.Context) (*AuditVerification, error)
+
+	// Close stops accepting background work and waits for in-flight work until ctx expires
+	Close(ctx context.Context) error
 }
 
 // service implements the Service interface
 type service struct {
 	repo      Repository
-	jwtSecret string
-
-	// For goroutine examples - tracking background operations
-	analyticsQueue chan int
-	wg             sync.WaitGroup
+	jobs      *JobQueue
+	scheduler *Scheduler
+	events    *EventBus
+	webhooks  *WebhookDispatcher
+	keys      *SigningKeys
+
+	// Retention of finished jobs and delivered outbox events, for the purge task
+	historyRetention time.Duration
+	// How long deleted users are kept before they are purged
+	userDeletionRetention time.Duration
+
+	// Latest snapshot from the recompute_statistics task
+	statsMu       sync.RWMutex
+	cachedStats   *UserStatistics
+	statsComputed time.Time
 }
 
 // PaginatedUsers represents paginated user results
@@ -45,6 +89,21 @@ type PaginatedUsers struct {
 	TotalPages int     `json:"total_pages"`
 }
 
+// PaginatedJobs represents a page of jobs
+type PaginatedJobs struct {
+	Jobs  []*Job `json:"jobs"`
+	Page  int    `json:"page"`
+	Limit int    `json:"limit"`
+	State string `json:"state,omitempty"`
+}
+
+// PaginatedAuditEvents represents a page of audit events, newest first
+type PaginatedAuditEvents struct {
+	Events []*AuditEvent `json:"events"`
+	Page   int           `json:"page"`
+	Limit  int           `json:"limit"`
+}
+
 // UserStatistics represents user analytics data
 type UserStatistics struct {
 	TotalUsers     int `json:"total_users"`
@@ -54,55 +113,83 @@ type UserStatistics struct {
 }
 
 // NewService creates a new service instance
-func NewService(repo Repository) Service {
+// Background work is queued on jobs, which runs it on its own worker pool;
+// maintenance tasks are registered on scheduler. Webhook deliveries also run on jobs.
+// User lifecycle events are published on events, where the side effects subscribe.
+// Login tokens are signed with keys
+func NewService(repo Repository, jobs *JobQueue, scheduler *Scheduler, events *EventBus, keys *SigningKeys) Service {
 	config := LoadConfig()
 
 	s := &service{
-		repo:           repo,
-		jwtSecret:      config.JWTSecret,
-		analyticsQueue: make(chan int, 100), // Buffered channel for background processing
+		repo:             repo,
+		jobs:             jobs,
+		scheduler:        scheduler,
+		events:           events,
+		webhooks:         NewWebhookDispatcher(repo, jobs, config.Webhooks),
+		keys:             keys,
+		historyRetention: config.HistoryRetention,
+
+		userDeletionRetention: config.UserDeletionRetention,
 	}
 
-	// Start background worker goroutines
-	s.startBackgroundWorkers()
+	// Register handlers for the job kinds this service queues
+	jobs.Register(JobUserAnalytics, s.analyticsWorker)
+
+	// Register maintenance tasks with their default schedules
+	scheduler.Register("purge_history", "Delete finished jobs and delivered outbox events older than HISTORY_RETENTION",
+		"0 3 * * *", s.purgeHistory)
+	scheduler.Register("recompute_statistics", "Refresh the user statistics exposed as metrics",
+		"*/5 * * * *", s.recomputeStatistics)
+	scheduler.Register("purge_deleted_users", "Remove users deleted longer than USER_DELETION_RETENTION ago",
+		"30 3 * * *", s.purgeDeletedUsers)
+
+	// React to user lifecycle events; new side effects subscribe here instead of
+	// being added to the methods that publish the events
+	Subscribe(events, "analytics", DeliverAsync, s.queueLoginAnalytics)
+	Subscribe(events, "analytics", DeliverAsync, s.logProfileUpdate)
+	Subscribe(events, "analytics", DeliverAsync, s.logDeletion)
+	Subscribe(events, "notifications", DeliverAsync, sendWelcome)
+	Subscribe(events, "notifications", DeliverAsync, s.notifyLogin)
 
 	return s
 }
 
-// startBackgroundWorkers starts goroutines for background processing
-func (s *service) startBackgroundWorkers() {
-	// Start 3 worker goroutines to process analytics
-	for i := 0; i < 3; i++ {
-		go s.analyticsWorker(i)
+// analyticsWorker processes a user.analytics job on one of the job queue workers
+// Returning an error makes the queue retry the job later
+func (s *service) analyticsWorker(ctx context.Context, job *Job) error {
+	var payload UserJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", job.Kind, err)
 	}
-}
+	userID := payload.UserID
 
-// analyticsWorker is a goroutine that processes user analytics in the background
-func (s *service) analyticsWorker(workerID int) {
-	for userID := range s.analyticsQueue {
-		// Simulate some analytics processing
-		// In a real app, this might update user stats, send emails, etc.
-		fmt.Printf("Worker %d processing analytics for user %d\n", workerID, userID)
+	// Simulate some analytics processing
+	// In a real app, this might update user stats, send emails, etc.
+	slog.InfoContext(ctx, "Processing analytics", "target_user_id", userID)
 
-		// Simulate some work
-		time.Sleep(100 * time.Millisecond)
+	// Simulate some work
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(100 * time.Millisecond):
+	}
 
-		// In a real application, you might:
-		// - Update user statistics in the database
-		// - Send welcome emails
-		// - Process user behavior data
-		// - Generate reports
+	// In a real application, you might:
+	// - Update user statistics in the database
+	// - Send welcome emails
+	// - Process user behavior data
+	// - Generate reports
 
-		fmt.Printf("Worker %d completed analytics for user %d\n", workerID, userID)
-	}
+	slog.InfoContext(ctx, "Completed analytics", "target_user_id", userID)
+	return nil
 }
 
 // Register creates a new user account
-func (s *service) Register(req *RegisterRequest) (*User, error) {
+func (s *service) Register(ctx context.Context, req *RegisterRequest) (*User, error) {
 	// Check if user already exists
-	existingUser, _ := s.repo.GetUserByEmail(req.Email)
+	existingUser, _ := s.repo.GetUserByEmail(ctx, req.Email)
 	if existingUser != nil {
-		return nil, fmt.Errorf("user with email %s already exists", req.Email)
+		return nil, &ErrConflict{Field: "email", Value: req.Email}
 	}
 
 	// Hash the password
@@ -118,61 +205,70 @@ func (s *service) Register(req *RegisterRequest) (*User, error) {
 		Password: hashedPassword,
 	}
 
-	// Save user to database
-	if err := s.repo.CreateUser(user); err != nil {
+	// Save user, its audit entry, its user.created event and its analytics job in one transaction
+	err = s.repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.CreateUser(ctx, user); err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, tx, AuditUserRegister, "user", strconv.Itoa(user.ID), nil, publicUser(user)); err != nil {
+			return err
+		}
+		if err := s.addUserEvent(ctx, tx, EventUserCreated, user, nil); err != nil {
+			return err
+		}
+		_, err := s.enqueueAnalytics(ctx, tx, user.ID)
+		return err
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Process user analytics in background (using goroutine)
-	s.ProcessUserAnalytics(user.ID)
+	// The job is visible now that the transaction has committed
+	s.jobs.Notify()
 
 	// Don't return password in response
 	user.Password = ""
 
+	s.publish(ctx, UserRegistered{User: publicUser(user), At: time.Now()})
 	return user, nil
 }
 
 // Login authenticates a user and returns a JWT token
-func (s *service) Login(req *LoginRequest) (string, error) {
+func (s *service) Login(ctx context.Context, req *LoginRequest) (string, error) {
 	// Get user by email
-	user, err := s.repo.GetUserByEmail(req.Email)
+	user, err := s.repo.GetUserByEmail(ctx, req.Email)
 	if err != nil {
-		return "", fmt.Errorf("invalid credentials")
+		if errors.Is(err, ErrNotFound) {
+			return "", ErrInvalidCredentials
+		}
+		return "", err
 	}
 
 	// Compare password
 	if err := ComparePassword(user.Password, req.Password); err != nil {
-		return "", fmt.Errorf("invalid credentials")
+		return "", ErrInvalidCredentials
 	}
 
 	// Generate JWT token
-	token, err := GenerateJWT(user.ID, s.jwtSecret)
+	token, err := s.keys.Sign(ctx, user.ID)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
 
-	// Process login analytics in background
-	go func() {
-		// This is a simple goroutine example
-		// In a real app, you might log the login, update last_login timestamp, etc.
-		fmt.Printf("User %d logged in at %s\n", user.ID, time.Now().Format(time.RFC3339))
+	// A login that can't be audited is refused
+	if err := s.recordAudit(ctx, s.repo, AuditUserLogin, "user", strconv.Itoa(user.ID), nil, nil); err != nil {
+		return "", fmt.Errorf("failed to audit login: %w", err)
+	}
 
-		// You could also add this to a more sophisticated queue
-		select {
-		case s.analyticsQueue <- user.ID:
-			// Successfully queued for processing
-		default:
-			// Queue is full, handle gracefully
-			fmt.Printf("Analytics queue full, skipping for user %d\n", user.ID)
-		}
-	}()
+	// Analytics, webhooks and the login log subscribe to this
+	s.publish(ctx, UserLoggedIn{User: publicUser(user), At: time.Now()})
 
 	return token, nil
 }
 
 // GetUser retrieves a user by ID
-func (s *service) GetUser(id int) (*User, error) {
-	user, err := s.repo.GetUserByID(id)
+func (s *service) GetUser(ctx context.Context, id int) (*User, error) {
+	user, err := s.repo.GetUserByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -184,7 +280,7 @@ func (s *service) GetUser(id int) (*User, error) {
 }
 
 // GetUsers retrieves a paginated list of users
-func (s *service) GetUsers(page, limit int) (*PaginatedUsers, error) {
+func (s *service) GetUsers(ctx context.Context, page, limit int) (*PaginatedUsers, error) {
 	// Validate pagination parameters
 	if page < 1 {
 		page = 1
@@ -208,7 +304,8 @@ func (s *service) GetUsers(page, limit int) (*PaginatedUsers, error) {
 	// Fetch users in a goroutine
 	go func() {
 		defer wg.Done()
-		users, userErr = s.repo.GetUsers(limit, offset)
+		defer recoverPanic(ctx, "get users", &userErr)
+		users, userErr = s.repo.GetUsers(ctx, limit, offset)
 
 		// Remove passwords from all users
 		for _, user := range users {
@@ -219,7 +316,8 @@ func (s *service) GetUsers(page, limit int) (*PaginatedUsers, error) {
 	// Get total count in another goroutine
 	go func() {
 		defer wg.Done()
-		total, countErr = s.repo.GetUserCount()
+		defer recoverPanic(ctx, "get users", &countErr)
+		total, countErr = s.repo.GetUserCount(ctx)
 	}()
 
 	// Wait for both operations to complete
@@ -246,100 +344,152 @@ func (s *service) GetUsers(page, limit int) (*PaginatedUsers, error) {
 }
 
 // UpdateUser updates a user's information
-func (s *service) UpdateUser(id int, req *UpdateUserRequest) (*User, error) {
-	// Check if user exists
-	existingUser, err := s.repo.GetUserByID(id)
-	if err != nil {
-		return nil, err
-	}
-
-	// Check if email is being changed and if it's already taken
-	if req.Email != "" && req.Email != existingUser.Email {
-		if existingUser, _ := s.repo.GetUserByEmail(req.Email); existingUser != nil {
-			return nil, fmt.Errorf("email %s is already taken", req.Email)
-		}
-	}
-
+func (s *service) UpdateUser(ctx context.Context, id int, req *UpdateUserRequest) (*User, error) {
 	// Build update map
 	updates := make(map[string]interface{})
+	var changedFields []string
 	if req.Username != "" {
 		updates["username"] = req.Username
+		changedFields = append(changedFields, "username")
 	}
 	if req.Email != "" {
 		updates["email"] = req.Email
+		changedFields = append(changedFields, "email")
 	}
 
-	// If no updates provided, return error
-	if len(updates) == 0 {
-		return nil, fmt.Errorf("no updates provided")
-	}
+	// Check the user, perform the update and record its audit entry and user.updated event
+	// in one transaction; reading inside it keeps the checks on the primary, never a lagging replica
+	var existingUser, updatedUser *User
+	err := s.repo.WithTx(ctx, func(tx Repository) error {
+		user, err := tx.GetUserByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		existingUser = user
 
-	// Perform update
-	if err := s.repo.UpdateUser(id, updates); err != nil {
-		return nil, err
-	}
+		// If no updates provided, return error
+		if len(updates) == 0 {
+			return &ErrValidation{Code: "no_updates", Message: "no updates provided"}
+		}
+
+		// Check if email is being changed and if it's already taken
+		if req.Email != "" && req.Email != existingUser.Email {
+			if other, _ := tx.GetUserByEmail(ctx, req.Email); other != nil {
+				return &ErrConflict{Field: "email", Value: req.Email}
+			}
+		}
+
+		if err := tx.UpdateUser(ctx, id, updates); err != nil {
+			return err
+		}
 
-	// Get updated user
-	updatedUser, err := s.repo.GetUserByID(id)
+		// Get updated user (inside the transaction, so it sees the write)
+		user, err = tx.GetUserByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		updatedUser = user
+		if err := s.recordAudit(ctx, tx, AuditUserUpdate, "user", strconv.Itoa(id), publicUser(existingUser), publicUser(user)); err != nil {
+			return err
+		}
+		return s.addUserEvent(ctx, tx, EventUserUpdated, user, changedFields)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Process update analytics in background
-	go func() {
-		fmt.Printf("User %d profile updated at %s\n", id, time.Now().Format(time.RFC3339))
-		// You could track what fields were updated, send notifications, etc.
-	}()
-
 	// Don't return password
 	updatedUser.Password = ""
 
+	s.publish(ctx, UserUpdated{
+		User:          publicUser(updatedUser),
+		Before:        publicUser(existingUser),
+		ChangedFields: changedFields,
+		At:            time.Now(),
+	})
+
 	return updatedUser, nil
 }
 
 // DeleteUser deletes a user account
-func (s *service) DeleteUser(id int) error {
-	// Check if user exists
-	_, err := s.repo.GetUserByID(id)
+func (s *service) DeleteUser(ctx context.Context, id int) error {
+	// Check the user, delete it and record its audit entry and user.deleted event in one transaction
+	var user *User
+	err := s.repo.WithTx(ctx, func(tx Repository) error {
+		existing, err := tx.GetUserByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		user = existing
+
+		if err := tx.DeleteUser(ctx, id); err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, tx, AuditUserDelete, "user", strconv.Itoa(id), publicUser(user), nil); err != nil {
+			return err
+		}
+		return s.addUserEvent(ctx, tx, EventUserDeleted, user, nil)
+	})
 	if err != nil {
 		return err
 	}
 
-	// Delete user
-	if err := s.repo.DeleteUser(id); err != nil {
+	s.publish(ctx, UserDeleted{User: publicUser(user), At: time.Now()})
+	return nil
+}
+
+// addUserEvent writes a user.* event to the outbox and queues its webhook deliveries
+// using the caller's transaction
+func (s *service) addUserEvent(ctx context.Context, tx Repository, eventType string, user *User, changedFields []string) error {
+	event, err := newUserEvent(eventType, user, changedFields)
+	if err != nil {
+		return err
+	}
+	if err := tx.AddOutboxEvent(ctx, event); err != nil {
 		return err
 	}
+	return s.webhooks.Dispatch(ctx, tx, eventType, event.Payload)
+}
 
-	// Process deletion analytics in background
-	go func() {
-		fmt.Printf("User %d deleted at %s\n", id, time.Now().Format(time.RFC3339))
-		// In a real app, you might:
-		// - Clean up user data
-		// - Send confirmation emails
-		// - Update analytics
-		// - Log the deletion for audit purposes
-	}()
+// notifyWebhooks queues webhook deliveries of a user.* event that isn't written to the outbox
+func (s *service) notifyWebhooks(ctx context.Context, repo Repository, eventType string, user *User, changedFields []string) error {
+	payload, err := json.Marshal(UserEventPayload{User: user, ChangedFields: changedFields})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+	return s.webhooks.Dispatch(ctx, repo, eventType, payload)
+}
 
-	return nil
+// ProcessUserAnalytics queues user analytics processing and returns the queued job
+func (s *service) ProcessUserAnalytics(ctx context.Context, userID int) (*Job, error) {
+	job, err := s.enqueueAnalytics(ctx, s.repo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Queued analytics job", "job_id", job.ID, "target_user_id", userID)
+	return job, nil
 }
 
-// ProcessUserAnalytics queues user analytics processing
-func (s *service) ProcessUserAnalytics(userID int) {
-	// This is non-blocking - if queue is full, we skip
-	select {
-	case s.analyticsQueue <- userID:
-		fmt.Printf("Queued analytics processing for user %d\n", userID)
-	default:
-		fmt.Printf("Analytics queue full, skipping user %d\n", userID)
+// enqueueAnalytics queues a user.analytics job using repo, which may be a transaction
+func (s *service) enqueueAnalytics(ctx context.Context, repo Repository, userID int) (*Job, error) {
+	job, err := NewJob(JobUserAnalytics, UserJobPayload{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	job.UserID = &userID
+	if err := s.jobs.Enqueue(ctx, repo, job); err != nil {
+		return nil, err
 	}
+	return job, nil
 }
 
 // GetUserStatistics returns user statistics (demonstrates concurrent processing)
-func (s *service) GetUserStatistics() (*UserStatistics, error) {
+func (s *service) GetUserStatistics(ctx context.Context) (*UserStatistics, error) {
 	stats := &UserStatistics{}
 
 	// Use context with timeout for all operations
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// Use goroutines to fetch different statistics concurrently
@@ -351,6 +501,7 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer recoverPanic(ctx, "user statistics", nil)
 
 		// Simulate work with context
 		select {
@@ -362,7 +513,7 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 		default:
 		}
 
-		total, err := s.repo.GetUserCount()
+		total, err := s.repo.GetUserCount(ctx)
 		mu.Lock()
 		if err != nil {
 			errors = append(errors, err)
@@ -376,6 +527,7 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer recoverPanic(ctx, "user statistics", nil)
 
 		select {
 		case <-ctx.Done():
@@ -399,6 +551,7 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer recoverPanic(ctx, "user statistics", nil)
 
 		select {
 		case <-ctx.Done():
@@ -409,9 +562,14 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 		default:
 		}
 
+		pending, err := s.repo.CountJobs(ctx, JobPending)
 		mu.Lock()
 		stats.ProcessedToday = 42 // Simulated value
-		stats.BackgroundJobs = len(s.analyticsQueue)
+		if err != nil {
+			errors = append(errors, err)
+		} else {
+			stats.BackgroundJobs = pending
+		}
 		mu.Unlock()
 	}()
 
@@ -425,3 +583,571 @@ func (s *service) GetUserStatistics() (*UserStatistics, error) {
 
 	return stats, nil
 }
+
+// GetJob retrieves a background job by ID
+func (s *service) GetJob(ctx context.Context, id int64) (*Job, error) {
+	return s.repo.GetJob(ctx, id)
+}
+
+// ListJobs retrieves a page of jobs, newest first, optionally filtered by state
+func (s *service) ListJobs(ctx context.Context, state string, page, limit int) (*PaginatedJobs, error) {
+	// Validate the state filter
+	switch JobState(state) {
+	case "", JobPending, JobRunning, JobSucceeded, JobDead, JobCancelled, JobFailed:
+	default:
+		return nil, &ErrValidation{
+			Code:    "invalid_state_filter",
+			Field:   "state",
+			Message: "must be one of pending, running, succeeded, failed, dead, cancelled",
+		}
+	}
+
+	// Validate pagination parameters
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	jobs, err := s.repo.ListJobs(ctx, JobFilter{
+		State:  JobState(state),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Always return a list, even when it is empty
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+
+	return &PaginatedJobs{Jobs: jobs, Page: page, Limit: limit, State: state}, nil
+}
+
+// RetryJob queues a failed or cancelled job to run again
+func (s *service) RetryJob(ctx context.Context, id int64) (*Job, error) {
+	var job *Job
+	err := s.repo.WithTx(ctx, func(tx Repository) error {
+		var err error
+		if job, err = tx.RetryJob(ctx, id); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditJobRetry, "job", strconv.FormatInt(id, 10), nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.jobs.Notify()
+	return job, nil
+}
+
+// CancelJob cancels a pending or running job
+func (s *service) CancelJob(ctx context.Context, id int64) (*Job, error) {
+	var job *Job
+	err := s.repo.WithTx(ctx, func(tx Repository) error {
+		var err error
+		if job, err = tx.CancelJob(ctx, id); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditJobCancel, "job", strconv.FormatInt(id, 10), nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop the job right away if one of our workers is running it
+	s.jobs.Interrupt(id)
+	return job, nil
+}
+
+// publish publishes a domain event; the change it describes has already been
+// committed, so subscriber errors are logged rather than returned
+func (s *service) publish(ctx context.Context, event DomainEvent) {
+	if err := s.events.Publish(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Event subscribers failed", "event", event.EventName(), "aggregate_id", event.AggregateID(), "error", err)
+	}
+}
+
+// publicUser returns a copy of user without the password hash, safe to hand to subscribers
+func publicUser(user *User) *User {
+	copied := *user
+	copied.Password = ""
+	return &copied
+}
+
+// queueLoginAnalytics queues analytics processing after a login
+func (s *service) queueLoginAnalytics(ctx context.Context, event UserLoggedIn) error {
+	_, err := s.ProcessUserAnalytics(ctx, event.User.ID)
+	return err
+}
+
+// logProfileUpdate records a profile update for analytics
+func (s *service) logProfileUpdate(ctx context.Context, event UserUpdated) error {
+	slog.InfoContext(ctx, "User profile updated", "target_user_id", event.User.ID, "at", event.At)
+	return nil
+}
+
+// logDeletion records an account deletion for analytics
+func (s *service) logDeletion(ctx context.Context, event UserDeleted) error {
+	slog.InfoContext(ctx, "User deleted", "target_user_id", event.User.ID, "at", event.At)
+	return nil
+}
+
+// sendWelcome sends a new user their welcome message
+// In a real app this would send an email; here it is only logged
+func sendWelcome(ctx context.Context, event UserRegistered) error {
+	slog.InfoContext(ctx, "Sending welcome message", "target_user_id", event.User.ID)
+	return nil
+}
+
+// notifyLogin sends user.logged_in to webhook subscribers
+func (s *service) notifyLogin(ctx context.Context, event UserLoggedIn) error {
+	return s.notifyWebhooks(ctx, s.repo, EventUserLoggedIn, event.User, nil)
+}
+
+// purgeHistory deletes finished jobs and delivered outbox events past the retention period
+func (s *service) purgeHistory(ctx context.Context) error {
+	before := time.Now().Add(-s.historyRetention)
+
+	jobs, err := s.repo.PurgeFinishedJobs(ctx, before)
+	if err != nil {
+		return err
+	}
+	events, err := s.repo.PurgeDispatchedOutbox(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Purged history", "jobs", jobs, "events", events, "before", before)
+	return nil
+}
+
+// purgeDeletedUsers removes the users whose deletion is older than the retention
+func (s *service) purgeDeletedUsers(ctx context.Context) error {
+	before := time.Now().Add(-s.userDeletionRetention)
+
+	users, err := s.repo.PurgeDeletedUsers(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Purged deleted users", "users", users, "before", before)
+	return nil
+}
+
+// recomputeStatistics refreshes the cached statistics snapshot
+func (s *service) recomputeStatistics(ctx context.Context) error {
+	stats, err := s.GetUserStatistics(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.cachedStats = stats
+	s.statsComputed = time.Now()
+	return nil
+}
+
+// CachedStatistics returns the latest statistics snapshot and when it was computed
+// It returns nil until recompute_statistics has run once
+func (s *service) CachedStatistics() (*UserStatistics, time.Time) {
+	s.statsMu.RLock()
+	defer s.statsMu.RUnlock()
+
+	return s.cachedStats, s.statsComputed
+}
+
+// ScheduledTasks describes the registered maintenance tasks
+func (s *service) ScheduledTasks() []TaskInfo {
+	return s.scheduler.Tasks()
+}
+
+// ListScheduledRuns retrieves recent task runs, optionally of a single task
+func (s *service) ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error) {
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	runs, err := s.repo.ListScheduledRuns(ctx, task, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always return a list, even when it is empty
+	if runs == nil {
+		runs = []*ScheduledRun{}
+	}
+	return runs, nil
+}
+
+// TriggerTask runs a maintenance task now, outside its schedule
+func (s *service) TriggerTask(ctx context.Context, name string) (*ScheduledRun, error) {
+	// The run only starts if its audit event is recorded
+	return s.scheduler.Trigger(name, func(tx Repository, _ *ScheduledRun) error {
+		return s.recordAudit(ctx, tx, AuditTaskRun, "task", name, nil, nil)
+	})
+}
+
+// CreateWebhook subscribes a URL to events
+// The secret is only returned here and when it is rotated
+func (s *service) CreateWebhook(ctx context.Context, req *CreateWebhookRequest) (*WebhookSubscription, error) {
+	if err := s.webhooks.ValidateURL(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		return nil, err
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		generated, err := newWebhookSecret()
+		if err != nil {
+			return nil, err
+		}
+		secret = generated
+	}
+	sealed, err := s.webhooks.SealSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &WebhookSubscription{
+		URL:    req.URL,
+		Events: req.Events,
+		Secret: sealed,
+		Active: true,
+	}
+	err = s.repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.CreateWebhookSubscription(ctx, sub); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditWebhookCreate, "webhook", strconv.FormatInt(sub.ID, 10), nil, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Secret = secret
+	return sub, nil
+}
+
+// ListWebhooks retrieves every webhook subscription, without secrets
+func (s *service) ListWebhooks(ctx context.Context) ([]*WebhookSubscription, error) {
+	subs, err := s.repo.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always return a list, even when it is empty
+	if subs == nil {
+		subs = []*WebhookSubscription{}
+	}
+	for _, sub := range subs {
+		sub.Secret = ""
+	}
+	return subs, nil
+}
+
+// GetWebhook retrieves a webhook subscription by ID, without its secret
+func (s *service) GetWebhook(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	sub, err := s.repo.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Secret = ""
+	return sub, nil
+}
+
+// UpdateWebhook changes a subscription's URL, events or active flag, or rotates its secret
+func (s *service) UpdateWebhook(ctx context.Context, id int64, req *UpdateWebhookRequest) (*WebhookSubscription, error) {
+	sub, err := s.repo.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL == "" && req.Events == nil && req.Active == nil && !req.RotateSecret {
+		return nil, &ErrValidation{Code: "no_updates", Message: "no updates provided"}
+	}
+	before := copyWebhookSubscription(sub)
+
+	if req.URL != "" {
+		if err := s.webhooks.ValidateURL(ctx, req.URL); err != nil {
+			return nil, err
+		}
+		sub.URL = req.URL
+	}
+	if req.Events != nil {
+		if err := validateWebhookEvents(req.Events); err != nil {
+			return nil, err
+		}
+		sub.Events = req.Events
+	}
+	if req.Active != nil {
+		sub.Active = *req.Active
+	}
+	var secret string
+	if req.RotateSecret {
+		secret, err = newWebhookSecret()
+		if err != nil {
+			return nil, err
+		}
+		if sub.Secret, err = s.webhooks.SealSecret(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.UpdateWebhookSubscription(ctx, sub); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditWebhookUpdate, "webhook", strconv.FormatInt(id, 10), before, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only show the secret when it has just been replaced
+	sub.Secret = secret
+	return sub, nil
+}
+
+// DeleteWebhook deletes a subscription and its delivery log
+func (s *service) DeleteWebhook(ctx context.Context, id int64) error {
+	sub, err := s.repo.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.DeleteWebhookSubscription(ctx, id); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditWebhookDelete, "webhook", strconv.FormatInt(id, 10), sub, nil)
+	})
+}
+
+// ListWebhookDeliveries retrieves the most recent deliveries to a subscription
+func (s *service) ListWebhookDeliveries(ctx context.Context, id int64, limit int) ([]*WebhookDelivery, error) {
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	// Distinguish a missing subscription from one without deliveries
+	if _, err := s.repo.GetWebhookSubscription(ctx, id); err != nil {
+		return nil, err
+	}
+
+	deliveries, err := s.repo.ListWebhookDeliveries(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always return a list, even when it is empty
+	if deliveries == nil {
+		deliveries = []*WebhookDelivery{}
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook queues a delivery to be sent again
+func (s *service) RedeliverWebhook(ctx context.Context, deliveryID int64) (*WebhookDelivery, error) {
+	var delivery *WebhookDelivery
+	err := s.repo.WithTx(ctx, func(tx Repository) error {
+		var err error
+		if delivery, err = s.webhooks.Redeliver(ctx, tx, deliveryID); err != nil {
+			return err
+		}
+		return s.recordAudit(ctx, tx, AuditWebhookRedeliver, "webhook_delivery", strconv.FormatInt(deliveryID, 10), nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// recordAudit appends an action to the audit log, with the actor and request details from ctx
+// using repo, so each change is audited in its own transaction; before and after are
+// the target's state around the change and either may be nil
+func (s *service) recordAudit(ctx context.Context, repo Repository, action, targetType, targetID string, before, after interface{}) error {
+	changes, err := auditChanges(before, after)
+	if err != nil {
+		return err
+	}
+
+	info := requestInfoFrom(ctx)
+	return repo.AppendAuditEvent(ctx, &AuditEvent{
+		OccurredAt: time.Now(),
+		ActorID:    info.ActorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    changes,
+		IP:         info.IP,
+		UserAgent:  info.UserAgent,
+		RequestID:  info.RequestID,
+	})
+}
+
+// ListAuditEvents retrieves a page of audit events matching filter, newest first
+func (s *service) ListAuditEvents(ctx context.Context, filter AuditFilter, page, limit int) (*PaginatedAuditEvents, error) {
+	// Validate pagination parameters
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	filter.Newest = true
+	filter.Limit = limit
+	filter.Offset = (page - 1) * limit
+
+	events, err := s.repo.ListAuditEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always return a list, even when it is empty
+	if events == nil {
+		events = []*AuditEvent{}
+	}
+	return &PaginatedAuditEvents{Events: events, Page: page, Limit: limit}, nil
+}
+
+// auditBatchSize is how many events the export and verification read at a time
+const auditBatchSize = 500
+
+// ExportAuditEvents calls fn for every audit event matching filter, oldest first
+// Events are read in batches, so the whole log is never held in memory
+func (s *service) ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error {
+	filter.Newest = false
+	filter.Limit = auditBatchSize
+	filter.Offset = 0
+
+	for {
+		events, err := s.repo.ListAuditEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(events) < auditBatchSize {
+			return nil
+		}
+		filter.AfterID = events[len(events)-1].ID
+	}
+}
+
+// VerifyAuditLog walks the whole audit chain and checks every event's links and hash
+func (s *service) VerifyAuditLog(ctx context.Context) (*AuditVerification, error) {
+	result := &AuditVerification{Valid: true, HeadHash: auditGenesisHash}
+
+	err := s.ExportAuditEvents(ctx, AuditFilter{}, func(event *AuditEvent) error {
+		result.Checked++
+		switch {
+		case event.PrevHash != result.HeadHash:
+			result.Reason = "previous hash does not match the preceding event; an event was removed or inserted"
+		case event.ComputeHash() != event.Hash:
+			result.Reason = "hash does not match the event's contents; the event was modified"
+		default:
+			result.HeadHash = event.Hash
+			return nil
+		}
+
+		id := event.ID
+		result.Valid = false
+		result.BrokenAt = &id
+		return errAuditChainBroken
+	})
+	if err != nil && !errors.Is(err, errAuditChainBroken) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// errAuditChainBroken stops VerifyAuditLog at the first broken event
+var errAuditChainBroken = errors.New("audit chain broken")
+
+// RegisterStatisticsMetrics exposes the cached statistics of svc as gauges
+// Scrapes read the snapshot, so they never query the database
+func RegisterStatisticsMetrics(registry *Registry, svc Service) {
+	cached := func(value func(stats *UserStatistics) int) func() []Sample {
+		return func() []Sample {
+			stats, _ := svc.CachedStatistics()
+			if stats == nil {
+				return nil
+			}
+			return []Sample{{Value: float64(value(stats))}}
+		}
+	}
+
+	registry.GaugeFunc("app_users_total", "Registered users",
+		cached(func(stats *UserStatistics) int { return stats.TotalUsers }))
+	registry.GaugeFunc("app_jobs_pending", "Background jobs waiting to run",
+		cached(func(stats *UserStatistics) int { return stats.BackgroundJobs }))
+}
+
+// DrainError reports the background work that was still running when Close gave up
+type DrainError struct {
+	AbandonedJobs      []int64  // IDs of jobs that were cancelled; they are retried like failed attempts
+	AbandonedEvents    int      // Domain events whose async subscribers hadn't finished
+	AbandonedScheduled []string // Maintenance tasks that were cancelled mid-run
+}
+
+func (e *DrainError) Error() string {
+	var parts []string
+	if len(e.AbandonedJobs) > 0 {
+		ids := make([]string, len(e.AbandonedJobs))
+		for i, id := range e.AbandonedJobs {
+			ids[i] = fmt.Sprint(id)
+		}
+		parts = append(parts, fmt.Sprintf("%d job(s) (ids %s)", len(e.AbandonedJobs), strings.Join(ids, ", ")))
+	}
+	if e.AbandonedEvents > 0 {
+		parts = append(parts, fmt.Sprintf("%d event(s)", e.AbandonedEvents))
+	}
+	if len(e.AbandonedScheduled) > 0 {
+		parts = append(parts, fmt.Sprintf("scheduled task(s) %s", strings.Join(e.AbandonedScheduled, ", ")))
+	}
+	return "abandoned " + strings.Join(parts, " and ")
+}
+
+// Close stops accepting background work and waits for in-flight work to finish
+// Work still running when ctx expires is abandoned and reported in a *DrainError
+func (s *service) Close(ctx context.Context) error {
+	// Drain the event subscribers first, since they may still queue jobs
+	abandonedEvents := s.events.Close(ctx)
+
+	// Stop the job workers and the scheduler; running work may finish until ctx expires
+	var abandonedJobs []int64
+	var abandonedScheduled []string
+	var stopping sync.WaitGroup
+	stopping.Add(2)
+	go func() {
+		defer stopping.Done()
+		abandonedJobs = s.jobs.Close(ctx)
+	}()
+	go func() {
+		defer stopping.Done()
+		abandonedScheduled = s.scheduler.Close(ctx)
+	}()
+	stopping.Wait()
+
+	if len(abandonedJobs) > 0 || abandonedEvents > 0 || len(abandonedScheduled) > 0 {
+		return &DrainError{
+			AbandonedJobs:      abandonedJobs,
+			AbandonedEvents:    abandonedEvents,
+			AbandonedScheduled: abandonedScheduled,
+		}
+	}
+	return nil
+}
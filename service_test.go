@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newDrainTestService creates a service whose job queue runs one worker, for shutdown tests
+func newDrainTestService(t *testing.T, repo Repository) *service {
+	t.Helper()
+
+	jobs := NewJobQueue(repo, JobQueueConfig{Workers: 1, PollInterval: time.Millisecond, VisibilityTimeout: time.Minute,
+		MaxAttempts: 3, RetryBackoff: time.Minute})
+	scheduler := NewScheduler(repo, NewTaskLocker(nil, DialectSQLite), nil)
+	keys := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+	return NewService(repo, jobs, scheduler, NewEventBus(EventBusConfig{QueueSize: 10}), keys).(*service)
+}
+
+func TestServiceCloseDrainsEventsBeforeJobs(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	svc := newDrainTestService(t, repo)
+	svc.jobs.Register(JobUserAnalytics, func(context.Context, *Job) error { return nil })
+	svc.jobs.Start(ctx)
+
+	// A subscriber still running when Close starts queues a job
+	enqueued := make(chan error, 1)
+	Subscribe(svc.events, "late", DeliverAsync, func(ctx context.Context, _ testEvent) error {
+		time.Sleep(20 * time.Millisecond)
+		job, _ := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+		err := svc.jobs.Enqueue(ctx, repo, job)
+		enqueued <- err
+		return err
+	})
+	svc.events.Publish(ctx, testEvent{Aggregate: 1})
+
+	closeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := svc.Close(closeCtx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := <-enqueued; err != nil {
+		t.Errorf("Enqueue() from a draining subscriber error = %v, want the job queued", err)
+	}
+}
+
+func TestServiceCloseReportsAbandonedWork(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	svc := newDrainTestService(t, repo)
+
+	// A job, a task and an event subscriber that are all still running at the deadline
+	jobStarted := make(chan struct{})
+	svc.jobs.Register(JobUserAnalytics, func(ctx context.Context, _ *Job) error {
+		close(jobStarted)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	svc.scheduler.Register("stuck", "Runs until it is cancelled", "", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	release := make(chan struct{})
+	defer close(release)
+	Subscribe(svc.events, "stuck", DeliverAsync, func(context.Context, testEvent) error {
+		<-release
+		return nil
+	})
+
+	svc.jobs.Start(ctx)
+	job := mustEnqueueJob(t, ctx, repo)
+	svc.jobs.Notify()
+	<-jobStarted
+	if _, err := svc.TriggerTask(ctx, "stuck"); err != nil {
+		t.Fatalf("TriggerTask() error = %v", err)
+	}
+	svc.events.Publish(ctx, testEvent{Aggregate: 1})
+
+	closeCtx, cancel := context.WithTimeout(ctx, 30*time.Millisecond)
+	defer cancel()
+	err := svc.Close(closeCtx)
+
+	var drainErr *DrainError
+	if !errors.As(err, &drainErr) {
+		t.Fatalf("Close() error = %v, want a *DrainError", err)
+	}
+	want := &DrainError{AbandonedJobs: []int64{job.ID}, AbandonedEvents: 1, AbandonedScheduled: []string{"stuck"}}
+	if !reflect.DeepEqual(drainErr, want) {
+		t.Errorf("Close() = %+v, want %+v", drainErr, want)
+	}
+}
+
+func TestDrainErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  *DrainError
+		want string
+	}{
+		{&DrainError{AbandonedJobs: []int64{3, 7}}, "abandoned 2 job(s) (ids 3, 7)"},
+		{&DrainError{AbandonedEvents: 4}, "abandoned 4 event(s)"},
+		{&DrainError{AbandonedJobs: []int64{3}, AbandonedEvents: 1, AbandonedScheduled: []string{"purge_history"}},
+			"abandoned 1 job(s) (ids 3) and 1 event(s) and scheduled task(s) purge_history"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// signing.go - Rotating JWT signing keys
+// Tokens are signed with the newest key in the signing_keys table and name it in their
+// "kid" header. The rotate_signing_keys task adds a key and drops those no unexpired
+// token can have been signed with. Each key is random, and stored encrypted with
+// SIGNING_KEY_ENCRYPTION_KEY, so neither the table nor JWT_SECRET alone is enough to
+// forge a token
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKeysRefresh is how often each instance reloads the keys, so it picks up rotations made elsewhere
+const signingKeysRefresh = time.Minute
+
+// signingKeysMissRefresh is the least time between reloads caused by tokens naming an unknown key
+const signingKeysMissRefresh = 5 * time.Second
+
+// signingKeySize is the length of the random key material, to match HS256
+const signingKeySize = 32
+
+// errUnknownSigningKey is returned for tokens signed with a key that doesn't exist or was purged
+var errUnknownSigningKey = errors.New("unknown signing key")
+
+// errSigningKeyEncryptionKeyMissing is returned when keys are added or read without SIGNING_KEY_ENCRYPTION_KEY
+var errSigningKeyEncryptionKeyMissing = errors.New("signing keys require SIGNING_KEY_ENCRYPTION_KEY")
+
+// SigningKey identifies one JWT signing key
+type SigningKey struct {
+	ID string `json:"kid"`
+	// Secret is the key material sealed with SIGNING_KEY_ENCRYPTION_KEY. It is empty for keys
+	// added before the material was stored, whose material is derived from JWT_SECRET
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SigningKeys signs and validates tokens with the keys stored in the repository
+// Tokens without a kid, signed with JWT_SECRET before the first key was added, are
+// accepted until they have expired
+type SigningKeys struct {
+	repo    Repository
+	secret  []byte
+	sealing cipher.AEAD // Nil without an encryption key
+
+	mu       sync.RWMutex
+	keys     []*SigningKey     // Newest first
+	material map[string][]byte // Opened key material by key ID
+	loadedAt time.Time
+}
+
+// CheckSigningKeyEncryptionKey refuses a configuration whose signing keys would be
+// encrypted with a missing key or with one of the other secrets
+func CheckSigningKeyEncryptionKey(config *Config) error {
+	switch config.SigningKeyEncryptionKey {
+	case "":
+		return errSigningKeyEncryptionKeyMissing
+	case config.JWTSecret:
+		return errors.New("SIGNING_KEY_ENCRYPTION_KEY must differ from JWT_SECRET")
+	case config.Webhooks.SecretKey:
+		return errors.New("SIGNING_KEY_ENCRYPTION_KEY must differ from WEBHOOK_SECRET_KEY")
+	}
+	return nil
+}
+
+// NewSigningKeys creates the key set of repo
+// secret only validates tokens and keys from before the key material was stored, and
+// encryptionKey seals the material of new keys
+func NewSigningKeys(repo Repository, secret, encryptionKey string) *SigningKeys {
+	k := &SigningKeys{repo: repo, secret: []byte(secret)}
+	if encryptionKey != "" {
+		// AES-256 with a key hashed from the configured one, so any length of key works
+		key := sha256.Sum256([]byte(encryptionKey))
+		block, _ := aes.NewCipher(key[:]) // Only fails for invalid key sizes
+		k.sealing, _ = cipher.NewGCM(block)
+	}
+	return k
+}
+
+// Load reads the keys from the repository and opens their material
+func (k *SigningKeys) Load(ctx context.Context) error {
+	keys, err := k.repo.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	material := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if key.Secret == "" {
+			continue
+		}
+		if material[key.ID], err = k.open(key); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+	k.material = material
+	k.loadedAt = time.Now()
+	return nil
+}
+
+// EnsureKey adds a key when there is none with stored material, so tokens stop being
+// signed with JWT_SECRET or keys derived from it
+func (k *SigningKeys) EnsureKey(ctx context.Context) error {
+	keys := k.current(ctx, signingKeysRefresh)
+	if len(keys) > 0 && keys[0].Secret != "" {
+		return nil
+	}
+	return k.Rotate(ctx)
+}
+
+// seal encrypts key material for storage, bound to the key's ID
+func (k *SigningKeys) seal(kid string, material []byte) (string, error) {
+	if k.sealing == nil {
+		return "", errSigningKeyEncryptionKeyMissing
+	}
+
+	nonce := make([]byte, k.sealing.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to encrypt signing key: %w", err)
+	}
+	return base64.RawStdEncoding.EncodeToString(k.sealing.Seal(nonce, nonce, material, []byte(kid))), nil
+}
+
+// open decrypts the material of a stored key
+func (k *SigningKeys) open(key *SigningKey) ([]byte, error) {
+	if k.sealing == nil {
+		return nil, errSigningKeyEncryptionKeyMissing
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(key.Secret)
+	if err != nil || len(sealed) < k.sealing.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt signing key %s: malformed value", key.ID)
+	}
+	nonce, ciphertext := sealed[:k.sealing.NonceSize()], sealed[k.sealing.NonceSize():]
+	material, err := k.sealing.Open(nil, nonce, ciphertext, []byte(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt signing key %s: wrong SIGNING_KEY_ENCRYPTION_KEY?", key.ID)
+	}
+	return material, nil
+}
+
+// current returns the keys, reloading them first if they were loaded longer than maxAge ago
+// A failed reload is logged and the keys already loaded are used
+func (k *SigningKeys) current(ctx context.Context, maxAge time.Duration) []*SigningKey {
+	k.mu.RLock()
+	keys, stale := k.keys, time.Since(k.loadedAt) > maxAge
+	k.mu.RUnlock()
+
+	if !stale {
+		return keys
+	}
+	if err := k.Load(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to load signing keys", "error", err)
+		return keys
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys
+}
+
+// keyMaterial returns the material of key: the stored one, or for older keys an HMAC
+// of its ID keyed with JWT_SECRET
+func (k *SigningKeys) keyMaterial(key *SigningKey) []byte {
+	if key.Secret == "" {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(key.ID))
+		return mac.Sum(nil)
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.material[key.ID]
+}
+
+// Sign issues a token for userID with the newest key
+func (k *SigningKeys) Sign(ctx context.Context, userID int) (string, error) {
+	keys := k.current(ctx, signingKeysRefresh)
+	if len(keys) == 0 {
+		return GenerateJWT(userID, "", k.secret)
+	}
+	return GenerateJWT(userID, keys[0].ID, k.keyMaterial(keys[0]))
+}
+
+// Validate checks token's signature against the key it names and returns its claims
+func (k *SigningKeys) Validate(ctx context.Context, token string) (*JWTClaims, error) {
+	return ValidateJWT(token, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		keys := k.current(ctx, signingKeysRefresh)
+
+		if kid == "" {
+			// Tokens signed with JWT_SECRET stay valid until the last of them has expired
+			if len(keys) > 0 && time.Since(keys[len(keys)-1].CreatedAt) > tokenLifetime+signingKeysRefresh {
+				return nil, errUnknownSigningKey
+			}
+			return k.secret, nil
+		}
+
+		key := findSigningKey(keys, kid)
+		if key == nil {
+			// The key may have just been added by another instance
+			keys = k.current(ctx, signingKeysMissRefresh)
+			if key = findSigningKey(keys, kid); key == nil {
+				return nil, errUnknownSigningKey
+			}
+		}
+		return k.keyMaterial(key), nil
+	})
+}
+
+// findSigningKey returns the key in keys with the given ID, or nil
+func findSigningKey(keys []*SigningKey, kid string) *SigningKey {
+	for _, key := range keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate adds a new key for signing and purges the keys no unexpired token can have been signed with
+// Other instances keep signing with the old key until they reload, so it is kept that much longer
+func (k *SigningKeys) Rotate(ctx context.Context) error {
+	id := make([]byte, 16)
+	material := make([]byte, signingKeySize)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	if _, err := rand.Read(material); err != nil {
+		return fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	key := &SigningKey{ID: hex.EncodeToString(id)}
+	sealed, err := k.seal(key.ID, material)
+	if err != nil {
+		return err
+	}
+	key.Secret = sealed
+	if err := k.repo.AddSigningKey(ctx, key); err != nil {
+		return err
+	}
+	purged, err := k.repo.PurgeSigningKeys(ctx, time.Now().Add(-tokenLifetime-signingKeysRefresh))
+	if err != nil {
+		return err
+	}
+	if err := k.Load(ctx); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Rotated signing key", "kid", key.ID, "purged", purged)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSigningKeysRotation(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	keys := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+	if err := keys.Load(ctx); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// Before the first rotation tokens are signed with the secret itself
+	legacy, err := keys.Sign(ctx, 7)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if claims, err := keys.Validate(ctx, legacy); err != nil || claims.UserID != 7 {
+		t.Fatalf("Validate() of a token without kid = %+v, %v", claims, err)
+	}
+
+	if err := keys.Rotate(ctx); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	rotated, err := keys.Sign(ctx, 7)
+	if err != nil {
+		t.Fatalf("Sign() after rotating error = %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(rotated, &JWTClaims{})
+	if err != nil || token.Header["kid"] == nil {
+		t.Fatalf("token after rotating has no kid: %v", err)
+	}
+	if _, err := keys.Validate(ctx, rotated); err != nil {
+		t.Errorf("Validate() of a rotated token error = %v", err)
+	}
+	if _, err := keys.Validate(ctx, legacy); err != nil {
+		t.Errorf("Validate() of an unexpired token without kid error = %v", err)
+	}
+
+	// Another instance sharing the repository picks up the new key
+	other := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+	if _, err := other.Validate(ctx, rotated); err != nil {
+		t.Errorf("Validate() on another instance error = %v", err)
+	}
+
+	// Keys don't depend on JWT_SECRET, and the table alone isn't enough to read them
+	if _, err := NewSigningKeys(repo, "other-secret", "test-encryption-key").Validate(ctx, rotated); err != nil {
+		t.Errorf("Validate() with a different JWT secret error = %v", err)
+	}
+	if err := NewSigningKeys(repo, "test-secret", "other-encryption-key").Load(ctx); err == nil {
+		t.Error("Load() with a different encryption key succeeded")
+	}
+	forged, _ := GenerateJWT(7, "unknown", []byte("test-secret"))
+	if _, err := keys.Validate(ctx, forged); err == nil {
+		t.Error("a token naming an unknown key validated")
+	}
+}
+
+func TestSigningKeysRejectLegacyTokensOnceExpired(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	keys := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+
+	// A key older than a token's lifetime means every token signed without kid has expired
+	expired := time.Now().Add(-tokenLifetime - signingKeysRefresh - time.Minute)
+	repo.(*memoryRepository).signingKeys = []*SigningKey{
+		{ID: "old", CreatedAt: expired},
+		{ID: "older", CreatedAt: expired.Add(-tokenLifetime)},
+	}
+	if err := keys.Load(ctx); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	legacy, _ := GenerateJWT(7, "", []byte("test-secret"))
+	if _, err := keys.Validate(ctx, legacy); err == nil {
+		t.Error("a token without kid validated after its lifetime passed")
+	}
+
+	// Rotating keeps the key that was still signing at the cutoff and drops the ones before it
+	if err := keys.Rotate(ctx); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	stored, _ := repo.ListSigningKeys(ctx)
+	if len(stored) != 2 || stored[1].ID != "old" {
+		t.Errorf("keys after rotating = %v, want the new key and old", stored)
+	}
+}
+
+func TestSigningKeysStoreEncryptedMaterial(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	keys := NewSigningKeys(repo, "test-secret", "test-encryption-key")
+
+	// A key from before the material was stored is derived from JWT_SECRET until it is replaced
+	repo.(*memoryRepository).signingKeys = []*SigningKey{{ID: "legacy", CreatedAt: time.Now()}}
+	if err := keys.Load(ctx); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	legacy, _ := keys.Sign(ctx, 7)
+	if err := keys.EnsureKey(ctx); err != nil {
+		t.Fatalf("EnsureKey() error = %v", err)
+	}
+	stored, _ := repo.ListSigningKeys(ctx)
+	if len(stored) != 2 || stored[0].Secret == "" {
+		t.Fatalf("keys after EnsureKey() = %+v, want a new key with stored material", stored)
+	}
+	if _, err := keys.Validate(ctx, legacy); err != nil {
+		t.Errorf("Validate() of a token signed with the derived key error = %v", err)
+	}
+
+	// The stored value is sealed and bound to its key ID
+	material := keys.keyMaterial(stored[0])
+	if len(material) != signingKeySize || strings.Contains(stored[0].Secret, base64.RawStdEncoding.EncodeToString(material)) {
+		t.Errorf("material = %x stored as %q, want %d random bytes stored encrypted", material, stored[0].Secret, signingKeySize)
+	}
+	if _, err := keys.open(&SigningKey{ID: "legacy", Secret: stored[0].Secret}); err == nil {
+		t.Error("open() accepted material stored under another key ID")
+	}
+
+	// Once there is such a key, EnsureKey leaves it in place
+	if err := keys.EnsureKey(ctx); err != nil {
+		t.Fatalf("EnsureKey() error = %v", err)
+	}
+	if again, _ := repo.ListSigningKeys(ctx); len(again) != 2 {
+		t.Errorf("EnsureKey() with a usable key added one: %d keys", len(again))
+	}
+
+	if err := NewSigningKeys(repo, "test-secret", "").Rotate(ctx); !errors.Is(err, errSigningKeyEncryptionKeyMissing) {
+		t.Errorf("Rotate() without an encryption key = %v, want errSigningKeyEncryptionKeyMissing", err)
+	}
+}
+
+func TestCheckSigningKeyEncryptionKey(t *testing.T) {
+	for key, want := range map[string]bool{"": false, "jwt-secret": false, "webhook-key": false, "signing-key": true} {
+		config := &Config{JWTSecret: "jwt-secret", SigningKeyEncryptionKey: key, Webhooks: WebhookConfig{SecretKey: "webhook-key"}}
+		if err := CheckSigningKeyEncryptionKey(config); (err == nil) != want {
+			t.Errorf("CheckSigningKeyEncryptionKey(%q) = %v, want accepted %t", key, err, want)
+		}
+	}
+}
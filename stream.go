@@ -0,0 +1,329 @@
+// stream.go - Real-time event stream
+// Every instance tails the outbox table by event ID, so each client sees every
+// user.* event whichever instance it is connected to. The stream keeps a bounded
+// replay buffer and fans events out to connected SSE and WebSocket clients. Each
+// client has its own small buffer; a client that falls too far behind is
+// disconnected with an "overflow" notice and can resume from the replay buffer
+// with Last-Event-ID instead of slowing down everyone else. Event IDs are outbox
+// IDs, so a client can resume on any instance, and after a restart
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Control messages sent to stream clients alongside user.* events
+const (
+	StreamHeartbeat = "heartbeat" // Sent every heartbeat interval so proxies keep the connection open
+	StreamReset     = "reset"     // The requested Last-Event-ID is no longer buffered; refetch current state
+	StreamOverflow  = "overflow"  // The client fell behind and is being disconnected; reconnect with Last-Event-ID
+)
+
+// streamBatchSize is how many outbox events one poll reads
+const streamBatchSize = 100
+
+// streamGapTimeout is how long the stream waits for a missing outbox ID below the highest
+// one it has read. Postgres assigns IDs before commit, so a transaction that commits late
+// shows up below events already streamed; IDs of rolled back transactions never show up
+const streamGapTimeout = time.Minute
+
+// streamMaxGaps bounds the missing IDs the stream waits for
+const streamMaxGaps = 1000
+
+// StreamConfig configures the event stream
+type StreamConfig struct {
+	ReplaySize        int           // Events kept for Last-Event-ID resume
+	ClientBuffer      int           // Events queued per client before it is disconnected
+	HeartbeatInterval time.Duration // How often idle connections get a heartbeat
+	WriteTimeout      time.Duration // How long a single write to a client may take
+	PollInterval      time.Duration // How often the outbox is read for new events
+}
+
+// streamMessage is the JSON sent for each event over WebSocket, and as SSE data
+type streamMessage struct {
+	ID    int64        `json:"id,omitempty"`
+	Type  string       `json:"type"`
+	Event *OutboxEvent `json:"event,omitempty"`
+}
+
+// StreamFilter decides whether a client may see an event
+type StreamFilter func(event *OutboxEvent) bool
+
+// StreamSubscription is one connected client
+type StreamSubscription struct {
+	events   chan *OutboxEvent
+	done     chan struct{} // Closed when the stream drops the client
+	overflow bool          // Set before done is closed if the client fell behind
+	filter   StreamFilter
+}
+
+// Events delivers the client's events in the order the stream read them
+func (s *StreamSubscription) Events() <-chan *OutboxEvent { return s.events }
+
+// Done is closed when the stream drops the client, because it fell behind or the stream closed
+func (s *StreamSubscription) Done() <-chan struct{} { return s.done }
+
+// Overflowed reports whether the client was dropped for falling behind; only valid after Done
+func (s *StreamSubscription) Overflowed() bool { return s.overflow }
+
+// EventStream pushes the events in the outbox to connected clients
+type EventStream struct {
+	repo   Repository
+	config StreamConfig
+
+	mu          sync.Mutex
+	buffer      []*OutboxEvent // Ring buffer of recent events in the order they were read, oldest at start
+	start       int
+	evictedID   int64 // Highest ID dropped from the buffer, or left out of it by Load
+	subscribers map[*StreamSubscription]struct{}
+	closed      bool
+
+	// Only used by the goroutine reading the outbox
+	lastID int64               // Highest outbox ID read
+	gaps   map[int64]time.Time // Missing IDs below lastID, with when they were noticed
+
+	overflows atomic.Int64 // Clients dropped for falling behind
+}
+
+// NewEventStream creates an event stream that reads the outbox of repo
+func NewEventStream(repo Repository, config StreamConfig) *EventStream {
+	return &EventStream{
+		repo:        repo,
+		config:      config,
+		buffer:      make([]*OutboxEvent, 0, config.ReplaySize),
+		subscribers: make(map[*StreamSubscription]struct{}),
+		gaps:        make(map[int64]time.Time),
+	}
+}
+
+// Load fills the replay buffer with the latest events, so clients can resume right
+// after a restart or from another instance; it must run before Start
+func (s *EventStream) Load(ctx context.Context) error {
+	last, err := s.repo.LastOutboxEventID(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.lastID = max(0, last-int64(s.config.ReplaySize))
+	s.mu.Lock()
+	s.evictedID = s.lastID
+	s.mu.Unlock()
+
+	for {
+		read, err := s.poll(ctx)
+		if err != nil {
+			return err
+		}
+		if read < streamBatchSize {
+			return nil
+		}
+	}
+}
+
+// Start reads new events from the outbox every PollInterval until ctx is cancelled
+func (s *EventStream) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			// Keep reading while full batches come back
+			for {
+				if read, err := s.pollSafely(ctx); err != nil || read < streamBatchSize {
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// pollSafely runs poll, recovering a panic so the stream keeps reading
+func (s *EventStream) pollSafely(ctx context.Context) (read int, err error) {
+	defer recoverPanic(ctx, "event stream", &err)
+
+	read, err = s.poll(ctx)
+	if err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "Event stream failed to read the outbox", "error", err)
+	}
+	return read, err
+}
+
+// poll publishes the events after lastID, and any missing ones that have since committed
+func (s *EventStream) poll(ctx context.Context) (int, error) {
+	events, err := s.repo.ListOutboxEvents(ctx, s.lastID, streamBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, event := range events {
+		for id := s.lastID + 1; id < event.ID && len(s.gaps) < streamMaxGaps; id++ {
+			s.gaps[id] = now
+		}
+		s.lastID = event.ID
+		s.publish(event)
+	}
+
+	if err := s.fillGaps(ctx, now); err != nil {
+		return len(events), err
+	}
+	return len(events), nil
+}
+
+// fillGaps publishes the missing events that have committed and gives up on those missing too long
+func (s *EventStream) fillGaps(ctx context.Context, now time.Time) error {
+	first := int64(0)
+	for id, noticed := range s.gaps {
+		if now.Sub(noticed) > streamGapTimeout {
+			delete(s.gaps, id)
+			continue
+		}
+		if first == 0 || id < first {
+			first = id
+		}
+	}
+	if first == 0 {
+		return nil
+	}
+
+	late, err := s.repo.ListOutboxEvents(ctx, first-1, streamBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, event := range late {
+		if _, ok := s.gaps[event.ID]; ok {
+			delete(s.gaps, event.ID)
+			s.publish(event)
+		}
+	}
+	return nil
+}
+
+// publish buffers an event and pushes it to every client allowed to see it
+// It never blocks on clients, so a slow client can't hold up the others
+func (s *EventStream) publish(event *OutboxEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if len(s.buffer) < s.config.ReplaySize {
+		s.buffer = append(s.buffer, event)
+	} else if s.config.ReplaySize > 0 {
+		s.evictedID = max(s.evictedID, s.buffer[s.start].ID)
+		s.buffer[s.start] = event
+		s.start = (s.start + 1) % len(s.buffer)
+	} else {
+		s.evictedID = max(s.evictedID, event.ID)
+	}
+
+	for sub := range s.subscribers {
+		if !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// The client's buffer is full - drop it rather than block
+			s.drop(sub, true)
+			s.overflows.Add(1)
+		}
+	}
+}
+
+// Subscribe registers a client and returns the buffered events it may see that it missed
+// after the event with ID lastID: those read after it, and any with a higher ID.
+// reset is true when events with a higher ID were already evicted from the replay
+// buffer, so the client missed events and should refetch current state
+func (s *EventStream) Subscribe(lastID int64, filter StreamFilter) (sub *StreamSubscription, replay []*OutboxEvent, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub = &StreamSubscription{
+		events: make(chan *OutboxEvent, s.config.ClientBuffer),
+		done:   make(chan struct{}),
+		filter: filter,
+	}
+	if s.closed {
+		close(sub.done)
+		return sub, nil, false
+	}
+
+	if lastID > 0 {
+		position := -1
+		for i := 0; i < len(s.buffer); i++ {
+			if s.buffer[(s.start+i)%len(s.buffer)].ID == lastID {
+				position = i
+			}
+		}
+		reset = position < 0 && lastID < s.evictedID
+
+		for i := 0; i < len(s.buffer); i++ {
+			event := s.buffer[(s.start+i)%len(s.buffer)]
+			if (event.ID > lastID || (position >= 0 && i > position)) && filter(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	s.subscribers[sub] = struct{}{}
+	return sub, replay, reset
+}
+
+// Unsubscribe removes a client
+func (s *EventStream) Unsubscribe(sub *StreamSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[sub]; ok {
+		s.drop(sub, false)
+	}
+}
+
+// Close disconnects every client; it is run when the server shuts down
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for sub := range s.subscribers {
+		s.drop(sub, false)
+	}
+}
+
+// Clients returns the number of connected clients
+func (s *EventStream) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subscribers)
+}
+
+// drop removes a client and signals it to disconnect; the caller must hold s.mu
+func (s *EventStream) drop(sub *StreamSubscription, overflow bool) {
+	delete(s.subscribers, sub)
+	sub.overflow = overflow
+	close(sub.done)
+}
+
+// RegisterStreamMetrics exposes the number of stream clients and overflows
+func RegisterStreamMetrics(registry *Registry, stream *EventStream) {
+	registry.GaugeFunc("app_stream_clients", "Connected SSE and WebSocket clients", func() []Sample {
+		return []Sample{{Value: float64(stream.Clients())}}
+	})
+	registry.CounterFunc("app_stream_overflows_total", "Stream clients disconnected for falling behind", func() []Sample {
+		return []Sample{{Value: float64(stream.overflows.Load())}}
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// addStreamEvents writes count user.updated events to the outbox, for users 1 and 2 in turn
+func addStreamEvents(t *testing.T, repo Repository, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		event := &OutboxEvent{EventType: EventUserUpdated, AggregateType: "user", AggregateID: 1 + i%2, Payload: json.RawMessage(`{}`)}
+		if err := repo.AddOutboxEvent(context.Background(), event); err != nil {
+			t.Fatalf("AddOutboxEvent() error = %v", err)
+		}
+	}
+}
+
+// newTestStream creates an event stream over repo and loads its recent events
+func newTestStream(t *testing.T, repo Repository, config StreamConfig) *EventStream {
+	t.Helper()
+
+	stream := NewEventStream(repo, config)
+	if err := stream.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return stream
+}
+
+// streamIDs lists the IDs of events, for comparisons
+func streamIDs(events []*OutboxEvent) []int64 {
+	var ids []int64
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestEventStreamSubscribeReplay(t *testing.T) {
+	all := func(*OutboxEvent) bool { return true }
+	user1 := func(event *OutboxEvent) bool { return event.AggregateID == 1 }
+
+	// Five events through a buffer of three leaves events 3 to 5
+	tests := []struct {
+		name   string
+		lastID int64
+		filter StreamFilter
+		replay []int64
+		reset  bool
+	}{
+		{"new client", 0, all, nil, false},
+		{"just before the buffer", 2, all, []int64{3, 4, 5}, false},
+		{"inside the buffer", 4, all, []int64{5}, false},
+		{"up to date", 5, all, nil, false},
+		{"evicted", 1, all, []int64{3, 4, 5}, true},
+		{"ahead of this instance", 9, all, nil, false},
+		{"filtered", 2, user1, []int64{3, 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewMemoryRepository()
+			stream := newTestStream(t, repo, StreamConfig{ReplaySize: 3, ClientBuffer: 1})
+			addStreamEvents(t, repo, 5)
+			if _, err := stream.poll(context.Background()); err != nil {
+				t.Fatalf("poll() error = %v", err)
+			}
+
+			sub, replay, reset := stream.Subscribe(tt.lastID, tt.filter)
+			if !reflect.DeepEqual(streamIDs(replay), tt.replay) || reset != tt.reset {
+				t.Errorf("Subscribe(%d) = %v, reset %t; want %v, reset %t", tt.lastID, streamIDs(replay), reset, tt.replay, tt.reset)
+			}
+			if stream.Clients() != 1 {
+				t.Errorf("Clients() = %d, want 1", stream.Clients())
+			}
+			stream.Unsubscribe(sub)
+		})
+	}
+}
+
+func TestEventStreamResumesOnAnotherInstance(t *testing.T) {
+	all := func(*OutboxEvent) bool { return true }
+	repo := NewMemoryRepository()
+	addStreamEvents(t, repo, 4)
+
+	// Both instances see every event, whichever relay delivered it, under the same IDs
+	first := newTestStream(t, repo, StreamConfig{ReplaySize: 10, ClientBuffer: 10})
+	second := newTestStream(t, repo, StreamConfig{ReplaySize: 10, ClientBuffer: 10})
+	if _, replay, _ := first.Subscribe(2, all); !reflect.DeepEqual(streamIDs(replay), []int64{3, 4}) {
+		t.Errorf("first instance replay = %v, want [3 4]", streamIDs(replay))
+	}
+	if _, replay, reset := second.Subscribe(2, all); !reflect.DeepEqual(streamIDs(replay), []int64{3, 4}) || reset {
+		t.Errorf("second instance replay = %v, reset %t; want [3 4]", streamIDs(replay), reset)
+	}
+
+	// A restarted instance loads the recent events, so clients resume instead of resetting
+	restarted := newTestStream(t, repo, StreamConfig{ReplaySize: 2, ClientBuffer: 10})
+	if _, replay, reset := restarted.Subscribe(3, all); !reflect.DeepEqual(streamIDs(replay), []int64{4}) || reset {
+		t.Errorf("restarted instance replay = %v, reset %t; want [4]", streamIDs(replay), reset)
+	}
+	if _, _, reset := restarted.Subscribe(1, all); !reset {
+		t.Error("restarted instance didn't reset a client older than its buffer")
+	}
+}
+
+func TestEventStreamPublishesLateCommits(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository().(*memoryRepository)
+	stream := newTestStream(t, repo, StreamConfig{ReplaySize: 10, ClientBuffer: 10})
+	sub, _, _ := stream.Subscribe(0, func(*OutboxEvent) bool { return true })
+
+	// Event 2's transaction commits after event 3's
+	addStreamEvents(t, repo, 3)
+	late := repo.outbox[1]
+	repo.outbox = append(repo.outbox[:1:1], repo.outbox[2])
+	stream.poll(ctx)
+
+	repo.outbox = []*memoryOutboxEntry{repo.outbox[0], late, repo.outbox[1]}
+	stream.poll(ctx)
+	stream.poll(ctx)
+
+	var received []int64
+	for len(sub.Events()) > 0 {
+		received = append(received, (<-sub.Events()).ID)
+	}
+	if !reflect.DeepEqual(received, []int64{1, 3, 2}) {
+		t.Errorf("received %v, want [1 3 2] with the late event once", received)
+	}
+
+	// A client that saw 3 before 2 committed still gets 2 on resume
+	if _, replay, _ := stream.Subscribe(3, func(*OutboxEvent) bool { return true }); !reflect.DeepEqual(streamIDs(replay), []int64{2}) {
+		t.Errorf("replay after 3 = %v, want [2]", streamIDs(replay))
+	}
+}
+
+func TestEventStreamDropsSlowClients(t *testing.T) {
+	repo := NewMemoryRepository()
+	stream := newTestStream(t, repo, StreamConfig{ReplaySize: 3, ClientBuffer: 1})
+	sub, _, _ := stream.Subscribe(0, func(*OutboxEvent) bool { return true })
+
+	addStreamEvents(t, repo, 2)
+	if _, err := stream.poll(context.Background()); err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+
+	if event := <-sub.Events(); event.ID != 1 {
+		t.Errorf("first event = %d, want 1", event.ID)
+	}
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatal("client with a full buffer was not dropped")
+	}
+	if !sub.Overflowed() || stream.Clients() != 0 || stream.overflows.Load() != 1 {
+		t.Errorf("overflowed = %t, clients = %d, overflows = %d", sub.Overflowed(), stream.Clients(), stream.overflows.Load())
+	}
+}
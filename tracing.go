@@ -0,0 +1,760 @@
+// tracing.go - OpenTelemetry tracing
+// TracingMiddleware starts a server span per request, continuing the caller's
+// trace from its W3C traceparent header. Service and Repository methods and SQL
+// statements get child spans. Jobs remember the traceparent of the request that
+// queued them and start their own trace linked back to it. Spans are exported
+// over OTLP/HTTP, or printed to stdout for local runs
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig configures span export
+type TracingConfig struct {
+	Exporter    string  // "none", "stdout" or "otlp"
+	Endpoint    string  // OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces
+	ServiceName string  // service.name resource attribute
+	SampleRatio float64 // Fraction of new traces to record; traces continued from a caller follow its decision
+}
+
+// tracer creates the application's spans
+// It is a global delegate, so spans go to whichever provider InitTracing installs
+var tracer = otel.Tracer("github.com/naval1525/my-go-api")
+
+// propagator reads and writes W3C traceparent/tracestate and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// InitTracing installs the tracer provider and propagator described by config
+// The returned function flushes buffered spans and must be called before exit
+func InitTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	// Propagate trace context even when nothing is exported, so downstream services stay in the caller's trace
+	otel.SetTextMapPropagator(propagator)
+	// Export failures are logged like everything else instead of through the SDK's own logger
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("Tracing failed", "error", err)
+	}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(config.Exporter) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", config.Exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(config.ServiceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// TracingMiddleware starts a server span for every request
+// It runs first so the request ID, logs and every later middleware see the span
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		// Name spans by route template so they group by endpoint; unmatched paths share one name
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if len(c.Errors) > 0 {
+			span.RecordError(c.Errors.Last().Err)
+		}
+		// Client errors are the caller's problem, so only server errors mark the span as failed
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+	}
+}
+
+// startSpan starts a child span of the span in ctx
+// Outside a trace it does nothing, so polling loops such as the job workers
+// and outbox relay don't start a new trace for every poll
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
+
+// failSpan records err on span and marks it as failed
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// traceParentFrom returns the W3C traceparent of the span in ctx, or "" outside a trace
+func traceParentFrom(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// startJobSpan starts the root span of one job attempt, linked to the span that queued the job
+// A job can run long after the request that queued it has finished, so it gets
+// its own trace instead of becoming a child of the request's
+func startJobSpan(ctx context.Context, job *Job) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int64("job.id", job.ID),
+			attribute.String("job.kind", string(job.Kind)),
+			attribute.Int("job.attempt", job.Attempts),
+		),
+	}
+
+	queued := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": job.TraceParent})
+	if parent := trace.SpanContextFromContext(queued); parent.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: parent}))
+	}
+	return tracer.Start(ctx, "job "+string(job.Kind), opts...)
+}
+
+// startQuerySpan starts the span of one SQL statement
+func startQuerySpan(ctx context.Context, dialect Dialect, query string) (context.Context, trace.Span) {
+	system := semconv.DBSystemNamePostgreSQL
+	if dialect == DialectSQLite {
+		system = semconv.DBSystemNameSQLite
+	}
+
+	sanitized := sanitizeQuery(query)
+	operation, _, _ := strings.Cut(sanitized, " ")
+	operation = strings.ToUpper(operation)
+	return startSpan(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(system, semconv.DBOperationName(operation), semconv.DBQueryText(sanitized)),
+	)
+}
+
+// quotedLiteral matches a single quoted SQL string, including doubled quotes inside it
+var quotedLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+
+// sanitizeQuery prepares a statement for logs and spans: whitespace is collapsed and
+// string literals are replaced with '?'. Values are passed as $N arguments, which are
+// never recorded, so this only guards against literals written into the SQL itself
+func sanitizeQuery(query string) string {
+	return quotedLiteral.ReplaceAllString(strings.Join(strings.Fields(query), " "), "'?'")
+}
+
+// tracedService starts a span for every Service method
+type tracedService struct {
+	next Service
+}
+
+// NewTracedService wraps svc so each of its methods runs in a child span
+func NewTracedService(svc Service) Service {
+	return &tracedService{next: svc}
+}
+
+func (t *tracedService) Register(ctx context.Context, req *RegisterRequest) (*User, error) {
+	ctx, span := startSpan(ctx, "Service.Register")
+	result, err := t.next.Register(ctx, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) Login(ctx context.Context, req *LoginRequest) (string, error) {
+	ctx, span := startSpan(ctx, "Service.Login")
+	result, err := t.next.Login(ctx, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) GetUser(ctx context.Context, id int) (*User, error) {
+	ctx, span := startSpan(ctx, "Service.GetUser")
+	result, err := t.next.GetUser(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) GetUsers(ctx context.Context, page, limit int) (*PaginatedUsers, error) {
+	ctx, span := startSpan(ctx, "Service.GetUsers")
+	result, err := t.next.GetUsers(ctx, page, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) UpdateUser(ctx context.Context, id int, req *UpdateUserRequest) (*User, error) {
+	ctx, span := startSpan(ctx, "Service.UpdateUser")
+	result, err := t.next.UpdateUser(ctx, id, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) DeleteUser(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "Service.DeleteUser")
+	err := t.next.DeleteUser(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedService) ProcessUserAnalytics(ctx context.Context, userID int) (*Job, error) {
+	ctx, span := startSpan(ctx, "Service.ProcessUserAnalytics")
+	result, err := t.next.ProcessUserAnalytics(ctx, userID)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) GetUserStatistics(ctx context.Context) (*UserStatistics, error) {
+	ctx, span := startSpan(ctx, "Service.GetUserStatistics")
+	result, err := t.next.GetUserStatistics(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) GetJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startSpan(ctx, "Service.GetJob")
+	result, err := t.next.GetJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) ListJobs(ctx context.Context, state string, page, limit int) (*PaginatedJobs, error) {
+	ctx, span := startSpan(ctx, "Service.ListJobs")
+	result, err := t.next.ListJobs(ctx, state, page, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) RetryJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startSpan(ctx, "Service.RetryJob")
+	result, err := t.next.RetryJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) CancelJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startSpan(ctx, "Service.CancelJob")
+	result, err := t.next.CancelJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) ScheduledTasks() []TaskInfo {
+	return t.next.ScheduledTasks()
+}
+
+func (t *tracedService) ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error) {
+	ctx, span := startSpan(ctx, "Service.ListScheduledRuns")
+	result, err := t.next.ListScheduledRuns(ctx, task, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) TriggerTask(ctx context.Context, name string) (*ScheduledRun, error) {
+	ctx, span := startSpan(ctx, "Service.TriggerTask")
+	result, err := t.next.TriggerTask(ctx, name)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) CachedStatistics() (*UserStatistics, time.Time) {
+	return t.next.CachedStatistics()
+}
+
+func (t *tracedService) CreateWebhook(ctx context.Context, req *CreateWebhookRequest) (*WebhookSubscription, error) {
+	ctx, span := startSpan(ctx, "Service.CreateWebhook")
+	result, err := t.next.CreateWebhook(ctx, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) ListWebhooks(ctx context.Context) ([]*WebhookSubscription, error) {
+	ctx, span := startSpan(ctx, "Service.ListWebhooks")
+	result, err := t.next.ListWebhooks(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) GetWebhook(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	ctx, span := startSpan(ctx, "Service.GetWebhook")
+	result, err := t.next.GetWebhook(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) UpdateWebhook(ctx context.Context, id int64, req *UpdateWebhookRequest) (*WebhookSubscription, error) {
+	ctx, span := startSpan(ctx, "Service.UpdateWebhook")
+	result, err := t.next.UpdateWebhook(ctx, id, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) DeleteWebhook(ctx context.Context, id int64) error {
+	ctx, span := startSpan(ctx, "Service.DeleteWebhook")
+	err := t.next.DeleteWebhook(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedService) ListWebhookDeliveries(ctx context.Context, id int64, limit int) ([]*WebhookDelivery, error) {
+	ctx, span := startSpan(ctx, "Service.ListWebhookDeliveries")
+	result, err := t.next.ListWebhookDeliveries(ctx, id, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) RedeliverWebhook(ctx context.Context, deliveryID int64) (*WebhookDelivery, error) {
+	ctx, span := startSpan(ctx, "Service.RedeliverWebhook")
+	result, err := t.next.RedeliverWebhook(ctx, deliveryID)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) ListAuditEvents(ctx context.Context, filter AuditFilter, page, limit int) (*PaginatedAuditEvents, error) {
+	ctx, span := startSpan(ctx, "Service.ListAuditEvents")
+	result, err := t.next.ListAuditEvents(ctx, filter, page, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error {
+	ctx, span := startSpan(ctx, "Service.ExportAuditEvents")
+	err := t.next.ExportAuditEvents(ctx, filter, fn)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedService) VerifyAuditLog(ctx context.Context) (*AuditVerification, error) {
+	ctx, span := startSpan(ctx, "Service.VerifyAuditLog")
+	result, err := t.next.VerifyAuditLog(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedService) Close(ctx context.Context) error {
+	return t.next.Close(ctx)
+}
+
+// startRepositorySpan starts the span of a Repository method and records the method in ctx,
+// so the statements it runs are timed under its name
+func startRepositorySpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	ctx = context.WithValue(ctx, repositoryMethodKey{}, method)
+	return startSpan(ctx, "Repository."+method)
+}
+
+// tracedRepository starts a span for every Repository method
+type tracedRepository struct {
+	next Repository
+}
+
+// NewTracedRepository wraps repo so each of its methods runs in a child span
+func NewTracedRepository(repo Repository) Repository {
+	return &tracedRepository{next: repo}
+}
+
+func (t *tracedRepository) CreateUser(ctx context.Context, user *User) error {
+	ctx, span := startRepositorySpan(ctx, "CreateUser")
+	err := t.next.CreateUser(ctx, user)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) GetUserByID(ctx context.Context, id int) (*User, error) {
+	ctx, span := startRepositorySpan(ctx, "GetUserByID")
+	result, err := t.next.GetUserByID(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := startRepositorySpan(ctx, "GetUserByEmail")
+	result, err := t.next.GetUserByEmail(ctx, email)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) GetUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	ctx, span := startRepositorySpan(ctx, "GetUsers")
+	result, err := t.next.GetUsers(ctx, limit, offset)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) UpdateUser(ctx context.Context, id int, updates map[string]interface{}) error {
+	ctx, span := startRepositorySpan(ctx, "UpdateUser")
+	err := t.next.UpdateUser(ctx, id, updates)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) DeleteUser(ctx context.Context, id int) error {
+	ctx, span := startRepositorySpan(ctx, "DeleteUser")
+	err := t.next.DeleteUser(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) GetUserCount(ctx context.Context) (int, error) {
+	ctx, span := startRepositorySpan(ctx, "GetUserCount")
+	result, err := t.next.GetUserCount(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "PurgeDeletedUsers")
+	result, err := t.next.PurgeDeletedUsers(ctx, before)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) AddOutboxEvent(ctx context.Context, event *OutboxEvent) error {
+	ctx, span := startRepositorySpan(ctx, "AddOutboxEvent")
+	err := t.next.AddOutboxEvent(ctx, event)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	ctx, span := startRepositorySpan(ctx, "ClaimOutboxEvents")
+	result, err := t.next.ClaimOutboxEvents(ctx, limit, lease)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) MarkOutboxDispatched(ctx context.Context, id int64) error {
+	ctx, span := startRepositorySpan(ctx, "MarkOutboxDispatched")
+	err := t.next.MarkOutboxDispatched(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) MarkOutboxFailed(ctx context.Context, id int64, lastError string, retryAt time.Time, deliveredSinks []string) error {
+	ctx, span := startRepositorySpan(ctx, "MarkOutboxFailed")
+	err := t.next.MarkOutboxFailed(ctx, id, lastError, retryAt, deliveredSinks)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ListOutboxEvents(ctx context.Context, afterID int64, limit int) ([]*OutboxEvent, error) {
+	ctx, span := startRepositorySpan(ctx, "ListOutboxEvents")
+	result, err := t.next.ListOutboxEvents(ctx, afterID, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) LastOutboxEventID(ctx context.Context) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "LastOutboxEventID")
+	result, err := t.next.LastOutboxEventID(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) EnqueueJob(ctx context.Context, job *Job) error {
+	ctx, span := startRepositorySpan(ctx, "EnqueueJob")
+	err := t.next.EnqueueJob(ctx, job)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ClaimJob(ctx context.Context, visibilityTimeout time.Duration) (*Job, error) {
+	ctx, span := startRepositorySpan(ctx, "ClaimJob")
+	result, err := t.next.ClaimJob(ctx, visibilityTimeout)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CompleteJob(ctx context.Context, id int64, attempt int) error {
+	ctx, span := startRepositorySpan(ctx, "CompleteJob")
+	err := t.next.CompleteJob(ctx, id, attempt)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) FailJob(ctx context.Context, id int64, attempt int, lastError string, retryAt *time.Time) error {
+	ctx, span := startRepositorySpan(ctx, "FailJob")
+	err := t.next.FailJob(ctx, id, attempt, lastError, retryAt)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) CountJobs(ctx context.Context, state JobState) (int, error) {
+	ctx, span := startRepositorySpan(ctx, "CountJobs")
+	result, err := t.next.CountJobs(ctx, state)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CountJobsByKind(ctx context.Context, state JobState) (map[JobKind]int, error) {
+	ctx, span := startRepositorySpan(ctx, "CountJobsByKind")
+	result, err := t.next.CountJobsByKind(ctx, state)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) GetJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startRepositorySpan(ctx, "GetJob")
+	result, err := t.next.GetJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) ListJobs(ctx context.Context, filter JobFilter) ([]*Job, error) {
+	ctx, span := startRepositorySpan(ctx, "ListJobs")
+	result, err := t.next.ListJobs(ctx, filter)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) RetryJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startRepositorySpan(ctx, "RetryJob")
+	result, err := t.next.RetryJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CancelJob(ctx context.Context, id int64) (*Job, error) {
+	ctx, span := startRepositorySpan(ctx, "CancelJob")
+	result, err := t.next.CancelJob(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) PurgeFinishedJobs(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "PurgeFinishedJobs")
+	result, err := t.next.PurgeFinishedJobs(ctx, before)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) PurgeDispatchedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "PurgeDispatchedOutbox")
+	result, err := t.next.PurgeDispatchedOutbox(ctx, before)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CreateScheduledRun(ctx context.Context, run *ScheduledRun) error {
+	ctx, span := startRepositorySpan(ctx, "CreateScheduledRun")
+	err := t.next.CreateScheduledRun(ctx, run)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) FinishScheduledRun(ctx context.Context, id int64, status, runError string) error {
+	ctx, span := startRepositorySpan(ctx, "FinishScheduledRun")
+	err := t.next.FinishScheduledRun(ctx, id, status, runError)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ScheduledRunExists(ctx context.Context, task string, scheduledAt time.Time) (bool, error) {
+	ctx, span := startRepositorySpan(ctx, "ScheduledRunExists")
+	result, err := t.next.ScheduledRunExists(ctx, task, scheduledAt)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) ListScheduledRuns(ctx context.Context, task string, limit int) ([]*ScheduledRun, error) {
+	ctx, span := startRepositorySpan(ctx, "ListScheduledRuns")
+	result, err := t.next.ListScheduledRuns(ctx, task, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CreateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	ctx, span := startRepositorySpan(ctx, "CreateWebhookSubscription")
+	err := t.next.CreateWebhookSubscription(ctx, sub)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) GetWebhookSubscription(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	ctx, span := startRepositorySpan(ctx, "GetWebhookSubscription")
+	result, err := t.next.GetWebhookSubscription(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) ListWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	ctx, span := startRepositorySpan(ctx, "ListWebhookSubscriptions")
+	result, err := t.next.ListWebhookSubscriptions(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) UpdateWebhookSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	ctx, span := startRepositorySpan(ctx, "UpdateWebhookSubscription")
+	err := t.next.UpdateWebhookSubscription(ctx, sub)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) DeleteWebhookSubscription(ctx context.Context, id int64) error {
+	ctx, span := startRepositorySpan(ctx, "DeleteWebhookSubscription")
+	err := t.next.DeleteWebhookSubscription(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	ctx, span := startRepositorySpan(ctx, "CreateWebhookDelivery")
+	err := t.next.CreateWebhookDelivery(ctx, delivery)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) GetWebhookDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	ctx, span := startRepositorySpan(ctx, "GetWebhookDelivery")
+	result, err := t.next.GetWebhookDelivery(ctx, id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) UpdateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	ctx, span := startRepositorySpan(ctx, "UpdateWebhookDelivery")
+	err := t.next.UpdateWebhookDelivery(ctx, delivery)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ListWebhookDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]*WebhookDelivery, error) {
+	ctx, span := startRepositorySpan(ctx, "ListWebhookDeliveries")
+	result, err := t.next.ListWebhookDeliveries(ctx, subscriptionID, limit)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) AppendAuditEvent(ctx context.Context, event *AuditEvent) error {
+	ctx, span := startRepositorySpan(ctx, "AppendAuditEvent")
+	err := t.next.AppendAuditEvent(ctx, event)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	ctx, span := startRepositorySpan(ctx, "ListAuditEvents")
+	result, err := t.next.ListAuditEvents(ctx, filter)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) ClaimIdempotencyKey(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	ctx, span := startRepositorySpan(ctx, "ClaimIdempotencyKey")
+	result, err := t.next.ClaimIdempotencyKey(ctx, record)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error {
+	ctx, span := startRepositorySpan(ctx, "CompleteIdempotencyKey")
+	err := t.next.CompleteIdempotencyKey(ctx, record)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	ctx, span := startRepositorySpan(ctx, "ReleaseIdempotencyKey")
+	err := t.next.ReleaseIdempotencyKey(ctx, scope, key)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "PurgeIdempotencyKeys")
+	result, err := t.next.PurgeIdempotencyKeys(ctx, before)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) AddSigningKey(ctx context.Context, key *SigningKey) error {
+	ctx, span := startRepositorySpan(ctx, "AddSigningKey")
+	err := t.next.AddSigningKey(ctx, key)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRepository) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	ctx, span := startRepositorySpan(ctx, "ListSigningKeys")
+	result, err := t.next.ListSigningKeys(ctx)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) PurgeSigningKeys(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := startRepositorySpan(ctx, "PurgeSigningKeys")
+	result, err := t.next.PurgeSigningKeys(ctx, before)
+	endSpan(span, err)
+	return result, err
+}
+
+func (t *tracedRepository) WithTx(ctx context.Context, fn func(tx Repository) error) error {
+	ctx, span := startRepositorySpan(ctx, "WithTx")
+	err := t.next.WithTx(ctx, func(tx Repository) error {
+		// Trace the calls made inside the transaction too
+		return fn(&tracedRepository{next: tx})
+	})
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanExporter   = tracetest.NewInMemoryExporter()
+	installTracing sync.Once
+)
+
+// recordedSpans installs a provider that keeps every ended span in memory and returns the
+// spans recorded so far in traceID. The global tracer binds to the first provider it is
+// given, so all tests share one exporter and tell their spans apart by trace
+func recordedSpans(traceID trace.TraceID) tracetest.SpanStubs {
+	installTracing.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+
+	var spans tracetest.SpanStubs
+	for _, span := range spanExporter.GetSpans() {
+		if span.SpanContext.TraceID() == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// spanNamed returns the span called name, failing the test if there is none
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	t.Fatalf("no span %q in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func TestTracingContinuesTheCallersTrace(t *testing.T) {
+	recordedSpans(trace.TraceID{})
+	ctx := context.Background()
+	repo := NewTracedRepository(repositoryBackends[1].open(t))
+	user := mustCreateUser(t, ctx, repo, "alice")
+	svc := NewTracedService(newTestService(t, repo))
+
+	router := gin.New()
+	router.Use(TracingMiddleware())
+	router.GET("/users/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		if _, err := svc.GetUser(c.Request.Context(), id); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	const caller = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/users/"+strconv.Itoa(user.ID), nil)
+	req.Header.Set("traceparent", caller)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /users/%d status = %d, want %d", user.ID, w.Code, http.StatusOK)
+	}
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spans := recordedSpans(traceID)
+	server := spanNamed(t, spans, "GET /users/:id")
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want the caller's span 00f067aa0ba902b7", got)
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span kind = %v, want %v", server.SpanKind, trace.SpanKindServer)
+	}
+
+	// Each layer's span is a child of the one that called it
+	service := spanNamed(t, spans, "Service.GetUser")
+	repository := spanNamed(t, spans, "Repository.GetUserByID")
+	query := spanNamed(t, spans, "SELECT")
+	for _, link := range []struct {
+		child, parent tracetest.SpanStub
+	}{
+		{service, server},
+		{repository, service},
+		{query, repository},
+	} {
+		if link.child.Parent.SpanID() != link.parent.SpanContext.SpanID() {
+			t.Errorf("%s parent = %s, want %s", link.child.Name, link.child.Parent.SpanID(), link.parent.Name)
+		}
+	}
+}
+
+func TestJobSpansLinkToTheRequestThatQueuedThem(t *testing.T) {
+	recordedSpans(trace.TraceID{})
+	repo := repositoryBackends[1].open(t)
+	queue := NewJobQueue(repo, JobQueueConfig{})
+
+	ctx, request := tracer.Start(context.Background(), "request")
+	job, err := NewJob(JobUserAnalytics, UserJobPayload{UserID: 1})
+	if err != nil {
+		t.Fatalf("NewJob() error = %v", err)
+	}
+	if err := queue.Enqueue(ctx, repo, job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	request.End()
+
+	claimed, err := repo.ClaimJob(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimJob() error = %v", err)
+	}
+	if claimed.TraceParent != traceParentFrom(ctx) {
+		t.Fatalf("claimed TraceParent = %q, want %q", claimed.TraceParent, traceParentFrom(ctx))
+	}
+
+	// Even when the worker's context is inside a trace, the job starts its own
+	jobCtx, span := startJobSpan(ctx, claimed)
+	span.End()
+	started := trace.SpanContextFromContext(jobCtx)
+	if started.TraceID() == request.SpanContext().TraceID() {
+		t.Fatal("job span joined the request's trace, want a new trace")
+	}
+
+	recorded := spanNamed(t, recordedSpans(started.TraceID()), "job "+string(JobUserAnalytics))
+	if recorded.Parent.IsValid() {
+		t.Errorf("job span parent = %s, want a root span", recorded.Parent.SpanID())
+	}
+	// The link is read back from the stored traceparent, so it is remote and only its IDs match
+	if len(recorded.Links) != 1 ||
+		recorded.Links[0].SpanContext.TraceID() != request.SpanContext().TraceID() ||
+		recorded.Links[0].SpanContext.SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("job span links = %v, want one link to the request span %s", recorded.Links, request.SpanContext().SpanID())
+	}
+}
+
+func TestStartSpanOutsideATraceDoesNothing(t *testing.T) {
+	recordedSpans(trace.TraceID{})
+
+	ctx, span := startSpan(context.Background(), "poll")
+	span.End()
+	if span.SpanContext().IsValid() || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("startSpan() started a trace without a parent span")
+	}
+	if got := traceParentFrom(ctx); got != "" {
+		t.Errorf("traceParentFrom() = %q outside a trace, want empty", got)
+	}
+}
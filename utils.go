@@ -2,14 +2,17 @@
 package main
 
 import (
-	"database/sql"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	_ "github.com/lib/pq" // PostgreSQL driver
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -42,59 +45,25 @@ type UpdateUserRequest struct {
 	Email    string `json:"email" binding:"omitempty,email"`
 }
 
-// JWTClaims represents the claims in our JWT token
-type JWTClaims struct {
-	UserID int `json:"user_id"`
-	jwt.RegisteredClaims
+// CreateWebhookRequest represents the request body for creating a webhook subscription
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events" binding:"required,min=1"`
+	Secret string   `json:"secret" binding:"omitempty,min=16,max=255"` // Generated when empty
 }
 
-// InitDatabase initializes the database connection
-func InitDatabase(databaseURL string) (*sql.DB, error) {
-	// Open connection to PostgreSQL
-	db, err := sql.Open("postgres", databaseURL)
-	if err != nil {
-		return nil, err
-	}
-
-	// Test the connection
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	// Configure connection pool
-	db.SetMaxOpenConns(25)                 // Maximum number of open connections
-	db.SetMaxIdleConns(25)                 // Maximum number of idle connections
-	db.SetConnMaxLifetime(5 * time.Minute) // Maximum connection lifetime
-
-	log.Println("Database connected successfully")
-	return db, nil
+// UpdateWebhookRequest represents the request body for updating a webhook subscription
+type UpdateWebhookRequest struct {
+	URL          string   `json:"url" binding:"omitempty,url"`
+	Events       []string `json:"events" binding:"omitempty,min=1"`
+	Active       *bool    `json:"active"`
+	RotateSecret bool     `json:"rotate_secret"` // Replace the secret with a new generated one
 }
 
-// RunMigrations creates the necessary tables if they don't exist
-func RunMigrations(db *sql.DB) error {
-	// Create users table
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		username VARCHAR(50) UNIQUE NOT NULL,
-		email VARCHAR(100) UNIQUE NOT NULL,
-		password VARCHAR(255) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`
-
-	if _, err := db.Exec(query); err != nil {
-		return err
-	}
-
-	// Create an index on email for faster lookups
-	indexQuery := `CREATE INDEX IF NOT EXISTS idx_users_email ON users(email)`
-	if _, err := db.Exec(indexQuery); err != nil {
-		return err
-	}
-
-	log.Println("Database migrations completed")
-	return nil
+// JWTClaims represents the claims in our JWT token
+type JWTClaims struct {
+	UserID int `json:"user_id"`
+	jwt.RegisteredClaims
 }
 
 // HashPassword hashes a password using bcrypt
@@ -112,13 +81,17 @@ func ComparePassword(hashedPassword, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
 
-// GenerateJWT generates a JWT token for a user
-func GenerateJWT(userID int, jwtSecret string) (string, error) {
+// tokenLifetime is how long a token is valid after it is issued
+const tokenLifetime = 24 * time.Hour
+
+// GenerateJWT generates a JWT token for a user, signed with key
+// kid names the key in the token's header; it is left out when empty
+func GenerateJWT(userID int, kid string, key []byte) (string, error) {
 	// Create claims with user ID and expiration time
 	claims := JWTClaims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // Token expires in 24 hours
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   "user-auth",
 		},
@@ -126,9 +99,12 @@ func GenerateJWT(userID int, jwtSecret string) (string, error) {
 
 	// Create token with claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
 
-	// Sign token with secret
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	// Sign token with the key
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -137,11 +113,10 @@ func GenerateJWT(userID int, jwtSecret string) (string, error) {
 }
 
 // ValidateJWT validates a JWT token and returns the claims
-func ValidateJWT(tokenString, jwtSecret string) (*JWTClaims, error) {
-	// Parse the token
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+// keyFunc returns the key the token must have been signed with
+func ValidateJWT(tokenString string, keyFunc jwt.Keyfunc) (*JWTClaims, error) {
+	// Parse the token; only HMAC signatures are accepted
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, keyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
@@ -155,77 +130,205 @@ func ValidateJWT(tokenString, jwtSecret string) (*JWTClaims, error) {
 	return nil, jwt.ErrInvalidKey
 }
 
-// CORSMiddleware adds CORS headers to responses
-func CORSMiddleware() gin.HandlerFunc {
+// LoggingMiddleware logs one line per request
+// The request ID and user ID come from the request context, so it must run after RequestIDMiddleware
+func LoggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		start := time.Now()
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+		// Process request
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
 		}
 
-		c.Next()
+		// Size is -1 until something is written
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+
+		// The route template keeps IDs out of the field, so requests can be grouped by endpoint
+		slog.LogAttrs(c.Request.Context(), level, "HTTP request",
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", bytes),
+			slog.String("client_ip", c.ClientIP()),
+		)
 	}
 }
 
-// LoggingMiddleware logs HTTP requests
-func LoggingMiddleware() gin.HandlerFunc {
+// MetricsMiddleware counts requests and times them by method, route template and status
+// Requests that match no route are labelled "unmatched", so unknown paths can't create new series
+func MetricsMiddleware(registry *Registry) gin.HandlerFunc {
+	requests := NewCounterVec("method", "route", "status")
+	durations := NewHistogramVec(DefaultBuckets, "method", "route", "status")
+	registry.CounterFunc("http_requests_total", "HTTP requests, by method, route and status", requests.Samples)
+	registry.HistogramFunc("http_request_duration_seconds", "HTTP request durations, by method, route and status", durations.Samples)
+
 	return func(c *gin.Context) {
 		start := time.Now()
 
-		// Process request
 		c.Next()
 
-		// Log after processing
-		latency := time.Since(start)
-		log.Printf(
-			"%s %s %d %v",
-			c.Request.Method,
-			c.Request.URL.Path,
-			c.Writer.Status(),
-			latency,
-		)
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		requests.Inc(c.Request.Method, route, status)
+		durations.Observe(time.Since(start).Seconds(), c.Request.Method, route, status)
 	}
 }
 
+// RequestIDMiddleware assigns every request an ID
+// An incoming X-Request-ID header is reused so IDs can be correlated across services
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+
+		c.Set("request_id", requestID)
+		c.Writer.Header().Set("X-Request-ID", requestID)
+
+		// Make the request details available to the service layer for the audit log
+		c.Request = c.Request.WithContext(withRequestInfo(c.Request.Context(), &RequestInfo{
+			RequestID: requestID,
+			IP:        c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+		}))
+		c.Next()
+	}
+}
+
+// newRequestID generates a random 16 byte hex encoded ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ErrorMiddleware turns errors recorded with c.Error into error responses
+// Handlers record the error and return; this middleware picks the status code
+// and renders problem+json (or the legacy shape, see writeError)
+func ErrorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		writeRecordedError(c)
+	}
+}
+
+// writeRecordedError renders the last error recorded with c.Error
+// It does nothing if there is no error or a response was already written
+func writeRecordedError(c *gin.Context) {
+	if len(c.Errors) == 0 || c.Writer.Written() {
+		return
+	}
+
+	last := c.Errors.Last()
+	err := last.Err
+
+	// Report the route's deadline rather than whatever error it caused further down.
+	// This runs wherever the error is rendered, including inside IdempotencyMiddleware
+	if errors.Is(context.Cause(c.Request.Context()), ErrRequestTimeout) {
+		err = ErrRequestTimeout
+	}
+
+	apiErr := mapError(err, last.Meta)
+	if apiErr.Status == http.StatusInternalServerError {
+		slog.ErrorContext(c.Request.Context(), "Request failed", "method", c.Request.Method, "path", c.Request.URL.Path, "error", last.Err)
+	}
+	writeError(c, apiErr)
+}
+
 // AuthMiddleware validates JWT tokens for protected routes
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(keys *SigningKeys) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get token from Authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+			reject(c, &UnauthorizedError{Message: "Authorization header required"})
 			return
 		}
 
 		// Check if header starts with "Bearer "
 		if len(authHeader) < 7 || authHeader[:7] != "Bearer " {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
-			c.Abort()
+			reject(c, &UnauthorizedError{Message: "Invalid authorization header format"})
 			return
 		}
 
 		// Extract token
 		tokenString := authHeader[7:]
 
-		// Load JWT secret from config
-		config := LoadConfig()
-
 		// Validate token
-		claims, err := ValidateJWT(tokenString, config.JWTSecret)
+		claims, err := keys.Validate(c.Request.Context(), tokenString)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			reject(c, &UnauthorizedError{Message: "Invalid token"})
 			return
 		}
 
-		// Store user ID in context for use in handlers
+		// Store user ID in context for use in handlers, and as the actor for the audit log
 		c.Set("user_id", claims.UserID)
+		userID := claims.UserID
+		requestInfoFrom(c.Request.Context()).ActorID = &userID
+		c.Next()
+	}
+}
+
+// AdminMiddleware restricts a route group to the configured admin user IDs
+// It must run after AuthMiddleware
+func AdminMiddleware(adminUserIDs []int) gin.HandlerFunc {
+	admins := make(map[int]bool, len(adminUserIDs))
+	for _, id := range adminUserIDs {
+		admins[id] = true
+	}
+
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(int)
+		if !ok || !admins[id] {
+			reject(c, &ErrForbidden{Message: "Admin privileges required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// MarkAdminMiddleware records whether the authenticated user is an admin as "is_admin"
+// for handlers that serve admins and regular users differently. It must run after AuthMiddleware
+func MarkAdminMiddleware(adminUserIDs []int) gin.HandlerFunc {
+	admins := make(map[int]bool, len(adminUserIDs))
+	for _, id := range adminUserIDs {
+		admins[id] = true
+	}
+
+	return func(c *gin.Context) {
+		c.Set("is_admin", admins[c.GetInt("user_id")])
+		c.Next()
+	}
+}
+
+// QueryTokenMiddleware lets clients that can't set headers, such as browser
+// EventSource and WebSocket, pass their token as ?access_token=
+// It must run before AuthMiddleware
+func QueryTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
 		c.Next()
 	}
 }
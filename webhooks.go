@@ -0,0 +1,451 @@
+// webhooks.go - Outgoing webhooks
+// Admins subscribe URLs to user.* events. Each matching event becomes a delivery
+// row plus a job, written in the same transaction as the change where there is
+// one, so deliveries are asynchronous and retried with the job queue's backoff.
+// Requests are signed with HMAC-SHA256 over "<timestamp>.<body>" using the
+// subscription's secret, which is stored encrypted. Unless allowed by config,
+// subscriptions can't target loopback, private or link-local addresses
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// JobWebhookDelivery delivers one webhook
+const JobWebhookDelivery JobKind = "webhook.deliver"
+
+// EventUserLoggedIn is sent to webhooks only; logins aren't written to the outbox
+const EventUserLoggedIn = "user.logged_in"
+
+// webhookTimeout bounds each delivery request
+const webhookTimeout = 10 * time.Second
+
+// Webhook request headers
+const (
+	WebhookHeaderID        = "X-Webhook-ID"        // Delivery ID, stable across retries
+	WebhookHeaderEvent     = "X-Webhook-Event"     // Event type, e.g. user.created
+	WebhookHeaderTimestamp = "X-Webhook-Timestamp" // Unix seconds when the request was signed
+	WebhookHeaderSignature = "X-Webhook-Signature" // "sha256=" + hex HMAC of "<timestamp>.<body>"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // Last attempt failed; the job may still retry it
+)
+
+// sealedSecretPrefix marks an encrypted subscription secret; secrets stored before
+// encryption was added have no prefix and are used as they are
+const sealedSecretPrefix = "enc:"
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice but not to netip
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// errWebhookTargetForbidden is returned when a delivery would connect to a forbidden address
+var errWebhookTargetForbidden = errors.New("webhook target is a loopback, private or link-local address")
+
+// webhookEventTypes are the events a subscription can filter on
+var webhookEventTypes = []string{EventUserCreated, EventUserUpdated, EventUserDeleted, EventUserLoggedIn}
+
+// WebhookSubscription is a URL that receives matching events
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // Event types, "user.*" or "*"
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Matches reports whether the subscription wants events of the given type
+func (s *WebhookSubscription) Matches(eventType string) bool {
+	for _, pattern := range s.Events {
+		if pattern == "*" || pattern == eventType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is the delivery of one event to one subscription
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int64           `json:"subscription_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"` // The request body, a WebhookEvent
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseCode   *int            `json:"response_code,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// WebhookEvent is the JSON body POSTed to subscribers
+type WebhookEvent struct {
+	Type       string          `json:"type"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// webhookJobPayload is the payload of webhook.deliver jobs
+type webhookJobPayload struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+// WebhookConfig configures webhook targets and secrets
+type WebhookConfig struct {
+	AllowPrivateTargets bool   // Let subscriptions target loopback, private and link-local addresses
+	SecretKey           string // Encrypts subscription secrets at rest; required, and never derived from JWT_SECRET
+}
+
+// WebhookDispatcher turns events into deliveries and sends them
+type WebhookDispatcher struct {
+	repo         Repository
+	jobs         *JobQueue
+	client       *http.Client
+	secrets      cipher.AEAD
+	allowPrivate bool
+}
+
+// errWebhookSecretKeyMissing is returned when secrets are sealed or opened without WEBHOOK_SECRET_KEY
+var errWebhookSecretKeyMissing = errors.New("webhook secrets require WEBHOOK_SECRET_KEY")
+
+// CheckWebhookSecretKey refuses a configuration whose webhook secrets would be encrypted
+// with a missing key or with the JWT secret, so one leaked secret doesn't expose the other
+func CheckWebhookSecretKey(config *Config) error {
+	switch config.Webhooks.SecretKey {
+	case "":
+		return errWebhookSecretKeyMissing
+	case config.JWTSecret:
+		return errors.New("WEBHOOK_SECRET_KEY must differ from JWT_SECRET")
+	}
+	return nil
+}
+
+// NewWebhookDispatcher creates a dispatcher and registers its job handler
+// Without a secret key it can't seal or open subscription secrets
+func NewWebhookDispatcher(repo Repository, jobs *JobQueue, config WebhookConfig) *WebhookDispatcher {
+	// AES-256 with a key hashed from the configured one, so any length of key works
+	var secrets cipher.AEAD
+	if config.SecretKey != "" {
+		key := sha256.Sum256([]byte(config.SecretKey))
+		block, _ := aes.NewCipher(key[:]) // Only fails for invalid key sizes
+		secrets, _ = cipher.NewGCM(block)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !config.AllowPrivateTargets {
+		// Check the address actually dialled, which also covers redirects and DNS answers
+		// that change after the subscription was validated. A proxy would hide the target
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{Timeout: webhookTimeout, Control: checkWebhookDial}).DialContext
+	}
+
+	d := &WebhookDispatcher{
+		repo:         repo,
+		jobs:         jobs,
+		client:       &http.Client{Timeout: webhookTimeout, Transport: transport},
+		secrets:      secrets,
+		allowPrivate: config.AllowPrivateTargets,
+	}
+	jobs.Register(JobWebhookDelivery, d.deliver)
+	return d
+}
+
+// Dispatch queues a delivery of an event to every active subscription that matches it
+// Pass the transaction that wrote the change so deliveries only exist if it commits
+func (d *WebhookDispatcher) Dispatch(ctx context.Context, tx Repository, eventType string, data json.RawMessage) error {
+	subscriptions, err := tx.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	for _, sub := range subscriptions {
+		if !sub.Active || !sub.Matches(eventType) {
+			continue
+		}
+
+		// Every subscriber gets the same body, so encode it once
+		if body == nil {
+			body, err = json.Marshal(WebhookEvent{Type: eventType, OccurredAt: time.Now().UTC(), Data: data})
+			if err != nil {
+				return fmt.Errorf("failed to encode %s webhook: %w", eventType, err)
+			}
+		}
+
+		delivery := &WebhookDelivery{
+			SubscriptionID: sub.ID,
+			EventType:      eventType,
+			Payload:        body,
+			Status:         DeliveryPending,
+		}
+		if err := tx.CreateWebhookDelivery(ctx, delivery); err != nil {
+			return err
+		}
+		if err := d.enqueue(ctx, tx, delivery.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redeliver sends a delivery again, whatever its current status
+// repo may be a transaction from Repository.WithTx, so the redelivery commits with the caller's changes
+func (d *WebhookDispatcher) Redeliver(ctx context.Context, repo Repository, id int64) (*WebhookDelivery, error) {
+	delivery, err := repo.GetWebhookDelivery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Status = DeliveryPending
+	err = repo.WithTx(ctx, func(tx Repository) error {
+		if err := tx.UpdateWebhookDelivery(ctx, delivery); err != nil {
+			return err
+		}
+		return d.enqueue(ctx, tx, delivery.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// enqueue queues a webhook.deliver job for a delivery
+func (d *WebhookDispatcher) enqueue(ctx context.Context, repo Repository, deliveryID int64) error {
+	job, err := NewJob(JobWebhookDelivery, webhookJobPayload{DeliveryID: deliveryID})
+	if err != nil {
+		return err
+	}
+	return d.jobs.Enqueue(ctx, repo, job)
+}
+
+// deliver runs a webhook.deliver job: it sends the request and logs the outcome
+// Returning an error makes the job queue retry with backoff
+func (d *WebhookDispatcher) deliver(ctx context.Context, job *Job) error {
+	var payload webhookJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", job.Kind, err)
+	}
+
+	delivery, err := d.repo.GetWebhookDelivery(ctx, payload.DeliveryID)
+	if errors.Is(err, ErrNotFound) {
+		return nil // Subscription was deleted along with its deliveries
+	}
+	if err != nil {
+		return err
+	}
+
+	sub, err := d.repo.GetWebhookSubscription(ctx, delivery.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	delivery.Attempts++
+	if !sub.Active {
+		delivery.Status = DeliveryFailed
+		delivery.Error = "subscription is disabled"
+		return d.repo.UpdateWebhookDelivery(ctx, delivery)
+	}
+
+	code, sendErr := d.send(ctx, sub, delivery)
+	delivery.ResponseCode = code
+	if sendErr != nil {
+		delivery.Status = DeliveryFailed
+		delivery.Error = sendErr.Error()
+	} else {
+		now := time.Now()
+		delivery.Status = DeliverySucceeded
+		delivery.Error = ""
+		delivery.DeliveredAt = &now
+	}
+
+	if err := d.repo.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// send POSTs a signed delivery and returns the response status code, if there was a response
+func (d *WebhookDispatcher) send(ctx context.Context, sub *WebhookSubscription, delivery *WebhookDelivery) (*int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookHeaderEvent, delivery.EventType)
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	secret, err := d.OpenSecret(sub.Secret)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(WebhookHeaderSignature, SignWebhook(secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	code := resp.StatusCode
+	if code < 200 || code > 299 {
+		return &code, fmt.Errorf("webhook responded with status %d", code)
+	}
+	return &code, nil
+}
+
+// SignWebhook returns the signature header value for a request body
+// Receivers should recompute it and reject timestamps that are too old to prevent replays
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// validateWebhookEvents checks that every event filter names a known event or wildcard
+func validateWebhookEvents(events []string) error {
+	for _, pattern := range events {
+		if pattern == "*" || pattern == "user.*" {
+			continue
+		}
+		known := false
+		for _, eventType := range webhookEventTypes {
+			if pattern == eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return &ErrValidation{
+				Code:    "invalid_event",
+				Field:   "events",
+				Message: fmt.Sprintf("unknown event %q; use %s, user.* or *", pattern, strings.Join(webhookEventTypes, ", ")),
+			}
+		}
+	}
+	return nil
+}
+
+// SealSecret encrypts a subscription secret for storage
+func (d *WebhookDispatcher) SealSecret(secret string) (string, error) {
+	if d.secrets == nil {
+		return "", errWebhookSecretKeyMissing
+	}
+	nonce := make([]byte, d.secrets.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to encrypt webhook secret: %w", err)
+	}
+	sealed := d.secrets.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedSecretPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSecret decrypts a stored subscription secret
+func (d *WebhookDispatcher) OpenSecret(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedSecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if d.secrets == nil {
+		return "", errWebhookSecretKeyMissing
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < d.secrets.NonceSize() {
+		return "", errors.New("failed to decrypt webhook secret: malformed value")
+	}
+	nonce, ciphertext := sealed[:d.secrets.NonceSize()], sealed[d.secrets.NonceSize():]
+	secret, err := d.secrets.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt webhook secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// ValidateURL checks that a subscription URL is an absolute http(s) URL and, unless
+// private targets are allowed, that its host doesn't resolve to a forbidden address
+func (d *WebhookDispatcher) ValidateURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &ErrValidation{Code: "invalid_url", Field: "url", Message: "must be an http or https URL"}
+	}
+	if d.allowPrivate {
+		return nil
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname()); err != nil {
+		return &ErrValidation{Code: "invalid_url", Field: "url", Message: "host could not be resolved"}
+	}
+	for _, addr := range addrs {
+		if !webhookTargetAllowed(addr) {
+			return &ErrValidation{Code: "forbidden_url", Field: "url", Message: "must not point to a loopback, private or link-local address"}
+		}
+	}
+	return nil
+}
+
+// webhookTargetAllowed reports whether deliveries may connect to addr when private targets aren't allowed
+func webhookTargetAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() && !sharedAddressSpace.Contains(addr)
+}
+
+// checkWebhookDial refuses connections to forbidden addresses; it is a net.Dialer Control function
+func checkWebhookDial(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !webhookTargetAllowed(addrPort.Addr()) {
+		return errWebhookTargetForbidden
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestDispatcher creates a webhook dispatcher on an in-memory repository
+func newTestDispatcher(config WebhookConfig) *WebhookDispatcher {
+	repo := NewMemoryRepository()
+	if config.SecretKey == "" {
+		config.SecretKey = "test-key"
+	}
+	return NewWebhookDispatcher(repo, NewJobQueue(repo, JobQueueConfig{}), config)
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"user.created"}`)
+
+	// HMAC-SHA256 of "1760000000.<body>" keyed with "whsec_test"
+	want := "sha256=eac46de4bc844f660e83e10464154b710a218a712ee8db2b14c90c5ab0fbb72d"
+	if got := SignWebhook("whsec_test", "1760000000", body); got != want {
+		t.Errorf("SignWebhook() = %s, want %s", got, want)
+	}
+
+	if SignWebhook("whsec_test", "1760000001", body) == want {
+		t.Error("signature doesn't cover the timestamp")
+	}
+	if SignWebhook("whsec_other", "1760000000", body) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestWebhookSecretSealing(t *testing.T) {
+	d := newTestDispatcher(WebhookConfig{})
+
+	sealed, err := d.SealSecret("whsec_test")
+	if err != nil {
+		t.Fatalf("SealSecret() error = %v", err)
+	}
+	if !strings.HasPrefix(sealed, sealedSecretPrefix) || strings.Contains(sealed, "whsec_test") {
+		t.Fatalf("SealSecret() = %q, want an encrypted value", sealed)
+	}
+	if again, _ := d.SealSecret("whsec_test"); again == sealed {
+		t.Error("sealing the same secret twice gave the same value")
+	}
+
+	if secret, err := d.OpenSecret(sealed); err != nil || secret != "whsec_test" {
+		t.Errorf("OpenSecret() = %q, %v; want whsec_test", secret, err)
+	}
+	if secret, err := d.OpenSecret("whsec_plain"); err != nil || secret != "whsec_plain" {
+		t.Errorf("OpenSecret() of a plaintext secret = %q, %v", secret, err)
+	}
+	if _, err := newTestDispatcher(WebhookConfig{SecretKey: "other-key"}).OpenSecret(sealed); err == nil {
+		t.Error("OpenSecret() with a different key succeeded")
+	}
+}
+
+func TestCheckWebhookSecretKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"", false},
+		{"jwt-secret", false},
+		{"webhook-key", true},
+	}
+	for _, tt := range tests {
+		err := CheckWebhookSecretKey(&Config{JWTSecret: "jwt-secret", Webhooks: WebhookConfig{SecretKey: tt.key}})
+		if (err == nil) != tt.want {
+			t.Errorf("CheckWebhookSecretKey(%q) = %v, want accepted %t", tt.key, err, tt.want)
+		}
+	}
+
+	// A dispatcher without a key refuses to seal secrets rather than use a well-known one
+	d := NewWebhookDispatcher(NewMemoryRepository(), NewJobQueue(NewMemoryRepository(), JobQueueConfig{}), WebhookConfig{})
+	if _, err := d.SealSecret("whsec_test"); !errors.Is(err, errWebhookSecretKeyMissing) {
+		t.Errorf("SealSecret() without a key = %v, want errWebhookSecretKeyMissing", err)
+	}
+}
+
+func TestWebhookValidateURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		code         string // Empty when the URL is accepted
+	}{
+		{"https://93.184.216.34/hook", false, ""},
+		{"ftp://93.184.216.34/hook", false, "invalid_url"},
+		{"/hook", false, "invalid_url"},
+		{"http://127.0.0.1:8080/hook", false, "forbidden_url"},
+		{"http://localhost/hook", false, "forbidden_url"},
+		{"http://[::1]/hook", false, "forbidden_url"},
+		{"http://[::ffff:10.0.0.1]/hook", false, "forbidden_url"},
+		{"http://10.1.2.3/hook", false, "forbidden_url"},
+		{"http://192.168.0.10/hook", false, "forbidden_url"},
+		{"http://169.254.169.254/latest/meta-data", false, "forbidden_url"},
+		{"http://100.64.0.1/hook", false, "forbidden_url"},
+		{"http://0.0.0.0/hook", false, "forbidden_url"},
+		{"http://127.0.0.1:8080/hook", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := newTestDispatcher(WebhookConfig{AllowPrivateTargets: tt.allowPrivate}).ValidateURL(context.Background(), tt.url)
+
+			var validation *ErrValidation
+			switch {
+			case tt.code == "" && err != nil:
+				t.Errorf("ValidateURL() error = %v, want nil", err)
+			case tt.code != "" && (!errors.As(err, &validation) || validation.Code != tt.code):
+				t.Errorf("ValidateURL() error = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebhookSendChecksDialledAddress(t *testing.T) {
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(WebhookHeaderSignature) == SignWebhook("whsec_test", r.Header.Get(WebhookHeaderTimestamp), body) {
+			signature = "valid"
+		}
+	}))
+	defer server.Close()
+
+	delivery := &WebhookDelivery{ID: 1, EventType: EventUserCreated, Payload: []byte(`{"type":"user.created"}`)}
+
+	// The subscription was validated while its host resolved elsewhere; the dial is still refused
+	guarded := newTestDispatcher(WebhookConfig{})
+	sealed, _ := guarded.SealSecret("whsec_test")
+	sub := &WebhookSubscription{ID: 1, URL: server.URL, Secret: sealed, Active: true}
+	if _, err := guarded.send(context.Background(), sub, delivery); !errors.Is(err, errWebhookTargetForbidden) {
+		t.Errorf("send() to a loopback address error = %v, want %v", err, errWebhookTargetForbidden)
+	}
+
+	allowed := newTestDispatcher(WebhookConfig{AllowPrivateTargets: true})
+	sub.Secret, _ = allowed.SealSecret("whsec_test")
+	code, err := allowed.send(context.Background(), sub, delivery)
+	if err != nil || code == nil || *code != http.StatusOK {
+		t.Fatalf("send() with private targets allowed = %v, %v", code, err)
+	}
+	if signature != "valid" {
+		t.Error("the receiver could not verify the signature with the plaintext secret")
+	}
+}